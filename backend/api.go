@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -13,7 +19,18 @@ import (
 
 	"github.com/gin-contrib/cors"
 
+	"backend/apierror"
+	"backend/archive"
+	"backend/clientip"
 	"backend/db"
+	"backend/ids"
+	"backend/pseudonym"
+	"backend/quarantine"
+	"backend/ratelimit"
+	"backend/scan"
+	"backend/storage"
+	"backend/sweeper"
+	"backend/tus"
 	"backend/utils"
 
 	"path/filepath"
@@ -23,297 +40,341 @@ import (
 )
 
 const (
-	requestLimit      = 5
-	timeLimit         = 1 * time.Minute
 	userMaxSpace      = float64(75 * (1024 * 1024)) // 75MB per user
 	maxHostSpaceUsage = 68 * userMaxSpace           // around 5GB, 68 users
+	pseudonymsKey     = "pseudonyms"                // Key of the pseudonyms of the client in the gin context
 )
 
 var logFile *os.File
-var allowedTypes = map[string]bool{
-	"image/jpeg": true,
-	"image/jpg":  true,
-	"image/png":  true,
-	"image/gif":  true,
 
-	"application/pdf":  true,
-	"application/json": true,
-
-	"application/zip":              true,
-	"application/x-tar":            true,
-	"application/x-rar-compressed": true,
+// server holds the dependencies shared by the handlers. It is built once in main and never modified afterwards.
+type server struct {
+	files        db.FileRepository        // Metadata of the files
+	users        db.UserRepository        // Users owning the files
+	blobs        storage.Storage          // Storage where the files are kept
+	staging      string                   // Directory where uploads are written before being accepted
+	expirations  expirationPolicy         // Expiration times uploaders can choose from
+	passwords    *attemptLimiter          // Failed password attempts of the protected files
+	types        *typesHolder             // File types uploaders can send, reloaded on SIGHUP
+	quarantine   *quarantine.Pool         // Uploads waiting to be scanned for malware
+	scanMaxSize  int64                    // Size of the largest file the scanner can scan, 0 if there is no limit
+	uploads      *tus.Handler             // Resumable uploads, whose unfinished ones count against the quotas
+	archives     *archive.Inspector       // Limits applied to the content of the uploaded archives
+	ids          *ids.Keyring             // Keys of the hashes stored in place of the private IDs
+	pseudonyms   *pseudonym.Pseudonymizer // Pseudonyms of the IP addresses identifying the users
+	clients      *clientip.Resolver       // Trusted proxies forwarding the address of the clients
+	ownerCookies bool                     // Whether uploads also set their owner token in an HttpOnly cookie
+	owners       ownerLocks               // Uploads of each owner being checked against the quota and saved
+}
 
-	"text/plain": true,
+// The bodies of the successful responses, described in the OpenAPI document served at /openapi.json.
+type (
+	// messageResponse confirms a request that returns no data.
+	messageResponse struct {
+		Message string `json:"message"`
+	}
 
-	"audio/mpeg":   true,
-	"audio/x-wav":  true,
-	"audio/x-flac": true,
-}
+	// uploadResponse answers an accepted upload, with the owner token returned only once.
+	uploadResponse struct {
+		Message    string  `json:"message"`
+		Data       db.File `json:"data"`       // The new file, whose idPrivate is the owner token
+		OwnerToken string  `json:"ownerToken"` // Token managing the file, sent as "Authorization: Bearer <token>"
+	}
 
-func init() {
-	var err error
-	logFile, err = os.OpenFile("requisitions.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatalf("Error opening log file: %v", err)
+	// fileInfoResponse describes a file to its owner.
+	fileInfoResponse struct {
+		Data              db.File `json:"data"`              // The file, whose idPrivate is the owner token
+		ExpiresIn         int64   `json:"expiresIn"`         // Seconds left before the file expires
+		PasswordProtected bool    `json:"passwordProtected"` // Whether downloads require a password
+		ScanStatus        string  `json:"scanStatus"`        // Result of the malware scan, "available" for files scanned during their upload
+		Signature         string  `json:"signature"`         // Name of the threat found by the scan, empty if there is none
 	}
-}
 
-func saveFile(c *gin.Context) {
-	receivedFile, err := c.FormFile("file")
-	email := c.DefaultPostForm("email", "")
-	typeFile := receivedFile.Header.Get("Content-Type")
+	// publicFileResponse describes a file to anyone knowing its public ID, without what only its owner may see.
+	publicFileResponse struct {
+		Data              publicFile `json:"data"`
+		ExpiresIn         int64      `json:"expiresIn"`         // Seconds left before the file expires
+		PasswordProtected bool       `json:"passwordProtected"` // Whether downloads require a password
+		ScanStatus        string     `json:"scanStatus"`        // Result of the malware scan, "available" for files scanned during their upload
+	}
 
-	allowed := allowedTypes[typeFile]
+	// publicFile is the metadata of a file that anyone able to download it may read.
+	publicFile struct {
+		IdPublic    string    `json:"idPublic"`
+		Name        string    `json:"name"`
+		Size        float64   `json:"size"`
+		ContentType string    `json:"contentType"`
+		ExpireDate  time.Time `json:"expireDate"`
+	}
 
-	if utils.GetFolderSize(os.Getenv("SAVE_PATH")) >= maxHostSpaceUsage {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "The host server storage capacity is full.",
-		})
-		return
+	// userResponse describes the data the server keeps about a client.
+	userResponse struct {
+		Data db.User `json:"data"`
 	}
 
-	ip := c.Request.Header.Get("CF-Connecting-IP")
-	if ip == "" {
-		ip = c.ClientIP()
+	// limitsResponse describes what can be uploaded.
+	limitsResponse struct {
+		Data uploadLimits `json:"data"`
 	}
 
-	// File Validation
-	if err != nil || receivedFile == nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Error receiving file.",
-		})
-		return
+	uploadLimits struct {
+		Types        map[string]typeRule `json:"types"`        // Rules of the allowed types, indexed by MIME type
+		UserMaxSpace int64               `json:"userMaxSpace"` // Space each client can use, in bytes
 	}
+)
 
-	// Extension validation
-	if !allowed {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "The uploaded file is not allowed. You can try compressing it in .rar, .zip, or .tar format, for example.",
-		})
+// clientIP returns the address of the client that sent a request, read from the forwarding headers only when the
+// request comes from a trusted proxy.
+func (s *server) clientIP(c *gin.Context) string {
+	return s.clients.IP(c.Request)
+}
+
+// identifyClient computes the pseudonyms of the address of the client once per request, before the handlers and the
+// rate limits that tell the clients apart. The request is refused when the salts of the pseudonyms cannot be read.
+func (s *server) identifyClient(c *gin.Context) {
+	candidates, err := s.pseudonyms.Candidates(s.clientIP(c))
+	if err != nil {
+		apierror.Respond(c, fmt.Errorf("error computing the pseudonym of the client: %v", err))
 		return
 	}
+	c.Set(pseudonymsKey, candidates)
+}
 
-	if _, err := db.GetUser(string(utils.EncryptString(ip))); err == nil {
-		err = rateLimit(string(utils.EncryptString(ip)))
-		fmt.Printf("%v\n", err)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"erro": "error related to ratelimit",
-			})
-			return
+// clientPseudonyms returns the pseudonyms of the client of a request computed by identifyClient, starting with the current one.
+func (s *server) clientPseudonyms(c *gin.Context) []string {
+	return c.MustGet(pseudonymsKey).([]string)
+}
+
+// userKey returns the pseudonym identifying the user of the client of a request, which also names their storage
+// directory. A user created under the previous salt keeps their pseudonym during the grace window that follows a rotation.
+// Parameters:
+//   c (*gin.Context): The request context.
+// Returns:
+//   string: The pseudonym of an existing user, or the current pseudonym of the client.
+func (s *server) userKey(c *gin.Context) string {
+	candidates := s.clientPseudonyms(c)
+	for _, candidate := range candidates {
+		if s.users.UserExists(candidate) {
+			return candidate
 		}
 	}
+	return candidates[0]
+}
 
-	// Testing Virus
-	path_ := filepath.Join(os.TempDir(), strings.Split(receivedFile.Filename, ".")[0])
-	if err = c.SaveUploadedFile(receivedFile, path_); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"erro": "Error saving the file temporarily",
-		})
-		return
+func init() {
+	var err error
+	logFile, err = os.OpenFile("requisitions.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("Error opening log file: %v", err)
 	}
-	defer os.Remove(path_)
+}
 
-	hasVirus, err := utils.CheckVirus(path_)
-	if err != nil && !hasVirus {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Error checking for viruses in the file.",
-		})
-		return
+// privateFile finds the file a private ID sent by a client belongs to.
+// Parameters:
+//   idPrivate (string): The private ID, as returned by the upload.
+// Returns:
+//   db.File: The file, whose IdPrivate is the stored hash.
+//   error: An error if no file has this private ID.
+func (s *server) privateFile(idPrivate string) (db.File, error) {
+	// The hash may have been made with a key rotated out since the upload
+	for _, candidate := range s.ids.Candidates(idPrivate) {
+		if file, err := s.files.GetFileFromID(candidate, "private"); err == nil {
+			return file, nil
+		}
 	}
 
-	if hasVirus {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "The system detected the file as infected with a virus.",
-		})
+	// Files uploaded before keyed hashes store the private ID as it is
+	if ids.Legacy(idPrivate) {
+		return s.files.GetFileFromID(idPrivate, "private")
+	}
+	return db.File{}, db.ErrNotFound
+}
+
+func (s *server) deleteFile(c *gin.Context) {
+	file, _, ok := s.ownedFile(c)
+	if !ok {
 		return
 	}
 
-	// Check available space
-	user, err := db.GetUser(utils.EncryptString(ip))
-	if err == nil {
-		if float64(user.UsedSpace)+float64(receivedFile.Size) > userMaxSpace {
-			remainingSpace := float64((userMaxSpace - float64(user.UsedSpace)) / (1024 * 1024))
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("The file size exceeds your available storage capacity. You have %.2f MB left.", remainingSpace),
-			})
+	// Files still in quarantine are not in the storage yet, the scanner drops them once their metadata is gone
+	var fileKey, owner string
+	if file.Available() {
+		var err error
+		if fileKey, owner, err = s.fileLocation(file); err != nil {
+			apierror.Respond(c, err)
 			return
 		}
 	}
 
-	// File content reading (to encrypt for ID generation)
-	content, err := os.ReadFile(path_)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Error accessing file contents.",
-		})
+	if _, err := s.files.DeleteFile(file.IdPrivate); err != nil {
+		apierror.Respond(c, fmt.Errorf("error deleting the metadata of %s: %v", file.IdPublic, err))
 		return
 	}
+	s.clearOwnerCookie(c, file)
 
-	// Validating Email
-	if !utils.ValidateEmail(email) && email != "" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "The uploaded file is not allowed. You can try compressing it in .rar, .zip, or .tar format, for example.",
-		})
+	if fileKey == "" {
+		c.JSON(http.StatusOK, messageResponse{Message: "File deleted successfully"})
 		return
 	}
 
-	// Generate ID for the file
-	var newFile db.File
-	idPublic := (utils.EncryptString(string(content)+receivedFile.Filename) + string(os.Getenv("ENCRYPTION_KEY")))
-	idPrivate := (utils.EncryptString(string(content)+receivedFile.Filename) + string(os.Getenv("ENCRYPTION_KEY")) + string(os.Getenv("EXCLUSION_KEY")))
-	filePath := filepath.Join(os.Getenv("SAVE_PATH")+string(utils.EncryptString(string(ip))), utils.EncryptString(string(idPublic))+"."+strings.Split(receivedFile.Filename, ".")[1])
+	err := s.blobs.Delete(c.Request.Context(), fileKey)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		apierror.Respond(c, fmt.Errorf("error deleting %s: %v", fileKey, err))
+		return
+	}
 
-	// Check if the file already exists
-	if utils.FileExists(filePath) {
-		existingFile, srcErr := db.GetFileFromID(utils.EncryptString(string(idPublic)), "public")
+	if err := s.users.SyncUser(owner, owner); err != nil {
+		apierror.Respond(c, fmt.Errorf("error updating the owner of %s: %v", file.IdPublic, err))
+		return
+	}
 
-		if srcErr != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "The file is already on the server, but it could not be found. " + srcErr.Error(),
-			})
-		} else {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "The file is already on the server.",
-				"data":  existingFile,
-			})
-		}
+	c.JSON(http.StatusOK, messageResponse{Message: "File deleted successfully"})
+}
+
+func (s *server) downloadFile(c *gin.Context) {
+	idPublic := publicIDParam(c)
 
+	if idPublic == "" {
+		apierror.Respond(c, apierror.New(apierror.InvalidRequest, "The public ID of the file is missing."))
 		return
 	}
 
-	// Save metadata to the DB
-	newFile, err = db.SaveMetadata(idPublic, idPrivate, receivedFile.Filename, email, float64(receivedFile.Size))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"erro": err,
-		})
+	file, err := s.files.GetFileFromID(idPublic, "public")
+	if errors.Is(err, db.ErrNotFound) {
+		apierror.Respond(c, apierror.New(apierror.FileNotFound, "The file does not exist or has expired."))
 		return
 	}
-
-	dirPath := filepath.Dir(filePath)
-	err = os.MkdirAll(dirPath, os.ModePerm)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Error creating directory.",
-		})
+		apierror.Respond(c, fmt.Errorf("error retrieving the file %s: %v", idPublic, err))
 		return
 	}
 
-	tempFilePath := filepath.Join(os.TempDir(), "temp_"+receivedFile.Filename)
-	if err := c.SaveUploadedFile(receivedFile, tempFilePath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"erro": "Error while saving temporary file"})
+	switch {
+	case file.ScanStatus == db.ScanQuarantined:
+		c.Header("Retry-After", "30")
+		apierror.Respond(c, apierror.New(apierror.FileScanning, "The file is still being scanned for viruses, try again later."))
 		return
-	}
-	defer os.Remove(tempFilePath)
-
-	if err := utils.CopyFileWithoutMetadata(tempFilePath, filePath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"erro": "Error processing the file"})
+	case !file.Available():
+		apierror.Respond(c, apierror.New(apierror.FileRejected, "The file was rejected by the virus scan.").With("signature", file.ScanSignature))
 		return
 	}
 
-	if saveUser(ip, c) {
-		c.JSON(http.StatusOK, gin.H{
-			"message": "File saved successfully",
-			"data":    newFile,
-		})
-	} else {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to create new user",
-		})
+	if file.PasswordHash != "" && !s.checkPassword(c, file) {
+		return
 	}
-}
 
-func deleteFile(c *gin.Context) {
-	idPrivate := c.DefaultPostForm("idPrivate", "0")
-	ip := c.Request.Header.Get("CF-Connecting-IP")
-	if ip == "" {
-		ip = c.ClientIP()
+	// The file is found from its metadata, anyone with its public ID can download it
+	fileKey, owner, err := s.fileLocation(file)
+	if err != nil {
+		apierror.Respond(c, err)
+		return
 	}
 
-	if idPrivate == "0" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "The provided id is not valid",
-		})
+	reader, object, err := s.blobs.Get(c.Request.Context(), fileKey)
+	if errors.Is(err, storage.ErrNotFound) {
+		apierror.Respond(c, apierror.New(apierror.FileNotFound, "The content of the file was not found."))
 		return
 	}
-
-	file, err := db.DeleteFile(idPrivate)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": err,
-		})
+		apierror.Respond(c, fmt.Errorf("error reading %s: %v", fileKey, err))
 		return
 	}
 
-	path_ := filepath.Join(os.Getenv("SAVE_PATH")+string(utils.EncryptString(string(ip))), string(file.IdPublic)+"."+strings.Split(file.Name, ".")[1])
-
-	err = os.Remove(path_)
+	// The counter is incremented before streaming, so concurrent downloads cannot exceed the limit
+	file, err = s.files.RegisterDownload(file.IdPublic)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Error deleting file",
-		})
+		reader.Close()
+		if errors.Is(err, db.ErrDownloadLimit) {
+			apierror.Respond(c, apierror.New(apierror.DownloadLimitReached, "The file reached its download limit."))
+		} else {
+			apierror.Respond(c, fmt.Errorf("error counting the download of %s: %v", file.IdPublic, err))
+		}
 		return
 	}
 
-	if saveUser(ip, c) {
-		c.JSON(http.StatusOK, gin.H{
-			"message": "File deleted successfully",
-		})
-	} else {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to update user data",
-		})
+	// Files saved before content detection fall back to their extension
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(file.Name))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
 	}
 
+	c.DataFromReader(http.StatusOK, object.Size, contentType, reader, map[string]string{
+		"Content-Disposition":    fmt.Sprintf("attachment; filename=%q", file.Name),
+		"X-Content-Type-Options": "nosniff",
+	})
+	reader.Close()
+
+	if file.LastDownload() {
+		// The file is deleted even if the client went away, its last download was already counted
+		s.burnFile(context.WithoutCancel(c.Request.Context()), file, fileKey, owner)
+	}
 }
 
-func downloadFile(c *gin.Context) {
-	idPublic := c.DefaultQuery("idPublic", "0")
-	ip := c.Request.Header.Get("CF-Connecting-IP")
-	if ip == "" {
-		ip = c.ClientIP()
+// checkPassword verifies the password sent in the X-File-Password header for a protected file,
+// replying to the client when it is missing, wrong, or when too many attempts failed recently.
+// Parameters:
+//   c (*gin.Context): The request context.
+//   file (db.File): The protected file.
+// Returns:
+//   bool: Returns true if the file can be downloaded.
+func (s *server) checkPassword(c *gin.Context, file db.File) bool {
+	// The attempt is counted before the password is verified, a wrong password keeps it
+	if wait := s.passwords.Reserve(file.IdPublic); wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		apierror.Respond(c, apierror.New(apierror.TooManyPasswordAttempts, "Too many wrong passwords for this file, try again later."))
+		return false
 	}
 
-	if idPublic == "0" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "The provided id is not valid",
-		})
-		return
+	password := c.GetHeader("X-File-Password")
+	if password == "" {
+		s.passwords.Refund(file.IdPublic)
+		apierror.Respond(c, apierror.New(apierror.PasswordRequired, "This file is protected by a password."))
+		return false
 	}
 
-	file, err := db.GetFileFromID(idPublic, "public")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Error retrieving file from the server",
-		})
-		return
+	if !utils.VerifyPassword(password, file.PasswordHash) {
+		apierror.Respond(c, apierror.New(apierror.WrongPassword, "The password is not valid."))
+		return false
 	}
-	fmt.Printf("%v", file.Name)
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file.Name))
 
-	path_ := filepath.Join(os.Getenv("SAVE_PATH")+string(utils.EncryptString(string(ip))), string(file.IdPublic)+"."+strings.Split(file.Name, ".")[1])
+	// Only the attempt of this request is given back, the wrong passwords sent by others still count
+	s.passwords.Refund(file.IdPublic)
+	return true
+}
 
-	if !utils.FileExists(path_) {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "File not found",
-		})
+// burnFile deletes a file that reached its download limit, along with its metadata, and updates its owner.
+// Parameters:
+//   ctx (context.Context): The context of the storage operations.
+//   file (db.File): The file to delete.
+//   fileKey (string): The storage key of the file.
+//   owner (string): The anonymized (hashed) IP address of the user who uploaded the file.
+func (s *server) burnFile(ctx context.Context, file db.File, fileKey string, owner string) {
+	if _, err := s.files.DeleteFile(file.IdPrivate); err != nil {
+		log.Printf("Error deleting the metadata of %s after its last download: %v", file.IdPublic, err)
 		return
 	}
 
-	c.File(path_)
+	if err := s.blobs.Delete(ctx, fileKey); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Printf("Error deleting %s after its last download: %v", fileKey, err)
+	}
+
+	if err := s.users.SyncUser(owner, owner); err != nil {
+		log.Printf("Error updating the owner of %s after its last download: %v", file.IdPublic, err)
+	}
 }
 
-func saveUser(ip string, c *gin.Context) bool {
+func (s *server) saveUser(c *gin.Context) bool {
+	owner := s.userKey(c)
 
-	if !db.UserExists(utils.EncryptString(ip)) {
+	if !s.users.UserExists(owner) {
 
-		_, err := db.CreateUser(utils.EncryptString(ip), filepath.Join(os.Getenv("SAVE_PATH")+string(utils.EncryptString(ip))))
+		_, err := s.users.CreateUser(owner, owner)
 
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"erro": err,
-			})
+			apierror.Respond(c, fmt.Errorf("error creating the user: %v", err))
 			return false
 		}
 
@@ -324,105 +385,127 @@ func saveUser(ip string, c *gin.Context) bool {
 		// })
 
 	} else {
-		err := db.UpdateUser(utils.EncryptString(ip), filepath.Join(os.Getenv("SAVE_PATH")+string(utils.EncryptString(ip))))
+		err := s.users.UpdateUser(owner, owner)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"erro": err,
-			})
+			apierror.Respond(c, fmt.Errorf("error updating the user: %v", err))
 			return false
 		}
 	}
 	return true
 }
 
-func userInfo(c *gin.Context) {
-	ip := c.Request.Header.Get("CF-Connecting-IP")
-	if ip == "" {
-		ip = c.ClientIP()
+func (s *server) userInfo(c *gin.Context) {
+	// Until it uploads again, a client known to the versions before pseudonyms finds the user they keyed with the
+	// unsalted hash of its address (see the upgrade notes)
+	key := s.userKey(c)
+	if !s.users.UserExists(key) {
+		key = pseudonym.Legacy(s.clientIP(c))
 	}
 
-	user, err := db.GetUser(string(utils.EncryptString(ip)))
+	user, err := s.users.GetUser(key)
 
+	if errors.Is(err, db.ErrNotFound) {
+		apierror.Respond(c, apierror.New(apierror.UserNotFound, "You have no data on the server."))
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"erro": err,
-		})
+		apierror.Respond(c, fmt.Errorf("error retrieving the user: %v", err))
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"data": user,
-	})
+	c.JSON(http.StatusOK, userResponse{Data: user})
 }
 
-func fileInfo(c *gin.Context) {
-	idPrivate := c.DefaultQuery("idPrivate", "0")
-
-	if idPrivate == "0" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"erro": "The 'idPrivate' parameter was not provided or is invalid.",
-		})
-		return
-	}
-
-	file, err := db.GetFileFromID(idPrivate, "private")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"erro": err,
-		})
+func (s *server) fileInfo(c *gin.Context) {
+	file, token, ok := s.ownedFile(c)
+	if !ok {
 		return
 	}
+	file.IdPrivate = token
 
-	c.JSON(http.StatusOK, gin.H{
-		"data": file,
+	c.JSON(http.StatusOK, fileInfoResponse{
+		Data:              file,
+		ExpiresIn:         expiresIn(file),
+		PasswordProtected: file.PasswordHash != "",
+		ScanStatus:        scanStatus(file),
+		Signature:         file.ScanSignature,
 	})
 }
 
-func deleteUser(c *gin.Context) {
-	ip := c.Request.Header.Get("CF-Connecting-IP")
-	if ip == "" {
-		ip = c.ClientIP()
+// fileDetails describes a file: its public metadata to anyone knowing its public ID, everything to its owner.
+func (s *server) fileDetails(c *gin.Context) {
+	if s.ownerToken(c) != "" {
+		s.fileInfo(c)
+		return
 	}
 
-	err := db.DeleteUser(string(utils.EncryptString(ip)))
-
+	file, err := s.files.GetFileFromID(c.Param("idPublic"), "public")
+	if errors.Is(err, db.ErrNotFound) {
+		apierror.Respond(c, apierror.New(apierror.FileNotFound, "The file does not exist."))
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"erro": err,
-		})
+		apierror.Respond(c, fmt.Errorf("error retrieving the file: %v", err))
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": "All of your data has been erased",
+	c.JSON(http.StatusOK, publicFileResponse{
+		Data: publicFile{
+			IdPublic:    file.IdPublic,
+			Name:        file.Name,
+			Size:        file.Size,
+			ContentType: file.ContentType,
+			ExpireDate:  file.ExpireDate,
+		},
+		ExpiresIn:         expiresIn(file),
+		PasswordProtected: file.PasswordHash != "",
+		ScanStatus:        scanStatus(file),
 	})
 }
 
-func rateLimit(ip string) error {
-	user, err := db.GetUser(ip)
+// expiresIn returns the seconds left before a file expires, 0 once it expired.
+func expiresIn(file db.File) int64 {
+	return max(int64(time.Until(file.ExpireDate).Seconds()), 0)
+}
 
-	if err != nil {
-		return err
+// scanStatus returns the state of the malware scan of a file. Files saved before asynchronous scanning were scanned
+// during their upload.
+func scanStatus(file db.File) string {
+	if file.ScanStatus == "" {
+		return db.ScanAvailable
 	}
+	return file.ScanStatus
+}
+
+// limits describes what can be uploaded, so the frontend can refuse files before sending them.
+func (s *server) limits(c *gin.Context) {
+	c.JSON(http.StatusOK, limitsResponse{Data: uploadLimits{
+		Types:        s.types.Load().Types,
+		UserMaxSpace: int64(userMaxSpace),
+	}})
+}
 
-	if time.Since(user.APILastCallDate) > timeLimit {
-		err = db.ResetRateLimit(ip)
+func (s *server) deleteUser(c *gin.Context) {
+	// The user the versions before pseudonyms keyed with the unsalted hash of the address is erased too (see the upgrade notes)
+	deleted := false
+	for _, key := range []string{s.userKey(c), pseudonym.Legacy(s.clientIP(c))} {
+		err := s.users.DeleteUser(key)
+		if errors.Is(err, db.ErrNotFound) {
+			continue
+		}
 		if err != nil {
-			return err
+			apierror.Respond(c, fmt.Errorf("error deleting the user: %v", err))
+			return
 		}
+		deleted = true
 	}
 
-	if user.APICalls >= requestLimit {
-		return fmt.Errorf("the number of API calls has been exceeded")
-	}
-
-	err = db.UpdateAPIRelatedData(ip)
-
-	if err != nil {
-		return err
+	if !deleted {
+		apierror.Respond(c, apierror.New(apierror.UserNotFound, "You have no data on the server."))
+		return
 	}
 
-	return nil
+	c.JSON(http.StatusOK, messageResponse{Message: "All of your data has been erased"})
 }
 
 func logUnauthorizedRequests() gin.HandlerFunc {
@@ -434,7 +517,7 @@ func logUnauthorizedRequests() gin.HandlerFunc {
 				time.Now().Format(time.RFC3339),
 				origin,
 				c.Request.Method,
-				c.Request.URL.Path,
+				redactedPath(c.Request),
 			)
 
 			if _, err := logFile.WriteString(logMessage); err != nil {
@@ -445,6 +528,64 @@ func logUnauthorizedRequests() gin.HandlerFunc {
 	}
 }
 
+// logRequests logs every request in the format of gin.Logger, with the owner tokens sent in the path or the query
+// string hidden.
+// Parameters:
+//   out (io.Writer): Where the lines are written.
+// Returns:
+//   gin.HandlerFunc: The middleware.
+func logRequests(out io.Writer) gin.HandlerFunc {
+	return gin.LoggerWithConfig(gin.LoggerConfig{
+		Output: out,
+		Formatter: func(param gin.LogFormatterParams) string {
+			return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+				param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+				param.StatusCode,
+				param.Latency,
+				param.ClientIP,
+				param.Method,
+				redactedPath(param.Request),
+				param.ErrorMessage,
+			)
+		},
+	})
+}
+
+// redactedPath returns the path and query string of a request, with the owner token of DELETE /api/v1/files/{idPublic}
+// and the idPrivate parameter replaced.
+func redactedPath(r *http.Request) string {
+	target := *r.URL
+	target.RawPath = ""
+
+	scheme, _, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if r.Method == http.MethodDelete && !strings.EqualFold(scheme, "Bearer") {
+		if segment, ok := strings.CutPrefix(target.Path, apiV1+"/files/"); ok && segment != "" && !strings.Contains(segment, "/") {
+			target.Path = apiV1 + "/files/REDACTED"
+		}
+	}
+
+	if query := target.Query(); query.Has("idPrivate") {
+		query.Set("idPrivate", "REDACTED")
+		target.RawQuery = query.Encode()
+	}
+
+	return target.RequestURI()
+}
+
+// handleErrors makes a router answer every error in the envelope of the apierror package: the requests get an ID,
+// panics become internal errors and unknown paths a route_not_found error.
+// Parameters:
+//   router (*gin.Engine): The router, before its routes are added.
+func handleErrors(router *gin.Engine) {
+	router.Use(apierror.RequestID())
+	router.Use(gin.CustomRecovery(func(c *gin.Context, recovered any) {
+		apierror.Respond(c, fmt.Errorf("panic: %v", recovered))
+	}))
+	router.NoRoute(func(c *gin.Context) {
+		apierror.Respond(c, apierror.New(apierror.RouteNotFound, "No route matches this path."))
+	})
+}
+
 func main() {
 
 	if err := godotenv.Load(); err != nil {
@@ -452,31 +593,220 @@ func main() {
 		return
 	}
 
-	db.Connect(os.Getenv("DB_URI"))
+	blobs, err := storage.FromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring the storage: %v", err)
+	}
+
+	expirations, err := expirationsFromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring the expiration times: %v", err)
+	}
+
+	maxAttempts := 5
+	if value := os.Getenv("PASSWORD_MAX_ATTEMPTS"); value != "" {
+		if maxAttempts, err = strconv.Atoi(value); err != nil || maxAttempts < 1 {
+			log.Fatalf("Invalid PASSWORD_MAX_ATTEMPTS %q", value)
+		}
+	}
 
-	router := gin.Default()
+	attemptsWindow := 15 * time.Minute
+	if value := os.Getenv("PASSWORD_ATTEMPTS_WINDOW"); value != "" {
+		if attemptsWindow, err = utils.ParseDuration(value); err != nil || attemptsWindow <= 0 {
+			log.Fatalf("Invalid PASSWORD_ATTEMPTS_WINDOW %q", value)
+		}
+	}
 
+	types, err := typesFromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring the allowed file types: %v", err)
+	}
+	types.WatchReload()
+
+	scanner, err := scan.FromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring the virus scanner: %v", err)
+	}
+
+	keyring, err := ids.FromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring the ID keys: %v", err)
+	}
+
+	clients, err := clientip.FromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring the trusted proxies: %v", err)
+	}
+	if len(clients.Trusted) == 0 {
+		log.Printf("WARNING: TRUSTED_PROXIES is not set, clients are identified by the address of their connection. Behind a reverse proxy or Cloudflare, every client shares the address of the proxy: see the upgrade notes.")
+	}
+
+	s := &server{blobs: blobs, expirations: expirations, passwords: newAttemptLimiter(maxAttempts, attemptsWindow), types: types, ids: keyring, clients: clients}
+	s.scanMaxSize = scan.MaxSize(scanner)
+
+	if value := os.Getenv("OWNER_COOKIE"); value != "" {
+		if s.ownerCookies, err = strconv.ParseBool(value); err != nil {
+			log.Fatalf("Invalid OWNER_COOKIE %q", value)
+		}
+	}
+
+	var salts db.SaltRepository
+	switch driver := os.Getenv("DB_DRIVER"); driver {
+	case "", "mongo":
+		saltsCollection := os.Getenv("SALTS_COLLECTION")
+		if saltsCollection == "" {
+			saltsCollection = "salts"
+		}
+		store, err := db.Connect(os.Getenv("DB_URI"), os.Getenv("DB_NAME"), os.Getenv("FILES_COLLECTION"), os.Getenv("USERS_COLLECTION"), saltsCollection, blobs)
+		if err != nil {
+			log.Fatalf("Error connecting to the database: %v", err)
+		}
+		defer store.Disconnect()
+		s.files, s.users, salts = store, store, store
+	case "sqlite":
+		path_ := os.Getenv("SQLITE_PATH")
+		if path_ == "" {
+			path_ = "moada.db"
+		}
+		store, err := db.OpenSQLite(path_, blobs)
+		if err != nil {
+			log.Fatalf("Error opening the database: %v", err)
+		}
+		defer store.Close()
+		s.files, s.users, salts = store, store, store
+	case "memory":
+		store := db.NewMemoryStore(blobs)
+		s.files, s.users, salts = store, store, store
+	default:
+		log.Fatalf("Unknown DB_DRIVER %q", driver)
+	}
+
+	// The salts of the pseudonyms are shared through the database, so every instance gives a client the same pseudonym
+	if s.pseudonyms, err = pseudonym.FromEnv(salts); err != nil {
+		log.Fatalf("Error configuring the IP pseudonyms: %v", err)
+	}
+
+	// Files saved before their storage key was recorded are located once, from the objects of the storage
+	located, missing, err := db.BackfillStorageKeys(s.files, blobs)
+	if err != nil {
+		log.Fatalf("Error recording the storage keys of the files: %v", err)
+	}
+	if located > 0 {
+		log.Printf("Recorded the storage key of %d files", located)
+	}
+	for _, file := range missing {
+		log.Printf("The content of %s (%s) is not in the storage, it cannot be downloaded until it is moved there, see the upgrade notes", file.IdPublic, file.Name)
+	}
+
+	// Private IDs stored in clear by the versions before keyed hashes are replaced with their keyed hash once
+	sealed, err := db.BackfillPrivateIDs(s.files, s.ids.Seal)
+	if err != nil {
+		log.Fatalf("Error sealing the private IDs stored in clear: %v", err)
+	}
+	if sealed > 0 {
+		log.Printf("Sealed the private ID of %d files", sealed)
+	}
+
+	sweep, err := sweeper.FromEnv(blobs, s.files, s.users)
+	if err != nil {
+		log.Fatalf("Error configuring the sweeper: %v", err)
+	}
+	sweep.Start(context.Background())
+
+	s.staging = os.Getenv("STAGING_PATH")
+	if s.staging == "" {
+		s.staging = filepath.Join(os.TempDir(), "moada-staging")
+		if os.Getenv("SAVE_PATH") != "" {
+			// Staging next to the stored files lets them be moved into place with a rename
+			s.staging = filepath.Join(os.Getenv("SAVE_PATH"), ".staging")
+		}
+	}
+
+	s.quarantine, err = quarantine.FromEnv(filepath.Join(s.staging, "quarantine"), scanner, blobs, s.files, s.users)
+	if err != nil {
+		log.Fatalf("Error configuring the quarantine: %v", err)
+	}
+	s.quarantine.Start(context.Background())
+
+	s.archives, err = archive.FromEnv(s.staging)
+	if err != nil {
+		log.Fatalf("Error configuring the archive inspection: %v", err)
+	}
+	if value := os.Getenv("ARCHIVE_APPLY_POLICY"); value != "" {
+		applyPolicy, err := strconv.ParseBool(value)
+		if err != nil {
+			log.Fatalf("Invalid ARCHIVE_APPLY_POLICY %q", value)
+		}
+		if applyPolicy {
+			// The entries must be of an allowed type, with an extension agreeing with their content
+			s.archives.Allow = func(name, contentType string) bool {
+				_, ok := s.types.Load().accepts(contentType, contentType, name)
+				return ok
+			}
+		}
+	}
+
+	uploadsPath := os.Getenv("TUS_PATH")
+	if uploadsPath == "" {
+		uploadsPath = filepath.Join(s.staging, "tus")
+	}
+
+	s.uploads, err = tus.NewHandler(uploadsPath, int64(userMaxSpace), s.completeUpload)
+	if err != nil {
+		log.Fatalf("Error configuring resumable uploads: %v", err)
+	}
+	s.uploads.Owner = s.uploadOwner
+	s.uploads.Owns = s.ownsUpload
+	s.uploads.Start(context.Background())
+
+	limiter, err := ratelimit.FromEnv(map[string]string{
+		"upload":   "5/1m",
+		"download": "30/1m",
+		"api":      "60/1m",
+	})
+	if err != nil {
+		log.Fatalf("Error configuring the rate limits: %v", err)
+	}
+
+	var sunset time.Time
+	if value := os.Getenv("LEGACY_ROUTES_SUNSET"); value != "" {
+		if sunset, err = time.Parse(time.DateOnly, value); err != nil {
+			log.Fatalf("Invalid LEGACY_ROUTES_SUNSET %q", value)
+		}
+	}
+
+	router := gin.New()
+
+	// The logs and c.ClientIP() follow the same proxies as the handlers
+	if err := router.SetTrustedProxies(clients.Proxies()); err != nil {
+		log.Fatalf("Error configuring the trusted proxies: %v", err)
+	}
+	router.RemoteIPHeaders = clients.Headers
+
+	handleErrors(router)
 	router.Use(logUnauthorizedRequests())
-	router.Use(gin.Logger())
-	router.Use(gin.Recovery())
+	router.Use(logRequests(gin.DefaultWriter))
 
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{os.Getenv("ALLOWED_ORIGIN")},
-		AllowMethods:     []string{"GET", "POST"},
-		AllowHeaders:     []string{"Origin", "Content-Type"},
-		ExposeHeaders:    []string{"Content-Length", "Content-Disposition"},
+		AllowMethods:     []string{"GET", "POST", "HEAD", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-Request-ID", "X-File-Password", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata"},
+		ExposeHeaders:    []string{"Content-Length", "Content-Disposition", "Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length", "Upload-Expires", "Deprecation", "Sunset", "Link", "RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "X-Request-ID"},
 		AllowCredentials: true,
 	}))
 
-	router.POST("/sendFile", saveFile) //
-	router.POST("/deleteFile", deleteFile)
-	router.POST("/deleteUser", deleteUser)
+	s.routes(router, limiter, sunset)
 
-	router.GET("/downloadFile", downloadFile) //
-	router.GET("/myInfo", userInfo)           //
-	router.GET("/fileInfo", fileInfo)         //
+	listener, err := net.Listen("tcp", ":"+os.Getenv("PORT"))
+	if err != nil {
+		log.Fatalf("Fail in server init: %v", err)
+	}
+	if clients.ProxyProtocol {
+		// The trusted proxies send the address of the client before the request
+		listener = &clientip.Listener{Listener: listener, Resolver: clients}
+	}
 
-	err := router.Run(":" + os.Getenv("PORT"))
+	err = router.RunListener(listener)
 	if err != nil {
 		log.Fatalf("Fail in server init: %v", err)
 	}
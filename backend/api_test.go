@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"backend/apierror"
+	"backend/db"
+	"backend/pseudonym"
+	"backend/scan"
+	"backend/scan/scantest"
+	"backend/storage"
+)
+
+func TestUploadAndDownload(t *testing.T) {
+	ts := newTestServer(t)
+	content := []byte("hello world, this is a text file")
+
+	uploaded := ts.upload(t, "hello.txt", content, map[string]string{"email": "someone@example.com"})
+	if uploaded.OwnerToken == "" || uploaded.Data.IdPrivate != uploaded.OwnerToken {
+		t.Fatalf("the upload did not return its owner token: %+v", uploaded)
+	}
+	if uploaded.Data.Name != "hello.txt" || uploaded.Data.Email != "someone@example.com" || uploaded.Data.ScanStatus != db.ScanQuarantined {
+		t.Fatalf("unexpected metadata: %+v", uploaded.Data)
+	}
+
+	stored := ts.waitScanned(t, uploaded.Data.IdPublic)
+	if stored.ScanStatus != db.ScanAvailable || stored.StorageKey == "" {
+		t.Fatalf("the file was not stored: %+v", stored)
+	}
+	if stored.IdPrivate == uploaded.OwnerToken {
+		t.Fatal("the owner token is stored in clear")
+	}
+
+	w := ts.do(http.MethodGet, "/api/v1/files/"+uploaded.Data.IdPublic+"/content", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("download: got %d %s", w.Code, w.Body)
+	}
+	if w.Body.String() != string(content) {
+		t.Errorf("download: got %q, want %q", w.Body, content)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="hello.txt"` {
+		t.Errorf("Content-Disposition: got %q", got)
+	}
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options: got %q", got)
+	}
+
+	// The legacy route answers the same way
+	w = ts.do(http.MethodGet, "/downloadFile?idPublic="+uploaded.Data.IdPublic, nil, nil)
+	if w.Code != http.StatusOK || w.Body.String() != string(content) {
+		t.Errorf("legacy download: got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestDownloadLimit(t *testing.T) {
+	ts := newTestServer(t)
+	uploaded := ts.upload(t, "burn.txt", []byte("read me once"), map[string]string{"burnAfterReading": "true"})
+	target := "/api/v1/files/" + uploaded.Data.IdPublic + "/content"
+
+	if w := ts.do(http.MethodGet, target, nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("first download: got %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodGet, target, nil, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("second download: got %d, want 404", w.Code)
+	}
+
+	if _, err := ts.files.GetFileFromID(uploaded.Data.IdPublic, "public"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("the file was not deleted after its last download: %v", err)
+	}
+}
+
+func TestDownloadPassword(t *testing.T) {
+	ts := newTestServer(t)
+	uploaded := ts.upload(t, "secret.txt", []byte("protected content"), map[string]string{"password": "open sesame"})
+	target := "/api/v1/files/" + uploaded.Data.IdPublic + "/content"
+
+	tests := []struct {
+		name     string
+		password string
+		want     int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"wrong", "guess", http.StatusForbidden},
+		{"right", "open sesame", http.StatusOK},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if test.password != "" {
+			header.Set("X-File-Password", test.password)
+		}
+		if w := ts.do(http.MethodGet, target, nil, header); w.Code != test.want {
+			t.Errorf("%s password: got %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
+
+func TestPasswordAttemptsKeptAfterSuccess(t *testing.T) {
+	ts := newTestServer(t)
+	uploaded := ts.upload(t, "secret.txt", []byte("protected content"), map[string]string{"password": "open sesame"})
+	target := "/api/v1/files/" + uploaded.Data.IdPublic + "/content"
+
+	// The limit of the test server is 3 wrong passwords, the right one in the middle does not clear them
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"guess 1", http.StatusForbidden},
+		{"guess 2", http.StatusForbidden},
+		{"open sesame", http.StatusOK},
+		{"guess 3", http.StatusForbidden},
+		{"guess 4", http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		if w := ts.do(http.MethodGet, target, nil, http.Header{"X-File-Password": {test.password}}); w.Code != test.want {
+			t.Errorf("%s: got %d, want %d", test.password, w.Code, test.want)
+		}
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	ts := newTestServer(t)
+	uploaded := ts.upload(t, "delete.txt", []byte("soon gone"), nil)
+	stored := ts.waitScanned(t, uploaded.Data.IdPublic)
+
+	if w := ts.do(http.MethodDelete, "/api/v1/files/not-a-token", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown token: got %d, want 404", w.Code)
+	}
+
+	w := ts.do(http.MethodDelete, "/api/v1/files/"+uploaded.OwnerToken, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: got %d %s", w.Code, w.Body)
+	}
+	if got := decode[messageResponse](t, w).Message; got == "" {
+		t.Error("delete: the response has no message")
+	}
+
+	if _, err := ts.files.GetFileFromID(uploaded.Data.IdPublic, "public"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("the metadata was not deleted: %v", err)
+	}
+	if _, err := ts.blobs.Stat(context.Background(), stored.StorageKey); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("the content was not deleted: %v", err)
+	}
+	if w := ts.do(http.MethodGet, "/api/v1/files/"+uploaded.Data.IdPublic+"/content", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("download after delete: got %d, want 404", w.Code)
+	}
+}
+
+func TestDeleteFileBearer(t *testing.T) {
+	ts := newTestServer(t)
+	mine := ts.upload(t, "mine.txt", []byte("deleted with the header"), nil)
+	other := ts.upload(t, "other.txt", []byte("left alone"), nil)
+	bearer := http.Header{"Authorization": {"Bearer " + mine.OwnerToken}}
+
+	if w := ts.do(http.MethodDelete, "/api/v1/files/"+other.Data.IdPublic, nil, bearer); w.Code != http.StatusForbidden {
+		t.Errorf("another file: got %d, want 403", w.Code)
+	}
+	// Without the header, the segment is read as the owner token
+	if w := ts.do(http.MethodDelete, "/api/v1/files/"+mine.Data.IdPublic, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("public ID without header: got %d, want 404", w.Code)
+	}
+
+	if w := ts.do(http.MethodDelete, "/api/v1/files/"+mine.Data.IdPublic, nil, bearer); w.Code != http.StatusOK {
+		t.Fatalf("delete: got %d %s", w.Code, w.Body)
+	}
+	if _, err := ts.files.GetFileFromID(mine.Data.IdPublic, "public"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("the metadata was not deleted: %v", err)
+	}
+	if _, err := ts.files.GetFileFromID(other.Data.IdPublic, "public"); err != nil {
+		t.Errorf("the other file was deleted: %v", err)
+	}
+}
+
+func TestRequestLogRedacted(t *testing.T) {
+	var logged bytes.Buffer
+	router := gin.New()
+	router.Use(logRequests(&logged))
+	router.NoRoute(func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	tests := []struct {
+		method, target string
+		header         http.Header
+		want           string
+	}{
+		{http.MethodDelete, "/api/v1/files/secret-token", nil, `"/api/v1/files/REDACTED"`},
+		{http.MethodDelete, "/api/v1/files/public-id", http.Header{"Authorization": {"Bearer secret-token"}}, `"/api/v1/files/public-id"`},
+		{http.MethodGet, "/api/v1/files/public-id", nil, `"/api/v1/files/public-id"`},
+		{http.MethodGet, "/fileInfo?idPublic=public-id&idPrivate=secret-token", nil, `"/fileInfo?idPrivate=REDACTED&idPublic=public-id"`},
+		{http.MethodDelete, "/uploads/upload-id", nil, `"/uploads/upload-id"`},
+	}
+
+	for _, test := range tests {
+		logged.Reset()
+		req := httptest.NewRequest(test.method, test.target, nil)
+		for name, values := range test.header {
+			req.Header[name] = values
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		if line := logged.String(); !strings.Contains(line, test.want) || strings.Contains(line, "secret-token") {
+			t.Errorf("%s %s: logged %q, want %s", test.method, test.target, line, test.want)
+		}
+	}
+}
+
+func TestLegacyDeleteFile(t *testing.T) {
+	ts := newTestServer(t)
+	uploaded := ts.upload(t, "legacy.txt", []byte("deleted through the form"), nil)
+
+	header := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	w := ts.do(http.MethodPost, "/deleteFile", strings.NewReader("idPrivate="+uploaded.OwnerToken), header)
+	if w.Code != http.StatusOK {
+		t.Fatalf("legacy delete: got %d %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Deprecation") == "" {
+		t.Error("legacy delete: the Deprecation header is missing")
+	}
+}
+
+func TestFileDetails(t *testing.T) {
+	ts := newTestServer(t)
+	uploaded := ts.upload(t, "details.txt", []byte("described to anyone"), map[string]string{"password": "secret"})
+	target := "/api/v1/files/" + uploaded.Data.IdPublic
+
+	// Without the owner token, only the public metadata is returned
+	w := ts.do(http.MethodGet, target, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("public details: got %d %s", w.Code, w.Body)
+	}
+	if body := w.Body.String(); strings.Contains(body, "idPrivate") || strings.Contains(body, uploaded.OwnerToken) {
+		t.Errorf("the public details reveal the owner token: %s", body)
+	}
+	details := decode[publicFileResponse](t, w)
+	if details.Data.Name != "details.txt" || details.Data.Size != float64(len("described to anyone")) {
+		t.Errorf("unexpected public details %+v", details.Data)
+	}
+	if !details.PasswordProtected || details.ScanStatus != db.ScanAvailable || details.ExpiresIn <= 0 {
+		t.Errorf("unexpected public details %+v", details)
+	}
+
+	// With it, the whole metadata is
+	w = ts.do(http.MethodGet, target, nil, http.Header{"Authorization": {"Bearer " + uploaded.OwnerToken}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("owner details: got %d %s", w.Code, w.Body)
+	}
+	if info := decode[fileInfoResponse](t, w); info.Data.IdPrivate != uploaded.OwnerToken {
+		t.Errorf("the owner details carry %q as idPrivate, want the owner token", info.Data.IdPrivate)
+	}
+
+	if w := ts.do(http.MethodGet, target, nil, http.Header{"Authorization": {"Bearer not-a-token"}}); w.Code != http.StatusNotFound {
+		t.Errorf("unknown token: got %d, want 404", w.Code)
+	}
+	if w := ts.do(http.MethodGet, "/api/v1/files/unknown", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("unknown file: got %d, want 404", w.Code)
+	}
+
+	// The former route stays reserved to the owner
+	if w := ts.do(http.MethodGet, "/fileInfo?idPublic="+uploaded.Data.IdPublic, nil, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("legacy route without token: got %d, want 401", w.Code)
+	}
+}
+
+func TestMe(t *testing.T) {
+	ts := newTestServer(t)
+
+	if w := ts.do(http.MethodGet, "/api/v1/me", nil, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("before any upload: got %d, want 404", w.Code)
+	}
+
+	content := []byte("counted in the quota")
+	uploaded := ts.upload(t, "me.txt", content, nil)
+	stored := ts.waitScanned(t, uploaded.Data.IdPublic)
+
+	w := ts.do(http.MethodGet, "/api/v1/me", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("me: got %d %s", w.Code, w.Body)
+	}
+	user := decode[userResponse](t, w).Data
+	if user.FilesNumber != 1 || len(user.Files) != 1 || user.Files[0] != uploaded.Data.IdPublic {
+		t.Errorf("me: unexpected files %+v", user)
+	}
+	if user.UsedSpace != float64(len(content)) {
+		t.Errorf("me: used space %v, want %d", user.UsedSpace, len(content))
+	}
+
+	if w := ts.do(http.MethodDelete, "/api/v1/me", nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("delete me: got %d %s", w.Code, w.Body)
+	}
+	if w := ts.do(http.MethodGet, "/api/v1/me", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("me after delete: got %d, want 404", w.Code)
+	}
+	if _, err := ts.blobs.Stat(context.Background(), stored.StorageKey); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("the files of the user were not deleted: %v", err)
+	}
+}
+
+func TestMeLegacyUser(t *testing.T) {
+	ts := newTestServer(t)
+
+	// A user and its file saved by the versions before pseudonyms, keyed by the unsalted hash of the address
+	legacy := pseudonym.Legacy("192.0.2.1")
+	key := storage.Key(legacy, "legacy1.txt")
+	if err := ts.blobs.Put(context.Background(), key, strings.NewReader("content"), 7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.store.SaveMetadata("legacy1", "private-legacy1", db.File{Name: "notes.txt", Size: 7, ExpireDate: time.Now().Add(time.Hour), StorageKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.store.CreateUser(legacy, legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	w := ts.do(http.MethodGet, "/api/v1/me", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("me: got %d %s", w.Code, w.Body)
+	}
+	if user := decode[userResponse](t, w).Data; len(user.Files) != 1 || user.Files[0] != "legacy1" {
+		t.Errorf("me: got %+v, want the legacy user", user)
+	}
+
+	// Once the client uploads again, erasing its data erases both users
+	ts.upload(t, "new.txt", []byte("uploaded after the upgrade"), nil)
+	if w := ts.do(http.MethodDelete, "/api/v1/me", nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("delete me: got %d %s", w.Code, w.Body)
+	}
+	if ts.users.UserExists(legacy) {
+		t.Error("the legacy user was not erased")
+	}
+	if _, err := ts.blobs.Stat(context.Background(), key); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("the file of the legacy user was not deleted: %v", err)
+	}
+	if w := ts.do(http.MethodGet, "/api/v1/me", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("me after delete: got %d, want 404", w.Code)
+	}
+}
+
+// unavailableSalts is a salt store whose database cannot be reached.
+type unavailableSalts struct{}
+
+func (unavailableSalts) GetOrCreateSalt(period int64, salt []byte) ([]byte, error) {
+	return nil, errors.New("database unavailable")
+}
+
+func (unavailableSalts) DeleteSaltsBefore(period int64) error {
+	return errors.New("database unavailable")
+}
+
+func TestSaltsUnavailable(t *testing.T) {
+	ts := newTestServer(t)
+	var err error
+	if ts.pseudonyms, err = pseudonym.New("test-pseudonym-secret", 24*time.Hour, time.Hour, unavailableSalts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a pseudonym, the client cannot be told apart from the others
+	checkError(t, ts.do(http.MethodGet, "/api/v1/me", nil, nil), apierror.Internal)
+}
+
+func TestLimits(t *testing.T) {
+	ts := newTestServer(t)
+
+	w := ts.do(http.MethodGet, "/api/v1/limits", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("limits: got %d %s", w.Code, w.Body)
+	}
+
+	limits := decode[limitsResponse](t, w).Data
+	if limits.UserMaxSpace != int64(userMaxSpace) {
+		t.Errorf("userMaxSpace: got %d, want %d", limits.UserMaxSpace, int64(userMaxSpace))
+	}
+	for contentType := range defaultTypes.Types {
+		if _, ok := limits.Types[contentType]; !ok {
+			t.Errorf("the type %s is missing", contentType)
+		}
+	}
+}
+
+func TestUploadMaxDownloads(t *testing.T) {
+	ts := newTestServer(t)
+
+	body, contentType := uploadForm(t, "negative.txt", "text/plain", []byte("limited"), map[string]string{"maxDownloads": "-1"})
+	w := ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("negative maxDownloads: got %d %s", w.Code, w.Body)
+	}
+	if got := decode[apierror.Envelope](t, w).Error; got.Code != apierror.InvalidField || !strings.Contains(got.Message, "non-negative") {
+		t.Errorf("negative maxDownloads: unexpected error %+v", got)
+	}
+
+	// Zero means no limit
+	uploaded := ts.upload(t, "unlimited.txt", []byte("unlimited"), map[string]string{"maxDownloads": "0"})
+	for i := 0; i < 3; i++ {
+		if w := ts.do(http.MethodGet, "/api/v1/files/"+uploaded.Data.IdPublic+"/content", nil, nil); w.Code != http.StatusOK {
+			t.Fatalf("download %d: got %d %s", i+1, w.Code, w.Body)
+		}
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	ts := newTestServer(t)
+
+	// A new client has no user yet, the size is still checked
+	body, contentType := uploadForm(t, "large.txt", "text/plain", bytes.Repeat([]byte("a"), int(userMaxSpace)+1), nil)
+	w := ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("upload: got %d %s", w.Code, w.Body)
+	}
+	if got := decode[apierror.Envelope](t, w).Error; got.Code != apierror.FileTooLarge || got.Details["maxSize"] != userMaxSpace {
+		t.Errorf("upload: unexpected error %+v", got)
+	}
+
+	current, err := ts.pseudonyms.Pseudonym("192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.users.UserExists(current) {
+		t.Error("the refused upload created a user")
+	}
+	if staged, _ := os.ReadDir(ts.staging); len(staged) != 0 {
+		t.Errorf("the refused upload was left in the staging directory: %v", staged)
+	}
+}
+
+func TestUploadOverScanLimit(t *testing.T) {
+	server, err := scantest.NewClamd(scantest.EICAR())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	clamd, err := scan.NewClamd(server.Addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clamd.StreamMaxLength = 1024
+	content := bytes.Repeat([]byte("a"), 1025)
+
+	// Files clamd cannot scan are refused before being quarantined, not rejected once accepted
+	ts := newTestServerWithScanner(t, &scan.Multi{Engines: []scan.Scanner{clamd}, Policy: scan.Any})
+	body, contentType := uploadForm(t, "large.txt", "text/plain", content, nil)
+	w := ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("upload: got %d %s", w.Code, w.Body)
+	}
+	if got := decode[apierror.Envelope](t, w).Error; got.Code != apierror.FileTooLarge || got.Details["maxSize"] != float64(1024) {
+		t.Errorf("upload: unexpected error %+v", got)
+	}
+
+	// With SkipLarge they are accepted unscanned
+	ts = newTestServerWithScanner(t, &scan.Multi{Engines: []scan.Scanner{clamd}, Policy: scan.Any, SkipLarge: true})
+	uploaded := ts.upload(t, "large.txt", content, nil)
+	if file := ts.waitScanned(t, uploaded.Data.IdPublic); file.ScanStatus != db.ScanAvailable {
+		t.Errorf("got scan status %q, want %q", file.ScanStatus, db.ScanAvailable)
+	}
+	if server.Scans() != 0 {
+		t.Errorf("clamd received %d scans, want 0", server.Scans())
+	}
+}
+
+func TestQuotaCountsQuarantinedFiles(t *testing.T) {
+	gate := newGateScanner()
+	ts := newTestServerWithScanner(t, gate)
+	size := int(userMaxSpace)/2 + 1
+
+	body, contentType := uploadForm(t, "first.txt", "text/plain", bytes.Repeat([]byte("a"), size), nil)
+	if w := ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}}); w.Code != http.StatusAccepted {
+		t.Fatalf("first upload: got %d %s", w.Code, w.Body)
+	}
+
+	// The first file is still quarantined, it already counts
+	w := ts.do(http.MethodGet, "/api/v1/me", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("me: got %d %s", w.Code, w.Body)
+	}
+	if user := decode[userResponse](t, w).Data; user.FilesNumber != 1 || user.UsedSpace != float64(size) {
+		t.Errorf("me: got %d files and %v bytes, want 1 file and %d bytes", user.FilesNumber, user.UsedSpace, size)
+	}
+
+	body, contentType = uploadForm(t, "second.txt", "text/plain", bytes.Repeat([]byte("b"), size), nil)
+	w = ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+	if w.Code != http.StatusRequestEntityTooLarge || decode[apierror.Envelope](t, w).Error.Code != apierror.QuotaExceeded {
+		t.Fatalf("second upload: got %d %s, want quota_exceeded", w.Code, w.Body)
+	}
+}
+
+func TestQuotaCountsUnfinishedUploads(t *testing.T) {
+	ts := newTestServer(t)
+	reserved := int(userMaxSpace)/2 + 1
+
+	// The resumable upload is created but its data is never sent
+	metadata := "filename cmVzdW1lZC50eHQ=,filetype dGV4dC9wbGFpbg==" // resumed.txt, text/plain
+	w := ts.do(http.MethodPost, "/api/v1/uploads", nil, tusRequestHeader("Upload-Length", strconv.Itoa(reserved), "Upload-Metadata", metadata))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d %s", w.Code, w.Body)
+	}
+
+	body, contentType := uploadForm(t, "second.txt", "text/plain", bytes.Repeat([]byte("b"), reserved), nil)
+	w = ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+	if w.Code != http.StatusRequestEntityTooLarge || decode[apierror.Envelope](t, w).Error.Code != apierror.QuotaExceeded {
+		t.Fatalf("upload: got %d %s, want quota_exceeded", w.Code, w.Body)
+	}
+
+	// Nor can the space be reserved again by another resumable upload
+	w = ts.do(http.MethodPost, "/api/v1/uploads", nil, tusRequestHeader("Upload-Length", strconv.Itoa(reserved), "Upload-Metadata", metadata))
+	if w.Code != http.StatusRequestEntityTooLarge || decode[apierror.Envelope](t, w).Error.Code != apierror.QuotaExceeded {
+		t.Fatalf("second create: got %d %s, want quota_exceeded", w.Code, w.Body)
+	}
+
+	// Other clients are not affected
+	body, contentType = uploadForm(t, "other.txt", "text/plain", []byte("other client"), nil)
+	if w := ts.doFrom("198.51.100.7:1234", http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}}); w.Code != http.StatusAccepted {
+		t.Fatalf("upload of another client: got %d %s", w.Code, w.Body)
+	}
+}
+
+// failingUsers is a user repository that cannot save the users.
+type failingUsers struct {
+	db.UserRepository
+}
+
+func (failingUsers) CreateUser(ip string, DirPath string) (db.User, error) {
+	return db.User{}, errors.New("database unavailable")
+}
+
+func (failingUsers) UpdateUser(ip string, DirPath string) error {
+	return errors.New("database unavailable")
+}
+
+func TestUploadUserNotSaved(t *testing.T) {
+	gate := newGateScanner()
+	ts := newTestServerWithScanner(t, gate)
+	users := ts.users
+	ts.users = failingUsers{users}
+
+	body, contentType := uploadForm(t, "notes.txt", "text/plain", []byte("never saved"), nil)
+	if w := ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}}); w.Code != http.StatusInternalServerError {
+		t.Fatalf("upload: got %d %s, want 500", w.Code, w.Body)
+	}
+
+	// Neither the file nor its metadata are left behind
+	if usage, err := ts.quarantine.Usage(); err != nil || usage != 0 {
+		t.Errorf("quarantine: got %d bytes, %v, want it empty", usage, err)
+	}
+	ts.users = users
+	body, contentType = uploadForm(t, "notes.txt", "text/plain", []byte("never saved"), nil)
+	if w := ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}}); w.Code != http.StatusAccepted {
+		t.Errorf("upload again: got %d %s, want 202", w.Code, w.Body)
+	}
+}
+
+func TestDeleteDuringScan(t *testing.T) {
+	gate := newGateScanner()
+	ts := newTestServerWithScanner(t, gate)
+
+	body, contentType := uploadForm(t, "scanned.txt", "text/plain", []byte("deleted while scanned"), nil)
+	w := ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("upload: got %d %s", w.Code, w.Body)
+	}
+	uploaded := decode[uploadResponse](t, w)
+	file, err := ts.files.GetFileFromID(uploaded.Data.IdPublic, "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleted once the scan started, so the worker already checked that the file exists
+	<-gate.started
+	if w := ts.do(http.MethodDelete, "/api/v1/files/"+uploaded.OwnerToken, nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("delete: got %d %s", w.Code, w.Body)
+	}
+	close(gate.release)
+
+	// The content stored once the scan ends is removed, since its metadata is gone
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := ts.blobs.Stat(context.Background(), file.StorageKey)
+		if !ts.quarantine.Holds(file.StorageKey) && errors.Is(err, storage.ErrNotFound) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the content of the deleted file was left in the storage: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
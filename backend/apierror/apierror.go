@@ -0,0 +1,225 @@
+// Package apierror defines the errors answered by the API. Every error is sent in the same JSON envelope:
+//
+//   {"error": {"code": "file_not_found", "message": "The file does not exist.", "details": {...}, "requestId": "..."}}
+//
+// The code is stable and meant for programs, the message is meant for people and may change. The HTTP status of an
+// error is decided by its code, so the same problem is always answered the same way.
+package apierror
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Code identifies the kind of an error.
+type Code string
+
+// Codes of the errors, with their HTTP status.
+const (
+	InvalidRequest          Code = "invalid_request"            // 400: The request is malformed or misses a parameter
+	OwnerTokenRequired      Code = "owner_token_required"       // 401: The owner token of the file was not sent
+	PasswordRequired        Code = "password_required"          // 401: The file is protected by a password that was not sent
+	OwnerTokenMismatch      Code = "owner_token_mismatch"       // 403: The owner token manages another file
+	WrongPassword           Code = "wrong_password"             // 403: The password of the file is not valid
+	FileNotFound            Code = "file_not_found"             // 404: No file has this ID or owner token
+	UserNotFound            Code = "user_not_found"             // 404: The client has no data on the server
+	RouteNotFound           Code = "route_not_found"            // 404: No route matches the path of the request
+	UploadNotFound          Code = "upload_not_found"           // 404: No resumable upload has this ID
+	FileScanning            Code = "file_scanning"              // 409: The file waits for its malware scan
+	DuplicateFile           Code = "duplicate_file"             // 409: The same file was already sent by the client
+	OffsetMismatch          Code = "offset_mismatch"            // 409: The chunk of a resumable upload does not start where the data ends
+	FileRejected            Code = "file_rejected"              // 410: The file was found infected
+	DownloadLimitReached    Code = "download_limit_reached"     // 410: The file reached its maximum number of downloads
+	UnsupportedTusVersion   Code = "unsupported_tus_version"    // 412: The tus version of the request is not supported
+	FileTooLarge            Code = "file_too_large"             // 413: The file is larger than allowed for its type or for a user
+	QuotaExceeded           Code = "quota_exceeded"             // 413: The file does not fit in the space left to the client
+	UnsupportedFileType     Code = "unsupported_file_type"      // 415: Files of this type cannot be uploaded
+	UnsupportedContentType  Code = "unsupported_content_type"   // 415: The Content-Type of the request is not the expected one
+	InvalidField            Code = "invalid_field"              // 422: A field is well formed but its value is not accepted
+	ContentMismatch         Code = "content_mismatch"           // 422: The content of the file does not match its type or extension
+	ArchiveRejected         Code = "archive_rejected"           // 422: The archive is too large once extracted, or contains forbidden files
+	MalformedFile           Code = "malformed_file"             // 422: The structure of the file is broken
+	UploadLocked            Code = "upload_locked"              // 423: The resumable upload is already receiving data
+	RateLimited             Code = "rate_limited"               // 429: The client made too many requests
+	TooManyPasswordAttempts Code = "too_many_password_attempts" // 429: Too many wrong passwords were sent for the file
+	Internal                Code = "internal_error"             // 500: The server failed, the request may be retried
+	StorageFull             Code = "storage_full"               // 507: The server has no space left for uploads
+)
+
+// statuses maps the codes to their HTTP status.
+var statuses = map[Code]int{
+	InvalidRequest:          http.StatusBadRequest,
+	OwnerTokenRequired:      http.StatusUnauthorized,
+	PasswordRequired:        http.StatusUnauthorized,
+	OwnerTokenMismatch:      http.StatusForbidden,
+	WrongPassword:           http.StatusForbidden,
+	FileNotFound:            http.StatusNotFound,
+	UserNotFound:            http.StatusNotFound,
+	RouteNotFound:           http.StatusNotFound,
+	UploadNotFound:          http.StatusNotFound,
+	FileScanning:            http.StatusConflict,
+	DuplicateFile:           http.StatusConflict,
+	OffsetMismatch:          http.StatusConflict,
+	FileRejected:            http.StatusGone,
+	DownloadLimitReached:    http.StatusGone,
+	UnsupportedTusVersion:   http.StatusPreconditionFailed,
+	FileTooLarge:            http.StatusRequestEntityTooLarge,
+	QuotaExceeded:           http.StatusRequestEntityTooLarge,
+	UnsupportedFileType:     http.StatusUnsupportedMediaType,
+	UnsupportedContentType:  http.StatusUnsupportedMediaType,
+	InvalidField:            http.StatusUnprocessableEntity,
+	ContentMismatch:         http.StatusUnprocessableEntity,
+	ArchiveRejected:         http.StatusUnprocessableEntity,
+	MalformedFile:           http.StatusUnprocessableEntity,
+	UploadLocked:            http.StatusLocked,
+	RateLimited:             http.StatusTooManyRequests,
+	TooManyPasswordAttempts: http.StatusTooManyRequests,
+	Internal:                http.StatusInternalServerError,
+	StorageFull:             http.StatusInsufficientStorage,
+}
+
+// Status returns the HTTP status of the errors of a code, 500 for unknown codes.
+func (code Code) Status() int {
+	if status, ok := statuses[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Codes returns every code the API may answer with, sorted.
+func Codes() []Code {
+	codes := make([]Code, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	return codes
+}
+
+// RequestIDHeader is the header carrying the ID of a request, sent back in every response.
+const RequestIDHeader = "X-Request-ID"
+
+const (
+	requestIDKey       = "apierror.requestID" // Key of the request ID in the gin context
+	maxRequestIDLength = 64
+)
+
+// Error is an error answered to the client.
+type Error struct {
+	Code      Code           `json:"code"`                // Stable identifier of the kind of error
+	Message   string         `json:"message"`             // Explanation for people
+	Details   map[string]any `json:"details,omitempty"`   // Values helping to handle the error, depending on the code
+	RequestID string         `json:"requestId,omitempty"` // ID of the request, to find it in the logs
+}
+
+// Envelope is the body of the error responses.
+type Envelope struct {
+	Error Error `json:"error"`
+}
+
+// New creates an error.
+// Parameters:
+//   code (Code): The kind of error, which decides its HTTP status.
+//   message (string): The explanation for people.
+// Returns:
+//   *Error: The error.
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// Newf creates an error whose message is formatted like fmt.Sprintf.
+func Newf(code Code, format string, args ...any) *Error {
+	return New(code, fmt.Sprintf(format, args...))
+}
+
+// Error returns the code and the message of the error.
+func (e *Error) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// Status returns the HTTP status of the error, 500 for unknown codes.
+func (e *Error) Status() int {
+	return e.Code.Status()
+}
+
+// With returns a copy of the error with a detail added.
+// Parameters:
+//   key (string): The name of the detail.
+//   value (any): Its value, which must be serializable to JSON.
+// Returns:
+//   *Error: The new error.
+func (e *Error) With(key string, value any) *Error {
+	copied := *e
+	copied.Details = make(map[string]any, len(e.Details)+1)
+	for k, v := range e.Details {
+		copied.Details[k] = v
+	}
+	copied.Details[key] = value
+	return &copied
+}
+
+// Respond answers a request with an error and stops its handlers. Errors that are not an *Error are logged and
+// answered as internal errors, so their text never reaches the client.
+// Parameters:
+//   c (*gin.Context): The request context.
+//   err (error): The error.
+func Respond(c *gin.Context, err error) {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		log.Printf("Request %s to %s failed: %v", ID(c), c.Request.URL.Path, err)
+		apiErr = New(Internal, "An internal error occurred, try again later.")
+	}
+
+	answered := *apiErr
+	answered.RequestID = ID(c)
+	c.AbortWithStatusJSON(answered.Status(), Envelope{Error: answered})
+}
+
+// RequestID gives an ID to every request, sent back in the X-Request-ID header and in the errors. The ID sent by
+// the client (or a proxy) is kept when it is short and printable, so a request can be followed across services.
+// Returns:
+//   gin.HandlerFunc: The middleware.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			buffer := make([]byte, 16)
+			if _, err := rand.Read(buffer); err != nil {
+				log.Printf("Error generating a request ID: %v", err)
+			}
+			id = hex.EncodeToString(buffer)
+		}
+
+		c.Set(requestIDKey, id)
+		c.Header(RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+// ID returns the ID given to a request by the RequestID middleware, empty if it was not used.
+func ID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// validRequestID reports whether an ID sent by a client can be reused: letters, digits, "-", "_", "." and ":" only.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
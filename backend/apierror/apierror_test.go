@@ -0,0 +1,200 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCodeStatus(t *testing.T) {
+	tests := map[Code]int{
+		InvalidRequest:          http.StatusBadRequest,
+		OwnerTokenRequired:      http.StatusUnauthorized,
+		PasswordRequired:        http.StatusUnauthorized,
+		OwnerTokenMismatch:      http.StatusForbidden,
+		WrongPassword:           http.StatusForbidden,
+		FileNotFound:            http.StatusNotFound,
+		UserNotFound:            http.StatusNotFound,
+		RouteNotFound:           http.StatusNotFound,
+		UploadNotFound:          http.StatusNotFound,
+		FileScanning:            http.StatusConflict,
+		DuplicateFile:           http.StatusConflict,
+		OffsetMismatch:          http.StatusConflict,
+		FileRejected:            http.StatusGone,
+		DownloadLimitReached:    http.StatusGone,
+		UnsupportedTusVersion:   http.StatusPreconditionFailed,
+		FileTooLarge:            http.StatusRequestEntityTooLarge,
+		QuotaExceeded:           http.StatusRequestEntityTooLarge,
+		UnsupportedFileType:     http.StatusUnsupportedMediaType,
+		UnsupportedContentType:  http.StatusUnsupportedMediaType,
+		InvalidField:            http.StatusUnprocessableEntity,
+		ContentMismatch:         http.StatusUnprocessableEntity,
+		ArchiveRejected:         http.StatusUnprocessableEntity,
+		MalformedFile:           http.StatusUnprocessableEntity,
+		UploadLocked:            http.StatusLocked,
+		RateLimited:             http.StatusTooManyRequests,
+		TooManyPasswordAttempts: http.StatusTooManyRequests,
+		Internal:                http.StatusInternalServerError,
+		StorageFull:             http.StatusInsufficientStorage,
+	}
+	for code, want := range tests {
+		if got := code.Status(); got != want {
+			t.Errorf("%s: got %d, want %d", code, got, want)
+		}
+		if got := New(code, "message").Status(); got != want {
+			t.Errorf("error %s: got %d, want %d", code, got, want)
+		}
+	}
+
+	// A code added without its status in this table is a change of the API worth a look
+	codes := Codes()
+	if len(codes) != len(tests) {
+		t.Errorf("Codes returned %d codes, the table has %d", len(codes), len(tests))
+	}
+	for i, code := range codes {
+		if _, ok := tests[code]; !ok {
+			t.Errorf("%s has no expected status", code)
+		}
+		if i > 0 && codes[i-1] >= code {
+			t.Errorf("Codes is not sorted: %s before %s", codes[i-1], code)
+		}
+	}
+
+	if got := Code("made_up").Status(); got != http.StatusInternalServerError {
+		t.Errorf("unknown code: got %d, want 500", got)
+	}
+}
+
+// newRouter returns a router answering with the given error, behind the RequestID middleware.
+func newRouter(err error) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RequestID())
+	router.GET("/", func(c *gin.Context) {
+		Respond(c, err)
+	})
+	return router
+}
+
+// get sends a request with the given request ID, none if empty.
+func get(router *gin.Engine, requestID string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if requestID != "" {
+		req.Header.Set(RequestIDHeader, requestID)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRespond(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		code    Code
+		details map[string]any
+	}{
+		{"error", New(QuotaExceeded, "No space left.").With("remainingSpace", 12), http.StatusRequestEntityTooLarge, QuotaExceeded, map[string]any{"remainingSpace": 12.0}},
+		{"wrapped", errors.Join(errors.New("context"), New(FileNotFound, "No file.")), http.StatusNotFound, FileNotFound, nil},
+		{"internal", errors.New("secret path /var/lib/moada"), http.StatusInternalServerError, Internal, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := get(newRouter(test.err), "client-request-1")
+			if w.Code != test.status {
+				t.Fatalf("got %d, want %d", w.Code, test.status)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+				t.Errorf("Content-Type: got %q", got)
+			}
+
+			// The envelope has a single member, error, with the documented keys only
+			var raw map[string]map[string]any
+			if err := json.Unmarshal(w.Body.Bytes(), &raw); err != nil {
+				t.Fatalf("invalid JSON body %q: %v", w.Body, err)
+			}
+			if len(raw) != 1 || raw["error"] == nil {
+				t.Fatalf("the body is not an error envelope: %s", w.Body)
+			}
+			for key := range raw["error"] {
+				switch key {
+				case "code", "message", "details", "requestId":
+				default:
+					t.Errorf("unexpected key %q in %s", key, w.Body)
+				}
+			}
+
+			var envelope Envelope
+			if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+				t.Fatal(err)
+			}
+			got := envelope.Error
+			if got.Code != test.code || got.Message == "" || got.RequestID != "client-request-1" {
+				t.Errorf("unexpected error %+v", got)
+			}
+			if len(got.Details) != len(test.details) {
+				t.Errorf("details: got %v, want %v", got.Details, test.details)
+			}
+			for key, value := range test.details {
+				if got.Details[key] != value {
+					t.Errorf("detail %s: got %v, want %v", key, got.Details[key], value)
+				}
+			}
+			if strings.Contains(w.Body.String(), "/var/lib") {
+				t.Errorf("the text of an internal error reached the client: %s", w.Body)
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+	tests := []struct {
+		name string
+		sent string
+		kept bool
+	}{
+		{"printable", "abc-123_X.y:z", true},
+		{"longest", strings.Repeat("a", maxRequestIDLength), true},
+		{"missing", "", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"space", "two words", false},
+		{"newline", "id\ninjected", false},
+		{"slash", "a/b", false},
+		{"non ASCII", "identité", false},
+	}
+
+	router := newRouter(New(FileNotFound, "No file."))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := get(router, test.sent)
+			id := w.Header().Get(RequestIDHeader)
+			if test.kept && id != test.sent {
+				t.Errorf("the request ID %q was replaced by %q", test.sent, id)
+			}
+			if !test.kept && !generated.MatchString(id) {
+				t.Errorf("the request ID %q was answered with %q, want a generated one", test.sent, id)
+			}
+
+			var envelope Envelope
+			if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+				t.Fatal(err)
+			}
+			if envelope.Error.RequestID != id {
+				t.Errorf("the error carries %q, the header %q", envelope.Error.RequestID, id)
+			}
+		})
+	}
+
+	// Each request gets its own ID
+	if first, second := get(router, "").Header().Get(RequestIDHeader), get(router, "").Header().Get(RequestIDHeader); first == second {
+		t.Errorf("two requests got the same ID %q", first)
+	}
+}
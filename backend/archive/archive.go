@@ -0,0 +1,414 @@
+// Package archive inspects the content of uploaded zip, tar and gzip files, refusing zip bombs,
+// path traversal entries and nested executables before the archives are shared.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"backend/sniff"
+)
+
+// ErrRejected is matched by every error refusing an archive because of its content, as opposed to the errors
+// reading or writing the files of the server.
+var ErrRejected = errors.New("the archive is not allowed")
+
+var (
+	ErrTooLarge       error = rejection("the archive is too large once extracted")
+	ErrRatio          error = rejection("the archive is compressed too much")
+	ErrTooManyEntries error = rejection("the archive has too many entries")
+	ErrTooDeep        error = rejection("the archive nests too many archives")
+	ErrUnsafePath     error = rejection("the archive has an entry outside of its root")
+	ErrExecutable     error = rejection("the archive contains an executable")
+	ErrEntryType      error = rejection("the archive contains a file type that is not allowed")
+	ErrUnreadable     error = rejection("the archive cannot be read")
+)
+
+// rejection is an error refusing an archive, which matches ErrRejected.
+type rejection string
+
+func (r rejection) Error() string {
+	return string(r)
+}
+
+func (r rejection) Is(target error) bool {
+	return target == ErrRejected
+}
+
+const ratioThreshold = 1024 * 1024 // Uncompressed size below which the compression ratio is not checked
+
+// executableExtensions lists the extensions of programs and scripts run by double-clicking them.
+var executableExtensions = map[string]bool{
+	"exe": true, "dll": true, "scr": true, "com": true, "pif": true, "cpl": true, "sys": true,
+	"msi": true, "bat": true, "cmd": true, "vbs": true, "vbe": true, "wsf": true, "ps1": true,
+	"jar": true, "apk": true, "app": true, "elf": true,
+}
+
+// Limits bounds what an archive may contain.
+type Limits struct {
+	MaxSize    int64   // Maximum number of bytes extracted, counting every nesting level
+	MaxRatio   float64 // Maximum ratio between the extracted size and the size of the archive
+	MaxEntries int     // Maximum number of entries, counting every nesting level
+	MaxDepth   int     // Maximum number of archives nested in each other, 0 to refuse any nested archive
+}
+
+// Entry describes a file found in an archive.
+type Entry struct {
+	Name string // Path of the file in the archive, nested archives being joined with "/"
+	Size int64  // Size of the extracted file in bytes
+}
+
+// Inspector checks archives against its limits.
+type Inspector struct {
+	Limits
+	TempDir string                              // Directory where nested archives are extracted to be inspected
+	Allow   func(name, contentType string) bool // When set, every entry must be accepted by it
+}
+
+// FromEnv builds an Inspector using the ARCHIVE_MAX_SIZE, ARCHIVE_MAX_RATIO, ARCHIVE_MAX_ENTRIES and ARCHIVE_MAX_DEPTH environment variables.
+// Parameters:
+//   tempDir (string): The directory where nested archives are extracted.
+// Returns:
+//   *Inspector: The configured inspector.
+//   error: An error if a variable is not a valid number.
+func FromEnv(tempDir string) (*Inspector, error) {
+	i := &Inspector{
+		Limits: Limits{
+			MaxSize:    1024 * 1024 * 1024,
+			MaxRatio:   100,
+			MaxEntries: 10000,
+			MaxDepth:   2,
+		},
+		TempDir: tempDir,
+	}
+
+	if value := os.Getenv("ARCHIVE_MAX_SIZE"); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid ARCHIVE_MAX_SIZE %q", value)
+		}
+		i.MaxSize = size
+	}
+
+	if value := os.Getenv("ARCHIVE_MAX_RATIO"); value != "" {
+		ratio, err := strconv.ParseFloat(value, 64)
+		if err != nil || ratio < 1 {
+			return nil, fmt.Errorf("invalid ARCHIVE_MAX_RATIO %q", value)
+		}
+		i.MaxRatio = ratio
+	}
+
+	if value := os.Getenv("ARCHIVE_MAX_ENTRIES"); value != "" {
+		entries, err := strconv.Atoi(value)
+		if err != nil || entries <= 0 {
+			return nil, fmt.Errorf("invalid ARCHIVE_MAX_ENTRIES %q", value)
+		}
+		i.MaxEntries = entries
+	}
+
+	if value := os.Getenv("ARCHIVE_MAX_DEPTH"); value != "" {
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 0 {
+			return nil, fmt.Errorf("invalid ARCHIVE_MAX_DEPTH %q", value)
+		}
+		i.MaxDepth = depth
+	}
+
+	return i, nil
+}
+
+// Supports reports whether archives of the given type can be inspected.
+// Parameters:
+//   contentType (string): A type returned by sniff.Detect.
+// Returns:
+//   bool: Returns true for zip, tar and gzip files.
+func Supports(contentType string) bool {
+	switch contentType {
+	case "application/zip", "application/x-tar", "application/gzip":
+		return true
+	}
+	return false
+}
+
+// Inspect reads every entry of an archive, nested archives included, and lists them.
+// Parameters:
+//   path_ (string): The path of the archive.
+//   contentType (string): The type of the archive, one accepted by Supports.
+// Returns:
+//   []Entry: The entries of the archive.
+//   error: One of the errors of the package, matching ErrRejected and wrapped with the name of the offending entry,
+//   or an error if the files of the server could not be read or written.
+func (i *Inspector) Inspect(path_ string, contentType string) ([]Entry, error) {
+	info, err := os.Stat(path_)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{Inspector: i, archiveSize: info.Size()}
+	if err := s.inspectFile(path_, contentType, 0, ""); err != nil {
+		return nil, err
+	}
+	return s.entries, nil
+}
+
+// session holds the counters of a single inspection.
+type session struct {
+	*Inspector
+	archiveSize int64   // Size of the inspected archive, the base of the compression ratio
+	extracted   int64   // Number of bytes extracted so far
+	entries     []Entry // Entries found so far
+}
+
+// inspectFile inspects an archive stored in a file.
+func (s *session) inspectFile(path_ string, contentType string, depth int, prefix string) error {
+	file, err := os.Open(path_)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch contentType {
+	case "application/zip":
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		return s.inspectZip(file, info.Size(), depth, prefix)
+	case "application/x-tar":
+		return s.inspectTar(file, depth, prefix)
+	case "application/gzip":
+		return s.inspectGzip(file, depth, prefix, path.Base(path_))
+	}
+
+	return fmt.Errorf("%w: unsupported type %s", ErrUnreadable, contentType)
+}
+
+// inspectZip inspects the entries of a zip file, refusing it from its central directory when the declared sizes are already over the limits.
+func (s *session) inspectZip(r io.ReaderAt, size int64, depth int, prefix string) error {
+	reader, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnreadable, err)
+	}
+
+	if len(s.entries)+len(reader.File) > s.MaxEntries {
+		return ErrTooManyEntries
+	}
+
+	var declared uint64
+	for _, f := range reader.File {
+		declared += f.UncompressedSize64
+	}
+	if declared > uint64(s.MaxSize-s.extracted) {
+		return ErrTooLarge
+	}
+
+	for _, f := range reader.File {
+		if f.Flags&0x1 != 0 {
+			return fmt.Errorf("%w: %s is encrypted", ErrUnreadable, prefix+f.Name)
+		}
+		if f.FileInfo().IsDir() {
+			if err := checkPath(f.Name); err != nil {
+				return fmt.Errorf("%w: %s", err, prefix+f.Name)
+			}
+			continue
+		}
+
+		content, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrUnreadable, prefix+f.Name, err)
+		}
+		err = s.inspectEntry(f.Name, content, depth, prefix)
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inspectTar inspects the entries of a tar stream.
+func (s *session) inspectTar(r io.Reader, depth int, prefix string) error {
+	reader := tar.NewReader(r)
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrUnreadable, err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			if err := s.inspectEntry(header.Name, reader, depth, prefix); err != nil {
+				return err
+			}
+		case tar.TypeSymlink, tar.TypeLink:
+			// Links may not point outside of the archive either
+			target := header.Linkname
+			if header.Typeflag == tar.TypeSymlink && !strings.HasPrefix(target, "/") {
+				target = path.Join(path.Dir(header.Name), target)
+			}
+			if err := checkPath(header.Name); err != nil {
+				return fmt.Errorf("%w: %s", err, prefix+header.Name)
+			}
+			if err := checkPath(target); err != nil {
+				return fmt.Errorf("%w: %s -> %s", err, prefix+header.Name, header.Linkname)
+			}
+		case tar.TypeDir:
+			if err := checkPath(header.Name); err != nil {
+				return fmt.Errorf("%w: %s", err, prefix+header.Name)
+			}
+		default:
+			return fmt.Errorf("%w: %s is a special file", ErrUnreadable, prefix+header.Name)
+		}
+	}
+}
+
+// inspectGzip inspects a gzip stream, as a tar archive when it holds one or as a single file otherwise.
+func (s *session) inspectGzip(r io.Reader, depth int, prefix string, fileName string) error {
+	reader, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnreadable, err)
+	}
+	defer reader.Close()
+
+	// The extracted bytes are counted by inspectEntry, for the tar entries or the single file
+	buffered := bufio.NewReaderSize(reader, 512)
+	header, _ := buffered.Peek(512)
+	if sniff.DetectHeader(header) == "application/x-tar" {
+		return s.inspectTar(buffered, depth, prefix)
+	}
+
+	name := reader.Name
+	if name == "" {
+		name = strings.TrimSuffix(strings.TrimSuffix(fileName, ".gz"), ".tgz")
+	}
+	return s.inspectEntry(name, buffered, depth, prefix)
+}
+
+// inspectEntry checks a single entry and extracts it to inspect its content when it is itself an archive or when Allow is set.
+func (s *session) inspectEntry(name string, content io.Reader, depth int, prefix string) error {
+	fullName := prefix + name
+
+	if err := checkPath(name); err != nil {
+		return fmt.Errorf("%w: %s", err, fullName)
+	}
+	if len(s.entries) >= s.MaxEntries {
+		return ErrTooManyEntries
+	}
+
+	extension := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	if executableExtensions[extension] {
+		return fmt.Errorf("%w: %s", ErrExecutable, fullName)
+	}
+
+	counted := &countingReader{r: content, s: s}
+	reader := bufio.NewReaderSize(counted, 512)
+	header, _ := reader.Peek(512)
+	contentType := sniff.DetectHeader(header)
+
+	if sniff.Executable(contentType) {
+		return fmt.Errorf("%w: %s", ErrExecutable, fullName)
+	}
+
+	start := s.extracted - int64(reader.Buffered())
+	nested := Supports(contentType)
+	if nested && depth >= s.MaxDepth {
+		return fmt.Errorf("%w: %s", ErrTooDeep, fullName)
+	}
+
+	if !nested && s.Allow == nil {
+		if _, err := io.Copy(io.Discard, reader); err != nil {
+			return wrapRead(err, fullName)
+		}
+		s.entries = append(s.entries, Entry{Name: fullName, Size: s.extracted - start})
+		return nil
+	}
+
+	// The entry is written to a file, so it can be read again as an archive or detected with its structure
+	temp, err := os.CreateTemp(s.TempDir, "entry_*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %v", err)
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = io.Copy(temp, reader)
+	closeErr := temp.Close()
+	if err != nil {
+		return wrapRead(err, fullName)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("error writing temporary file: %v", closeErr)
+	}
+	s.entries = append(s.entries, Entry{Name: fullName, Size: s.extracted - start})
+
+	if !nested {
+		detected, err := sniff.Detect(temp.Name())
+		if err != nil {
+			return err
+		}
+		if !s.Allow(name, detected) {
+			return fmt.Errorf("%w: %s (%s)", ErrEntryType, fullName, detected)
+		}
+		return nil
+	}
+
+	return s.inspectFile(temp.Name(), contentType, depth+1, fullName+"/")
+}
+
+// countingReader counts the extracted bytes of a session, failing as soon as a limit is exceeded.
+type countingReader struct {
+	r io.Reader
+	s *session
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.s.extracted += int64(n)
+
+	if c.s.extracted > c.s.MaxSize {
+		return n, ErrTooLarge
+	}
+	if c.s.extracted > ratioThreshold && float64(c.s.extracted) > c.s.MaxRatio*float64(max(c.s.archiveSize, 1)) {
+		return n, ErrRatio
+	}
+	return n, err
+}
+
+// wrapRead keeps the limit errors and the errors of the file system, and reports the other read errors as an
+// unreadable archive.
+func wrapRead(err error, name string) error {
+	var pathErr *fs.PathError
+	if errors.Is(err, ErrTooLarge) || errors.Is(err, ErrRatio) || errors.As(err, &pathErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %s: %v", ErrUnreadable, name, err)
+}
+
+// checkPath refuses the entry names that would be extracted outside of the destination directory.
+func checkPath(name string) error {
+	name = strings.ReplaceAll(name, "\\", "/")
+
+	if strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return ErrUnsafePath
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return ErrUnsafePath
+		}
+	}
+	return nil
+}
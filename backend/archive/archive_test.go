@@ -0,0 +1,303 @@
+package archive_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"backend/archive"
+)
+
+// file is an entry of a crafted archive.
+type file struct {
+	name    string
+	content []byte
+}
+
+// text returns a file with a text content.
+func text(name, content string) file {
+	return file{name, []byte(content)}
+}
+
+// zipArchive builds a zip archive, compressed with deflate.
+func zipArchive(t *testing.T, files ...file) []byte {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	w := zip.NewWriter(&buffer)
+	for _, f := range files {
+		entry, err := w.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Write(f.content)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// tarArchive builds a tar archive from the headers of its entries.
+func tarArchive(t *testing.T, headers ...*tar.Header) []byte {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	w := tar.NewWriter(&buffer)
+	for _, header := range headers {
+		content := header.Linkname
+		if header.Typeflag == tar.TypeReg {
+			// The content of regular files is given in Linkname, to keep the table short
+			header.Size = int64(len(content))
+			header.Linkname = ""
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			w.Write([]byte(content))
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// regular returns the header of a regular file of a tar archive.
+func regular(name, content string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeReg, Linkname: content}
+}
+
+// gzipped compresses content with gzip.
+func gzipped(t *testing.T, name string, content []byte) []byte {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	w := gzip.NewWriter(&buffer)
+	w.Name = name
+	w.Write(content)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// newInspector returns an inspector with small limits, extracting nested archives in a temporary directory.
+func newInspector(t *testing.T) *archive.Inspector {
+	return &archive.Inspector{
+		Limits:  archive.Limits{MaxSize: 4 * 1024 * 1024, MaxRatio: 100, MaxEntries: 8, MaxDepth: 1},
+		TempDir: t.TempDir(),
+	}
+}
+
+// inspect writes an archive to a file and inspects it.
+func inspect(t *testing.T, inspector *archive.Inspector, name, contentType string, content []byte) ([]archive.Entry, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return inspector.Inspect(path, contentType)
+}
+
+func TestInspectEntries(t *testing.T) {
+	inner := zipArchive(t, text("readme.txt", "nested readme"))
+
+	tests := []struct {
+		name, contentType string
+		content           func(t *testing.T) []byte
+		want              []archive.Entry
+	}{
+		{"zip", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, text("docs/a.txt", "first"), text("b.txt", "second file"))
+		}, []archive.Entry{{"docs/a.txt", 5}, {"b.txt", 11}}},
+		{"nested zip", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, file{"inner.zip", inner}, text("top.txt", "top"))
+		}, []archive.Entry{{"inner.zip", int64(len(inner))}, {"inner.zip/readme.txt", 13}, {"top.txt", 3}}},
+		{"tar", "application/x-tar", func(t *testing.T) []byte {
+			return tarArchive(t, &tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}, regular("dir/a.txt", "in a directory"),
+				&tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "a.txt"})
+		}, []archive.Entry{{"dir/a.txt", 14}}},
+		{"tar.gz", "application/gzip", func(t *testing.T) []byte {
+			return gzipped(t, "", tarArchive(t, regular("a.txt", "compressed tar")))
+		}, []archive.Entry{{"a.txt", 14}}},
+		{"gzip of a single file", "application/gzip", func(t *testing.T) []byte {
+			return gzipped(t, "notes.txt", []byte("a single compressed file"))
+		}, []archive.Entry{{"notes.txt", 24}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := inspect(t, newInspector(t), "upload", test.contentType, test.content(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(entries, test.want) {
+				t.Errorf("got %v, want %v", entries, test.want)
+			}
+		})
+	}
+}
+
+func TestInspectRejected(t *testing.T) {
+	zeros := bytes.Repeat([]byte{0}, 2*1024*1024)
+	inner := zipArchive(t, text("readme.txt", "nested"))
+	elf := append([]byte("\x7fELF\x02\x01\x01\x00"), bytes.Repeat([]byte{0}, 120)...)
+
+	tests := []struct {
+		name, contentType string
+		content           func(t *testing.T) []byte
+		limits            func(i *archive.Inspector) // Changes the limits of the inspector, if set
+		want              error
+	}{
+		// Zip bombs
+		{"compression ratio", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, file{"zeros.bin", zeros})
+		}, nil, archive.ErrRatio},
+		{"gzip compression ratio", "application/gzip", func(t *testing.T) []byte {
+			return gzipped(t, "zeros.bin", zeros)
+		}, nil, archive.ErrRatio},
+		{"declared size", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, file{"zeros.bin", zeros})
+		}, func(i *archive.Inspector) { i.MaxSize = 1024 * 1024; i.MaxRatio = 1e9 }, archive.ErrTooLarge},
+		{"extracted size", "application/x-tar", func(t *testing.T) []byte {
+			return tarArchive(t, regular("a.txt", strings.Repeat("a", 600)), regular("b.txt", strings.Repeat("b", 600)))
+		}, func(i *archive.Inspector) { i.MaxSize = 1000 }, archive.ErrTooLarge},
+		{"nested size", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, file{"inner.zip", zipArchive(t, text("big.txt", strings.Repeat("x", 900)))})
+		}, func(i *archive.Inspector) { i.MaxSize = 1000 }, archive.ErrTooLarge},
+
+		// Entries and nesting
+		{"zip entries", "application/zip", func(t *testing.T) []byte {
+			var files []file
+			for _, name := range []string{"1", "2", "3", "4", "5", "6", "7", "8", "9"} {
+				files = append(files, text(name+".txt", name))
+			}
+			return zipArchive(t, files...)
+		}, nil, archive.ErrTooManyEntries},
+		{"tar entries", "application/x-tar", func(t *testing.T) []byte {
+			var headers []*tar.Header
+			for _, name := range []string{"1", "2", "3", "4", "5", "6", "7", "8", "9"} {
+				headers = append(headers, regular(name+".txt", name))
+			}
+			return tarArchive(t, headers...)
+		}, nil, archive.ErrTooManyEntries},
+		{"nested entries", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, file{"inner.zip", zipArchive(t, text("1", "1"), text("2", "2"), text("3", "3"))})
+		}, func(i *archive.Inspector) { i.MaxEntries = 3 }, archive.ErrTooManyEntries},
+		{"depth", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, file{"middle.zip", zipArchive(t, file{"inner.zip", inner})})
+		}, nil, archive.ErrTooDeep},
+		{"no nesting allowed", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, file{"inner.zip", inner})
+		}, func(i *archive.Inspector) { i.MaxDepth = 0 }, archive.ErrTooDeep},
+		{"tar in gzip in zip", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, file{"inner.tar.gz", gzipped(t, "", tarArchive(t, regular("a.txt", "a")))})
+		}, func(i *archive.Inspector) { i.MaxDepth = 0 }, archive.ErrTooDeep},
+
+		// Path traversal
+		{"parent directory", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, text("../evil.txt", "evil"))
+		}, nil, archive.ErrUnsafePath},
+		{"parent directory inside a path", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, text("docs/../../evil.txt", "evil"))
+		}, nil, archive.ErrUnsafePath},
+		{"backslashes", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, text(`docs\..\..\evil.txt`, "evil"))
+		}, nil, archive.ErrUnsafePath},
+		{"absolute path", "application/x-tar", func(t *testing.T) []byte {
+			return tarArchive(t, regular("/etc/cron.d/evil", "evil"))
+		}, nil, archive.ErrUnsafePath},
+		{"drive letter", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, text(`C:\Windows\evil.txt`, "evil"))
+		}, nil, archive.ErrUnsafePath},
+		{"directory", "application/x-tar", func(t *testing.T) []byte {
+			return tarArchive(t, &tar.Header{Name: "../dir/", Typeflag: tar.TypeDir, Mode: 0755})
+		}, nil, archive.ErrUnsafePath},
+		{"symbolic link", "application/x-tar", func(t *testing.T) []byte {
+			return tarArchive(t, &tar.Header{Name: "docs/link", Typeflag: tar.TypeSymlink, Linkname: "../../etc/passwd"})
+		}, nil, archive.ErrUnsafePath},
+		{"absolute symbolic link", "application/x-tar", func(t *testing.T) []byte {
+			return tarArchive(t, &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"})
+		}, nil, archive.ErrUnsafePath},
+		{"hard link", "application/x-tar", func(t *testing.T) []byte {
+			return tarArchive(t, &tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../secret"})
+		}, nil, archive.ErrUnsafePath},
+		{"nested traversal", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, file{"inner.zip", zipArchive(t, text("../evil.txt", "evil"))})
+		}, nil, archive.ErrUnsafePath},
+
+		// Executables and types
+		{"executable extension", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, text("setup.EXE", "not really a program"))
+		}, nil, archive.ErrExecutable},
+		{"executable content", "application/x-tar", func(t *testing.T) []byte {
+			return tarArchive(t, regular("photo.jpg", string(elf)))
+		}, nil, archive.ErrExecutable},
+		{"nested executable", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, file{"inner.zip", zipArchive(t, text("run.bat", "@echo off"))})
+		}, nil, archive.ErrExecutable},
+		{"type not allowed", "application/zip", func(t *testing.T) []byte {
+			return zipArchive(t, text("data.bin", "\x00\x01\x02\x03 binary data"))
+		}, func(i *archive.Inspector) {
+			i.Allow = func(name, contentType string) bool { return contentType == "text/plain" }
+		}, archive.ErrEntryType},
+
+		// Unreadable archives
+		{"not a zip", "application/zip", func(t *testing.T) []byte {
+			return []byte("PK\x03\x04 but nothing else")
+		}, nil, archive.ErrUnreadable},
+		{"truncated gzip", "application/gzip", func(t *testing.T) []byte {
+			compressed := gzipped(t, "notes.txt", []byte(strings.Repeat("notes ", 100)))
+			return compressed[:len(compressed)/2]
+		}, nil, archive.ErrUnreadable},
+		{"special file", "application/x-tar", func(t *testing.T) []byte {
+			return tarArchive(t, &tar.Header{Name: "null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3})
+		}, nil, archive.ErrUnreadable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inspector := newInspector(t)
+			if test.limits != nil {
+				test.limits(inspector)
+			}
+
+			_, err := inspect(t, inspector, "upload", test.contentType, test.content(t))
+			if !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+			if !errors.Is(err, archive.ErrRejected) {
+				t.Errorf("%v does not match ErrRejected", err)
+			}
+		})
+	}
+}
+
+func TestInspectServerErrors(t *testing.T) {
+	inspector := newInspector(t)
+
+	// The archive is missing
+	if _, err := inspector.Inspect(filepath.Join(t.TempDir(), "missing.zip"), "application/zip"); err == nil || errors.Is(err, archive.ErrRejected) {
+		t.Errorf("missing archive: got %v, want an error of the server", err)
+	}
+
+	// Nested archives cannot be extracted
+	inspector.TempDir = filepath.Join(t.TempDir(), "missing")
+	content := zipArchive(t, file{"inner.zip", zipArchive(t, text("a.txt", "a"))})
+	if _, err := inspect(t, inspector, "upload.zip", "application/zip", content); err == nil || errors.Is(err, archive.ErrRejected) {
+		t.Errorf("missing temporary directory: got %v, want an error of the server", err)
+	}
+}
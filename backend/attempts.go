@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// attemptLimiter counts the failed password attempts of each file, refusing new attempts once too many failed in a window.
+// Attempts are counted as soon as they start, the ones still being verified included.
+type attemptLimiter struct {
+	Max    int           // Number of failed attempts allowed in a window
+	Window time.Duration // Duration of the window, starting at the first attempt
+
+	mu       sync.Mutex
+	failures map[string]attempts // Failed attempts indexed by public ID of the file
+	windows  []window            // Windows in the order they started, so the ones that are over are found first
+}
+
+// window records when the window of a file started, for pruning.
+type window struct {
+	Key   string
+	Start time.Time
+}
+
+// attempts records the failed attempts made on a file during the current window.
+type attempts struct {
+	Count int       // Number of failed attempts, the ones being verified included
+	Start time.Time // Date of the first attempt of the window
+}
+
+// newAttemptLimiter creates a limiter allowing max failed attempts per window.
+// Parameters:
+//   max (int): The number of failed attempts allowed in a window.
+//   window (time.Duration): The duration of the window.
+// Returns:
+//   *attemptLimiter: The new limiter.
+func newAttemptLimiter(max int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		Max:      max,
+		Window:   window,
+		failures: map[string]attempts{},
+	}
+}
+
+// Reserve counts a new attempt on a file before its password is verified, so concurrent attempts cannot exceed the
+// limit while the slow verification runs. The attempt is refused, and not counted, once too many failed in the window.
+// Parameters:
+//   key (string): The public ID of the file.
+// Returns:
+//   time.Duration: The time left before a new attempt is allowed, 0 if the attempt was counted and can be made now.
+func (l *attemptLimiter) Reserve(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	current, ok := l.failures[key]
+	if !ok || now.Sub(current.Start) >= l.Window {
+		l.prune(now)
+		current = attempts{Start: now}
+		l.windows = append(l.windows, window{Key: key, Start: now})
+	}
+
+	if current.Count >= l.Max {
+		return l.Window - now.Sub(current.Start)
+	}
+
+	current.Count++
+	l.failures[key] = current
+	return 0
+}
+
+// Refund gives back an attempt reserved on a file that did not fail, because no password was sent or it was the right one.
+// Only that attempt is given back: the failures of other clients still count until the window is over.
+// Parameters:
+//   key (string): The public ID of the file.
+func (l *attemptLimiter) Refund(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	current, ok := l.failures[key]
+	if !ok {
+		return
+	}
+
+	current.Count--
+	if current.Count <= 0 {
+		delete(l.failures, key)
+		return
+	}
+	l.failures[key] = current
+}
+
+// prune removes the windows that are over, so files that are never tried again do not stay in memory. Windows all
+// last the same time, so the ones that are over are at the start of the list and each is only looked at once.
+// The caller must hold the lock.
+func (l *attemptLimiter) prune(now time.Time) {
+	over := 0
+	for _, w := range l.windows {
+		if now.Sub(w.Start) < l.Window {
+			break
+		}
+		// The file may have started a newer window since, or have been refunded
+		if current, ok := l.failures[w.Key]; ok && current.Start.Equal(w.Start) {
+			delete(l.failures, w.Key)
+		}
+		over++
+	}
+	l.windows = l.windows[over:]
+}
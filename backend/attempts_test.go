@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttemptLimiterPrune(t *testing.T) {
+	limiter := newAttemptLimiter(2, 20*time.Millisecond)
+	limiter.Reserve("old")
+	limiter.Reserve("refunded")
+	limiter.Refund("refunded")
+	time.Sleep(30 * time.Millisecond)
+
+	// Starting a new window drops the ones that are over, and only those
+	limiter.Reserve("recent")
+	limiter.Reserve("new")
+	if len(limiter.failures) != 2 || len(limiter.windows) != 2 {
+		t.Errorf("got %d files and %d windows, want 2 of each", len(limiter.failures), len(limiter.windows))
+	}
+
+	// The window of a file that was tried again is not dropped by its previous start
+	time.Sleep(30 * time.Millisecond)
+	limiter.Reserve("recent")
+	if current := limiter.failures["recent"]; current.Count != 1 || len(limiter.failures) != 1 {
+		t.Errorf("got %+v and %d files, want a new window for recent only", current, len(limiter.failures))
+	}
+}
@@ -0,0 +1,211 @@
+// Package clientip finds the address of the client that sent a request. Forwarding headers are only read when the
+// request comes from a trusted proxy, and X-Forwarded-For chains are walked from the right so that the entries added
+// by the client itself are never used.
+package clientip
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Published ranges of the Cloudflare proxies, https://www.cloudflare.com/ips/
+var cloudflare = []string{
+	"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22", "141.101.64.0/18", "108.162.192.0/18",
+	"190.93.240.0/20", "188.114.96.0/20", "197.234.240.0/22", "198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+	"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+	"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32", "2405:8100::/32", "2a06:98c0::/29", "2c0f:f248::/32",
+}
+
+// Names that can be used in TRUSTED_PROXIES instead of listing the ranges.
+var presets = map[string][]string{
+	"cloudflare": cloudflare,
+	"loopback":   {"127.0.0.0/8", "::1/128"},
+	"private":    {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+}
+
+// Resolver finds the client address of the requests.
+type Resolver struct {
+	Trusted       []netip.Prefix // Networks of the proxies whose headers are believed
+	Headers       []string       // Headers holding the client address, in order of preference
+	ProxyProtocol bool           // Whether trusted proxies send the client address with the PROXY protocol, see Listener
+
+	warned atomic.Bool // Whether the requests forwarded by an untrusted Cloudflare were reported
+}
+
+// FromEnv builds the resolver from TRUSTED_PROXIES, a comma separated list of networks and addresses (or the "cloudflare",
+// "loopback" and "private" presets), CLIENT_IP_HEADERS (default "X-Forwarded-For") and PROXY_PROTOCOL (default false).
+// Without TRUSTED_PROXIES no header is trusted and the address of the connection is used.
+// Returns:
+//   *Resolver: The resolver.
+//   error: An error if a network or a value is not valid.
+func FromEnv() (*Resolver, error) {
+	r := &Resolver{Headers: []string{"X-Forwarded-For"}}
+
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		networks, ok := presets[strings.ToLower(entry)]
+		if !ok {
+			networks = []string{entry}
+		}
+		for _, network := range networks {
+			prefix, err := parsePrefix(network)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q", entry)
+			}
+			r.Trusted = append(r.Trusted, prefix)
+		}
+	}
+
+	if value := os.Getenv("CLIENT_IP_HEADERS"); value != "" {
+		r.Headers = nil
+		for _, header := range strings.Split(value, ",") {
+			if header = strings.TrimSpace(header); header != "" {
+				r.Headers = append(r.Headers, http.CanonicalHeaderKey(header))
+			}
+		}
+	}
+
+	if value := os.Getenv("PROXY_PROTOCOL"); value != "" {
+		var err error
+		if r.ProxyProtocol, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid PROXY_PROTOCOL %q", value)
+		}
+	}
+
+	return r, nil
+}
+
+// parsePrefix reads a network, or a single address which is a network of one.
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Proxies returns the trusted networks in their text form.
+func (r *Resolver) Proxies() []string {
+	proxies := make([]string, len(r.Trusted))
+	for i, prefix := range r.Trusted {
+		proxies[i] = prefix.String()
+	}
+	return proxies
+}
+
+// IsTrusted reports whether an address belongs to a trusted proxy.
+func (r *Resolver) IsTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range r.Trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IP returns the address of the client that sent a request.
+// Parameters:
+//   req (*http.Request): The request.
+// Returns:
+//   string: The address from the first trusted header holding one when the request comes from a trusted proxy, the
+//   address of the connection otherwise.
+func (r *Resolver) IP(req *http.Request) string {
+	peer, err := parseAddr(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	if r.IsTrusted(peer) {
+		for _, header := range r.Headers {
+			if client, ok := r.fromHeader(req.Header.Values(header)); ok {
+				return client.String()
+			}
+		}
+	}
+
+	// The first versions read CF-Connecting-IP from anyone, deployments behind Cloudflare now need to trust it
+	if len(r.Trusted) == 0 && !r.warned.Load() && req.Header.Get("CF-Connecting-IP") != "" && fromCloudflare(peer) && r.warned.CompareAndSwap(false, true) {
+		log.Printf("WARNING: requests come through Cloudflare but TRUSTED_PROXIES is not set, every client is counted as " +
+			"the Cloudflare address it comes from. Set TRUSTED_PROXIES=cloudflare and CLIENT_IP_HEADERS=CF-Connecting-IP.")
+	}
+
+	return peer.String()
+}
+
+// fromCloudflare reports whether an address belongs to the Cloudflare proxies.
+func fromCloudflare(addr netip.Addr) bool {
+	for _, network := range cloudflare {
+		if prefix, err := parsePrefix(network); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromHeader reads the client address from the values of a header, each being a comma separated list of addresses
+// appended by the proxies the request went through. The rightmost address that is not a trusted proxy is the client,
+// any address on its left could have been sent by the client itself.
+func (r *Resolver) fromHeader(values []string) (netip.Addr, bool) {
+	var hops []string
+	for _, value := range values {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := parseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// A malformed chain cannot be trusted past this point
+			return netip.Addr{}, false
+		}
+
+		client = addr
+		if !r.IsTrusted(addr) {
+			break
+		}
+	}
+
+	return client, client.IsValid()
+}
+
+// parseAddr reads an address with or without a port, as found in RemoteAddr and in the forwarding headers.
+func parseAddr(value string) (netip.Addr, error) {
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr().Unmap().WithZone(""), nil
+	}
+
+	addr, err := netip.ParseAddr(strings.Trim(value, "[]"))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap().WithZone(""), nil
+}
+
+// tcpAddr converts an address and port to a *net.TCPAddr.
+func tcpAddr(addr netip.Addr, port uint16) *net.TCPAddr {
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port))
+}
@@ -0,0 +1,152 @@
+package clientip
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIP(t *testing.T) {
+	resolver := &Resolver{
+		Trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.1.10/32"), netip.MustParsePrefix("2001:db8:ffff::/48")},
+		Headers: []string{"X-Forwarded-For"},
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{name: "untrusted peer", remoteAddr: "203.0.113.7:4000", want: "203.0.113.7"},
+		{name: "spoofed header from an untrusted peer", remoteAddr: "203.0.113.7:4000", forwarded: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "spoofed header from an untrusted peer in a trusted chain", remoteAddr: "203.0.113.7:4000", forwarded: []string{"198.51.100.1, 10.0.0.2"}, want: "203.0.113.7"},
+		{name: "trusted proxy", remoteAddr: "10.0.0.1:4000", forwarded: []string{"203.0.113.7"}, want: "203.0.113.7"},
+		{name: "trusted proxy without header", remoteAddr: "10.0.0.1:4000", want: "10.0.0.1"},
+		{name: "entry added by the client", remoteAddr: "10.0.0.1:4000", forwarded: []string{"198.51.100.1, 203.0.113.7"}, want: "203.0.113.7"},
+		{name: "chain of trusted proxies", remoteAddr: "10.0.0.1:4000", forwarded: []string{"203.0.113.7, 192.168.1.10, 10.0.0.2"}, want: "203.0.113.7"},
+		{name: "untrusted proxy in the chain", remoteAddr: "10.0.0.1:4000", forwarded: []string{"198.51.100.1, 203.0.113.7, 10.0.0.2"}, want: "203.0.113.7"},
+		{name: "untrusted neighbour of a trusted address", remoteAddr: "10.0.0.1:4000", forwarded: []string{"203.0.113.7, 192.168.1.11"}, want: "192.168.1.11"},
+		{name: "only trusted proxies", remoteAddr: "10.0.0.1:4000", forwarded: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "repeated header", remoteAddr: "10.0.0.1:4000", forwarded: []string{"198.51.100.1", "203.0.113.7, 10.0.0.2"}, want: "203.0.113.7"},
+		{name: "addresses with ports", remoteAddr: "10.0.0.1:4000", forwarded: []string{"203.0.113.7:5000, [2001:db8::1]:4711"}, want: "2001:db8::1"},
+		{name: "IPv6 chain", remoteAddr: "[2001:db8:ffff::1]:4000", forwarded: []string{"2001:db8::1, 2001:db8:ffff::2"}, want: "2001:db8::1"},
+		{name: "IPv4-mapped proxy", remoteAddr: "[::ffff:10.0.0.1]:4000", forwarded: []string{"::ffff:203.0.113.7"}, want: "203.0.113.7"},
+		{name: "malformed entry on the right", remoteAddr: "10.0.0.1:4000", forwarded: []string{"203.0.113.7, not-an-address"}, want: "10.0.0.1"},
+		{name: "malformed entry behind the client", remoteAddr: "10.0.0.1:4000", forwarded: []string{"not-an-address, 203.0.113.7"}, want: "203.0.113.7"},
+		{name: "empty entry", remoteAddr: "10.0.0.1:4000", forwarded: []string{"203.0.113.7, "}, want: "10.0.0.1"},
+		{name: "malformed remote address", remoteAddr: "somewhere", forwarded: []string{"203.0.113.7"}, want: "somewhere"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := resolver.IP(req); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIPHeaderPreference(t *testing.T) {
+	resolver := &Resolver{
+		Trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		Headers: []string{"Cf-Connecting-Ip", "X-Forwarded-For"},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:4000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if got := resolver.IP(req); got != "198.51.100.1" {
+		t.Errorf("without the preferred header: got %s", got)
+	}
+
+	req.Header.Set("CF-Connecting-IP", "203.0.113.7")
+	if got := resolver.IP(req); got != "203.0.113.7" {
+		t.Errorf("with the preferred header: got %s", got)
+	}
+}
+
+func TestUntrustedCloudflare(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	tests := []struct {
+		name       string
+		resolver   *Resolver
+		remoteAddr string
+		warned     bool
+	}{
+		{name: "direct client", resolver: &Resolver{}, remoteAddr: "203.0.113.7:4000"},
+		{name: "cloudflare without trusted proxies", resolver: &Resolver{}, remoteAddr: "172.64.1.1:4000", warned: true},
+		{name: "cloudflare trusted", resolver: &Resolver{Trusted: []netip.Prefix{netip.MustParsePrefix("172.64.0.0/13")}, Headers: []string{"Cf-Connecting-Ip"}}, remoteAddr: "172.64.1.1:4000"},
+	}
+
+	for _, test := range tests {
+		logged.Reset()
+		for i := 0; i < 3; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = test.remoteAddr
+			req.Header.Set("CF-Connecting-IP", "198.51.100.1")
+			test.resolver.IP(req)
+		}
+
+		// Reported once, not for every request
+		want := 0
+		if test.warned {
+			want = 1
+		}
+		if got := strings.Count(logged.String(), "TRUSTED_PROXIES=cloudflare"); got != want {
+			t.Errorf("%s: got %d warnings, want warned %v", test.name, got, test.warned)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "loopback, 192.168.1.10, ::ffff:10.0.0.0/104")
+	t.Setenv("CLIENT_IP_HEADERS", "x-real-ip, X-Forwarded-For")
+	t.Setenv("PROXY_PROTOCOL", "true")
+
+	resolver, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"127.0.0.0/8", "::1/128", "192.168.1.10/32", "10.0.0.0/8"}
+	if got := resolver.Proxies(); len(got) != len(want) {
+		t.Errorf("got the proxies %v, want %v", got, want)
+	} else {
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("got the proxies %v, want %v", got, want)
+				break
+			}
+		}
+	}
+	if len(resolver.Headers) != 2 || resolver.Headers[0] != "X-Real-Ip" {
+		t.Errorf("unexpected headers %v", resolver.Headers)
+	}
+	if !resolver.ProxyProtocol {
+		t.Error("PROXY_PROTOCOL was not read")
+	}
+
+	for name, value := range map[string]string{"TRUSTED_PROXIES": "10.0.0.0/33", "PROXY_PROTOCOL": "sometimes"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := FromEnv(); err == nil {
+				t.Errorf("%s=%q was accepted", name, value)
+			}
+		})
+	}
+}
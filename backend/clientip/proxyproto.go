@@ -0,0 +1,189 @@
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrProxyHeader is returned by the connections of a Listener whose PROXY protocol header is missing or not valid.
+var ErrProxyHeader = errors.New("invalid PROXY protocol header")
+
+const (
+	headerTimeout = 10 * time.Second // Time a trusted proxy has to send the header
+	maxV1Length   = 107              // Longest version 1 header, including the CRLF
+)
+
+// Signature starting the version 2 headers.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Listener accepts connections whose client address is sent by the proxy with the PROXY protocol (version 1 or 2),
+// as HAProxy, AWS load balancers and Traefik do. Only the connections of trusted proxies are expected to start with
+// the header, which then replaces their remote address; the other connections are used as they are.
+type Listener struct {
+	net.Listener
+	Resolver *Resolver // Resolver whose trusted networks are the proxies sending the header
+}
+
+// Accept waits for the next connection. Its header is read on the first Read or RemoteAddr call, from the goroutine
+// serving the connection, so a slow proxy does not block the other ones.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	peer, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !l.Resolver.IsTrusted(peer.AddrPort().Addr()) {
+		return conn, nil
+	}
+
+	return &proxyConn{Conn: conn, reader: bufio.NewReaderSize(conn, 512), remote: conn.RemoteAddr()}, nil
+}
+
+// proxyConn is a connection from a trusted proxy starting with a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	return c.remote
+}
+
+// readHeader reads the header and keeps the client address it holds. Connections without a valid header fail on
+// their first Read.
+func (c *proxyConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	start, err := c.reader.Peek(len(v2Signature))
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	var remote net.Addr
+	if bytes.Equal(start, v2Signature) {
+		remote, err = readV2(c.reader)
+	} else {
+		remote, err = readV1(c.reader)
+	}
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	// LOCAL and UNKNOWN headers, sent for health checks, keep the address of the proxy
+	if remote != nil {
+		c.remote = remote
+	}
+}
+
+func (c *proxyConn) fail(err error) {
+	c.err = fmt.Errorf("%w from %s: %v", ErrProxyHeader, c.Conn.RemoteAddr(), err)
+	c.Conn.Close()
+}
+
+// readV1 reads a text header, "PROXY TCP4 <source> <destination> <source port> <destination port>\r\n".
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxV1Length {
+			return nil, fmt.Errorf("header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("not a PROXY protocol header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed header")
+	}
+
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil || addr.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %q", fields[4])
+	}
+
+	return tcpAddr(addr, uint16(port)), nil
+}
+
+// readV2 reads a binary header: the signature, the version and command, the address family, the length of the
+// addresses and the addresses themselves, followed by optional TLVs which are skipped.
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	versionCommand, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:16]))
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", versionCommand&0x0f)
+	}
+
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		if length < 12 {
+			return nil, fmt.Errorf("truncated addresses")
+		}
+		addr := netip.AddrFrom4([4]byte(body[0:4]))
+		return tcpAddr(addr, binary.BigEndian.Uint16(body[8:10])), nil
+	case 0x2: // AF_INET6
+		if length < 36 {
+			return nil, fmt.Errorf("truncated addresses")
+		}
+		addr := netip.AddrFrom16([16]byte(body[0:16])).Unmap()
+		return tcpAddr(addr, binary.BigEndian.Uint16(body[32:34])), nil
+	default: // AF_UNSPEC and AF_UNIX carry no client address
+		return nil, nil
+	}
+}
@@ -0,0 +1,203 @@
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// v2Header builds a version 2 header.
+func v2Header(versionCommand, family byte, addresses []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, versionCommand, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+// v2Addresses returns the address block of a header: source, destination, source port and destination port.
+func v2Addresses(source, destination netip.Addr, sourcePort, destinationPort uint16) []byte {
+	block := append(source.AsSlice(), destination.AsSlice()...)
+	block = binary.BigEndian.AppendUint16(block, sourcePort)
+	return binary.BigEndian.AppendUint16(block, destinationPort)
+}
+
+func TestReadV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    string // Empty when the header keeps the address of the proxy
+		wantErr bool
+	}{
+		{name: "TCP4", header: "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n", want: "203.0.113.7:56324"},
+		{name: "TCP6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", want: "[2001:db8::1]:56324"},
+		{name: "UNKNOWN", header: "PROXY UNKNOWN\r\n"},
+		{name: "UNKNOWN with addresses", header: "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"},
+		{name: "not a PROXY header", header: "GET / HTTP/1.1\r\n", wantErr: true},
+		{name: "missing fields", header: "PROXY TCP4 203.0.113.7 10.0.0.1 56324\r\n", wantErr: true},
+		{name: "unknown protocol", header: "PROXY UDP4 203.0.113.7 10.0.0.1 56324 443\r\n", wantErr: true},
+		{name: "IPv6 source in TCP4", header: "PROXY TCP4 2001:db8::1 10.0.0.1 56324 443\r\n", wantErr: true},
+		{name: "IPv4 source in TCP6", header: "PROXY TCP6 203.0.113.7 2001:db8::2 56324 443\r\n", wantErr: true},
+		{name: "malformed source", header: "PROXY TCP4 203.0.113 10.0.0.1 56324 443\r\n", wantErr: true},
+		{name: "port out of range", header: "PROXY TCP4 203.0.113.7 10.0.0.1 65536 443\r\n", wantErr: true},
+		{name: "truncated", header: "PROXY TCP4 203.0.113.7 10.0", wantErr: true},
+		{name: "without CRLF", header: "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\n", wantErr: true},
+		{name: "too long", header: "PROXY TCP4 " + strings.Repeat("1", maxV1Length) + "\r\n", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, err := readV1(bufio.NewReader(strings.NewReader(test.header)))
+			checkAddr(t, addr, err, test.want, test.wantErr)
+		})
+	}
+}
+
+func TestReadV2(t *testing.T) {
+	source4, destination4 := netip.MustParseAddr("203.0.113.7"), netip.MustParseAddr("10.0.0.1")
+	source6, destination6 := netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2")
+	addresses4 := v2Addresses(source4, destination4, 56324, 443)
+	addresses6 := v2Addresses(source6, destination6, 56324, 443)
+
+	tests := []struct {
+		name    string
+		header  []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "IPv4", header: v2Header(0x21, 0x11, addresses4), want: "203.0.113.7:56324"},
+		{name: "IPv6", header: v2Header(0x21, 0x21, addresses6), want: "[2001:db8::1]:56324"},
+		{name: "TLVs skipped", header: v2Header(0x21, 0x11, append(addresses4, 0x04, 0x00, 0x01, 0xff)), want: "203.0.113.7:56324"},
+		{name: "LOCAL", header: v2Header(0x20, 0x00, nil)},
+		{name: "AF_UNSPEC", header: v2Header(0x21, 0x00, nil)},
+		{name: "AF_UNIX", header: v2Header(0x21, 0x31, make([]byte, 216))},
+		{name: "version 1 in a version 2 header", header: v2Header(0x11, 0x11, addresses4), wantErr: true},
+		{name: "unknown command", header: v2Header(0x22, 0x11, addresses4), wantErr: true},
+		{name: "IPv4 addresses too short", header: v2Header(0x21, 0x11, addresses4[:8]), wantErr: true},
+		{name: "IPv6 addresses too short", header: v2Header(0x21, 0x21, addresses4), wantErr: true},
+		{name: "body shorter than its length", header: v2Header(0x21, 0x11, addresses4)[:20], wantErr: true},
+		{name: "truncated fixed part", header: v2Header(0x21, 0x11, addresses4)[:14], wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, err := readV2(bufio.NewReader(bytes.NewReader(test.header)))
+			checkAddr(t, addr, err, test.want, test.wantErr)
+		})
+	}
+}
+
+// checkAddr compares the result of reading a header with the expected address.
+func checkAddr(t *testing.T, addr net.Addr, err error, want string, wantErr bool) {
+	t.Helper()
+
+	if wantErr {
+		if err == nil {
+			t.Fatalf("the header was accepted, with the address %v", addr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := ""
+	if addr != nil {
+		got = addr.String()
+	}
+	if got != want {
+		t.Errorf("got the address %q, want %q", got, want)
+	}
+}
+
+// accept listens on the loopback, trusting the given networks, and returns the server side of a connection on which
+// the client sent data.
+func accept(t *testing.T, trusted []netip.Prefix, data []byte) net.Conn {
+	t.Helper()
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &Listener{Listener: inner, Resolver: &Resolver{Trusted: trusted}}
+	t.Cleanup(func() { listener.Close() })
+
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// The server sees the end of the data
+	client.(*net.TCPConn).CloseWrite()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestListener(t *testing.T) {
+	loopback := []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	elsewhere := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	request := "GET / HTTP/1.1\r\n\r\n"
+	v1 := "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n"
+	v2 := string(v2Header(0x21, 0x11, v2Addresses(netip.MustParseAddr("203.0.113.7"), netip.MustParseAddr("10.0.0.1"), 56324, 443)))
+
+	tests := []struct {
+		name     string
+		trusted  []netip.Prefix
+		data     string
+		wantAddr string // Empty for the address of the connection
+		wantData string
+		wantErr  bool
+	}{
+		{name: "version 1 from a trusted proxy", trusted: loopback, data: v1 + request, wantAddr: "203.0.113.7:56324", wantData: request},
+		{name: "version 2 from a trusted proxy", trusted: loopback, data: v2 + request, wantAddr: "203.0.113.7:56324", wantData: request},
+		{name: "health check of a trusted proxy", trusted: loopback, data: "PROXY UNKNOWN\r\n" + request, wantData: request},
+		{name: "trusted proxy without header", trusted: loopback, data: request, wantErr: true},
+		{name: "trusted proxy with a truncated header", trusted: loopback, data: v1[:20], wantErr: true},
+		{name: "trusted proxy with a truncated version 2 header", trusted: loopback, data: v2[:20], wantErr: true},
+		// The header of an untrusted client is not read, the request it starts is then refused by the HTTP server
+		{name: "version 1 from an untrusted client", trusted: elsewhere, data: v1 + request, wantData: v1 + request},
+		{name: "version 2 from an untrusted client", trusted: elsewhere, data: v2 + request, wantData: v2 + request},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := accept(t, test.trusted, []byte(test.data))
+
+			data, err := io.ReadAll(conn)
+			if test.wantErr {
+				if !errors.Is(err, ErrProxyHeader) {
+					t.Fatalf("got %q, %v, want ErrProxyHeader", data, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.wantData {
+				t.Errorf("read %q, want %q", data, test.wantData)
+			}
+
+			addr := conn.RemoteAddr().(*net.TCPAddr)
+			if test.wantAddr == "" {
+				if !addr.IP.IsLoopback() {
+					t.Errorf("got the address %s, want the one of the connection", addr)
+				}
+			} else if addr.String() != test.wantAddr {
+				t.Errorf("got the address %s, want %s", addr, test.wantAddr)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentRequests sends uploads and lookups of several clients at once through the handlers, which share the
+// store. Run with go test -race, it reports the data races between requests.
+func TestConcurrentRequests(t *testing.T) {
+	ts := newTestServer(t)
+	const clients, uploadsPerClient = 6, 4
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients*uploadsPerClient*4)
+	for client := 0; client < clients; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			remoteAddr := fmt.Sprintf("198.51.100.%d:4000", client+1)
+
+			for i := 0; i < uploadsPerClient; i++ {
+				name := fmt.Sprintf("client%d-%d.txt", client, i)
+				body, contentType := uploadForm(t, name, "text/plain", []byte("content of "+name), nil)
+				w := ts.doFrom(remoteAddr, http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+				if w.Code != http.StatusAccepted {
+					errs <- fmt.Errorf("upload of %s: got %d %s", name, w.Code, w.Body)
+					continue
+				}
+
+				var uploaded uploadResponse
+				if err := decodeBody(w, &uploaded); err != nil {
+					errs <- err
+					continue
+				}
+				bearer := http.Header{"Authorization": {"Bearer " + uploaded.OwnerToken}}
+				if w := ts.doFrom(remoteAddr, http.MethodGet, "/api/v1/files/"+uploaded.Data.IdPublic, nil, bearer); w.Code != http.StatusOK {
+					errs <- fmt.Errorf("info of %s: got %d %s", name, w.Code, w.Body)
+				}
+				if w := ts.doFrom(remoteAddr, http.MethodGet, "/api/v1/me", nil, nil); w.Code != http.StatusOK {
+					errs <- fmt.Errorf("me of client %d: got %d %s", client, w.Code, w.Body)
+				}
+				// The file may still be scanned, both answers are expected
+				if w := ts.doFrom(remoteAddr, http.MethodGet, "/api/v1/files/"+uploaded.Data.IdPublic+"/content", nil, nil); w.Code != http.StatusOK && w.Code != http.StatusConflict {
+					errs <- fmt.Errorf("download of %s: got %d %s", name, w.Code, w.Body)
+				}
+			}
+		}(client)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestConcurrentPasswordAttempts guesses the password of a file with many requests at once: the slow verification must
+// not let more attempts through than the limit allows.
+func TestConcurrentPasswordAttempts(t *testing.T) {
+	ts := newTestServer(t)
+	uploaded := ts.upload(t, "secret.txt", []byte("protected content"), map[string]string{"password": "open sesame"})
+	target := "/api/v1/files/" + uploaded.Data.IdPublic + "/content"
+	const guesses = 12
+
+	var wg sync.WaitGroup
+	codes := make(chan int, guesses)
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := ts.do(http.MethodGet, target, nil, http.Header{"X-File-Password": {fmt.Sprintf("guess %d", i)}})
+			codes <- w.Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusForbidden] != ts.passwords.Max || counts[http.StatusTooManyRequests] != guesses-ts.passwords.Max {
+		t.Errorf("got %v, want %d wrong passwords and the other attempts refused", counts, ts.passwords.Max)
+	}
+
+	// The right password is refused too until the window is over
+	if w := ts.do(http.MethodGet, target, nil, http.Header{"X-File-Password": {"open sesame"}}); w.Code != http.StatusTooManyRequests {
+		t.Errorf("right password after the guesses: got %d, want 429", w.Code)
+	}
+}
+
+// TestConcurrentQuota sends uploads of one client at once, each taking more than half of its space: only one can be
+// saved, the others must see it when they check the quota.
+func TestConcurrentQuota(t *testing.T) {
+	ts := newTestServer(t)
+	const uploads = 4
+	size := int(userMaxSpace)/2 + 1
+
+	var wg sync.WaitGroup
+	codes := make(chan int, uploads)
+	for i := 0; i < uploads; i++ {
+		body, contentType := uploadForm(t, fmt.Sprintf("large%d.txt", i), "text/plain", bytes.Repeat([]byte{byte('a' + i)}, size), nil)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}}).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusAccepted] != 1 || counts[http.StatusRequestEntityTooLarge] != uploads-1 {
+		t.Errorf("got %v, want one upload accepted and the others over the quota", counts)
+	}
+}
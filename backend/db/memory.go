@@ -0,0 +1,504 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/storage"
+)
+
+// MemoryStore is a thread-safe in-memory implementation of FileRepository and UserRepository.
+// Its content is lost when the process stops, which makes it suited to tests and local development.
+type MemoryStore struct {
+	mu    sync.RWMutex
+	files map[string]File // Files indexed by public ID
+	users map[string]User // Users indexed by anonymized (hashed) IP address
+	salts map[int64][]byte // Salts of the IP pseudonyms indexed by period
+	blobs storage.Storage // Storage where the users files are kept
+}
+
+// NewMemoryStore creates an empty in-memory store.
+// Parameters:
+//   blobs (storage.Storage): The storage where the users files are kept.
+// Returns:
+//   *MemoryStore: The new store.
+func NewMemoryStore(blobs storage.Storage) *MemoryStore {
+	return &MemoryStore{
+		files: map[string]File{},
+		users: map[string]User{},
+		salts: map[int64][]byte{},
+		blobs: blobs,
+	}
+}
+
+// SaveMetadata saves file metadata in memory.
+// Parameters:
+//   idPublic (string): The public ID of the file.
+//   idPrivate (string): The keyed hash of the private ID of the file, stored in its place.
+//   file (File): The metadata of the file (name, size, email, expiration, ...); its IDs and saved date are filled in.
+// Returns:
+//   File: The saved File object.
+//   error: An error if a file with the same public ID already exists.
+func (m *MemoryStore) SaveMetadata(idPublic, idPrivate string, file File) (File, error) {
+	newFile := file
+	newFile.IdPublic = idPublic
+	newFile.IdPrivate = idPrivate
+	newFile.SavedDate = time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.files[newFile.IdPublic]; exists {
+		return File{}, fmt.Errorf("error while saving the metadata")
+	}
+	m.files[newFile.IdPublic] = newFile
+
+	return newFile, nil
+}
+
+// GetFileFromID retrieves a file based on the provided ID and ID type ("public", "private" or "content" for the content hash).
+// Parameters:
+//   id (string): The ID of the file to retrieve.
+//   idType (string): The type of ID provided.
+// Returns:
+//   File: The file found.
+//   error: ErrNotFound if no file is found, or an error if the ID type is not valid.
+func (m *MemoryStore) GetFileFromID(id, idType string) (File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.findFile(id, idType)
+}
+
+// findFile looks a file up by ID. The caller must hold the lock.
+func (m *MemoryStore) findFile(id, idType string) (File, error) {
+	switch idType {
+	case "public":
+		if file, ok := m.files[id]; ok {
+			return file, nil
+		}
+	case "private":
+		for _, file := range m.files {
+			if file.IdPrivate == id {
+				return file, nil
+			}
+		}
+	case "content":
+		for _, file := range m.files {
+			if id != "" && file.ContentHash == id {
+				return file, nil
+			}
+		}
+	default:
+		return File{}, fmt.Errorf("idType provided not valid")
+	}
+
+	return File{}, ErrNotFound
+}
+
+// DeleteFile deletes a file based on its private ID.
+// Parameters:
+//   idPrivate (string): The private ID of the file to delete.
+// Returns:
+//   File: The file that was deleted.
+//   error: An error if no file has this private ID.
+func (m *MemoryStore) DeleteFile(idPrivate string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := m.findFile(idPrivate, "private")
+	if err != nil {
+		return File{}, fmt.Errorf("error retrieving file from the database")
+	}
+
+	delete(m.files, file.IdPublic)
+	return file, nil
+}
+
+// RegisterDownload atomically increments the download counter of a file, unless it already reached its limit.
+// Parameters:
+//   idPublic (string): The public ID of the file being downloaded.
+// Returns:
+//   File: The file with its updated counter.
+//   error: ErrDownloadLimit if the file cannot be downloaded anymore, or an error if it does not exist.
+func (m *MemoryStore) RegisterDownload(idPublic string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[idPublic]
+	if !ok {
+		return File{}, ErrNotFound
+	}
+
+	if file.LastDownload() {
+		return File{}, ErrDownloadLimit
+	}
+
+	file.Downloads++
+	m.files[idPublic] = file
+
+	return file, nil
+}
+
+// SetScanResult records the result of the malware scan of a file.
+// Parameters:
+//   idPublic (string): The public ID of the scanned file.
+//   status (string): The new scan status (ScanAvailable or ScanRejected).
+//   signature (string): The name of the detected threat, empty if there is none.
+// Returns:
+//   File: The updated file.
+//   error: An error if the file does not exist.
+func (m *MemoryStore) SetScanResult(idPublic, status, signature string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[idPublic]
+	if !ok {
+		return File{}, ErrNotFound
+	}
+
+	file.ScanStatus = status
+	file.ScanSignature = signature
+	m.files[idPublic] = file
+
+	return file, nil
+}
+
+// SetStorageKey records the key under which the content of a file is stored.
+// Parameters:
+//   idPublic (string): The public ID of the file.
+//   key (string): The storage key of its content.
+// Returns:
+//   File: The updated file.
+//   error: An error if the file does not exist.
+func (m *MemoryStore) SetStorageKey(idPublic, key string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[idPublic]
+	if !ok {
+		return File{}, ErrNotFound
+	}
+
+	file.StorageKey = key
+	m.files[idPublic] = file
+
+	return file, nil
+}
+
+// SetPrivateID replaces the stored private ID of a file.
+// Parameters:
+//   idPublic (string): The public ID of the file.
+//   idPrivate (string): The keyed hash of its private ID, stored in its place.
+// Returns:
+//   File: The updated file.
+//   error: An error if the file does not exist.
+func (m *MemoryStore) SetPrivateID(idPublic, idPrivate string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[idPublic]
+	if !ok {
+		return File{}, ErrNotFound
+	}
+
+	file.IdPrivate = idPrivate
+	m.files[idPublic] = file
+
+	return file, nil
+}
+
+// GetExpiredFiles retrieves every file whose expiration date is before the given date.
+// Parameters:
+//   date (time.Time): The reference date, usually the current time.
+// Returns:
+//   []File: The expired files.
+//   error: Always nil.
+func (m *MemoryStore) GetExpiredFiles(date time.Time) ([]File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var files []File
+	for _, file := range m.files {
+		if file.ExpireDate.Before(date) {
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
+
+// GetUnlocatedFiles retrieves every file saved without storage key.
+// Returns:
+//   []File: The files without storage key.
+//   error: Always nil.
+func (m *MemoryStore) GetUnlocatedFiles() ([]File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var files []File
+	for _, file := range m.files {
+		if file.StorageKey == "" {
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
+
+// GetOwnerFiles retrieves every file stored, or waiting in quarantine, under a users storage directory.
+// Parameters:
+//   DirPath (string): The storage directory (key prefix) containing the users files.
+// Returns:
+//   []File: The files of the user.
+//   error: Always nil.
+func (m *MemoryStore) GetOwnerFiles(DirPath string) ([]File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var files []File
+	for _, file := range m.files {
+		if strings.HasPrefix(file.StorageKey, ownerPrefix(DirPath)) {
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
+
+// GetUnsealedFiles retrieves every file whose private ID is stored in clear, saved before keyed hashes.
+// Returns:
+//   []File: The files with a private ID in clear.
+//   error: Always nil.
+func (m *MemoryStore) GetUnsealedFiles() ([]File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var files []File
+	for _, file := range m.files {
+		if !strings.Contains(file.IdPrivate, sealSeparator) {
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
+
+// UserExists checks if a user with a specific anonymized (hashed) IP address exists.
+// Parameters:
+//   ip (string): The anonymized (hashed) IP address to search for.
+// Returns:
+//   bool: Returns true if the user exists, false otherwise.
+func (m *MemoryStore) UserExists(ip string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.users[ip]
+	return ok
+}
+
+// GetUser retrieves a user based on their anonymized (hashed) IP address.
+// Parameters:
+//   ip (string): The anonymized (hashed) IP address of the user.
+// Returns:
+//   User: The user found.
+//   error: ErrNotFound if the user does not exist.
+func (m *MemoryStore) GetUser(ip string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[ip]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+
+	return copyUser(user), nil
+}
+
+// CreateUser creates a new user from the metadata of their files.
+// Parameters:
+//   ip (string): The anonymized (hashed) IP address of the user to create.
+//   DirPath (string): The storage directory (key prefix) containing the users files.
+// Returns:
+//   User: The created user.
+//   error: An error if the files could not be read or the user already exists.
+func (m *MemoryStore) CreateUser(ip string, DirPath string) (User, error) {
+	filesNumber, usedSpace, ids, lastExpiration, err := collectFiles(m, DirPath)
+	if err != nil {
+		return User{}, err
+	}
+
+	newUser := User{
+		Ip:           ip,
+		Files:        ids,
+		FilesNumber:  filesNumber,
+		UsedSpace:    usedSpace,
+		IpSavedDate:  time.Now(),
+		IpExpireDate: userExpireDate(lastExpiration),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.users[ip]; exists {
+		return User{}, fmt.Errorf("error while creating user")
+	}
+	m.users[ip] = newUser
+
+	return copyUser(newUser), nil
+}
+
+// UpdateUser recomputes a users files from their metadata and extends their expiration date.
+// Parameters:
+//   ip (string): The anonymized (hashed) IP address of the user.
+//   DirPath (string): The storage directory (key prefix) containing the users files.
+// Returns:
+//   error: An error if the files could not be read or the user does not exist.
+func (m *MemoryStore) UpdateUser(ip string, DirPath string) error {
+	return m.updateUserFiles(ip, DirPath, true)
+}
+
+// SyncUser recomputes a users files from their metadata without extending their expiration date.
+// Parameters:
+//   ip (string): The anonymized (hashed) IP address of the user.
+//   DirPath (string): The storage directory (key prefix) containing the users files.
+// Returns:
+//   error: An error if the files could not be read or the user does not exist.
+func (m *MemoryStore) SyncUser(ip string, DirPath string) error {
+	return m.updateUserFiles(ip, DirPath, false)
+}
+
+func (m *MemoryStore) updateUserFiles(ip string, DirPath string, renew bool) error {
+	filesNumber, usedSpace, ids, lastExpiration, err := collectFiles(m, DirPath)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[ip]
+	if !ok {
+		return fmt.Errorf("user was not updated")
+	}
+
+	user.Files = ids
+	user.FilesNumber = filesNumber
+	user.UsedSpace = usedSpace
+	if renew {
+		user.IpExpireDate = userExpireDate(lastExpiration)
+	}
+	m.users[ip] = user
+
+	return nil
+}
+
+// DeleteUser deletes a user and all their associated files from the storage and from memory.
+// Parameters:
+//   ip (string): The anonymized (hashed) IP address of the user to delete.
+// Returns:
+//   error: An error if there is any issue during the process.
+func (m *MemoryStore) DeleteUser(ip string) error {
+	user, err := m.GetUser(ip)
+	if err != nil {
+		return err
+	}
+
+	if err = deleteUserFiles(m, m.blobs, user); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.users, ip)
+	return nil
+}
+
+// GetExpiredUsers retrieves every user whose expiration date is before the given date.
+// Parameters:
+//   date (time.Time): The reference date, usually the current time.
+// Returns:
+//   []User: The expired users.
+//   error: Always nil.
+func (m *MemoryStore) GetExpiredUsers(date time.Time) ([]User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var users []User
+	for _, user := range m.users {
+		if user.IpExpireDate.Before(date) {
+			users = append(users, copyUser(user))
+		}
+	}
+
+	return users, nil
+}
+
+// GetFileOwner retrieves the user whose file list contains the given public ID.
+// Parameters:
+//   idPublic (string): The public ID of the file.
+// Returns:
+//   User: The user that uploaded the file.
+//   error: An error if no user owns the file.
+func (m *MemoryStore) GetFileOwner(idPublic string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, user := range m.users {
+		for _, id := range user.Files {
+			if id == idPublic {
+				return copyUser(user), nil
+			}
+		}
+	}
+
+	return User{}, fmt.Errorf("error while searching for the owner of the file")
+}
+
+// copyUser returns a copy of the user that does not share its file list with the stored one.
+func copyUser(user User) User {
+	user.Files = append([]string(nil), user.Files...)
+	return user
+}
+
+// GetOrCreateSalt returns the salt of a period, storing the given one first when the period has none yet.
+// Parameters:
+//   period (int64): The number of the rotation period.
+//   salt ([]byte): The salt stored when the period has none.
+// Returns:
+//   []byte: The salt of the period.
+//   error: Always nil.
+func (m *MemoryStore) GetOrCreateSalt(period int64, salt []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stored, ok := m.salts[period]; ok {
+		return stored, nil
+	}
+	m.salts[period] = salt
+	return salt, nil
+}
+
+// DeleteSaltsBefore removes the salts of the periods before the given one.
+// Parameters:
+//   period (int64): The oldest period whose salt is kept.
+// Returns:
+//   error: Always nil.
+func (m *MemoryStore) DeleteSaltsBefore(period int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for stored := range m.salts {
+		if stored < period {
+			delete(m.salts, stored)
+		}
+	}
+	return nil
+}
+
+var _ FileRepository = (*MemoryStore)(nil)
+var _ UserRepository = (*MemoryStore)(nil)
+var _ SaltRepository = (*MemoryStore)(nil)
@@ -1,121 +1,96 @@
-// Package db handles database operations for managing users and their associated files, using MongoDB.
 package db
 
 import (
 	"context"
-	"strings"
 
 	"fmt"
 
+	"regexp"
 	"time"
 
-	"backend/utils"
-	"path/filepath"
+	"backend/storage"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
-	"os"
-
-	"github.com/joho/godotenv"
 )
 
-// File represents a file uploaded by a user with metadata such as identifiers, name, size, and associated email.
-type File struct {
-	IdPublic string `json:"idPublic" bson:"idPublic"` // Public identifier of the file
-	IdPrivate string `json:"idPrivate" bson:"idPrivate"` // Private identifier of the file
-	Name string `json:"name" bson:"name"` // Name of the file
-	Size float64 `json:"size" bson:"size"` // Size of the file in bytes
-	SavedDate  time.Time `json:"savedDate" bson:"savedDate"` // Date when the file was saved
-	ExpireDate time.Time `json:"expireDate" bson:"expireDate"` // Expiration date of the file
-	Email string `json:"email" bson:"email"` // Email of the user who uploaded the file
-}
-
-
-// User represents a user in the system.
-// It contains information about the users anonymized (hashed) IP address, file data, and metadata for usage tracking.
-type User struct {
-    Ip string `bson:"ip"`  // anonymized (hashed) IP address of the user
-    Files []string `bson:"files"`  // List of public ids for files associated with the user
-    FilesNumber int `bson:"filesNumber"`  // Number of files the user has uploaded
-    UsedSpace float64 `bson:"usedSpace"`  // Total space consumed by the user
-    IpSavedDate time.Time `bson:"ipSavedDate"`  // Date when the users IP was saved
-    IpExpireDate time.Time `bson:"ipExpireDate"` // Expiration date for the users data
-    APICalls int `bson:"APICalls"` // Number of API calls made by the user
-    APILastCallDate time.Time `bson:"APILastCallDate"`  // Date of the last API call
+// Store is the MongoDB implementation of FileRepository and UserRepository.
+// Its collection handles are set once by Connect and never change, so a Store can be shared by concurrent requests.
+type Store struct {
+	client *mongo.Client     // Connection to the MongoDB server
+	files  *mongo.Collection // Collection holding the files metadata
+	users  *mongo.Collection // Collection holding the users
+	salts  *mongo.Collection // Collection holding the salts of the IP pseudonyms
+	blobs  storage.Storage   // Storage where the users files are kept
 }
 
-
-var client *mongo.Client
-var collection *mongo.Collection
-
-
-// Connect establishes a connection to a MongoDB database.
+// Connect establishes a connection to a MongoDB database and returns a Store using its files, users and salts collections.
 // Parameters:
 //   uri (string): The URI connection string for the MongoDB database.
+//   dbName (string): The name of the database.
+//   filesCollection (string): The name of the collection holding the files metadata.
+//   usersCollection (string): The name of the collection holding the users.
+//   saltsCollection (string): The name of the collection holding the salts of the IP pseudonyms.
+//   blobs (storage.Storage): The storage where the users files are kept.
 // Returns:
-//   None: This function does not return any values. It prints messages to indicate the connection status.
-func Connect(uri string) {
-	if client != nil {
-		return
-	}
-
+//   *Store: The store using the given collections.
+//   error: An error if the server could not be reached.
+func Connect(uri, dbName, filesCollection, usersCollection, saltsCollection string, blobs storage.Storage) (*Store, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	var err error
-	client, err = mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
 	if err != nil {
-		fmt.Printf("Error connecting to MongoDB: %v", err)
-		return
+		return nil, fmt.Errorf("error connecting to MongoDB: %v", err)
 	}
 
 	err = client.Ping(ctx, nil)
 	if err != nil {
-		fmt.Printf("Error pinging MongoDB: %v\n", err)
-		return
+		return nil, fmt.Errorf("error pinging MongoDB: %v", err)
 	}
 
 	fmt.Printf("Successfully connected to MongoDB\n")
+
+	database := client.Database(dbName)
+	return &Store{
+		client: client,
+		files:  database.Collection(filesCollection),
+		users:  database.Collection(usersCollection),
+		salts:  database.Collection(saltsCollection),
+		blobs:  blobs,
+	}, nil
 }
 
-// ChangeCollection switches the current MongoDB collection to the one specified by the provided database and collection names.
-// Parameters:
-//   dbName (string): The name of the database to connect to.
-//   collectionName (string): The name of the collection within the database.
+// Disconnect closes the connection to the MongoDB server.
 // Returns:
-//   None: This function does not return any values. It changes the current collection.
-func ChangeCollection(dbName, collectionName string) {
-	collection = client.Database(dbName).Collection(collectionName)
+//   error: An error if the connection could not be closed.
+func (s *Store) Disconnect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return s.client.Disconnect(ctx)
 }
 
-// SaveMetadata saves file metadata to the MongoDB collection.
+// SaveMetadata saves file metadata to the files collection of MongoDB.
 // Parameters:
 //   idPublic (string): The public ID of the file.
-//   idPrivate (string): The private ID of the file.
-//   name (string): The name, with extension, of the file.
-//   email (string): The email associated with the file.
-//   size (float64): The size of the file in bytes.
+//   idPrivate (string): The keyed hash of the private ID of the file, stored in its place.
+//   file (File): The metadata of the file (name, size, email, expiration, ...); its IDs and saved date are filled in.
 // Returns:
 //   File: The saved File object.
 //   error: An error if there was an issue saving the metadata.
-func SaveMetadata(idPublic, idPrivate, name, email string, size float64) (File, error) {
-	ChangeCollection(os.Getenv("DB_NAME"), os.Getenv("FILES_COLLECTION"))
-	newFile := File{
-		IdPublic: utils.EncryptString(idPublic),
-		IdPrivate:   utils.EncryptString(idPrivate),
-		Name:       name,
-		Size:       size,
-		SavedDate:  time.Now(),
-		ExpireDate: time.Now().AddDate(0, 0, 1),
-		Email:      email,
-	}
+func (s *Store) SaveMetadata(idPublic, idPrivate string, file File) (File, error) {
+	newFile := file
+	newFile.IdPublic = idPublic
+	newFile.IdPrivate = idPrivate
+	newFile.SavedDate = time.Now()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	_, err := collection.InsertOne(ctx, newFile)
+	_, err := s.files.InsertOne(ctx, newFile)
 
 	if err != nil {
 		return File{}, fmt.Errorf("error while saving the metadata")
@@ -127,12 +102,11 @@ func SaveMetadata(idPublic, idPrivate, name, email string, size float64) (File,
 // GetFileFromID retrieves a file from the MongoDB collection based on the provided ID and ID type.
 // Parameters:
 //   id (string): The ID of the file to retrieve (either public or private).
-//   idType (string): The type of ID provided. It can either be "public" or "private".
+//   idType (string): The type of ID provided. It can be "public", "private" or "content" for the content hash.
 // Returns:
 //   File: The file object retrieved from the database.
-//   error: An error if there was an issue retrieving the file or if no document is found.
-func GetFileFromID(id, idType string) (File, error) {
-	ChangeCollection(os.Getenv("DB_NAME"), os.Getenv("FILES_COLLECTION"))
+//   error: ErrNotFound if no document is found, or an error if there was an issue retrieving the file.
+func (s *Store) GetFileFromID(id, idType string) (File, error) {
 	var file File
 	var filter bson.M
 
@@ -140,6 +114,8 @@ func GetFileFromID(id, idType string) (File, error) {
 		filter = bson.M{"idPrivate": id}
 	}else if idType == "public"{
 		filter = bson.M{"idPublic": id}
+	}else if idType == "content" && id != ""{
+		filter = bson.M{"contentHash": id}
 	}else{
 		return File{}, fmt.Errorf("idType provided not valid")
 	}
@@ -147,11 +123,11 @@ func GetFileFromID(id, idType string) (File, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	err := collection.FindOne(ctx, filter).Decode(&file)
+	err := s.files.FindOne(ctx, filter).Decode(&file)
 
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return File{}, fmt.Errorf("no document found with the specified id")
+			return File{}, ErrNotFound
 		} else {
 			return File{}, fmt.Errorf("error retrieving the file: %v", err)
 		}
@@ -166,15 +142,14 @@ func GetFileFromID(id, idType string) (File, error) {
 // Returns:
 //   File: The file object that was deleted.
 //   error: An error if there was an issue.
-func DeleteFile(idPrivate string) (File, error) {
-	ChangeCollection(os.Getenv("DB_NAME"), os.Getenv("FILES_COLLECTION"))
+func (s *Store) DeleteFile(idPrivate string) (File, error) {
 	filter := bson.D{{Key: "idPrivate", Value: idPrivate}}
 	var res bson.M
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	err := collection.FindOne(ctx, filter).Decode(&res)
+	err := s.files.FindOne(ctx, filter).Decode(&res)
 	if err != nil {
 		return File{}, fmt.Errorf("error retrieving file from the database")
 	}
@@ -184,12 +159,12 @@ func DeleteFile(idPrivate string) (File, error) {
 		return File{}, fmt.Errorf("field 'IdPublic' not found in the database")
 	}
 
-	file, err := GetFileFromID(IdPublic, "public")
+	file, err := s.GetFileFromID(IdPublic, "public")
 	if err != nil {
 		return File{}, fmt.Errorf("error retrieving file metadata")
 	}
 
-	result, err := collection.DeleteOne(context.Background(), filter)
+	result, err := s.files.DeleteOne(context.Background(), filter)
 	if err != nil {
 		return File{}, fmt.Errorf("error attempting to delete the file from the database")
 	}
@@ -201,17 +176,129 @@ func DeleteFile(idPrivate string) (File, error) {
 	return file, nil
 }
 
-// UserExists checks if a user with a specific anonymized (hashed) IP address exists in the MongoDB collection.
+// RegisterDownload atomically increments the download counter of a file, unless it already reached its limit.
+// Parameters:
+//   idPublic (string): The public ID of the file being downloaded.
+// Returns:
+//   File: The file with its updated counter.
+//   error: ErrDownloadLimit if the file cannot be downloaded anymore, or an error if it does not exist.
+func (s *Store) RegisterDownload(idPublic string) (File, error) {
+	var file File
+
+	// Files saved before download limits existed have no maxDownloads field
+	filter := bson.M{
+		"idPublic": idPublic,
+		"$or": bson.A{
+			bson.M{"maxDownloads": bson.M{"$exists": false}},
+			bson.M{"maxDownloads": bson.M{"$lte": 0}},
+			bson.M{"$expr": bson.M{"$lt": bson.A{bson.M{"$ifNull": bson.A{"$downloads", 0}}, "$maxDownloads"}}},
+		},
+	}
+	update := bson.M{"$inc": bson.M{"downloads": 1}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := s.files.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&file)
+	if err == mongo.ErrNoDocuments {
+		if _, err := s.GetFileFromID(idPublic, "public"); err != nil {
+			return File{}, err
+		}
+		return File{}, ErrDownloadLimit
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("error updating the download counter: %v", err)
+	}
+
+	return file, nil
+}
+
+// SetScanResult records the result of the malware scan of a file.
+// Parameters:
+//   idPublic (string): The public ID of the scanned file.
+//   status (string): The new scan status (ScanAvailable or ScanRejected).
+//   signature (string): The name of the detected threat, empty if there is none.
+// Returns:
+//   File: The updated file.
+//   error: An error if the file does not exist or could not be updated.
+func (s *Store) SetScanResult(idPublic, status, signature string) (File, error) {
+	var file File
+	update := bson.M{"$set": bson.M{"scanStatus": status, "scanSignature": signature}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := s.files.FindOneAndUpdate(ctx, bson.M{"idPublic": idPublic}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&file)
+	if err == mongo.ErrNoDocuments {
+		return File{}, ErrNotFound
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("error updating the scan status: %v", err)
+	}
+
+	return file, nil
+}
+
+// SetStorageKey records the key under which the content of a file is stored.
+// Parameters:
+//   idPublic (string): The public ID of the file.
+//   key (string): The storage key of its content.
+// Returns:
+//   File: The updated file.
+//   error: An error if the file does not exist or could not be updated.
+func (s *Store) SetStorageKey(idPublic, key string) (File, error) {
+	var file File
+	update := bson.M{"$set": bson.M{"storageKey": key}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := s.files.FindOneAndUpdate(ctx, bson.M{"idPublic": idPublic}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&file)
+	if err == mongo.ErrNoDocuments {
+		return File{}, ErrNotFound
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("error updating the storage key: %v", err)
+	}
+
+	return file, nil
+}
+
+// SetPrivateID replaces the stored private ID of a file.
+// Parameters:
+//   idPublic (string): The public ID of the file.
+//   idPrivate (string): The keyed hash of its private ID, stored in its place.
+// Returns:
+//   File: The updated file.
+//   error: An error if the file does not exist or could not be updated.
+func (s *Store) SetPrivateID(idPublic, idPrivate string) (File, error) {
+	var file File
+	update := bson.M{"$set": bson.M{"idPrivate": idPrivate}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := s.files.FindOneAndUpdate(ctx, bson.M{"idPublic": idPublic}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&file)
+	if err == mongo.ErrNoDocuments {
+		return File{}, ErrNotFound
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("error updating the private ID: %v", err)
+	}
+
+	return file, nil
+}
+
+// UserExists checks if a user with a specific anonymized (hashed) IP address exists in the users collection of MongoDB.
 // Parameters:
 //   ip (string): The IP address anonymized (hashed) to search for in the users collection.
 // Returns:
 //   bool: Returns true if the user exists, false otherwise.
-func UserExists(ip string) bool {
-	ChangeCollection(os.Getenv("DB_NAME"), os.Getenv("USERS_COLLECTION"))
+func (s *Store) UserExists(ip string) bool {
 	filter := bson.D{{Key: "ip", Value: ip}}
 
 	var result bson.M
-	err := collection.FindOne(context.Background(), filter).Decode(&result)
+	err := s.users.FindOne(context.Background(), filter).Decode(&result)
 
 	if err == mongo.ErrNoDocuments {
 		return false
@@ -227,18 +314,17 @@ func UserExists(ip string) bool {
 // CreateUser creates a new user in the MongoDB collection and returns the created user or an error.
 // Parameters:
 //   ip (string): The IP address of the user to create.
-//   DirPath (string): The path to the directory containing the users files.
+//   DirPath (string): The storage directory (key prefix) containing the users files.
 // Returns:
 //   User: The created user object if successful.
 //   error: An error if the user creation fails.
-func CreateUser(ip string, DirPath string) (User, error) {
-	ChangeCollection(os.Getenv("DB_NAME"), os.Getenv("USERS_COLLECTION"))
-	
-	filesNumber, usedSpace, ids, err := getFilesFromDir(DirPath)
+func (s *Store) CreateUser(ip string, DirPath string) (User, error) {
+	filesNumber, usedSpace, ids, lastExpiration, err := collectFiles(s, DirPath)
 	
 	if err != nil {
 		return User{}, err
 	}
+
 	
 	newUser := User{
 		Ip: ip,
@@ -246,15 +332,13 @@ func CreateUser(ip string, DirPath string) (User, error) {
 		FilesNumber: filesNumber,
 		UsedSpace: usedSpace,
 		IpSavedDate: time.Now(),
-		IpExpireDate: time.Now().AddDate(0, 0, 1),
-		APICalls: 1,
-		APILastCallDate: time.Now(),
+		IpExpireDate: userExpireDate(lastExpiration),
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	
-	a, err := collection.InsertOne(ctx, newUser)
+	a, err := s.users.InsertOne(ctx, newUser)
 	fmt.Printf("%v\n%v\n", err, a)
 	if err != nil {
 		return User{}, fmt.Errorf("error while creating user")
@@ -266,12 +350,32 @@ func CreateUser(ip string, DirPath string) (User, error) {
 // UpdateUser updates a users data based on their anonymized (hashed) IP address and the directory path with new file information.
 // Parameters:
 //   ip (string): The anonymized (hashed) IP address of the user whose data is being updated.
-//   DirPath (string): The path to the directory containing the users files.
+//   DirPath (string): The storage directory (key prefix) containing the users files.
+// Returns:
+//   error: Returns nil if the update is successful, or an error message if something goes wrong.
+func (s *Store) UpdateUser(ip string, DirPath string) error {
+	return s.updateUserFiles(ip, DirPath, true)
+}
+
+// SyncUser recomputes a users file list and used space from their directory without extending their expiration date.
+// Parameters:
+//   ip (string): The anonymized (hashed) IP address of the user whose data is being synchronized.
+//   DirPath (string): The storage directory (key prefix) containing the users files.
+// Returns:
+//   error: Returns nil if the update is successful, or an error message if something goes wrong.
+func (s *Store) SyncUser(ip string, DirPath string) error {
+	return s.updateUserFiles(ip, DirPath, false)
+}
+
+// updateUserFiles writes the file data found in DirPath to the user document, optionally renewing its expiration date.
+// Parameters:
+//   ip (string): The anonymized (hashed) IP address of the user whose data is being updated.
+//   DirPath (string): The storage directory (key prefix) containing the users files.
+//   renew (bool): Whether the users expiration date should be pushed one day forward.
 // Returns:
 //   error: Returns nil if the update is successful, or an error message if something goes wrong.
-func UpdateUser(ip string, DirPath string) error {
-	ChangeCollection(os.Getenv("DB_NAME"), os.Getenv("USERS_COLLECTION"))
-	filesNumber, usedSpace, ids, err := getFilesFromDir(DirPath)
+func (s *Store) updateUserFiles(ip string, DirPath string, renew bool) error {
+	filesNumber, usedSpace, ids, lastExpiration, err := collectFiles(s, DirPath)
 	
 	if err != nil {
 		return err
@@ -279,16 +383,18 @@ func UpdateUser(ip string, DirPath string) error {
 
 	filter := bson.D{{Key: "ip", Value: ip}}
 
-	update := bson.D{
-		{Key: "$set", Value: bson.D{
-			{Key: "files", Value: ids},
-			{Key: "filesNumber", Value: filesNumber},
-			{Key: "usedSpace", Value: usedSpace},
-			{Key: "ipExpireDate", Value: time.Now().AddDate(0, 0, 1)},
-		}},
+	fields := bson.D{
+		{Key: "files", Value: ids},
+		{Key: "filesNumber", Value: filesNumber},
+		{Key: "usedSpace", Value: usedSpace},
 	}
-	
-	result, err := collection.UpdateOne(context.Background(), filter, update)
+	if renew {
+		fields = append(fields, bson.E{Key: "ipExpireDate", Value: userExpireDate(lastExpiration)})
+	}
+
+	update := bson.D{{Key: "$set", Value: fields}}
+
+	result, err := s.users.UpdateOne(context.Background(), filter, update)
 	if err != nil {
 		return fmt.Errorf("error while updating user data")
 	}
@@ -300,171 +406,260 @@ func UpdateUser(ip string, DirPath string) error {
 	return nil
 }
 
-// UpdateAPIRelatedData increments the anonymized (hashed) API call count and updates the last API call timestamp for a user.
+
+// GetUser retrieves the user data from the database based on the provided IP address.
 // Parameters:
-//   ip (string): The anonymized (hashed) IP address of the user whose API data is being updated.
+//   ip (string): The IP address of the user to retrieve.
 // Returns:
-//   error: Returns nil if the update is successful, or an error message if something goes wrong.
-func UpdateAPIRelatedData(ip string) error{
-	ChangeCollection(os.Getenv("DB_NAME"), os.Getenv("USERS_COLLECTION"))
+//   User: The user data corresponding to the given IP address.
+//   error: ErrNotFound if the user does not exist, or an error if there is an issue during the query.
+func (s *Store) GetUser(ip string) (User, error) {
+	var user User
+
+	filter := bson.D{{Key: "ip", Value: ip}}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	
-	_, err := collection.UpdateOne(
-		ctx,
-		bson.M{"ip": ip},
-		bson.M{
-			"$inc": bson.M{
-				"APICalls": 1,
-			},
-			"$set": bson.M{
-				"APILastCallDate": time.Now(),
-			},
-		},
-	)
 
+	err := s.users.FindOne(ctx, filter).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return User{}, ErrNotFound
+	}
 	if err != nil {
-		return fmt.Errorf("failed to update rate limit: %v", err)
+		return User{}, fmt.Errorf("error while searching for user in database")
 	}
 
-	return nil
+	return user, nil
 }
 
-// ResetRateLimit resets the API call count and updates the last API call timestamp for a user.
+// DeleteUser deletes a user and all their associated files from the system and database.
 // Parameters:
-//   ip (string): The anonymized (hashed) IP address of the user whose API data is being reset.
+//   ip (string): The IP address of the user to delete.
 // Returns:
-//   error: Returns nil if the reset is successful, or an error message if something goes wrong.
-func ResetRateLimit(ip string) error{
-	ChangeCollection(os.Getenv("DB_NAME"), os.Getenv("USERS_COLLECTION"))
+//   error: An error if there is any issue during the process (deleting files, database operations, etc.).
+func (s *Store) DeleteUser(ip string) error {
+	user, err := s.GetUser(ip)
+	if err != nil {
+		return err
+	}
+
+	if err = deleteUserFiles(s, s.blobs, user); err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	_, err := collection.UpdateOne(
-		ctx,
-		bson.M{"ip": ip},
-		bson.M{
-			"$set": bson.M{
-				"APICalls":        0,
-				"APILastCallDate": time.Now(),
-			},
-		},
-	)
+	filter := bson.D{{Key: "ip", Value: ip}}
+
+	result, err := s.users.DeleteOne(ctx, filter)
+
 	if err != nil {
-		return fmt.Errorf("failed to reset rate limit: %v", err)
+		return fmt.Errorf("error while searching for user in database")
+	}
+
+	if result.DeletedCount < 1 {
+		return fmt.Errorf("the file was not deleted from the database")
 	}
 
 	return nil
 }
 
 
-// getFilesFromDir retrieves the number of files, total used space, and file metadata from a specified directory.
+// GetExpiredFiles retrieves every file whose expiration date is before the given date.
 // Parameters:
-//   DirPath (string): The path to the directory containing the users files.
+//   date (time.Time): The reference date, usually the current time.
 // Returns:
-//   filesNumber (int): The total number of files found in the directory.
-//   usedSpace (float64): The total size in bytes of all files in the directory.
-//   files ([]File): A list of File objects representing metadata for each file.
-//   error: Returns an error if any issue occurs during processing.
-func getFilesFromDir(DirPath string) (int, float64, []string, error) {
-	ChangeCollection(os.Getenv("DB_NAME"), os.Getenv("FILES_COLLECTION"))
-	godotenv.Load()
-
-	filesArray, err := utils.GetStoredFiles(DirPath)
-	var filesNumber int
-	var usedSpace float64
-	var ids []string
+//   []File: The expired files.
+//   error: An error if there was an issue querying the database.
+func (s *Store) GetExpiredFiles(date time.Time) ([]File, error) {
+	filter := bson.M{"expireDate": bson.M{"$lt": date}}
 
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := s.files.Find(ctx, filter)
 	if err != nil {
-		return 0, 0.0, []string{}, fmt.Errorf("error accessing user's directory")
+		return []File{}, fmt.Errorf("error searching for expired files: %v", err)
 	}
-	
-	for _, arq := range filesArray {
-		IdPublic := strings.Split((filepath.Base(arq)), ".")[0]
-		fileNow, err := GetFileFromID(IdPublic, "public")
-		if err != nil {
-			return 0, 0.0, []string{}, fmt.Errorf("error retrieving file from ID %s: %v", IdPublic, err)
-		}
 
-		ids = append(ids, fileNow.IdPublic)
-		filesNumber += 1
-		usedSpace += fileNow.Size
+	var files []File
+	if err = cursor.All(ctx, &files); err != nil {
+		return []File{}, fmt.Errorf("error decoding expired files: %v", err)
 	}
 
-	ChangeCollection(os.Getenv("DB_NAME"), os.Getenv("USERS_COLLECTION"))
-	return filesNumber, usedSpace, ids, nil
+	return files, nil
 }
 
-// GetUser retrieves the user data from the database based on the provided IP address.
+// GetUnlocatedFiles retrieves every file saved before storage keys were recorded.
+// Returns:
+//   []File: The files without storage key.
+//   error: An error if there was an issue querying the database.
+func (s *Store) GetUnlocatedFiles() ([]File, error) {
+	filter := bson.M{"$or": bson.A{bson.M{"storageKey": bson.M{"$exists": false}}, bson.M{"storageKey": ""}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := s.files.Find(ctx, filter)
+	if err != nil {
+		return []File{}, fmt.Errorf("error searching for files without storage key: %v", err)
+	}
+
+	var files []File
+	if err = cursor.All(ctx, &files); err != nil {
+		return []File{}, fmt.Errorf("error decoding files without storage key: %v", err)
+	}
+
+	return files, nil
+}
+
+// GetOwnerFiles retrieves every file stored, or waiting in quarantine, under a users storage directory.
 // Parameters:
-//   ip (string): The IP address of the user to retrieve.
+//   DirPath (string): The storage directory (key prefix) containing the users files.
 // Returns:
-//   User: The user data corresponding to the given IP address.
-//   error: An error if the user cannot be found or if there is an issue during the query.
-func GetUser(ip string) (User, error) {
-	ChangeCollection(os.Getenv("DB_NAME"), os.Getenv("USERS_COLLECTION"))
-	var user User
+//   []File: The files of the user.
+//   error: An error if there was an issue querying the database.
+func (s *Store) GetOwnerFiles(DirPath string) ([]File, error) {
+	// The keys starting with the prefix sort between it and the prefix ended by the character following "/"
+	filter := bson.M{"storageKey": bson.M{"$gte": ownerPrefix(DirPath), "$lt": DirPath + "0"}}
 
-	filter := bson.D{{Key: "ip", Value: ip}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := s.files.Find(ctx, filter)
+	if err != nil {
+		return []File{}, fmt.Errorf("error searching for the files of the user: %v", err)
+	}
+
+	var files []File
+	if err = cursor.All(ctx, &files); err != nil {
+		return []File{}, fmt.Errorf("error decoding the files of the user: %v", err)
+	}
+
+	return files, nil
+}
+
+// GetUnsealedFiles retrieves every file whose private ID is stored in clear, saved before keyed hashes.
+// Returns:
+//   []File: The files with a private ID in clear.
+//   error: An error if there was an issue querying the database.
+func (s *Store) GetUnsealedFiles() ([]File, error) {
+	filter := bson.M{"idPrivate": bson.M{"$not": bson.M{"$regex": regexp.QuoteMeta(sealSeparator)}}}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	err := collection.FindOne(ctx, filter).Decode(&user)
+	cursor, err := s.files.Find(ctx, filter)
 	if err != nil {
-		return User{}, fmt.Errorf("error while searching for user in database")
+		return []File{}, fmt.Errorf("error searching for files with a private ID in clear: %v", err)
 	}
 
-	return user, nil
+	var files []File
+	if err = cursor.All(ctx, &files); err != nil {
+		return []File{}, fmt.Errorf("error decoding files with a private ID in clear: %v", err)
+	}
+
+	return files, nil
 }
 
-// DeleteUser deletes a user and all their associated files from the system and database.
+// GetExpiredUsers retrieves every user whose expiration date is before the given date.
 // Parameters:
-//   ip (string): The IP address of the user to delete.
+//   date (time.Time): The reference date, usually the current time.
 // Returns:
-//   error: An error if there is any issue during the process (deleting files, database operations, etc.).
-func DeleteUser(ip string) error {
-	user, err := GetUser(ip)
+//   []User: The expired users.
+//   error: An error if there was an issue querying the database.
+func (s *Store) GetExpiredUsers(date time.Time) ([]User, error) {
+	filter := bson.M{"ipExpireDate": bson.M{"$lt": date}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := s.users.Find(ctx, filter)
 	if err != nil {
-		return err
+		return []User{}, fmt.Errorf("error searching for expired users: %v", err)
 	}
 
-	for _, value := range user.Files {
-		file, err := GetFileFromID(value, "public")
+	var users []User
+	if err = cursor.All(ctx, &users); err != nil {
+		return []User{}, fmt.Errorf("error decoding expired users: %v", err)
+	}
 
-		if err != nil {
-			return err
-		}
+	return users, nil
+}
 
-		_, err = DeleteFile(file.IdPrivate)
-		if err != nil {
-			return err
-		}
-	}
-	
-	path_ := filepath.Join(os.Getenv("SAVE_PATH") + ip)
+// GetFileOwner retrieves the user whose file list contains the given public ID.
+// Parameters:
+//   idPublic (string): The public ID of the file.
+// Returns:
+//   User: The user that uploaded the file.
+//   error: An error if no user owns the file or if there is an issue during the query.
+func (s *Store) GetFileOwner(idPublic string) (User, error) {
+	var user User
+
+	filter := bson.M{"files": idPublic}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	err = os.RemoveAll(path_)
+	err := s.users.FindOne(ctx, filter).Decode(&user)
 	if err != nil {
-		return fmt.Errorf("error deleting files from system")
+		return User{}, fmt.Errorf("error while searching for the owner of the file")
 	}
 
-	ChangeCollection(os.Getenv("DB_NAME"), os.Getenv("USERS_COLLECTION"))
-	filter := bson.D{{Key: "ip", Value: ip}}
+	return user, nil
+}
 
+// salt is a document of the salts collection, whose ID is the period so that each period has a single salt.
+type salt struct {
+	Period int64  `bson:"_id"`
+	Salt   []byte `bson:"salt"`
+}
+
+// GetOrCreateSalt returns the salt of a period, storing the given one first when the period has none yet.
+// Parameters:
+//   period (int64): The number of the rotation period.
+//   value ([]byte): The salt stored when the period has none.
+// Returns:
+//   []byte: The salt of the period, the one stored first when several instances create it at once.
+//   error: An error if the salt could not be stored or read.
+func (s *Store) GetOrCreateSalt(period int64, value []byte) ([]byte, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	result, err := collection.DeleteOne(ctx, filter)
+	// Concurrent upserts of the same period may fail on the unique ID, the salt of the other one is read then
+	filter := bson.D{{Key: "_id", Value: period}}
+	update := bson.D{{Key: "$setOnInsert", Value: bson.D{{Key: "salt", Value: value}}}}
+	_, err := s.salts.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return nil, fmt.Errorf("error storing the salt: %v", err)
+	}
 
-	if err != nil {
-		return fmt.Errorf("error while searching for user in database")
+	var stored salt
+	if err := s.salts.FindOne(ctx, filter).Decode(&stored); err != nil {
+		return nil, fmt.Errorf("error reading the salt: %v", err)
 	}
 
-	if result.DeletedCount < 1 {
-		return fmt.Errorf("the file was not deleted from the database")
+	return stored.Salt, nil
+}
+
+// DeleteSaltsBefore removes the salts of the periods before the given one.
+// Parameters:
+//   period (int64): The oldest period whose salt is kept.
+// Returns:
+//   error: An error if the salts could not be deleted.
+func (s *Store) DeleteSaltsBefore(period int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.D{{Key: "_id", Value: bson.D{{Key: "$lt", Value: period}}}}
+	if _, err := s.salts.DeleteMany(ctx, filter); err != nil {
+		return fmt.Errorf("error deleting the salts: %v", err)
 	}
 
 	return nil
 }
 
+var _ FileRepository = (*Store)(nil)
+var _ UserRepository = (*Store)(nil)
+var _ SaltRepository = (*Store)(nil)
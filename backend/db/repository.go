@@ -0,0 +1,299 @@
+// Package db handles database operations for managing users and their associated files.
+// The handlers talk to the FileRepository, UserRepository and SaltRepository interfaces, implemented with MongoDB (Store),
+// SQLite (SQLiteStore) and in memory (MemoryStore).
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"backend/storage"
+)
+
+// File represents a file uploaded by a user with metadata such as identifiers, name, size, and associated email.
+type File struct {
+	IdPublic   string    `json:"idPublic" bson:"idPublic"`     // Public identifier of the file
+	IdPrivate  string    `json:"idPrivate" bson:"idPrivate"`   // Keyed hash of the private identifier of the file (the identifier itself for files saved before keyed hashes)
+	Name       string    `json:"name" bson:"name"`             // Name of the file
+	Size       float64   `json:"size" bson:"size"`             // Size of the file in bytes
+	SavedDate  time.Time `json:"savedDate" bson:"savedDate"`   // Date when the file was saved
+	ExpireDate time.Time `json:"expireDate" bson:"expireDate"` // Expiration date of the file
+	Email      string    `json:"email" bson:"email"`           // Email of the user who uploaded the file
+
+	ContentType string `json:"contentType" bson:"contentType,omitempty"` // Type detected from the content of the file, empty for files saved before detection existed
+
+	MaxDownloads int `json:"maxDownloads" bson:"maxDownloads"` // Number of downloads after which the file is deleted, 0 for no limit
+	Downloads    int `json:"downloads" bson:"downloads"`       // Number of times the file was downloaded
+
+	PasswordHash string `json:"-" bson:"passwordHash,omitempty"` // argon2id hash of the password required to download the file, empty if there is none
+
+	ScanStatus    string `json:"scanStatus" bson:"scanStatus,omitempty"`       // Result of the malware scan (ScanQuarantined, ScanAvailable or ScanRejected), empty for files saved before asynchronous scanning
+	ScanSignature string `json:"scanSignature" bson:"scanSignature,omitempty"` // Name of the threat detected by the scan, empty if there is none
+
+	ContentHash string `json:"-" bson:"contentHash,omitempty"` // Keyed hash of the content, name and owner of the file, used to find duplicates
+	StorageKey  string `json:"-" bson:"storageKey,omitempty"`  // Key of the content in the storage: "<owner directory>/<idPublic>.<detected extension>"
+
+	Entries []ArchiveEntry `json:"entries,omitempty" bson:"entries,omitempty"` // Files contained in the file when it is an archive
+}
+
+// ArchiveEntry describes a file contained in an uploaded archive.
+type ArchiveEntry struct {
+	Name string `json:"name" bson:"name"` // Path of the file in the archive, nested archives being joined with "/"
+	Size int64  `json:"size" bson:"size"` // Size of the extracted file in bytes
+}
+
+// States of the malware scan of a file.
+const (
+	ScanQuarantined = "quarantined" // The file waits to be scanned and cannot be downloaded
+	ScanAvailable   = "available"   // The file was scanned and found clean
+	ScanRejected    = "rejected"    // The file was found infected (or could not be scanned) and was deleted
+)
+
+// sealSeparator separates the key version from the hash in the sealed private IDs ("<version>$<hash>"), the private IDs
+// stored in clear before keyed hashes have none.
+const sealSeparator = "$"
+
+// ErrNotFound is returned when no file or user has the requested ID.
+var ErrNotFound = errors.New("no document found with the specified id")
+
+// ErrDownloadLimit is returned by RegisterDownload when a file already reached its maximum number of downloads.
+var ErrDownloadLimit = errors.New("the file reached its download limit")
+
+// LastDownload reports whether the file reached its maximum number of downloads and must be deleted.
+// Returns:
+//   bool: Returns true if the file has a download limit and it was reached.
+func (f File) LastDownload() bool {
+	return f.MaxDownloads > 0 && f.Downloads >= f.MaxDownloads
+}
+
+// Available reports whether the file passed the malware scan and can be downloaded.
+// Returns:
+//   bool: Returns true if the file was found clean, or was saved before asynchronous scanning.
+func (f File) Available() bool {
+	return f.ScanStatus == "" || f.ScanStatus == ScanAvailable
+}
+
+// User represents a user in the system.
+// It contains information about the users anonymized (hashed) IP address, file data, and metadata for usage tracking.
+type User struct {
+	Ip           string    `json:"ip" bson:"ip"`                     // pseudonym (keyed hash) of the IP address of the user
+	Files        []string  `json:"files" bson:"files"`               // List of public ids for files associated with the user
+	FilesNumber  int       `json:"filesNumber" bson:"filesNumber"`   // Number of files the user has uploaded
+	UsedSpace    float64   `json:"usedSpace" bson:"usedSpace"`       // Total space consumed by the user
+	IpSavedDate  time.Time `json:"ipSavedDate" bson:"ipSavedDate"`   // Date when the users IP was saved
+	IpExpireDate time.Time `json:"ipExpireDate" bson:"ipExpireDate"` // Expiration date for the users data
+}
+
+// FileRepository stores the metadata of the uploaded files.
+type FileRepository interface {
+	SaveMetadata(idPublic, idPrivate string, file File) (File, error)
+	GetFileFromID(id, idType string) (File, error)
+	DeleteFile(idPrivate string) (File, error)
+	RegisterDownload(idPublic string) (File, error)
+	SetScanResult(idPublic, status, signature string) (File, error)
+	SetStorageKey(idPublic, key string) (File, error)
+	SetPrivateID(idPublic, idPrivate string) (File, error)
+	GetExpiredFiles(date time.Time) ([]File, error)
+	GetUnlocatedFiles() ([]File, error)
+	GetOwnerFiles(DirPath string) ([]File, error)
+	GetUnsealedFiles() ([]File, error)
+}
+
+// UserRepository stores the users and their files summary.
+type UserRepository interface {
+	UserExists(ip string) bool
+	GetUser(ip string) (User, error)
+	CreateUser(ip string, DirPath string) (User, error)
+	UpdateUser(ip string, DirPath string) error
+	SyncUser(ip string, DirPath string) error
+	DeleteUser(ip string) error
+	GetExpiredUsers(date time.Time) ([]User, error)
+	GetFileOwner(idPublic string) (User, error)
+}
+
+// SaltRepository stores the salts of the IP pseudonyms, so every instance gives an address the same pseudonym.
+type SaltRepository interface {
+	GetOrCreateSalt(period int64, salt []byte) ([]byte, error)
+	DeleteSaltsBefore(period int64) error
+}
+
+// collectFiles retrieves the number of files, total used space, and public ids of the files of a user from their metadata.
+// Files waiting in quarantine are counted, so uploads sent while others are scanned cannot exceed the quota.
+// Parameters:
+//   files (FileRepository): The repository holding the metadata of the files.
+//   DirPath (string): The storage directory (key prefix) containing the users files.
+// Returns:
+//   filesNumber (int): The total number of files of the user.
+//   usedSpace (float64): The total size in bytes of the files.
+//   ids ([]string): The public ids of the files.
+//   lastExpiration (time.Time): The latest expiration date among the files, zero if there are none.
+//   error: Returns an error if any issue occurs during processing.
+func collectFiles(files FileRepository, DirPath string) (int, float64, []string, time.Time, error) {
+	owned, err := files.GetOwnerFiles(DirPath)
+	var filesNumber int
+	var usedSpace float64
+	var ids []string
+	var lastExpiration time.Time
+
+	if err != nil {
+		return 0, 0.0, []string{}, time.Time{}, fmt.Errorf("error retrieving user's files: %v", err)
+	}
+
+	for _, fileNow := range owned {
+		// The content of rejected files was deleted, only their metadata is kept to answer downloads
+		if fileNow.ScanStatus == ScanRejected {
+			continue
+		}
+
+		ids = append(ids, fileNow.IdPublic)
+		filesNumber += 1
+		usedSpace += fileNow.Size
+		if fileNow.ExpireDate.After(lastExpiration) {
+			lastExpiration = fileNow.ExpireDate
+		}
+	}
+
+	return filesNumber, usedSpace, ids, lastExpiration, nil
+}
+
+// ownerPrefix returns the prefix of the storage keys of a users files.
+func ownerPrefix(DirPath string) string {
+	return DirPath + "/"
+}
+
+// userExpireDate returns the date when a user expires: one day from now, or later if one of their files outlives that.
+// Parameters:
+//   lastExpiration (time.Time): The latest expiration date among the users files.
+// Returns:
+//   time.Time: The expiration date of the user.
+func userExpireDate(lastExpiration time.Time) time.Time {
+	expireDate := time.Now().AddDate(0, 0, 1)
+	if lastExpiration.After(expireDate) {
+		return lastExpiration
+	}
+
+	return expireDate
+}
+
+// deleteUserFiles removes the metadata of every file of a user, then the object stored under its storage key.
+// Parameters:
+//   files (FileRepository): The repository holding the metadata of the files.
+//   blobs (storage.Storage): The storage where the users files are kept.
+//   user (User): The user whose files are deleted.
+// Returns:
+//   error: An error if there is any issue during the process.
+func deleteUserFiles(files FileRepository, blobs storage.Storage, user User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, value := range user.Files {
+		file, err := files.GetFileFromID(value, "public")
+
+		if err != nil {
+			return err
+		}
+
+		_, err = files.DeleteFile(file.IdPrivate)
+		if err != nil {
+			return err
+		}
+
+		// Files saved before storage keys were recorded have none until BackfillStorageKeys locates them. Quarantined
+		// files are not in the storage yet: they are reported as not found, and the quarantine drops their content
+		// once it sees their metadata is gone
+		if file.StorageKey == "" {
+			continue
+		}
+		if err = blobs.Delete(ctx, file.StorageKey); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("error deleting files from system")
+		}
+	}
+
+	return nil
+}
+
+// BackfillStorageKeys records the storage key of the files saved before keys were stored, by searching the storage
+// (SAVE_PATH for the local backend) for the objects named after their public ID.
+// Parameters:
+//   files (FileRepository): The repository holding the metadata of the files.
+//   blobs (storage.Storage): The storage where the users files are kept.
+// Returns:
+//   int: The number of files whose key was recorded.
+//   []File: The files whose content is not in the storage nor in quarantine, left without key.
+//   error: An error if the files or the storage could not be read, or a key could not be recorded.
+func BackfillStorageKeys(files FileRepository, blobs storage.Storage) (int, []File, error) {
+	unlocated, err := files.GetUnlocatedFiles()
+	if err != nil || len(unlocated) == 0 {
+		return 0, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	objects, err := blobs.List(ctx, "")
+	if err != nil {
+		return 0, nil, fmt.Errorf("error listing the stored files: %v", err)
+	}
+
+	keys := make(map[string]string, len(objects))
+	for _, object := range objects {
+		IdPublic := strings.Split(path.Base(object.Key), ".")[0]
+		keys[IdPublic] = object.Key
+	}
+
+	recorded := 0
+	var missing []File
+	for _, file := range unlocated {
+		key, ok := keys[file.IdPublic]
+		if !ok && file.ScanStatus == ScanQuarantined {
+			// The quarantine records the key once the file is stored
+			continue
+		}
+		if !ok {
+			// New files are saved with their key, so the content of these legacy files was lost or kept outside of the
+			// storage, like the directories the first versions created next to a SAVE_PATH without trailing separator
+			missing = append(missing, file)
+			continue
+		}
+
+		if _, err := files.SetStorageKey(file.IdPublic, key); err != nil {
+			return recorded, missing, err
+		}
+		recorded++
+	}
+
+	return recorded, missing, nil
+}
+
+// BackfillPrivateIDs replaces the private IDs stored in clear, by the versions saved before keyed hashes, with their
+// keyed hash, so a copy of the database cannot be used to manage the files. Their owners keep using the same ID.
+// Parameters:
+//   files (FileRepository): The repository holding the metadata of the files.
+//   seal (func(string) string): The keyed hash of a private ID, as stored for new files.
+// Returns:
+//   int: The number of private IDs sealed.
+//   error: An error if the files could not be read, or a private ID could not be replaced.
+func BackfillPrivateIDs(files FileRepository, seal func(string) string) (int, error) {
+	unsealed, err := files.GetUnsealedFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	sealed := 0
+	for _, file := range unsealed {
+		if _, err := files.SetPrivateID(file.IdPublic, seal(file.IdPrivate)); err != nil {
+			// Deleted since it was listed
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return sealed, err
+		}
+		sealed++
+	}
+
+	return sealed, nil
+}
@@ -0,0 +1,738 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"backend/storage"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore is an embedded SQLite implementation of FileRepository and UserRepository, meant for single-node deployments.
+// Dates are stored as Unix nanoseconds so that they can be compared directly in SQL.
+type SQLiteStore struct {
+	db    *sql.DB         // Connection pool to the database file
+	blobs storage.Storage // Storage where the users files are kept
+}
+
+// migrations holds the schema changes applied in order; the index of a migration plus one is its version.
+// Existing entries must never be modified, new changes are appended.
+var migrations = []string{
+	`CREATE TABLE files (
+		id_public   TEXT PRIMARY KEY,
+		id_private  TEXT NOT NULL UNIQUE,
+		name        TEXT NOT NULL,
+		size        REAL NOT NULL,
+		saved_date  INTEGER NOT NULL,
+		expire_date INTEGER NOT NULL,
+		email       TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX files_expire_date ON files (expire_date);
+
+	CREATE TABLE users (
+		ip                 TEXT PRIMARY KEY,
+		files_number       INTEGER NOT NULL DEFAULT 0,
+		used_space         REAL NOT NULL DEFAULT 0,
+		ip_saved_date      INTEGER NOT NULL,
+		ip_expire_date     INTEGER NOT NULL,
+		api_calls          INTEGER NOT NULL DEFAULT 0,
+		api_last_call_date INTEGER NOT NULL
+	);
+	CREATE INDEX users_ip_expire_date ON users (ip_expire_date);
+
+	CREATE TABLE user_files (
+		ip        TEXT NOT NULL REFERENCES users (ip) ON DELETE CASCADE,
+		id_public TEXT NOT NULL,
+		position  INTEGER NOT NULL,
+		PRIMARY KEY (ip, id_public)
+	);
+	CREATE INDEX user_files_id_public ON user_files (id_public);`,
+
+	`ALTER TABLE files ADD COLUMN max_downloads INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE files ADD COLUMN downloads INTEGER NOT NULL DEFAULT 0;`,
+
+	`ALTER TABLE files ADD COLUMN password_hash TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE files ADD COLUMN content_type TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE files ADD COLUMN scan_status TEXT NOT NULL DEFAULT '';
+	ALTER TABLE files ADD COLUMN scan_signature TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE files ADD COLUMN entries TEXT NOT NULL DEFAULT '';`,
+
+	`ALTER TABLE files ADD COLUMN content_hash TEXT NOT NULL DEFAULT '';
+	CREATE INDEX files_content_hash ON files (content_hash);`,
+
+	`ALTER TABLE users DROP COLUMN api_calls;
+	ALTER TABLE users DROP COLUMN api_last_call_date;`,
+
+	`ALTER TABLE files ADD COLUMN storage_key TEXT NOT NULL DEFAULT '';`,
+
+	`CREATE INDEX files_storage_key ON files (storage_key);`,
+
+	`CREATE TABLE salts (
+		period INTEGER PRIMARY KEY,
+		salt   BLOB NOT NULL
+	);`,
+}
+
+const fileColumns = "id_public, id_private, name, size, saved_date, expire_date, email, max_downloads, downloads, password_hash, content_type, scan_status, scan_signature, entries, content_hash, storage_key"
+const userColumns = "ip, files_number, used_space, ip_saved_date, ip_expire_date"
+
+// OpenSQLite opens (or creates) an SQLite database file and applies the pending migrations.
+// Parameters:
+//   path (string): The path of the database file.
+//   blobs (storage.Storage): The storage where the users files are kept.
+// Returns:
+//   *SQLiteStore: The store using the database.
+//   error: An error if the database could not be opened or migrated.
+func OpenSQLite(path string, blobs storage.Storage) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("error opening SQLite database: %v", err)
+	}
+
+	store := &SQLiteStore{db: db, blobs: blobs}
+	if err := store.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Close closes the database.
+// Returns:
+//   error: An error if the database could not be closed.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// migrate applies, each in its own transaction, the migrations that were not applied yet.
+func (s *SQLiteStore) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("error creating the migrations table: %v", err)
+	}
+
+	var current int
+	if err := s.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return fmt.Errorf("error reading the schema version: %v", err)
+	}
+
+	for version := current + 1; version <= len(migrations); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return fmt.Errorf("error starting migration %d: %v", version, err)
+		}
+
+		if _, err := tx.Exec(migrations[version-1]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error applying migration %d: %v", version, err)
+		}
+
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)", version, time.Now().UnixNano()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error recording migration %d: %v", version, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error committing migration %d: %v", version, err)
+		}
+	}
+
+	return nil
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanFile(row rowScanner) (File, error) {
+	var file File
+	var savedDate, expireDate int64
+	var entries string
+
+	err := row.Scan(&file.IdPublic, &file.IdPrivate, &file.Name, &file.Size, &savedDate, &expireDate, &file.Email,
+		&file.MaxDownloads, &file.Downloads, &file.PasswordHash, &file.ContentType, &file.ScanStatus, &file.ScanSignature, &entries, &file.ContentHash, &file.StorageKey)
+	if err != nil {
+		return File{}, err
+	}
+
+	// The entries of archives are kept as a JSON array
+	if entries != "" {
+		if err := json.Unmarshal([]byte(entries), &file.Entries); err != nil {
+			return File{}, fmt.Errorf("error decoding the archive entries: %v", err)
+		}
+	}
+
+	file.SavedDate = time.Unix(0, savedDate)
+	file.ExpireDate = time.Unix(0, expireDate)
+	return file, nil
+}
+
+// scanUser reads a users row; the file list is loaded separately by loadUserFiles.
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var savedDate, expireDate int64
+
+	err := row.Scan(&user.Ip, &user.FilesNumber, &user.UsedSpace, &savedDate, &expireDate)
+	if err != nil {
+		return User{}, err
+	}
+
+	user.IpSavedDate = time.Unix(0, savedDate)
+	user.IpExpireDate = time.Unix(0, expireDate)
+	return user, nil
+}
+
+// loadUserFiles fills the file list of a user.
+func (s *SQLiteStore) loadUserFiles(user *User) error {
+	rows, err := s.db.Query("SELECT id_public FROM user_files WHERE ip = ? ORDER BY position", user.Ip)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	user.Files = []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		user.Files = append(user.Files, id)
+	}
+
+	return rows.Err()
+}
+
+// SaveMetadata saves file metadata to the files table.
+// Parameters:
+//   idPublic (string): The public ID of the file.
+//   idPrivate (string): The keyed hash of the private ID of the file, stored in its place.
+//   file (File): The metadata of the file (name, size, email, expiration, ...); its IDs and saved date are filled in.
+// Returns:
+//   File: The saved File object.
+//   error: An error if there was an issue saving the metadata.
+func (s *SQLiteStore) SaveMetadata(idPublic, idPrivate string, file File) (File, error) {
+	newFile := file
+	newFile.IdPublic = idPublic
+	newFile.IdPrivate = idPrivate
+	newFile.SavedDate = time.Now()
+
+	var entries []byte
+	if len(newFile.Entries) > 0 {
+		var err error
+		if entries, err = json.Marshal(newFile.Entries); err != nil {
+			return File{}, fmt.Errorf("error encoding the archive entries: %v", err)
+		}
+	}
+
+	_, err := s.db.Exec("INSERT INTO files ("+fileColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		newFile.IdPublic, newFile.IdPrivate, newFile.Name, newFile.Size,
+		newFile.SavedDate.UnixNano(), newFile.ExpireDate.UnixNano(), newFile.Email,
+		newFile.MaxDownloads, newFile.Downloads, newFile.PasswordHash, newFile.ContentType,
+		newFile.ScanStatus, newFile.ScanSignature, string(entries), newFile.ContentHash, newFile.StorageKey)
+	if err != nil {
+		return File{}, fmt.Errorf("error while saving the metadata")
+	}
+
+	return newFile, nil
+}
+
+// GetFileFromID retrieves a file based on the provided ID and ID type ("public", "private" or "content" for the content hash).
+// Parameters:
+//   id (string): The ID of the file to retrieve.
+//   idType (string): The type of ID provided.
+// Returns:
+//   File: The file found.
+//   error: ErrNotFound if no file is found, or an error if the ID type is not valid.
+func (s *SQLiteStore) GetFileFromID(id, idType string) (File, error) {
+	var column string
+
+	if idType == "private" {
+		column = "id_private"
+	} else if idType == "public" {
+		column = "id_public"
+	} else if idType == "content" && id != "" {
+		column = "content_hash"
+	} else {
+		return File{}, fmt.Errorf("idType provided not valid")
+	}
+
+	file, err := scanFile(s.db.QueryRow("SELECT "+fileColumns+" FROM files WHERE "+column+" = ?", id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return File{}, ErrNotFound
+		}
+		return File{}, fmt.Errorf("error retrieving the file: %v", err)
+	}
+
+	return file, nil
+}
+
+// RegisterDownload atomically increments the download counter of a file, unless it already reached its limit.
+// Parameters:
+//   idPublic (string): The public ID of the file being downloaded.
+// Returns:
+//   File: The file with its updated counter.
+//   error: ErrDownloadLimit if the file cannot be downloaded anymore, or an error if it does not exist.
+func (s *SQLiteStore) RegisterDownload(idPublic string) (File, error) {
+	file, err := scanFile(s.db.QueryRow("UPDATE files SET downloads = downloads + 1 WHERE id_public = ? AND (max_downloads <= 0 OR downloads < max_downloads) RETURNING "+fileColumns, idPublic))
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := s.GetFileFromID(idPublic, "public"); err != nil {
+			return File{}, err
+		}
+		return File{}, ErrDownloadLimit
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("error updating the download counter: %v", err)
+	}
+
+	return file, nil
+}
+
+// SetScanResult records the result of the malware scan of a file.
+// Parameters:
+//   idPublic (string): The public ID of the scanned file.
+//   status (string): The new scan status (ScanAvailable or ScanRejected).
+//   signature (string): The name of the detected threat, empty if there is none.
+// Returns:
+//   File: The updated file.
+//   error: An error if the file does not exist or could not be updated.
+func (s *SQLiteStore) SetScanResult(idPublic, status, signature string) (File, error) {
+	file, err := scanFile(s.db.QueryRow("UPDATE files SET scan_status = ?, scan_signature = ? WHERE id_public = ? RETURNING "+fileColumns, status, signature, idPublic))
+	if errors.Is(err, sql.ErrNoRows) {
+		return File{}, ErrNotFound
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("error updating the scan status: %v", err)
+	}
+
+	return file, nil
+}
+
+// SetStorageKey records the key under which the content of a file is stored.
+// Parameters:
+//   idPublic (string): The public ID of the file.
+//   key (string): The storage key of its content.
+// Returns:
+//   File: The updated file.
+//   error: An error if the file does not exist or could not be updated.
+func (s *SQLiteStore) SetStorageKey(idPublic, key string) (File, error) {
+	file, err := scanFile(s.db.QueryRow("UPDATE files SET storage_key = ? WHERE id_public = ? RETURNING "+fileColumns, key, idPublic))
+	if errors.Is(err, sql.ErrNoRows) {
+		return File{}, ErrNotFound
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("error updating the storage key: %v", err)
+	}
+
+	return file, nil
+}
+
+// SetPrivateID replaces the stored private ID of a file.
+// Parameters:
+//   idPublic (string): The public ID of the file.
+//   idPrivate (string): The keyed hash of its private ID, stored in its place.
+// Returns:
+//   File: The updated file.
+//   error: An error if the file does not exist or could not be updated.
+func (s *SQLiteStore) SetPrivateID(idPublic, idPrivate string) (File, error) {
+	file, err := scanFile(s.db.QueryRow("UPDATE files SET id_private = ? WHERE id_public = ? RETURNING "+fileColumns, idPrivate, idPublic))
+	if errors.Is(err, sql.ErrNoRows) {
+		return File{}, ErrNotFound
+	}
+	if err != nil {
+		return File{}, fmt.Errorf("error updating the private ID: %v", err)
+	}
+
+	return file, nil
+}
+
+// DeleteFile deletes a file based on its private ID.
+// Parameters:
+//   idPrivate (string): The private ID of the file to delete.
+// Returns:
+//   File: The file that was deleted.
+//   error: An error if there was an issue.
+func (s *SQLiteStore) DeleteFile(idPrivate string) (File, error) {
+	file, err := scanFile(s.db.QueryRow("DELETE FROM files WHERE id_private = ? RETURNING "+fileColumns, idPrivate))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return File{}, fmt.Errorf("error retrieving file from the database")
+		}
+		return File{}, fmt.Errorf("error attempting to delete the file from the database")
+	}
+
+	return file, nil
+}
+
+// GetExpiredFiles retrieves every file whose expiration date is before the given date.
+// Parameters:
+//   date (time.Time): The reference date, usually the current time.
+// Returns:
+//   []File: The expired files.
+//   error: An error if there was an issue querying the database.
+func (s *SQLiteStore) GetExpiredFiles(date time.Time) ([]File, error) {
+	rows, err := s.db.Query("SELECT "+fileColumns+" FROM files WHERE expire_date < ?", date.UnixNano())
+	if err != nil {
+		return []File{}, fmt.Errorf("error searching for expired files: %v", err)
+	}
+	defer rows.Close()
+
+	var files []File
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return []File{}, fmt.Errorf("error decoding expired files: %v", err)
+		}
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+// GetUnlocatedFiles retrieves every file saved before storage keys were recorded.
+// Returns:
+//   []File: The files without storage key.
+//   error: An error if there was an issue querying the database.
+func (s *SQLiteStore) GetUnlocatedFiles() ([]File, error) {
+	rows, err := s.db.Query("SELECT " + fileColumns + " FROM files WHERE storage_key = ''")
+	if err != nil {
+		return []File{}, fmt.Errorf("error searching for files without storage key: %v", err)
+	}
+	defer rows.Close()
+
+	var files []File
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return []File{}, fmt.Errorf("error decoding files without storage key: %v", err)
+		}
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+// GetOwnerFiles retrieves every file stored, or waiting in quarantine, under a users storage directory.
+// Parameters:
+//   DirPath (string): The storage directory (key prefix) containing the users files.
+// Returns:
+//   []File: The files of the user.
+//   error: An error if there was an issue querying the database.
+func (s *SQLiteStore) GetOwnerFiles(DirPath string) ([]File, error) {
+	// The keys starting with the prefix sort between it and the prefix ended by the character following "/"
+	prefix := ownerPrefix(DirPath)
+	rows, err := s.db.Query("SELECT "+fileColumns+" FROM files WHERE storage_key >= ? AND storage_key < ?", prefix, DirPath+"0")
+	if err != nil {
+		return []File{}, fmt.Errorf("error searching for the files of the user: %v", err)
+	}
+	defer rows.Close()
+
+	var files []File
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return []File{}, fmt.Errorf("error decoding the files of the user: %v", err)
+		}
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+// GetUnsealedFiles retrieves every file whose private ID is stored in clear, saved before keyed hashes.
+// Returns:
+//   []File: The files with a private ID in clear.
+//   error: An error if there was an issue querying the database.
+func (s *SQLiteStore) GetUnsealedFiles() ([]File, error) {
+	rows, err := s.db.Query("SELECT "+fileColumns+" FROM files WHERE instr(id_private, ?) = 0", sealSeparator)
+	if err != nil {
+		return []File{}, fmt.Errorf("error searching for files with a private ID in clear: %v", err)
+	}
+	defer rows.Close()
+
+	var files []File
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return []File{}, fmt.Errorf("error decoding files with a private ID in clear: %v", err)
+		}
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+// UserExists checks if a user with a specific anonymized (hashed) IP address exists.
+// Parameters:
+//   ip (string): The anonymized (hashed) IP address to search for.
+// Returns:
+//   bool: Returns true if the user exists, false otherwise.
+func (s *SQLiteStore) UserExists(ip string) bool {
+	var found int
+	err := s.db.QueryRow("SELECT 1 FROM users WHERE ip = ?", ip).Scan(&found)
+	return err == nil
+}
+
+// GetUser retrieves a user based on their anonymized (hashed) IP address.
+// Parameters:
+//   ip (string): The anonymized (hashed) IP address of the user.
+// Returns:
+//   User: The user found.
+//   error: ErrNotFound if the user does not exist, or an error if there is an issue during the query.
+func (s *SQLiteStore) GetUser(ip string) (User, error) {
+	user, err := scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE ip = ?", ip))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("error while searching for user in database")
+	}
+
+	if err := s.loadUserFiles(&user); err != nil {
+		return User{}, fmt.Errorf("error while searching for user in database")
+	}
+
+	return user, nil
+}
+
+// CreateUser creates a new user from the metadata of their files.
+// Parameters:
+//   ip (string): The anonymized (hashed) IP address of the user to create.
+//   DirPath (string): The storage directory (key prefix) containing the users files.
+// Returns:
+//   User: The created user.
+//   error: An error if the user creation fails.
+func (s *SQLiteStore) CreateUser(ip string, DirPath string) (User, error) {
+	filesNumber, usedSpace, ids, lastExpiration, err := collectFiles(s, DirPath)
+	if err != nil {
+		return User{}, err
+	}
+
+	newUser := User{
+		Ip:           ip,
+		Files:        ids,
+		FilesNumber:  filesNumber,
+		UsedSpace:    usedSpace,
+		IpSavedDate:  time.Now(),
+		IpExpireDate: userExpireDate(lastExpiration),
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, fmt.Errorf("error while creating user")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO users ("+userColumns+") VALUES (?, ?, ?, ?, ?)",
+		newUser.Ip, newUser.FilesNumber, newUser.UsedSpace, newUser.IpSavedDate.UnixNano(), newUser.IpExpireDate.UnixNano())
+	if err != nil {
+		return User{}, fmt.Errorf("error while creating user")
+	}
+
+	if err := replaceUserFiles(tx, ip, ids); err != nil {
+		return User{}, fmt.Errorf("error while creating user")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return User{}, fmt.Errorf("error while creating user")
+	}
+
+	return newUser, nil
+}
+
+// UpdateUser recomputes a users files from their metadata and extends their expiration date.
+// Parameters:
+//   ip (string): The anonymized (hashed) IP address of the user.
+//   DirPath (string): The storage directory (key prefix) containing the users files.
+// Returns:
+//   error: Returns nil if the update is successful, or an error message if something goes wrong.
+func (s *SQLiteStore) UpdateUser(ip string, DirPath string) error {
+	return s.updateUserFiles(ip, DirPath, true)
+}
+
+// SyncUser recomputes a users files from their metadata without extending their expiration date.
+// Parameters:
+//   ip (string): The anonymized (hashed) IP address of the user.
+//   DirPath (string): The storage directory (key prefix) containing the users files.
+// Returns:
+//   error: Returns nil if the update is successful, or an error message if something goes wrong.
+func (s *SQLiteStore) SyncUser(ip string, DirPath string) error {
+	return s.updateUserFiles(ip, DirPath, false)
+}
+
+func (s *SQLiteStore) updateUserFiles(ip string, DirPath string, renew bool) error {
+	filesNumber, usedSpace, ids, lastExpiration, err := collectFiles(s, DirPath)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error while updating user data")
+	}
+	defer tx.Rollback()
+
+	var result sql.Result
+	if renew {
+		result, err = tx.Exec("UPDATE users SET files_number = ?, used_space = ?, ip_expire_date = ? WHERE ip = ?",
+			filesNumber, usedSpace, userExpireDate(lastExpiration).UnixNano(), ip)
+	} else {
+		result, err = tx.Exec("UPDATE users SET files_number = ?, used_space = ? WHERE ip = ?", filesNumber, usedSpace, ip)
+	}
+	if err != nil {
+		return fmt.Errorf("error while updating user data")
+	}
+
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return fmt.Errorf("user was not updated")
+	}
+
+	if err := replaceUserFiles(tx, ip, ids); err != nil {
+		return fmt.Errorf("error while updating user data")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error while updating user data")
+	}
+
+	return nil
+}
+
+// replaceUserFiles rewrites the file list of a user inside a transaction.
+func replaceUserFiles(tx *sql.Tx, ip string, ids []string) error {
+	if _, err := tx.Exec("DELETE FROM user_files WHERE ip = ?", ip); err != nil {
+		return err
+	}
+
+	for position, id := range ids {
+		if _, err := tx.Exec("INSERT INTO user_files (ip, id_public, position) VALUES (?, ?, ?)", ip, id, position); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteUser deletes a user and all their associated files from the storage and the database.
+// Parameters:
+//   ip (string): The anonymized (hashed) IP address of the user to delete.
+// Returns:
+//   error: An error if there is any issue during the process.
+func (s *SQLiteStore) DeleteUser(ip string) error {
+	user, err := s.GetUser(ip)
+	if err != nil {
+		return err
+	}
+
+	if err = deleteUserFiles(s, s.blobs, user); err != nil {
+		return err
+	}
+
+	result, err := s.db.Exec("DELETE FROM users WHERE ip = ?", ip)
+	if err != nil {
+		return fmt.Errorf("error while searching for user in database")
+	}
+
+	if deleted, err := result.RowsAffected(); err != nil || deleted < 1 {
+		return fmt.Errorf("the file was not deleted from the database")
+	}
+
+	return nil
+}
+
+// GetExpiredUsers retrieves every user whose expiration date is before the given date.
+// Parameters:
+//   date (time.Time): The reference date, usually the current time.
+// Returns:
+//   []User: The expired users.
+//   error: An error if there was an issue querying the database.
+func (s *SQLiteStore) GetExpiredUsers(date time.Time) ([]User, error) {
+	rows, err := s.db.Query("SELECT "+userColumns+" FROM users WHERE ip_expire_date < ?", date.UnixNano())
+	if err != nil {
+		return []User{}, fmt.Errorf("error searching for expired users: %v", err)
+	}
+
+	var users []User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			rows.Close()
+			return []User{}, fmt.Errorf("error decoding expired users: %v", err)
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+
+	for i := range users {
+		if err := s.loadUserFiles(&users[i]); err != nil {
+			return []User{}, fmt.Errorf("error decoding expired users: %v", err)
+		}
+	}
+
+	return users, nil
+}
+
+// GetFileOwner retrieves the user whose file list contains the given public ID.
+// Parameters:
+//   idPublic (string): The public ID of the file.
+// Returns:
+//   User: The user that uploaded the file.
+//   error: An error if no user owns the file or if there is an issue during the query.
+func (s *SQLiteStore) GetFileOwner(idPublic string) (User, error) {
+	var ip string
+	err := s.db.QueryRow("SELECT ip FROM user_files WHERE id_public = ? LIMIT 1", idPublic).Scan(&ip)
+	if err != nil {
+		return User{}, fmt.Errorf("error while searching for the owner of the file")
+	}
+
+	return s.GetUser(ip)
+}
+
+// GetOrCreateSalt returns the salt of a period, storing the given one first when the period has none yet.
+// Parameters:
+//   period (int64): The number of the rotation period.
+//   salt ([]byte): The salt stored when the period has none.
+// Returns:
+//   []byte: The salt of the period, the one stored first when several instances create it at once.
+//   error: An error if the salt could not be stored or read.
+func (s *SQLiteStore) GetOrCreateSalt(period int64, salt []byte) ([]byte, error) {
+	if _, err := s.db.Exec("INSERT OR IGNORE INTO salts (period, salt) VALUES (?, ?)", period, salt); err != nil {
+		return nil, fmt.Errorf("error storing the salt: %v", err)
+	}
+
+	var stored []byte
+	if err := s.db.QueryRow("SELECT salt FROM salts WHERE period = ?", period).Scan(&stored); err != nil {
+		return nil, fmt.Errorf("error reading the salt: %v", err)
+	}
+
+	return stored, nil
+}
+
+// DeleteSaltsBefore removes the salts of the periods before the given one.
+// Parameters:
+//   period (int64): The oldest period whose salt is kept.
+// Returns:
+//   error: An error if the salts could not be deleted.
+func (s *SQLiteStore) DeleteSaltsBefore(period int64) error {
+	if _, err := s.db.Exec("DELETE FROM salts WHERE period < ?", period); err != nil {
+		return fmt.Errorf("error deleting the salts: %v", err)
+	}
+
+	return nil
+}
+
+var _ FileRepository = (*SQLiteStore)(nil)
+var _ UserRepository = (*SQLiteStore)(nil)
+var _ SaltRepository = (*SQLiteStore)(nil)
@@ -0,0 +1,402 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"backend/storage"
+)
+
+// hammer uses the repositories from many goroutines at once, as concurrent requests do. Run with go test -race, it
+// reports the data races of the implementations.
+func hammer(t *testing.T, files FileRepository, users UserRepository, blobs storage.Storage) {
+	const clients, filesPerClient = 8, 5
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients*filesPerClient*8)
+	for client := 0; client < clients; client++ {
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+
+			owner := fmt.Sprintf("owner%02d", client)
+			if _, err := users.CreateUser(owner, owner); err != nil {
+				errs <- fmt.Errorf("CreateUser %s: %v", owner, err)
+				return
+			}
+
+			for i := 0; i < filesPerClient; i++ {
+				idPublic := fmt.Sprintf("%s-file%02d", owner, i)
+				key := owner + "/" + idPublic + ".txt"
+				if err := blobs.Put(context.Background(), key, strings.NewReader(idPublic), int64(len(idPublic))); err != nil {
+					errs <- fmt.Errorf("Put %s: %v", key, err)
+					continue
+				}
+
+				file := File{Name: idPublic + ".txt", Size: float64(len(idPublic)), ExpireDate: time.Now().Add(time.Hour), ScanStatus: ScanAvailable, StorageKey: key}
+				if _, err := files.SaveMetadata(idPublic, "private-"+idPublic, file); err != nil {
+					errs <- fmt.Errorf("SaveMetadata %s: %v", idPublic, err)
+					continue
+				}
+				if _, err := files.GetFileFromID(idPublic, "public"); err != nil {
+					errs <- fmt.Errorf("GetFileFromID public %s: %v", idPublic, err)
+				}
+				if _, err := files.GetFileFromID("private-"+idPublic, "private"); err != nil {
+					errs <- fmt.Errorf("GetFileFromID private %s: %v", idPublic, err)
+				}
+				if _, err := files.RegisterDownload(idPublic); err != nil {
+					errs <- fmt.Errorf("RegisterDownload %s: %v", idPublic, err)
+				}
+				if err := users.UpdateUser(owner, owner); err != nil {
+					errs <- fmt.Errorf("UpdateUser %s: %v", owner, err)
+				}
+				if _, err := users.GetUser(owner); err != nil {
+					errs <- fmt.Errorf("GetUser %s: %v", owner, err)
+				}
+			}
+
+			// Half of the files are deleted while the other clients keep writing
+			for i := 0; i < filesPerClient; i += 2 {
+				idPublic := fmt.Sprintf("%s-file%02d", owner, i)
+				if _, err := files.DeleteFile("private-" + idPublic); err != nil {
+					errs <- fmt.Errorf("DeleteFile %s: %v", idPublic, err)
+				}
+				if err := blobs.Delete(context.Background(), owner+"/"+idPublic+".txt"); err != nil {
+					errs <- fmt.Errorf("Delete %s: %v", idPublic, err)
+				}
+			}
+			if err := users.SyncUser(owner, owner); err != nil {
+				errs <- fmt.Errorf("SyncUser %s: %v", owner, err)
+			}
+		}(client)
+	}
+
+	// Readers listing every file run alongside the writers
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := files.GetExpiredFiles(time.Now()); err != nil {
+					errs <- fmt.Errorf("GetExpiredFiles: %v", err)
+					return
+				}
+				if _, err := users.GetExpiredUsers(time.Now()); err != nil {
+					errs <- fmt.Errorf("GetExpiredUsers: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Every client kept the files it did not delete
+	for client := 0; client < clients; client++ {
+		owner := fmt.Sprintf("owner%02d", client)
+		user, err := users.GetUser(owner)
+		if err != nil {
+			t.Fatalf("GetUser %s: %v", owner, err)
+		}
+		if user.FilesNumber != filesPerClient/2 {
+			t.Errorf("%s has %d files, want %d", owner, user.FilesNumber, filesPerClient/2)
+		}
+
+		if _, err := files.GetFileFromID(owner+"-file00", "public"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("the deleted file of %s is still found: %v", owner, err)
+		}
+	}
+}
+
+func TestMemoryStoreConcurrency(t *testing.T) {
+	blobs, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore(blobs)
+
+	hammer(t, store, store, blobs)
+}
+
+func TestSQLiteStoreConcurrency(t *testing.T) {
+	dir := t.TempDir()
+	blobs, err := storage.NewLocal(filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenSQLite(filepath.Join(dir, "moada.db"), blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	hammer(t, store, store, blobs)
+}
+
+// checkOwnerFiles verifies that the users are counted from the metadata of their files, quarantined ones included.
+func checkOwnerFiles(t *testing.T, files FileRepository, users UserRepository) {
+	saved := []struct {
+		idPublic, key, status string
+		size                  float64
+	}{
+		{"stored", "owner/stored.txt", ScanAvailable, 10},
+		{"quarantined", "owner/quarantined.txt", ScanQuarantined, 20},
+		{"rejected", "owner/rejected.txt", ScanRejected, 40},
+		{"other", "owner2/other.txt", ScanAvailable, 80},
+		{"prefixed", "owner-2/prefixed.txt", ScanAvailable, 160},
+	}
+	for _, file := range saved {
+		if _, err := files.SaveMetadata(file.idPublic, "private-"+file.idPublic, File{Name: file.idPublic + ".txt", Size: file.size, ExpireDate: time.Now().Add(time.Hour), ScanStatus: file.status, StorageKey: file.key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	owned, err := files.GetOwnerFiles("owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owned) != 3 {
+		t.Errorf("GetOwnerFiles returned %d files, want 3", len(owned))
+	}
+
+	user, err := users.CreateUser("owner", "owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.FilesNumber != 2 || user.UsedSpace != 30 {
+		t.Errorf("the user has %d files and %v bytes, want 2 files and 30 bytes", user.FilesNumber, user.UsedSpace)
+	}
+}
+
+func TestMemoryStoreOwnerFiles(t *testing.T) {
+	blobs, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore(blobs)
+
+	checkOwnerFiles(t, store, store)
+}
+
+func TestSQLiteStoreOwnerFiles(t *testing.T) {
+	dir := t.TempDir()
+	blobs, err := storage.NewLocal(filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenSQLite(filepath.Join(dir, "moada.db"), blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	checkOwnerFiles(t, store, store)
+}
+
+// checkBackfillPrivateIDs verifies that only the private IDs stored in clear are sealed.
+func checkBackfillPrivateIDs(t *testing.T, files FileRepository) {
+	seal := func(id string) string { return "1$sealed-" + id }
+	saved := map[string]string{"legacy1": "clear-id-1", "legacy2": "clear-id-2", "recent": "1$already-sealed"}
+	for idPublic, idPrivate := range saved {
+		if _, err := files.SaveMetadata(idPublic, idPrivate, File{Name: idPublic + ".txt", ExpireDate: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sealed, err := BackfillPrivateIDs(files, seal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed != 2 {
+		t.Errorf("%d private IDs were sealed, want 2", sealed)
+	}
+
+	for idPublic, idPrivate := range saved {
+		want := idPrivate
+		if !strings.Contains(idPrivate, "$") {
+			want = seal(idPrivate)
+		}
+		if file, err := files.GetFileFromID(want, "private"); err != nil || file.IdPublic != idPublic {
+			t.Errorf("%s is not found from %q: %v", idPublic, want, err)
+		}
+	}
+
+	// Once sealed, the files are left alone
+	if sealed, err := BackfillPrivateIDs(files, seal); err != nil || sealed != 0 {
+		t.Errorf("the second backfill sealed %d private IDs: %v", sealed, err)
+	}
+}
+
+func TestMemoryStoreBackfillPrivateIDs(t *testing.T) {
+	blobs, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkBackfillPrivateIDs(t, NewMemoryStore(blobs))
+}
+
+func TestSQLiteStoreBackfillPrivateIDs(t *testing.T) {
+	dir := t.TempDir()
+	blobs, err := storage.NewLocal(filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenSQLite(filepath.Join(dir, "moada.db"), blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	checkBackfillPrivateIDs(t, store)
+}
+
+// checkBackfillStorageKeys verifies that the legacy files get the key of the object named after them, and that those
+// whose content is missing are reported unless they are still quarantined.
+func checkBackfillStorageKeys(t *testing.T, files FileRepository, blobs storage.Storage) {
+	saved := []struct {
+		idPublic, key, status, object string // object is the key of the content in the storage, empty if it is missing
+	}{
+		{idPublic: "legacy1", object: "0a1b2c/legacy1.txt"},
+		{idPublic: "legacy2", object: "3d4e5f/legacy2.pdf"},
+		{idPublic: "lost"},
+		{idPublic: "waiting", status: ScanQuarantined},
+		{idPublic: "recent", key: "3d4e5f/recent.txt", object: "3d4e5f/recent.txt"},
+	}
+	for _, file := range saved {
+		if _, err := files.SaveMetadata(file.idPublic, "private-"+file.idPublic, File{Name: file.idPublic + ".txt", ExpireDate: time.Now().Add(time.Hour), ScanStatus: file.status, StorageKey: file.key}); err != nil {
+			t.Fatal(err)
+		}
+		if file.object != "" {
+			if err := blobs.Put(context.Background(), file.object, strings.NewReader("content"), 7); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	located, missing, err := BackfillStorageKeys(files, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if located != 2 {
+		t.Errorf("%d keys were recorded, want 2", located)
+	}
+	if len(missing) != 1 || missing[0].IdPublic != "lost" {
+		t.Errorf("got the missing files %+v, want lost only", missing)
+	}
+
+	want := map[string]string{"legacy1": "0a1b2c/legacy1.txt", "legacy2": "3d4e5f/legacy2.pdf", "lost": "", "waiting": "", "recent": "3d4e5f/recent.txt"}
+	for idPublic, key := range want {
+		file, err := files.GetFileFromID(idPublic, "public")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.StorageKey != key {
+			t.Errorf("%s: got the key %q, want %q", idPublic, file.StorageKey, key)
+		}
+	}
+
+	// Once located, only the files without content are left
+	if located, missing, err := BackfillStorageKeys(files, blobs); err != nil || located != 0 || len(missing) != 1 {
+		t.Errorf("the second backfill recorded %d keys and missed %d files: %v", located, len(missing), err)
+	}
+}
+
+func TestMemoryStoreBackfillStorageKeys(t *testing.T) {
+	blobs, err := storage.NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkBackfillStorageKeys(t, NewMemoryStore(blobs), blobs)
+}
+
+func TestSQLiteStoreBackfillStorageKeys(t *testing.T) {
+	dir := t.TempDir()
+	blobs, err := storage.NewLocal(filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenSQLite(filepath.Join(dir, "moada.db"), blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	checkBackfillStorageKeys(t, store, blobs)
+}
+
+// checkSalts verifies that the salt stored first for a period is the one every caller gets, even when several create it
+// at once, and that the salts of the older periods are deleted.
+func checkSalts(t *testing.T, salts SaltRepository) {
+	const callers = 8
+
+	var wg sync.WaitGroup
+	got := make([][]byte, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			got[i], errs[i] = salts.GetOrCreateSalt(100, []byte(fmt.Sprintf("salt %d", i)))
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range got {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if string(got[i]) != string(got[0]) {
+			t.Fatalf("caller %d got the salt %q, want %q", i, got[i], got[0])
+		}
+	}
+
+	if _, err := salts.GetOrCreateSalt(101, []byte("next")); err != nil {
+		t.Fatal(err)
+	}
+	if err := salts.DeleteSaltsBefore(101); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deleted salt is replaced by the next one created, the kept one is unchanged
+	if salt, err := salts.GetOrCreateSalt(100, []byte("replaced")); err != nil || string(salt) != "replaced" {
+		t.Errorf("got %q, %v, want the deleted salt replaced", salt, err)
+	}
+	if salt, err := salts.GetOrCreateSalt(101, []byte("other")); err != nil || string(salt) != "next" {
+		t.Errorf("got %q, %v, want the kept salt", salt, err)
+	}
+}
+
+func TestMemoryStoreSalts(t *testing.T) {
+	checkSalts(t, NewMemoryStore(nil))
+}
+
+func TestSQLiteStoreSalts(t *testing.T) {
+	store, err := OpenSQLite(filepath.Join(t.TempDir(), "moada.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	checkSalts(t, store)
+}
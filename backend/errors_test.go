@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"backend/apierror"
+	"backend/ratelimit"
+	"backend/scan"
+)
+
+// rejectScanner finds every file infected.
+type rejectScanner struct{}
+
+func (rejectScanner) Name() string {
+	return "reject"
+}
+
+func (rejectScanner) Scan(ctx context.Context, path string) (scan.Verdict, error) {
+	return scan.Verdict{Infected: true, Signature: "Test.Signature", Engine: "reject"}, nil
+}
+
+// checkError verifies that a response is the error envelope of a code, with the status of the code and the ID of the
+// request.
+func checkError(t *testing.T, w *httptest.ResponseRecorder, code apierror.Code) apierror.Error {
+	t.Helper()
+
+	if w.Code != code.Status() {
+		t.Errorf("got status %d, want %d for %s: %s", w.Code, code.Status(), code, w.Body)
+	}
+	got := decode[apierror.Envelope](t, w).Error
+	if got.Code != code || got.Message == "" {
+		t.Errorf("got error %+v, want %s", got, code)
+	}
+	if id := w.Header().Get(apierror.RequestIDHeader); got.RequestID == "" || got.RequestID != id {
+		t.Errorf("the error carries the request ID %q, the header %q", got.RequestID, id)
+	}
+	return got
+}
+
+// tusRequestHeader returns the headers of a tus request.
+func tusRequestHeader(pairs ...string) http.Header {
+	header := http.Header{"Tus-Resumable": {"1.0.0"}}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		header.Set(pairs[i], pairs[i+1])
+	}
+	return header
+}
+
+func TestHandlerErrors(t *testing.T) {
+	tests := []struct {
+		code    apierror.Code
+		scanner scan.Scanner // The scanner of the uploads, none if nil
+		send    func(t *testing.T, ts *testServer) *httptest.ResponseRecorder
+	}{
+		{apierror.RouteNotFound, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			return ts.do(http.MethodGet, "/api/v1/nothing", nil, nil)
+		}},
+		{apierror.InvalidRequest, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			return ts.do(http.MethodPost, "/api/v1/files", strings.NewReader("{}"), http.Header{"Content-Type": {"application/json"}})
+		}},
+		{apierror.InvalidField, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			body, contentType := uploadForm(t, "file.txt", "text/plain", []byte("text"), map[string]string{"burnAfterReading": "maybe"})
+			return ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+		}},
+		{apierror.UnsupportedFileType, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			body, contentType := uploadForm(t, "page.html", "text/html", []byte("<!DOCTYPE html><html><body>page</body></html>"), nil)
+			return ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+		}},
+		{apierror.ContentMismatch, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			body, contentType := uploadForm(t, "image.png", "image/png", []byte("not an image at all"), nil)
+			return ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+		}},
+		{apierror.MalformedFile, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			broken := append([]byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), bytes.Repeat([]byte{0x42}, 64)...)
+			body, contentType := uploadForm(t, "photo.jpg", "image/jpeg", broken, nil)
+			return ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+		}},
+		{apierror.DuplicateFile, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			ts.upload(t, "twice.txt", []byte("sent twice"), nil)
+			body, contentType := uploadForm(t, "twice.txt", "text/plain", []byte("sent twice"), nil)
+			return ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+		}},
+		{apierror.OwnerTokenRequired, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			uploaded := ts.upload(t, "owned.txt", []byte("owned"), nil)
+			return ts.do(http.MethodGet, "/fileInfo?idPublic="+uploaded.Data.IdPublic, nil, nil)
+		}},
+		{apierror.OwnerTokenMismatch, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			mine := ts.upload(t, "mine.txt", []byte("mine"), nil)
+			other := ts.upload(t, "other.txt", []byte("other"), nil)
+			return ts.do(http.MethodGet, "/api/v1/files/"+other.Data.IdPublic, nil, http.Header{"Authorization": {"Bearer " + mine.OwnerToken}})
+		}},
+		{apierror.FileNotFound, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			return ts.do(http.MethodGet, "/api/v1/files/unknown/content", nil, nil)
+		}},
+		{apierror.UserNotFound, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			return ts.do(http.MethodGet, "/api/v1/me", nil, nil)
+		}},
+		{apierror.PasswordRequired, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			uploaded := ts.upload(t, "locked.txt", []byte("locked"), map[string]string{"password": "open sesame"})
+			return ts.do(http.MethodGet, "/api/v1/files/"+uploaded.Data.IdPublic+"/content", nil, nil)
+		}},
+		{apierror.WrongPassword, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			uploaded := ts.upload(t, "locked.txt", []byte("locked"), map[string]string{"password": "open sesame"})
+			return ts.do(http.MethodGet, "/api/v1/files/"+uploaded.Data.IdPublic+"/content", nil, http.Header{"X-File-Password": {"guess"}})
+		}},
+		{apierror.TooManyPasswordAttempts, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			uploaded := ts.upload(t, "locked.txt", []byte("locked"), map[string]string{"password": "open sesame"})
+			target := "/api/v1/files/" + uploaded.Data.IdPublic + "/content"
+			for i := 0; i < 3; i++ {
+				ts.do(http.MethodGet, target, nil, http.Header{"X-File-Password": {"guess"}})
+			}
+			return ts.do(http.MethodGet, target, nil, http.Header{"X-File-Password": {"open sesame"}})
+		}},
+		{apierror.FileScanning, newGateScanner(), func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			body, contentType := uploadForm(t, "waiting.txt", "text/plain", []byte("waiting for its scan"), nil)
+			w := ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("upload: got %d %s", w.Code, w.Body)
+			}
+			return ts.do(http.MethodGet, "/api/v1/files/"+decode[uploadResponse](t, w).Data.IdPublic+"/content", nil, nil)
+		}},
+		{apierror.FileRejected, rejectScanner{}, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			uploaded := ts.upload(t, "infected.txt", []byte("infected"), nil)
+			return ts.do(http.MethodGet, "/api/v1/files/"+uploaded.Data.IdPublic+"/content", nil, nil)
+		}},
+		{apierror.RateLimited, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			ts.limit("api", ratelimit.Limit{Requests: 1, Period: time.Minute})
+			ts.do(http.MethodGet, "/api/v1/me", nil, nil)
+			return ts.do(http.MethodGet, "/api/v1/me", nil, nil)
+		}},
+		{apierror.UnsupportedTusVersion, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			return ts.do(http.MethodDelete, "/api/v1/uploads/unknown", nil, http.Header{"Tus-Resumable": {"0.2.2"}})
+		}},
+		{apierror.FileTooLarge, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("large.txt")) + ",filetype " + base64.StdEncoding.EncodeToString([]byte("text/plain"))
+			return ts.do(http.MethodPost, "/api/v1/uploads", nil, tusRequestHeader("Upload-Length", "1099511627776", "Upload-Metadata", metadata))
+		}},
+		{apierror.UploadNotFound, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			header := tusRequestHeader("Content-Type", "application/offset+octet-stream", "Upload-Offset", "0")
+			return ts.do(http.MethodPatch, "/api/v1/uploads/unknown", strings.NewReader("data"), header)
+		}},
+		{apierror.OffsetMismatch, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("chunked.txt")) + ",filetype " + base64.StdEncoding.EncodeToString([]byte("text/plain"))
+			w := ts.do(http.MethodPost, "/api/v1/uploads", nil, tusRequestHeader("Upload-Length", "8", "Upload-Metadata", metadata))
+			if w.Code != http.StatusCreated {
+				t.Fatalf("create: got %d %s", w.Code, w.Body)
+			}
+			header := tusRequestHeader("Content-Type", "application/offset+octet-stream", "Upload-Offset", "4")
+			return ts.do(http.MethodPatch, w.Header().Get("Location"), strings.NewReader("data"), header)
+		}},
+		{apierror.UnsupportedContentType, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			header := tusRequestHeader("Content-Type", "text/plain", "Upload-Offset", "0")
+			return ts.do(http.MethodPatch, "/api/v1/uploads/unknown", strings.NewReader("data"), header)
+		}},
+		{apierror.Internal, nil, func(t *testing.T, ts *testServer) *httptest.ResponseRecorder {
+			ts.router.GET("/panic", func(c *gin.Context) { panic("broken handler") })
+			return ts.do(http.MethodGet, "/panic", nil, nil)
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.code), func(t *testing.T) {
+			ts := newTestServer(t)
+			if test.scanner != nil {
+				ts = newTestServerWithScanner(t, test.scanner)
+			}
+			if gate, ok := test.scanner.(*gateScanner); ok {
+				defer close(gate.release)
+			}
+
+			got := checkError(t, test.send(t, ts), test.code)
+			if test.code == apierror.Internal && strings.Contains(got.Message, "broken handler") {
+				t.Errorf("the panic reached the client: %q", got.Message)
+			}
+		})
+	}
+}
+
+func TestRouteNotFound(t *testing.T) {
+	ts := newTestServer(t)
+
+	for _, target := range []string{"/nothing", "/api/v2/files", "/api/v1/files/id/content/extra"} {
+		w := ts.do(http.MethodGet, target, nil, nil)
+		if got := checkError(t, w, apierror.RouteNotFound); got.Details != nil {
+			t.Errorf("%s: unexpected details %v", target, got.Details)
+		}
+	}
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	ts := newTestServer(t)
+	generated := regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	tests := []struct {
+		name string
+		sent string
+		kept bool
+	}{
+		{"echoed", "trace-42:step.1", true},
+		{"missing", "", false},
+		{"too long", strings.Repeat("x", 65), false},
+		{"invalid characters", "trace 42;drop", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			if test.sent != "" {
+				header.Set(apierror.RequestIDHeader, test.sent)
+			}
+
+			// Successful responses carry the ID as well as errors
+			for _, target := range []string{"/api/v1/limits", "/api/v1/me"} {
+				w := ts.do(http.MethodGet, target, nil, header)
+				id := w.Header().Get(apierror.RequestIDHeader)
+				if test.kept && id != test.sent {
+					t.Errorf("%s: the request ID %q was replaced by %q", target, test.sent, id)
+				}
+				if !test.kept && !generated.MatchString(id) {
+					t.Errorf("%s: the request ID %q was answered with %q, want a generated one", target, test.sent, id)
+				}
+				if w.Code != http.StatusOK {
+					checkError(t, w, apierror.UserNotFound)
+				}
+			}
+		})
+	}
+}
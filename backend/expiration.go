@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"backend/utils"
+)
+
+// expirationPolicy lists the expiration times uploaders can choose from.
+type expirationPolicy struct {
+	Allowed []time.Duration // Expiration times accepted in the expiresIn field
+	Default time.Duration   // Expiration used when expiresIn is not provided
+	Max     time.Duration   // Longest expiration accepted, whatever the allowed list says
+}
+
+// expirationsFromEnv builds the expiration policy from ALLOWED_EXPIRATIONS, DEFAULT_EXPIRATION and MAX_EXPIRATION.
+// Returns:
+//   expirationPolicy: The policy to apply to uploads.
+//   error: Returns an error if a value is not a valid duration or if the default is not allowed.
+func expirationsFromEnv() (expirationPolicy, error) {
+	var policy expirationPolicy
+
+	allowed := os.Getenv("ALLOWED_EXPIRATIONS")
+	if allowed == "" {
+		allowed = "10m,1h,1d,7d"
+	}
+
+	max := os.Getenv("MAX_EXPIRATION")
+	if max == "" {
+		max = "7d"
+	}
+
+	defaultValue := os.Getenv("DEFAULT_EXPIRATION")
+	if defaultValue == "" {
+		defaultValue = "1d"
+	}
+
+	var err error
+	if policy.Max, err = utils.ParseDuration(max); err != nil {
+		return expirationPolicy{}, fmt.Errorf("invalid MAX_EXPIRATION: %v", err)
+	}
+
+	for _, value := range strings.Split(allowed, ",") {
+		duration, err := utils.ParseDuration(strings.TrimSpace(value))
+		if err != nil || duration <= 0 {
+			return expirationPolicy{}, fmt.Errorf("invalid ALLOWED_EXPIRATIONS entry %q", value)
+		}
+		policy.Allowed = append(policy.Allowed, duration)
+	}
+
+	if policy.Default, err = utils.ParseDuration(defaultValue); err != nil {
+		return expirationPolicy{}, fmt.Errorf("invalid DEFAULT_EXPIRATION: %v", err)
+	}
+	if _, ok := policy.parse(""); !ok {
+		return expirationPolicy{}, fmt.Errorf("DEFAULT_EXPIRATION %s is not allowed", defaultValue)
+	}
+
+	return policy, nil
+}
+
+// parse validates an expiresIn value sent by an uploader.
+// Parameters:
+//   value (string): The requested expiration time (e.g. "10m", "1h", "7d"), empty for the default one.
+// Returns:
+//   time.Duration: The expiration time to apply.
+//   bool: Returns false if the value is not a duration or is not allowed.
+func (p expirationPolicy) parse(value string) (time.Duration, bool) {
+	duration := p.Default
+	if value != "" {
+		var err error
+		if duration, err = utils.ParseDuration(value); err != nil {
+			return 0, false
+		}
+	}
+
+	if duration > p.Max {
+		return 0, false
+	}
+
+	for _, allowed := range p.Allowed {
+		if duration == allowed {
+			return duration, true
+		}
+	}
+
+	return 0, false
+}
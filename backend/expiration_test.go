@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"backend/apierror"
+)
+
+func TestExpirationsFromEnv(t *testing.T) {
+	const day = 24 * time.Hour
+
+	tests := []struct {
+		name              string
+		allowed, def, max string
+		want              expirationPolicy
+		valid             bool
+	}{
+		{name: "defaults", want: expirationPolicy{Allowed: []time.Duration{10 * time.Minute, time.Hour, day, 7 * day}, Default: day, Max: 7 * day}, valid: true},
+		{name: "custom", allowed: "1h, 2d ,30d", def: "2d", max: "30d", want: expirationPolicy{Allowed: []time.Duration{time.Hour, 2 * day, 30 * day}, Default: 2 * day, Max: 30 * day}, valid: true},
+		{name: "allowed past the maximum", allowed: "1h,30d", def: "1h", want: expirationPolicy{Allowed: []time.Duration{time.Hour, 30 * day}, Default: time.Hour, Max: 7 * day}, valid: true},
+		{name: "default not allowed", allowed: "1h,7d", def: "1d"},
+		{name: "default past the maximum", allowed: "1h,7d", def: "7d", max: "1d"},
+		{name: "invalid allowed entry", allowed: "1h,forever"},
+		{name: "empty allowed entry", allowed: "1h,,1d"},
+		{name: "zero allowed entry", allowed: "0s,1d"},
+		{name: "invalid default", def: "tomorrow"},
+		{name: "invalid maximum", max: "a week"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("ALLOWED_EXPIRATIONS", test.allowed)
+			t.Setenv("DEFAULT_EXPIRATION", test.def)
+			t.Setenv("MAX_EXPIRATION", test.max)
+
+			policy, err := expirationsFromEnv()
+			if (err == nil) != test.valid {
+				t.Fatalf("got %v, want valid %v", err, test.valid)
+			}
+			if err == nil && !reflect.DeepEqual(policy, test.want) {
+				t.Errorf("got %+v, want %+v", policy, test.want)
+			}
+		})
+	}
+}
+
+func TestExpirationPolicyParse(t *testing.T) {
+	policy := expirationPolicy{
+		Allowed: []time.Duration{10 * time.Minute, time.Hour, 24 * time.Hour, 30 * 24 * time.Hour},
+		Default: time.Hour,
+		Max:     7 * 24 * time.Hour,
+	}
+
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", time.Hour, true},
+		{"10m", 10 * time.Minute, true},
+		{"1d", 24 * time.Hour, true},
+		{"24h", 24 * time.Hour, true},
+		{"60m", time.Hour, true},
+		// Allowed, but past the maximum
+		{"30d", 0, false},
+		{"2h", 0, false},
+		{"-1h", 0, false},
+		{"soon", 0, false},
+		{"1", 0, false},
+	}
+
+	for _, test := range tests {
+		got, ok := policy.parse(test.value)
+		if got != test.want || ok != test.ok {
+			t.Errorf("parse(%q): got %v, %v, want %v, %v", test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestUploadExpiration(t *testing.T) {
+	ts := newTestServer(t)
+
+	tests := []struct {
+		expiresIn string
+		want      time.Duration
+		valid     bool
+	}{
+		{"", 24 * time.Hour, true},
+		{"10m", 10 * time.Minute, true},
+		{"7d", 7 * 24 * time.Hour, true},
+		{"2h", 0, false},
+		{"8d", 0, false},
+		{"never", 0, false},
+	}
+
+	for i, test := range tests {
+		t.Run(test.expiresIn, func(t *testing.T) {
+			// Each upload has its own content, so none is refused as a duplicate
+			content := []byte(fmt.Sprintf("notes %d", i))
+			fields := map[string]string{}
+			if test.expiresIn != "" {
+				fields["expiresIn"] = test.expiresIn
+			}
+
+			if !test.valid {
+				body, contentType := uploadForm(t, "notes.txt", "text/plain", content, fields)
+				w := ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+				if got := checkError(t, w, apierror.InvalidField); got.Details["field"] != "expiresIn" {
+					t.Errorf("got the details %v, want the field expiresIn", got.Details)
+				}
+				return
+			}
+
+			before := time.Now()
+			uploaded := ts.upload(t, "notes.txt", content, fields)
+			expires := uploaded.Data.ExpireDate
+			if expires.Before(before.Add(test.want)) || expires.After(time.Now().Add(test.want)) {
+				t.Errorf("expires at %v, want %v after the upload at %v", expires, test.want, before)
+			}
+		})
+	}
+}
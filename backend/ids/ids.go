@@ -0,0 +1,167 @@
+// Package ids generates the identifiers of the uploaded files and the keyed hashes stored in their place.
+// Public and private IDs are random; only an HMAC-SHA256 of the private ID is stored, so the database alone cannot be used
+// to delete or manage files. The HMAC keys are versioned: new hashes use the current key, and the previous keys are
+// kept to recognize the hashes made before a rotation.
+package ids
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	idSize       = 32 // Number of random bytes of an ID, written as 64 hexadecimal characters
+	minKeyLength = 16
+	separator    = "$" // Separates the key version from the hash in the stored values
+)
+
+// Keyring holds the versioned HMAC keys.
+type Keyring struct {
+	Current int            // Version of the key used for new hashes
+	keys    map[int][]byte // Keys indexed by version
+}
+
+// NewKeyring creates a keyring.
+// Parameters:
+//   keys (map[int]string): The secrets indexed by version, at least 16 characters long.
+//   current (int): The version used for new hashes.
+// Returns:
+//   *Keyring: The keyring.
+//   error: An error if a secret is too short or the current version has no key.
+func NewKeyring(keys map[int]string, current int) (*Keyring, error) {
+	k := &Keyring{Current: current, keys: map[int][]byte{}}
+
+	for version, secret := range keys {
+		if version < 1 {
+			return nil, fmt.Errorf("invalid key version %d", version)
+		}
+		if len(secret) < minKeyLength {
+			return nil, fmt.Errorf("the key %d must be at least %d characters long", version, minKeyLength)
+		}
+		k.keys[version] = []byte(secret)
+	}
+
+	if _, ok := k.keys[current]; !ok {
+		return nil, fmt.Errorf("no key has the current version %d", current)
+	}
+	return k, nil
+}
+
+// FromEnv builds the keyring from ID_KEYS, a comma separated list of "<version>:<secret>", and ID_KEY_VERSION, the version
+// used for new hashes (the highest one by default). Without ID_KEYS, ENCRYPTION_KEY is used as the key of version 1.
+// Returns:
+//   *Keyring: The keyring.
+//   error: An error if no key is configured or a value is not valid.
+func FromEnv() (*Keyring, error) {
+	keys := map[int]string{}
+	current := 0
+
+	if value := os.Getenv("ID_KEYS"); value != "" {
+		for _, entry := range strings.Split(value, ",") {
+			versionText, secret, ok := strings.Cut(strings.TrimSpace(entry), ":")
+			version, err := strconv.Atoi(versionText)
+			if !ok || err != nil {
+				return nil, fmt.Errorf("invalid ID_KEYS entry %q, expected <version>:<secret>", redact(entry))
+			}
+			if _, exists := keys[version]; exists {
+				return nil, fmt.Errorf("the key version %d is repeated in ID_KEYS", version)
+			}
+			keys[version] = secret
+			current = max(current, version)
+		}
+	} else if secret := os.Getenv("ENCRYPTION_KEY"); secret != "" {
+		keys[1] = secret
+		current = 1
+	} else {
+		return nil, fmt.Errorf("ID_KEYS must be set")
+	}
+
+	if value := os.Getenv("ID_KEY_VERSION"); value != "" {
+		version, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID_KEY_VERSION %q", value)
+		}
+		current = version
+	}
+
+	return NewKeyring(keys, current)
+}
+
+// redact returns an ID_KEYS entry with its secret hidden, so it can be shown in errors.
+func redact(entry string) string {
+	versionText, _, ok := strings.Cut(strings.TrimSpace(entry), ":")
+	if !ok {
+		// Without separator the whole entry may be the secret
+		return "<redacted>"
+	}
+	return versionText + ":<redacted>"
+}
+
+// New returns a random ID.
+// Returns:
+//   string: 64 hexadecimal characters.
+//   error: An error if the random generator failed.
+func New() (string, error) {
+	id := make([]byte, idSize)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("error generating an ID: %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Seal returns the value to store in place of a secret, hashed with the current key.
+// Parameters:
+//   value (string): The secret (e.g. a private ID).
+// Returns:
+//   string: "<version>$<hexadecimal HMAC>".
+func (k *Keyring) Seal(value string) string {
+	return k.seal(k.Current, value)
+}
+
+// Candidates returns the values a secret may have been stored as, under every key, starting with the current one.
+// Parameters:
+//   value (string): The secret sent by a client.
+// Returns:
+//   []string: The sealed values to look for.
+func (k *Keyring) Candidates(value string) []string {
+	versions := make([]int, 0, len(k.keys))
+	for version := range k.keys {
+		if version != k.Current {
+			versions = append(versions, version)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	candidates := []string{k.seal(k.Current, value)}
+	for _, version := range versions {
+		candidates = append(candidates, k.seal(version, value))
+	}
+	return candidates
+}
+
+// seal hashes a value with the key of the given version.
+func (k *Keyring) seal(version int, value string) string {
+	mac := hmac.New(sha256.New, k.keys[version])
+	mac.Write([]byte(value))
+	return strconv.Itoa(version) + separator + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Legacy reports whether an ID sent by a client may be one generated before keyed hashes, which were stored as they are.
+// Parameters:
+//   id (string): The ID sent by a client.
+// Returns:
+//   bool: Returns true if the ID is 64 hexadecimal characters.
+func Legacy(id string) bool {
+	if len(id) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,88 @@
+package ids
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		name, keys, version string
+		current             int
+		wantErr             bool
+	}{
+		{name: "single key", keys: "1:first-secret-0123456789", current: 1},
+		{name: "highest version by default", keys: "1:first-secret-0123456789, 2:second-secret-0123456789", current: 2},
+		{name: "chosen version", keys: "1:first-secret-0123456789,2:second-secret-0123456789", version: "1", current: 1},
+		{name: "short secret", keys: "1:short", wantErr: true},
+		{name: "repeated version", keys: "1:first-secret-0123456789,1:second-secret-0123456789", wantErr: true},
+		{name: "unknown current version", keys: "1:first-secret-0123456789", version: "2", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("ID_KEYS", test.keys)
+			t.Setenv("ID_KEY_VERSION", test.version)
+
+			keyring, err := FromEnv()
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("the configuration was accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keyring.Current != test.current {
+				t.Errorf("current version %d, want %d", keyring.Current, test.current)
+			}
+		})
+	}
+}
+
+func TestFromEnvRedactsSecrets(t *testing.T) {
+	tests := []struct {
+		entry, want string
+	}{
+		{"one:top-secret-value-0123456789", `"one:<redacted>"`},
+		{"top-secret-value-0123456789", `"<redacted>"`},
+	}
+
+	for _, test := range tests {
+		t.Setenv("ID_KEYS", "1:first-secret-0123456789,"+test.entry)
+
+		_, err := FromEnv()
+		if err == nil {
+			t.Fatalf("%q was accepted", test.entry)
+		}
+		if strings.Contains(err.Error(), "top-secret") {
+			t.Errorf("the error reveals the secret: %v", err)
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("the error %q does not name the entry as %s", err, test.want)
+		}
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	old, err := NewKeyring(map[int]string{1: "first-secret-0123456789"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := NewKeyring(map[int]string{1: "first-secret-0123456789", 2: "second-secret-0123456789"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := old.Seal("private-id")
+	if !strings.HasPrefix(sealed, "1$") || strings.Contains(sealed, "private-id") {
+		t.Fatalf("unexpected sealed value %q", sealed)
+	}
+
+	// Values sealed before the rotation are still recognized, after the ones of the current key
+	candidates := rotated.Candidates("private-id")
+	if len(candidates) != 2 || candidates[0] != rotated.Seal("private-id") || candidates[1] != sealed {
+		t.Errorf("unexpected candidates %q", candidates)
+	}
+}
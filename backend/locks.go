@@ -0,0 +1,47 @@
+package main
+
+import "sync"
+
+// ownerLocks serializes the uploads of each owner, so that concurrent uploads cannot all pass the quota check before
+// any of them is saved. Uploads of different owners go on in parallel. The zero value is ready to use.
+type ownerLocks struct {
+	mu    sync.Mutex
+	locks map[string]*ownerLock // Locks indexed by owner, removed once no upload holds or waits for them
+}
+
+// ownerLock is the lock of one owner, with the number of uploads holding or waiting for it.
+type ownerLock struct {
+	mu    sync.Mutex
+	users int
+}
+
+// Lock waits until no other upload of the owner holds its lock.
+// Parameters:
+//   owner (string): The anonymized (hashed) IP address of the owner.
+// Returns:
+//   func(): Releases the lock, it must be called once.
+func (l *ownerLocks) Lock(owner string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*ownerLock{}
+	}
+	lock, ok := l.locks[owner]
+	if !ok {
+		lock = &ownerLock{}
+		l.locks[owner] = lock
+	}
+	lock.users++
+	l.mu.Unlock()
+
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		lock.users--
+		if lock.users == 0 {
+			delete(l.locks, owner)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"backend/archive"
+	"backend/clientip"
+	"backend/db"
+	"backend/ids"
+	"backend/pseudonym"
+	"backend/quarantine"
+	"backend/ratelimit"
+	"backend/scan"
+	"backend/storage"
+	"backend/tus"
+)
+
+// testServer is a server running on a MemoryStore and a local storage in a temporary directory.
+type testServer struct {
+	*server
+	store   *db.MemoryStore
+	limiter *ratelimit.Limiter // Without limits, tests set the ones they need with limit
+	router  *gin.Engine
+}
+
+// newTestServer builds a server whose uploads are scanned by no engine, so they become available right away.
+func newTestServer(t *testing.T) *testServer {
+	return newTestServerWithScanner(t, &scan.Multi{Policy: scan.Any})
+}
+
+// newTestServerWithScanner builds a server whose uploads are scanned by the given scanner.
+func newTestServerWithScanner(t *testing.T, scanner scan.Scanner) *testServer {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("QUARANTINE_PATH", "")
+	t.Setenv("SCAN_WORKERS", "")
+
+	dir := t.TempDir()
+	blobs, err := storage.NewLocal(filepath.Join(dir, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := db.NewMemoryStore(blobs)
+
+	keyring, err := ids.NewKeyring(map[int]string{1: "test-id-key-0123456789"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pseudonyms, err := pseudonym.New("test-pseudonym-secret", 24*time.Hour, time.Hour, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := &typesHolder{}
+	policy := defaultTypes
+	types.current.Store(&policy)
+
+	s := &server{
+		files:   store,
+		users:   store,
+		blobs:   blobs,
+		staging: filepath.Join(dir, "staging"),
+		expirations: expirationPolicy{
+			Allowed: []time.Duration{10 * time.Minute, time.Hour, 24 * time.Hour, 7 * 24 * time.Hour},
+			Default: 24 * time.Hour,
+			Max:     7 * 24 * time.Hour,
+		},
+		passwords:   newAttemptLimiter(3, time.Minute),
+		types:       types,
+		scanMaxSize: scan.MaxSize(scanner),
+		ids:         keyring,
+		pseudonyms:  pseudonyms,
+		clients:     &clientip.Resolver{},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	if s.quarantine, err = quarantine.FromEnv(filepath.Join(dir, "quarantine"), scanner, blobs, store, store); err != nil {
+		t.Fatal(err)
+	}
+	s.quarantine.Start(ctx)
+
+	if s.archives, err = archive.FromEnv(s.staging); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.uploads, err = tus.NewHandler(filepath.Join(dir, "tus"), int64(userMaxSpace), s.completeUpload); err != nil {
+		t.Fatal(err)
+	}
+	s.uploads.Owner = s.uploadOwner
+	s.uploads.Owns = s.ownsUpload
+
+	ts := &testServer{
+		server:  s,
+		store:   store,
+		limiter: &ratelimit.Limiter{Store: ratelimit.NewMemory(), Limits: map[string]ratelimit.Limit{}},
+	}
+	ts.route()
+	return ts
+}
+
+// route builds the router of the server, with the middleware answering the errors like in production.
+func (ts *testServer) route() {
+	ts.router = gin.New()
+	handleErrors(ts.router)
+	ts.routes(ts.router, ts.limiter, time.Time{})
+}
+
+// limit sets the rate limit of a class of routes. The middleware read their limit when the routes are added, so the
+// router is built again.
+func (ts *testServer) limit(class string, limit ratelimit.Limit) {
+	ts.limiter.Limits[class] = limit
+	ts.route()
+}
+
+// gateScanner holds every scan until release is closed, so tests can act on files while they are quarantined.
+type gateScanner struct {
+	release chan struct{}
+	started chan struct{} // Receives a value when a scan starts, if the test waits for it
+}
+
+// newGateScanner creates a scanner holding the scans.
+func newGateScanner() *gateScanner {
+	return &gateScanner{release: make(chan struct{}), started: make(chan struct{}, 16)}
+}
+
+func (g *gateScanner) Name() string {
+	return "gate"
+}
+
+func (g *gateScanner) Scan(ctx context.Context, path string) (scan.Verdict, error) {
+	select {
+	case g.started <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-g.release:
+		return scan.Verdict{Engine: "gate"}, nil
+	case <-ctx.Done():
+		return scan.Verdict{}, ctx.Err()
+	}
+}
+
+// do sends a request to the router and returns the recorded response.
+func (ts *testServer) do(method, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	return ts.doFrom("192.0.2.1:1234", method, target, body, header)
+}
+
+// doFrom sends a request from the given client address.
+func (ts *testServer) doFrom(remoteAddr, method, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	req.RemoteAddr = remoteAddr
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	w := httptest.NewRecorder()
+	ts.router.ServeHTTP(w, req)
+	return w
+}
+
+// uploadForm returns the multipart body of an upload and its content type.
+func uploadForm(t *testing.T, name, contentType string, content []byte, fields map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for field, value := range fields {
+		if err := form.WriteField(field, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="`+name+`"`)
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, form.FormDataContentType()
+}
+
+// upload sends a text file to POST /api/v1/files and waits for its scan.
+func (ts *testServer) upload(t *testing.T, name string, content []byte, fields map[string]string) uploadResponse {
+	t.Helper()
+
+	body, contentType := uploadForm(t, name, "text/plain", content, fields)
+	w := ts.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("upload of %s: got %d %s", name, w.Code, w.Body)
+	}
+
+	response := decode[uploadResponse](t, w)
+	ts.waitScanned(t, response.Data.IdPublic)
+	return response
+}
+
+// waitScanned waits until the quarantine recorded the scan of a file.
+func (ts *testServer) waitScanned(t *testing.T, idPublic string) db.File {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		file, err := ts.files.GetFileFromID(idPublic, "public")
+		if err == nil && file.ScanStatus != db.ScanQuarantined {
+			return file
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the scan of %s did not end", idPublic)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// decode reads the JSON body of a response.
+func decode[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+
+	var value T
+	if err := decodeBody(w, &value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// decodeBody reads the JSON body of a response, for the goroutines that cannot stop the test.
+func decodeBody(w *httptest.ResponseRecorder, value any) error {
+	if err := json.Unmarshal(w.Body.Bytes(), value); err != nil {
+		return fmt.Errorf("invalid JSON body %q: %v", w.Body, err)
+	}
+	return nil
+}
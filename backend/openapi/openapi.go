@@ -0,0 +1,342 @@
+// Package openapi builds an OpenAPI 3.1 document describing the routes as they are registered. The schemas of the
+// bodies are derived by reflection from the Go types the handlers read and answer with, following their json tags,
+// so the document changes with the code instead of being written by hand.
+package openapi
+
+import (
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Version is the version of the OpenAPI specification the documents follow.
+const Version = "3.1.0"
+
+// Document is an OpenAPI document.
+type Document struct {
+	OpenAPI    string                  `json:"openapi"`
+	Info       Info                    `json:"info"`
+	Paths      map[string]PathItem     `json:"paths"`
+	Components Components              `json:"components"`
+	Tags       []Tag                   `json:"tags,omitempty"`
+	types      map[reflect.Type]string // Names of the components of the struct types already described
+}
+
+// Info describes the API.
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// Tag groups operations.
+type Tag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem holds the operations of a path, indexed by lowercase HTTP method.
+type PathItem map[string]*Operation
+
+// Components holds the schemas and security schemes referenced by the operations.
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// SecurityScheme describes how a client authenticates.
+type SecurityScheme struct {
+	Type        string `json:"type"`             // "http" or "apiKey"
+	Scheme      string `json:"scheme,omitempty"` // "bearer" for the http type
+	Name        string `json:"name,omitempty"`   // Name of the header, query parameter or cookie of the apiKey type
+	In          string `json:"in,omitempty"`     // "header", "query" or "cookie" for the apiKey type
+	Description string `json:"description,omitempty"`
+}
+
+// Operation describes what a method does on a path.
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Deprecated  bool                  `json:"deprecated,omitempty"`
+	Security    []map[string][]string `json:"security,omitempty"`
+	Parameters  []*Parameter          `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+}
+
+// Parameter describes a path, query, header or cookie parameter.
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"` // "path", "query", "header" or "cookie"
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody describes the body of a request.
+type RequestBody struct {
+	Description string               `json:"description,omitempty"`
+	Required    bool                 `json:"required,omitempty"`
+	Content     map[string]MediaType `json:"content"`
+}
+
+// MediaType describes a body of a given content type.
+type MediaType struct {
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+// Response describes a response of an operation.
+type Response struct {
+	Description string               `json:"description"`
+	Headers     map[string]*Header   `json:"headers,omitempty"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// Header describes a header of a response.
+type Header struct {
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// Schema is a JSON Schema, limited to what the API needs.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 any                `json:"type,omitempty"` // A type name, or a list of them for values that may be null
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"` // The value matches exactly one of these schemas
+}
+
+// New creates an empty document.
+// Parameters:
+//   title (string): The name of the API.
+//   version (string): The version of the API.
+// Returns:
+//   *Document: The document, to be filled with Add.
+func New(title, version string) *Document {
+	return &Document{
+		OpenAPI:    Version,
+		Info:       Info{Title: title, Version: version},
+		Paths:      map[string]PathItem{},
+		Components: Components{Schemas: map[string]*Schema{}},
+		types:      map[reflect.Type]string{},
+	}
+}
+
+// Add describes an operation. The parameters of the path (":name" segments, as written for gin) are declared when
+// the operation does not describe them itself.
+// Parameters:
+//   method (string): The HTTP method.
+//   path (string): The path, in the syntax of gin.
+//   op (*Operation): The operation.
+func (d *Document) Add(method, path string, op *Operation) {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, ":") {
+			continue
+		}
+		name := segment[1:]
+		segments[i] = "{" + name + "}"
+
+		declared := false
+		for _, parameter := range op.Parameters {
+			declared = declared || (parameter.In == "path" && parameter.Name == name)
+		}
+		if !declared {
+			op.Parameters = append(op.Parameters, &Parameter{Name: name, In: "path", Required: true, Schema: String("")})
+		}
+	}
+	path = strings.Join(segments, "/")
+
+	if d.Paths[path] == nil {
+		d.Paths[path] = PathItem{}
+	}
+	d.Paths[path][strings.ToLower(method)] = op
+}
+
+// Schema describes the JSON encoding of a Go value. Structs are described once in the components and referenced.
+// Parameters:
+//   v (any): A value of the type to describe.
+// Returns:
+//   *Schema: The schema of the type.
+func (d *Document) Schema(v any) *Schema {
+	return d.schemaOf(reflect.TypeOf(v))
+}
+
+// Component returns the schema of a component, nil if there is none with this name.
+func (d *Document) Component(name string) *Schema {
+	return d.Components.Schemas[name]
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf describes a type.
+func (d *Document) schemaOf(t reflect.Type) *Schema {
+	if t == nil {
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return d.schemaOf(t.Elem())
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		// Nil slices are encoded as null
+		return &Schema{Type: []string{"array", "null"}, Items: d.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: []string{"object", "null"}, AdditionalProperties: d.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t == timeType {
+			return &Schema{Type: "string", Format: "date-time"}
+		}
+		return d.component(t)
+	default:
+		// Interfaces may hold any value
+		return &Schema{}
+	}
+}
+
+// component describes a struct type in the components and returns a reference to it.
+func (d *Document) component(t reflect.Type) *Schema {
+	if name, ok := d.types[t]; ok {
+		return Ref(name)
+	}
+
+	name := componentName(t.Name())
+	if _, taken := d.Components.Schemas[name]; taken {
+		// Types of different packages may share a name
+		name = componentName(path.Base(t.PkgPath())) + name
+	}
+	return d.describe(t, name)
+}
+
+// Named describes a struct type under a chosen component name, instead of the name of the type.
+// Parameters:
+//   name (string): The name of the component.
+//   v (any): A value of the struct type.
+// Returns:
+//   *Schema: A reference to the component.
+func (d *Document) Named(name string, v any) *Schema {
+	t := reflect.TypeOf(v)
+	if existing, ok := d.types[t]; ok {
+		return Ref(existing)
+	}
+	return d.describe(t, name)
+}
+
+// describe adds the component of a struct type and returns a reference to it.
+func (d *Document) describe(t reflect.Type, name string) *Schema {
+	// Registered before its fields, so recursive types end
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	d.types[t] = name
+	d.Components.Schemas[name] = schema
+
+	d.addFields(schema, t)
+	sort.Strings(schema.Required)
+	return Ref(name)
+}
+
+// addFields describes the encoded fields of a struct, the fields of embedded structs included.
+func (d *Document) addFields(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" && options == "" {
+			continue
+		}
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			d.addFields(schema, field.Type)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = d.schemaOf(field.Type)
+
+		if !strings.Contains(","+options+",", ",omitempty,") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
+
+// componentName returns a name with an upper case first letter, so unexported types get the same kind of names.
+func componentName(name string) string {
+	runes := []rune(name)
+	if len(runes) == 0 {
+		return "Object"
+	}
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
+
+// Ref returns a schema referencing a component.
+func Ref(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// OneOf returns the schema of a value matching exactly one of the given schemas.
+func OneOf(schemas ...*Schema) *Schema {
+	return &Schema{OneOf: schemas}
+}
+
+// String returns the schema of a string.
+func String(description string) *Schema {
+	return &Schema{Type: "string", Description: description}
+}
+
+// Integer returns the schema of a non-negative integer.
+func Integer(description string) *Schema {
+	zero := 0.0
+	return &Schema{Type: "integer", Minimum: &zero, Description: description}
+}
+
+// Boolean returns the schema of a boolean.
+func Boolean(description string) *Schema {
+	return &Schema{Type: "boolean", Description: description}
+}
+
+// Binary returns the schema of raw bytes, such as an uploaded or downloaded file.
+func Binary(description string) *Schema {
+	return &Schema{Type: "string", Format: "binary", Description: description}
+}
+
+// JSON returns a response whose body is the JSON encoding of v.
+// Parameters:
+//   d (*Document): The document holding the components.
+//   description (string): The description of the response.
+//   v (any): A value of the type of the body.
+// Returns:
+//   *Response: The response.
+func JSON(d *Document, description string, v any) *Response {
+	return &Response{
+		Description: description,
+		Content:     map[string]MediaType{"application/json": {Schema: d.Schema(v)}},
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"backend/apierror"
+	"backend/db"
+)
+
+// ownerCookiePrefix starts the name of the cookies holding owner tokens, followed by the public ID of the file.
+const ownerCookiePrefix = "moada_owner_"
+
+// ownerToken reads the owner token of a request: the private ID returned by the upload, which manages the file.
+// It is read from the Authorization header ("Bearer <token>"), then the idPrivate path segment or parameter, then the
+// cookie set by the upload for the file named by the idPublic parameter.
+// Parameters:
+//   c (*gin.Context): The request context.
+// Returns:
+//   string: The token, empty if the request has none.
+func (s *server) ownerToken(c *gin.Context) string {
+	if token, ok := bearerToken(c); ok {
+		return token
+	}
+	if token := c.Param("idPrivate"); token != "" {
+		return token
+	}
+
+	if token := c.PostForm("idPrivate"); token != "" {
+		return token
+	}
+	if token := c.Query("idPrivate"); token != "" {
+		return token
+	}
+
+	if idPublic := publicIDParam(c); idPublic != "" {
+		if token, err := c.Cookie(ownerCookiePrefix + idPublic); err == nil {
+			return token
+		}
+	}
+
+	return ""
+}
+
+// bearerToken reads the token of an "Authorization: Bearer <token>" header.
+// Parameters:
+//   c (*gin.Context): The request context.
+// Returns:
+//   string: The token.
+//   bool: Returns false if the request has no bearer token.
+func bearerToken(c *gin.Context) (string, bool) {
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// publicIDParam returns the idPublic path segment, or parameter of the body or the query string, empty if there is none.
+func publicIDParam(c *gin.Context) string {
+	if idPublic := c.Param("idPublic"); idPublic != "" {
+		return idPublic
+	}
+	if idPublic := c.PostForm("idPublic"); idPublic != "" {
+		return idPublic
+	}
+	return c.Query("idPublic")
+}
+
+// ownedFile finds the file managed by the owner token of a request, replying to the client when there is none.
+// Parameters:
+//   c (*gin.Context): The request context.
+// Returns:
+//   db.File: The file, whose IdPrivate is the stored hash of the token.
+//   string: The token.
+//   bool: Returns false if the request was answered.
+func (s *server) ownedFile(c *gin.Context) (db.File, string, bool) {
+	token := s.ownerToken(c)
+	if token == "" {
+		apierror.Respond(c, apierror.New(apierror.OwnerTokenRequired, "The owner token of the file was not provided."))
+		return db.File{}, "", false
+	}
+
+	file, err := s.privateFile(token)
+	if errors.Is(err, db.ErrNotFound) {
+		apierror.Respond(c, apierror.New(apierror.FileNotFound, "No file is managed by this owner token."))
+		return db.File{}, "", false
+	}
+	if err != nil {
+		apierror.Respond(c, fmt.Errorf("error retrieving the file of an owner token: %v", err))
+		return db.File{}, "", false
+	}
+
+	// A cookie only manages the file it was set for
+	if idPublic := publicIDParam(c); idPublic != "" && idPublic != file.IdPublic {
+		apierror.Respond(c, apierror.New(apierror.OwnerTokenMismatch, "The owner token does not manage this file."))
+		return db.File{}, "", false
+	}
+
+	return file, token, true
+}
+
+// fileLocation returns where a file is stored, from the storage key saved with its metadata, whoever requests it.
+// Parameters:
+//   file (db.File): The file, which must have left the quarantine.
+// Returns:
+//   string: The storage key of the file.
+//   string: The storage directory of the user who uploaded it, which is also their pseudonym.
+//   error: An error if the file has no storage key.
+func (s *server) fileLocation(file db.File) (string, string, error) {
+	if file.StorageKey == "" {
+		return "", "", fmt.Errorf("the storage key of the file %s is unknown", file.IdPublic)
+	}
+
+	return file.StorageKey, path.Dir(file.StorageKey), nil
+}
+
+// setOwnerCookie stores the owner token of a new file in an HttpOnly cookie, when OWNER_COOKIE is enabled, so the
+// browser that uploaded it can manage it without keeping the token itself.
+// Parameters:
+//   c (*gin.Context): The request context.
+//   file (db.File): The new file.
+//   token (string): Its owner token.
+func (s *server) setOwnerCookie(c *gin.Context, file db.File, token string) {
+	if !s.ownerCookies {
+		return
+	}
+
+	maxAge := int(time.Until(file.ExpireDate).Seconds())
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(ownerCookiePrefix+file.IdPublic, token, maxAge, "/", "", true, true)
+}
+
+// clearOwnerCookie removes the cookie of a deleted file.
+func (s *server) clearOwnerCookie(c *gin.Context, file db.File) {
+	if _, err := c.Cookie(ownerCookiePrefix + file.IdPublic); err != nil {
+		return
+	}
+
+	c.SetSameSite(http.SameSiteStrictMode)
+	c.SetCookie(ownerCookiePrefix+file.IdPublic, "", -1, "/", "", true, true)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+
+	"backend/sniff"
+)
+
+// typePolicy lists the file types uploaders can send. It is never modified once loaded, a reload replaces it as a whole.
+type typePolicy struct {
+	Types map[string]typeRule `yaml:"types" json:"types"` // Rules indexed by canonical MIME type
+}
+
+// typeRule describes how files of an allowed type are accepted.
+type typeRule struct {
+	MaxSize    int64    `yaml:"maxSize" json:"maxSize"`                           // Maximum size of the files in bytes, 0 for the user quota only
+	Extensions []string `yaml:"extensions" json:"extensions"`                     // Extensions accepted besides the ones known for the type, without the dot
+	DetectedAs string   `yaml:"detectedAs,omitempty" json:"detectedAs,omitempty"` // Type reported by the content detection for formats built on another one (e.g. "application/zip" for .docx)
+}
+
+// defaultTypes is the policy used when TYPES_POLICY is not set.
+var defaultTypes = typePolicy{Types: map[string]typeRule{
+	"image/jpeg": {},
+	"image/png":  {},
+	"image/gif":  {},
+
+	"application/pdf":  {},
+	"application/json": {},
+
+	"application/zip":              {},
+	"application/x-tar":            {},
+	"application/x-rar-compressed": {},
+
+	"text/plain": {},
+
+	"audio/mpeg":   {},
+	"audio/x-wav":  {},
+	"audio/x-flac": {},
+}}
+
+// typesHolder keeps the current type policy, so it can be swapped on SIGHUP while requests read it.
+type typesHolder struct {
+	path    string // Path of the policy file, empty for the default policy
+	current atomic.Pointer[typePolicy]
+}
+
+// typesFromEnv loads the type policy from the file named by TYPES_POLICY, or the default one when it is not set.
+// Returns:
+//   *typesHolder: The holder of the loaded policy.
+//   error: Returns an error if the file cannot be read or is not valid.
+func typesFromEnv() (*typesHolder, error) {
+	holder := &typesHolder{path: os.Getenv("TYPES_POLICY")}
+
+	if holder.path == "" {
+		policy := defaultTypes
+		holder.current.Store(&policy)
+		return holder, nil
+	}
+
+	if err := holder.reload(); err != nil {
+		return nil, err
+	}
+	return holder, nil
+}
+
+// Load returns the current policy.
+func (h *typesHolder) Load() *typePolicy {
+	return h.current.Load()
+}
+
+// reload reads the policy file again and replaces the current policy, which is kept if the file is not valid.
+func (h *typesHolder) reload() error {
+	if h.path == "" {
+		return nil
+	}
+
+	policy, err := loadTypePolicy(h.path)
+	if err != nil {
+		return err
+	}
+
+	h.current.Store(policy)
+	return nil
+}
+
+// WatchReload reloads the policy every time the process receives SIGHUP.
+func (h *typesHolder) WatchReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			if err := h.reload(); err != nil {
+				log.Printf("Error reloading the type policy, keeping the previous one: %v", err)
+				continue
+			}
+			log.Printf("Type policy reloaded from %s", h.path)
+		}
+	}()
+}
+
+// loadTypePolicy reads a policy file. JSON files are read as YAML, which they are a subset of.
+// Parameters:
+//   path_ (string): The path of the YAML or JSON file.
+// Returns:
+//   *typePolicy: The policy, with its types and extensions normalized.
+//   error: Returns an error if the file cannot be read or a rule is not valid.
+func loadTypePolicy(path_ string) (*typePolicy, error) {
+	content, err := os.ReadFile(path_)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the type policy: %v", err)
+	}
+
+	var raw typePolicy
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing the type policy %s: %v", filepath.Base(path_), err)
+	}
+
+	if len(raw.Types) == 0 {
+		return nil, fmt.Errorf("the type policy %s allows no type", filepath.Base(path_))
+	}
+
+	policy := &typePolicy{Types: map[string]typeRule{}}
+	for contentType, rule := range raw.Types {
+		if rule.MaxSize < 0 {
+			return nil, fmt.Errorf("invalid maxSize for %s", contentType)
+		}
+
+		for i, extension := range rule.Extensions {
+			rule.Extensions[i] = strings.ToLower(strings.TrimPrefix(extension, "."))
+		}
+		if rule.DetectedAs != "" {
+			if len(rule.Extensions) == 0 {
+				return nil, fmt.Errorf("%s is detected as %s but lists no extension", contentType, rule.DetectedAs)
+			}
+			rule.DetectedAs = sniff.Canonical(rule.DetectedAs)
+		}
+
+		policy.Types[sniff.Canonical(contentType)] = rule
+	}
+
+	return policy, nil
+}
+
+// rule returns the rule of a type declared by a client.
+// Parameters:
+//   contentType (string): The MIME type, in any form accepted by sniff.Canonical.
+// Returns:
+//   typeRule: The rule of the type.
+//   bool: Returns false if the type is not allowed.
+func (p *typePolicy) rule(contentType string) (typeRule, bool) {
+	rule, ok := p.Types[sniff.Canonical(contentType)]
+	return rule, ok
+}
+
+// accepts checks a staged file against the rule of its declared type.
+// Parameters:
+//   declared (string): The type sent by the client.
+//   detected (string): The type returned by sniff.Detect.
+//   name (string): The name of the file.
+// Returns:
+//   string: The type to store for the file.
+//   bool: Returns false if the content or the extension do not agree with the declared type.
+func (p *typePolicy) accepts(declared, detected, name string) (string, bool) {
+	rule, ok := p.rule(declared)
+	if !ok {
+		return "", false
+	}
+
+	// Formats built on another one keep their declared type, the content only has to match the container
+	if rule.DetectedAs != "" {
+		return sniff.Canonical(declared), detected == rule.DetectedAs && rule.hasExtension(name)
+	}
+
+	if _, ok := p.Types[detected]; !ok || !sniff.Matches(declared, detected) {
+		return "", false
+	}
+	return detected, sniff.ExtensionMatches(name, detected) || rule.hasExtension(name)
+}
+
+// hasExtension reports whether the extension of a file name is one listed in the rule.
+func (r typeRule) hasExtension(name string) bool {
+	extension := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+
+	for _, e := range r.Extensions {
+		if e == extension {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writePolicy writes a policy file in a temporary directory.
+func writePolicy(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTypePolicy(t *testing.T) {
+	tests := []struct {
+		name, file, content string
+		want                map[string]typeRule
+		valid               bool
+	}{
+		{
+			name: "yaml",
+			file: "types.yaml",
+			content: `types:
+  image/jpg: {}
+  Text/Plain; charset=utf-8:
+    maxSize: 1024
+    extensions: [".MD", csv]
+  application/vnd.openxmlformats-officedocument.wordprocessingml.document:
+    extensions: [docx]
+    detectedAs: application/x-zip-compressed
+`,
+			want: map[string]typeRule{
+				"image/jpeg": {},
+				"text/plain": {MaxSize: 1024, Extensions: []string{"md", "csv"}},
+				"application/vnd.openxmlformats-officedocument.wordprocessingml.document": {Extensions: []string{"docx"}, DetectedAs: "application/zip"},
+			},
+			valid: true,
+		},
+		{
+			name:    "json",
+			file:    "types.json",
+			content: `{"types": {"application/pdf": {"maxSize": 10}}}`,
+			want:    map[string]typeRule{"application/pdf": {MaxSize: 10}},
+			valid:   true,
+		},
+		{name: "no type", file: "types.yaml", content: "types: {}\n"},
+		{name: "empty file", file: "types.yaml", content: ""},
+		{name: "not yaml", file: "types.yaml", content: "types: [unclosed\n"},
+		{name: "negative size", file: "types.yaml", content: "types:\n  text/plain:\n    maxSize: -1\n"},
+		{name: "detected without extension", file: "types.yaml", content: "types:\n  application/epub+zip:\n    detectedAs: application/zip\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy, err := loadTypePolicy(writePolicy(t, test.file, test.content))
+			if (err == nil) != test.valid {
+				t.Fatalf("got %v, want valid %v", err, test.valid)
+			}
+			if err == nil && !reflect.DeepEqual(policy.Types, test.want) {
+				t.Errorf("got %+v, want %+v", policy.Types, test.want)
+			}
+		})
+	}
+
+	if _, err := loadTypePolicy(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("a missing file was loaded")
+	}
+}
+
+func TestTypePolicyAccepts(t *testing.T) {
+	const docx = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	policy := &typePolicy{Types: map[string]typeRule{
+		"image/jpeg":       {},
+		"text/plain":       {Extensions: []string{"log"}},
+		"application/json": {},
+		"application/zip":  {},
+		docx:               {Extensions: []string{"docx"}, DetectedAs: "application/zip"},
+	}}
+
+	tests := []struct {
+		name                     string
+		declared, detected, file string
+		want                     string
+		ok                       bool
+	}{
+		{"allowed", "image/jpeg", "image/jpeg", "photo.jpg", "image/jpeg", true},
+		{"alias declared", "image/jpg", "image/jpeg", "photo.JPEG", "image/jpeg", true},
+		{"type not allowed", "image/png", "image/png", "photo.png", "", false},
+		{"content of another type", "image/jpeg", "application/zip", "photo.jpg", "", false},
+		{"wrong extension", "image/jpeg", "image/jpeg", "photo.png", "image/jpeg", false},
+		{"extension of the rule", "text/plain", "text/plain", "server.log", "text/plain", true},
+		// JSON is text, the detected type is stored when both are allowed
+		{"json declared as text", "text/plain", "application/json", "data.json", "application/json", true},
+		{"text declared as json", "application/json", "text/plain", "data.json", "", false},
+		{"detected as its container", docx, "application/zip", "report.docx", docx, true},
+		{"container with the wrong extension", docx, "application/zip", "report.zip", docx, false},
+		{"not the container", docx, "application/pdf", "report.docx", docx, false},
+		// Without a rule of its own, a zip-based document is only accepted as a zip
+		{"container declared", "application/zip", "application/zip", "report.docx", "application/zip", false},
+	}
+
+	for _, test := range tests {
+		got, ok := policy.accepts(test.declared, test.detected, test.file)
+		if got != test.want || ok != test.ok {
+			t.Errorf("%s: got %q, %v, want %q, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestTypesReload(t *testing.T) {
+	path := writePolicy(t, "types.yaml", "types:\n  image/png: {}\n")
+	t.Setenv("TYPES_POLICY", path)
+	holder, err := typesFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder.WatchReload()
+
+	// reload waits until the policy allows or refuses a type after a SIGHUP
+	reload := func(content, contentType string, allowed bool) bool {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if _, ok := holder.Load().rule(contentType); ok == allowed {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !reload("types:\n  image/jpeg: {}\n", "image/jpeg", true) {
+		t.Fatal("the new policy was not loaded")
+	}
+	previous := holder.Load()
+
+	// An invalid file keeps the previous policy
+	if reload("types: [unclosed\n", "image/jpeg", false) {
+		t.Error("the policy changed to an invalid one")
+	}
+	if holder.Load() != previous {
+		t.Error("the previous policy was replaced")
+	}
+}
@@ -0,0 +1,244 @@
+// Package pseudonym replaces the IP addresses of the users by pseudonyms that cannot be reversed without a secret.
+// A pseudonym is an HMAC-SHA256 of the address keyed with the secret and a random salt that changes every period (a day
+// by default). The salts are kept in storage shared by every instance, so they all give an address the same pseudonym,
+// and the previous one is still accepted for a grace window after each rotation so users keep their data across it.
+// Salts are deleted once they are no longer accepted: the pseudonyms made with them cannot be computed again, even with
+// the secret.
+package pseudonym
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"backend/utils"
+)
+
+const (
+	minSecretLength = 16
+	saltSize        = 32 // Size of the random salts in bytes
+)
+
+// SaltStore keeps the salts where every instance reads them, such as the database.
+type SaltStore interface {
+	// GetOrCreateSalt returns the salt of a period, storing the given one first when the period has none yet. Every
+	// caller gets the salt stored first.
+	GetOrCreateSalt(period int64, salt []byte) ([]byte, error)
+	// DeleteSaltsBefore removes the salts of the periods before the given one.
+	DeleteSaltsBefore(period int64) error
+}
+
+// Pseudonymizer computes the pseudonyms of IP addresses.
+type Pseudonymizer struct {
+	Period       time.Duration    // Time during which a salt is used
+	Grace        time.Duration    // Time after a rotation during which the previous salt is still accepted
+	TruncateIPv6 bool             // Whether IPv6 addresses are reduced to their /64 network, which a single client usually owns
+	Now          func() time.Time // Clock used to pick the salt, time.Now when nil
+	secret       []byte
+	salts        SaltStore
+
+	mu     sync.Mutex
+	cache  map[int64][]byte // Salts read from the store, indexed by period
+	pruned int64            // Period before which the salts were deleted from the store
+}
+
+// New creates a pseudonymizer.
+// Parameters:
+//   secret (string): The secret combined with the salts, at least 16 characters long.
+//   period (time.Duration): The time during which a salt is used.
+//   grace (time.Duration): The time after a rotation during which the previous salt is still accepted, shorter than the period.
+//   salts (SaltStore): The store keeping the salts, shared by every instance.
+// Returns:
+//   *Pseudonymizer: The pseudonymizer, which does not truncate IPv6 addresses.
+//   error: An error if the secret is too short or the durations are not valid.
+func New(secret string, period, grace time.Duration, salts SaltStore) (*Pseudonymizer, error) {
+	if len(secret) < minSecretLength {
+		return nil, fmt.Errorf("the pseudonym secret must be at least %d characters long", minSecretLength)
+	}
+	if period <= 0 {
+		return nil, fmt.Errorf("the pseudonym rotation period must be positive")
+	}
+	if grace < 0 || grace >= period {
+		return nil, fmt.Errorf("the pseudonym grace window must be shorter than the rotation period")
+	}
+
+	return &Pseudonymizer{Period: period, Grace: grace, secret: []byte(secret), salts: salts, cache: map[int64][]byte{}}, nil
+}
+
+// FromEnv builds the pseudonymizer from PSEUDONYM_SECRET, PSEUDONYM_ROTATION (default "1d"), PSEUDONYM_GRACE
+// (default "1h") and PSEUDONYM_TRUNCATE_IPV6 (default false).
+// Parameters:
+//   salts (SaltStore): The store keeping the salts, shared by every instance.
+// Returns:
+//   *Pseudonymizer: The pseudonymizer.
+//   error: An error if no secret is configured or a value is not valid.
+func FromEnv(salts SaltStore) (*Pseudonymizer, error) {
+	secret := os.Getenv("PSEUDONYM_SECRET")
+	if secret == "" {
+		return nil, fmt.Errorf("PSEUDONYM_SECRET must be set")
+	}
+
+	period := 24 * time.Hour
+	if value := os.Getenv("PSEUDONYM_ROTATION"); value != "" {
+		var err error
+		if period, err = utils.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid PSEUDONYM_ROTATION %q", value)
+		}
+	}
+
+	grace := time.Hour
+	if value := os.Getenv("PSEUDONYM_GRACE"); value != "" {
+		var err error
+		if grace, err = utils.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("invalid PSEUDONYM_GRACE %q", value)
+		}
+	}
+
+	p, err := New(secret, period, grace, salts)
+	if err != nil {
+		return nil, err
+	}
+
+	if value := os.Getenv("PSEUDONYM_TRUNCATE_IPV6"); value != "" {
+		if p.TruncateIPv6, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid PSEUDONYM_TRUNCATE_IPV6 %q", value)
+		}
+	}
+
+	return p, nil
+}
+
+// Pseudonym returns the pseudonym of an IP address with the current salt.
+// Parameters:
+//   ip (string): The IP address of a client.
+// Returns:
+//   string: 64 hexadecimal characters.
+//   error: An error if the salt could not be read from the store.
+func (p *Pseudonymizer) Pseudonym(ip string) (string, error) {
+	candidates, err := p.Candidates(ip)
+	if err != nil {
+		return "", err
+	}
+	return candidates[0], nil
+}
+
+// Candidates returns the pseudonyms an IP address may have been given under the salts still accepted, starting with the
+// current one. The previous salt is only included during the grace window that follows a rotation.
+// Parameters:
+//   ip (string): The IP address of a client.
+// Returns:
+//   []string: One or two pseudonyms.
+//   error: An error if the salts could not be read from the store.
+func (p *Pseudonymizer) Candidates(ip string) ([]string, error) {
+	now := time.Now
+	if p.Now != nil {
+		now = p.Now
+	}
+
+	elapsed := now().UnixNano()
+	epoch := elapsed / int64(p.Period)
+	periods := []int64{epoch}
+	if time.Duration(elapsed%int64(p.Period)) < p.Grace {
+		periods = append(periods, epoch-1)
+	}
+
+	salts, err := p.load(periods)
+	if err != nil {
+		return nil, err
+	}
+
+	address := p.normalize(ip)
+	candidates := make([]string, len(salts))
+	for i, salt := range salts {
+		candidates[i] = p.hash(salt, address)
+	}
+	return candidates, nil
+}
+
+// load returns the salts of the given periods, the oldest one last. Salts are read from the store once and cached, the
+// ones of the periods before the oldest are deleted from the store once per rotation.
+func (p *Pseudonymizer) load(periods []int64) ([][]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// A failure is only logged, the deletion is tried again at the next call
+	if oldest := periods[len(periods)-1]; oldest > p.pruned {
+		if err := p.salts.DeleteSaltsBefore(oldest); err != nil {
+			log.Printf("Error deleting the pseudonym salts no longer accepted: %v", err)
+		} else {
+			p.pruned = oldest
+		}
+		for period := range p.cache {
+			if period < oldest {
+				delete(p.cache, period)
+			}
+		}
+	}
+
+	salts := make([][]byte, len(periods))
+	for i, period := range periods {
+		salt, ok := p.cache[period]
+		if !ok {
+			created := make([]byte, saltSize)
+			if _, err := rand.Read(created); err != nil {
+				return nil, fmt.Errorf("error generating the pseudonym salt: %v", err)
+			}
+
+			// Another instance may have stored the salt of the period first, it is used instead
+			var err error
+			if salt, err = p.salts.GetOrCreateSalt(period, created); err != nil {
+				return nil, fmt.Errorf("error reading the pseudonym salt: %v", err)
+			}
+			p.cache[period] = salt
+		}
+		salts[i] = salt
+	}
+	return salts, nil
+}
+
+// normalize writes an address in a single form, so its different notations get the same pseudonym.
+// Values that are not IP addresses are returned as they are.
+func (p *Pseudonymizer) normalize(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.String()
+	}
+	if p.TruncateIPv6 {
+		return parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return parsed.String()
+}
+
+// hash returns the pseudonym of a normalized address with a salt. The key combines the salt with the secret, so the
+// stored salts alone are not enough to test addresses.
+func (p *Pseudonymizer) hash(salt []byte, address string) string {
+	key := hmac.New(sha256.New, p.secret)
+	key.Write(salt)
+
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write([]byte(address))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Legacy returns the key the versions before pseudonyms gave the user of an IP address: an unsalted SHA-256 of the
+// address as it was received. It is only used to find the users created by these versions until they expire.
+// Parameters:
+//   ip (string): The IP address of a client.
+// Returns:
+//   string: 64 hexadecimal characters.
+func Legacy(ip string) string {
+	sum := sha256.Sum256([]byte(ip))
+	return hex.EncodeToString(sum[:])
+}
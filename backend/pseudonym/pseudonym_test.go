@@ -0,0 +1,308 @@
+package pseudonym_test
+
+import (
+	"errors"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"backend/pseudonym"
+)
+
+const secret = "test-pseudonym-secret"
+
+// saltStore keeps the salts in memory, shared by the pseudonymizers of a test as the database is by the instances.
+type saltStore struct {
+	mu    sync.Mutex
+	salts map[int64][]byte
+	err   error // Returned by every call when set
+}
+
+func newSaltStore() *saltStore {
+	return &saltStore{salts: map[int64][]byte{}}
+}
+
+func (s *saltStore) GetOrCreateSalt(period int64, salt []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+	if stored, ok := s.salts[period]; ok {
+		return stored, nil
+	}
+	s.salts[period] = salt
+	return salt, nil
+}
+
+func (s *saltStore) DeleteSaltsBefore(period int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	for stored := range s.salts {
+		if stored < period {
+			delete(s.salts, stored)
+		}
+	}
+	return nil
+}
+
+// periods returns the number of salts stored.
+func (s *saltStore) periods() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.salts)
+}
+
+// newPseudonymizer creates a pseudonymizer rotating daily with an hour of grace, whose clock is set by the returned function.
+func newPseudonymizer(t *testing.T, salts pseudonym.SaltStore) (*pseudonym.Pseudonymizer, func(time.Time)) {
+	t.Helper()
+
+	p, err := pseudonym.New(secret, 24*time.Hour, time.Hour, salts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var now time.Time
+	p.Now = func() time.Time { return now }
+	return p, func(at time.Time) { now = at }
+}
+
+// mustPseudonym returns the current pseudonym of an address.
+func mustPseudonym(t *testing.T, p *pseudonym.Pseudonymizer, ip string) string {
+	t.Helper()
+
+	value, err := p.Pseudonym(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestRotation(t *testing.T) {
+	p, setClock := newPseudonymizer(t, newSaltStore())
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	setClock(day.Add(2 * time.Hour))
+	first := mustPseudonym(t, p, "192.0.2.1")
+	if !regexp.MustCompile("^[0-9a-f]{64}$").MatchString(first) {
+		t.Fatalf("unexpected pseudonym %q", first)
+	}
+
+	tests := []struct {
+		name       string
+		at         time.Time
+		current    bool // Whether the pseudonym is still first
+		candidates int
+		previous   bool // Whether first is accepted as the previous pseudonym
+	}{
+		{"same period", day.Add(23 * time.Hour), true, 1, false},
+		{"next period, in the grace window", day.Add(24*time.Hour + 30*time.Minute), false, 2, true},
+		{"next period, end of the grace window", day.Add(25*time.Hour - time.Nanosecond), false, 2, true},
+		{"next period, after the grace window", day.Add(25 * time.Hour), false, 1, false},
+		{"two periods later, in the grace window", day.Add(48*time.Hour + time.Minute), false, 2, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setClock(test.at)
+			candidates, err := p.Candidates("192.0.2.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(candidates) != test.candidates {
+				t.Fatalf("got %d candidates, want %d", len(candidates), test.candidates)
+			}
+			if candidates[0] != mustPseudonym(t, p, "192.0.2.1") {
+				t.Error("the current pseudonym is not the first candidate")
+			}
+			if (candidates[0] == first) != test.current {
+				t.Errorf("got the pseudonym of the first period: %v, want %v", candidates[0] == first, test.current)
+			}
+			if previous := len(candidates) == 2 && candidates[1] == first; previous != test.previous {
+				t.Errorf("the pseudonym of the first period is accepted: %v, want %v", previous, test.previous)
+			}
+		})
+	}
+}
+
+func TestPseudonyms(t *testing.T) {
+	salts := newSaltStore()
+	p, setClock := newPseudonymizer(t, salts)
+	setClock(time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC))
+
+	truncating, _ := newPseudonymizer(t, salts)
+	truncating.TruncateIPv6 = true
+	truncating.Now = p.Now
+
+	tests := []struct {
+		name  string
+		p     *pseudonym.Pseudonymizer
+		a, b  string
+		equal bool
+	}{
+		{"same address", p, "192.0.2.1", "192.0.2.1", true},
+		{"other address", p, "192.0.2.1", "192.0.2.2", false},
+		{"IPv4-mapped IPv6", p, "192.0.2.1", "::ffff:192.0.2.1", true},
+		{"IPv6 notations", p, "2001:db8::1", "2001:0db8:0000::0001", true},
+		{"IPv6 in the same /64", p, "2001:db8::1", "2001:db8::2", false},
+		{"IPv6 in the same /64, truncated", truncating, "2001:db8::1", "2001:db8::ffff:2", true},
+		{"IPv6 in another /64, truncated", truncating, "2001:db8::1", "2001:db8:0:1::1", false},
+		{"IPv4 is not truncated", truncating, "192.0.2.1", "192.0.2.2", false},
+	}
+
+	for _, test := range tests {
+		if equal := mustPseudonym(t, test.p, test.a) == mustPseudonym(t, test.p, test.b); equal != test.equal {
+			t.Errorf("%s: got equal pseudonyms %v, want %v", test.name, equal, test.equal)
+		}
+	}
+}
+
+func TestSharedSalts(t *testing.T) {
+	salts := newSaltStore()
+	p, setClock := newPseudonymizer(t, salts)
+	setClock(time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC))
+	want := mustPseudonym(t, p, "192.0.2.1")
+
+	// Instances sharing the secret and the store agree
+	again, _ := newPseudonymizer(t, salts)
+	again.Now = p.Now
+	if got := mustPseudonym(t, again, "192.0.2.1"); got != want {
+		t.Error("two pseudonymizers sharing the salts disagree")
+	}
+
+	// The salts are random: another store gives other pseudonyms
+	elsewhere, _ := newPseudonymizer(t, newSaltStore())
+	elsewhere.Now = p.Now
+	if got := mustPseudonym(t, elsewhere, "192.0.2.1"); got == want {
+		t.Error("two stores give the same pseudonym")
+	}
+
+	// The pseudonyms depend on the secret too
+	other, err := pseudonym.New("another-pseudonym-secret", 24*time.Hour, time.Hour, salts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Now = p.Now
+	if got := mustPseudonym(t, other, "192.0.2.1"); got == want {
+		t.Error("two secrets give the same pseudonym")
+	}
+}
+
+func TestSaltsDeleted(t *testing.T) {
+	salts := newSaltStore()
+	p, setClock := newPseudonymizer(t, salts)
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	setClock(day.Add(12 * time.Hour))
+	first := mustPseudonym(t, p, "192.0.2.1")
+
+	tests := []struct {
+		name  string
+		at    time.Time
+		salts int
+	}{
+		{"in the grace window", day.Add(24*time.Hour + 30*time.Minute), 2},
+		{"after the grace window", day.Add(25 * time.Hour), 1},
+		{"next grace window", day.Add(48*time.Hour + 30*time.Minute), 2},
+	}
+
+	for _, test := range tests {
+		setClock(test.at)
+		mustPseudonym(t, p, "192.0.2.1")
+		if got := salts.periods(); got != test.salts {
+			t.Errorf("%s: got %d salts stored, want %d", test.name, got, test.salts)
+		}
+	}
+
+	// Once its salt is deleted, a pseudonym cannot be computed again, even by an instance knowing the secret
+	again, _ := newPseudonymizer(t, salts)
+	again.Now = func() time.Time { return day.Add(12 * time.Hour) }
+	if mustPseudonym(t, again, "192.0.2.1") == first {
+		t.Error("the pseudonym of a deleted salt was computed again")
+	}
+}
+
+func TestStoreUnavailable(t *testing.T) {
+	salts := newSaltStore()
+	p, setClock := newPseudonymizer(t, salts)
+	day := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	setClock(day.Add(12 * time.Hour))
+	want := mustPseudonym(t, p, "192.0.2.1")
+
+	// The salt of the period is kept in memory
+	salts.err = errors.New("database unavailable")
+	if got, err := p.Pseudonym("192.0.2.1"); err != nil || got != want {
+		t.Errorf("got %q, %v, want the pseudonym of the cached salt", got, err)
+	}
+
+	// The salt of a new period cannot be read
+	setClock(day.Add(36 * time.Hour))
+	if _, err := p.Candidates("192.0.2.1"); err == nil {
+		t.Error("got pseudonyms without their salt")
+	}
+
+	salts.err = nil
+	if _, err := p.Candidates("192.0.2.1"); err != nil {
+		t.Errorf("got %v once the store is back", err)
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	// SHA-256 of "192.0.2.1", the key the versions before pseudonyms gave its user
+	if got := pseudonym.Legacy("192.0.2.1"); got != "37fcff24bf62035b2b08020afc08b4fecd4fcffce57ab23518e3561ff0fe76b9" {
+		t.Errorf("unexpected legacy key %q", got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name          string
+		secret        string
+		period, grace time.Duration
+		valid         bool
+	}{
+		{"valid", secret, 24 * time.Hour, time.Hour, true},
+		{"no grace", secret, time.Hour, 0, true},
+		{"short secret", "too-short", 24 * time.Hour, time.Hour, false},
+		{"no period", secret, 0, 0, false},
+		{"negative grace", secret, time.Hour, -time.Minute, false},
+		{"grace as long as the period", secret, time.Hour, time.Hour, false},
+	}
+
+	for _, test := range tests {
+		if _, err := pseudonym.New(test.secret, test.period, test.grace, newSaltStore()); (err == nil) != test.valid {
+			t.Errorf("%s: got %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		name, secret, encryptionKey string
+		valid                       bool
+	}{
+		{"secret", secret, "", true},
+		{"no secret", "", "", false},
+		// ENCRYPTION_KEY hashes the private IDs, it is not used for the pseudonyms
+		{"encryption key only", "", "test-encryption-key", false},
+		{"short secret", "too-short", "", false},
+	}
+
+	for _, test := range tests {
+		t.Setenv("PSEUDONYM_SECRET", test.secret)
+		t.Setenv("ENCRYPTION_KEY", test.encryptionKey)
+		t.Setenv("PSEUDONYM_ROTATION", "")
+		t.Setenv("PSEUDONYM_GRACE", "")
+		t.Setenv("PSEUDONYM_TRUNCATE_IPV6", "")
+		if _, err := pseudonym.FromEnv(newSaltStore()); (err == nil) != test.valid {
+			t.Errorf("%s: got %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+// Package quarantine holds accepted uploads until they are scanned, so clients do not wait for the malware engines.
+// A pool of workers scans the quarantined files, then moves the clean ones into the storage and marks the infected ones as rejected.
+package quarantine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/db"
+	"backend/scan"
+	"backend/storage"
+	"backend/utils"
+)
+
+const (
+	defaultWorkers = 2
+	queueSize      = 256
+	retryDelay     = time.Minute // Time before a file is scanned again when the scanner is unavailable
+	scanTimeout    = 10 * time.Minute
+	defaultMaxWait = 24 * time.Hour // Time after which a file the scanner could not be reached for is rejected
+)
+
+// Pool scans the files of the quarantine directory with a fixed number of workers.
+// Files are kept under their storage key, so the queue can be rebuilt from the directory after a restart.
+type Pool struct {
+	Dir     string            // Directory holding the files waiting to be scanned
+	Workers int               // Number of files scanned at the same time
+	Scanner scan.Scanner      // Malware engines
+	Storage storage.Storage   // Storage receiving the clean files
+	Files   db.FileRepository // Metadata of the files, where the scan results are recorded
+	Users   db.UserRepository // Users owning the files
+	MaxWait time.Duration     // Time after the upload past which a file is rejected if the scanner still cannot be reached
+
+	jobs chan string     // Storage keys of the files to scan
+	done <-chan struct{} // Closed when the pool stops, set by Start
+}
+
+// FromEnv builds a Pool using the QUARANTINE_PATH, SCAN_WORKERS and SCAN_MAX_WAIT environment variables.
+// Parameters:
+//   defaultDir (string): The quarantine directory used when QUARANTINE_PATH is not set.
+//   scanner (scan.Scanner): The malware engines.
+//   blobs (storage.Storage): The storage receiving the clean files.
+//   files (db.FileRepository): The repository holding the metadata of the files.
+//   users (db.UserRepository): The repository holding the users.
+// Returns:
+//   *Pool: The configured pool, not started yet.
+//   error: An error if SCAN_WORKERS or SCAN_MAX_WAIT is not valid or the directory could not be created.
+func FromEnv(defaultDir string, scanner scan.Scanner, blobs storage.Storage, files db.FileRepository, users db.UserRepository) (*Pool, error) {
+	p := &Pool{
+		Dir:     os.Getenv("QUARANTINE_PATH"),
+		Workers: defaultWorkers,
+		MaxWait: defaultMaxWait,
+		Scanner: scanner,
+		Storage: blobs,
+		Files:   files,
+		Users:   users,
+		jobs:    make(chan string, queueSize),
+	}
+	if p.Dir == "" {
+		p.Dir = defaultDir
+	}
+
+	if value := os.Getenv("SCAN_WORKERS"); value != "" {
+		workers, err := strconv.Atoi(value)
+		if err != nil || workers < 1 {
+			return nil, fmt.Errorf("invalid SCAN_WORKERS %q", value)
+		}
+		p.Workers = workers
+	}
+
+	if value := os.Getenv("SCAN_MAX_WAIT"); value != "" {
+		maxWait, err := utils.ParseDuration(value)
+		if err != nil || maxWait <= 0 {
+			return nil, fmt.Errorf("invalid SCAN_MAX_WAIT %q", value)
+		}
+		p.MaxWait = maxWait
+	}
+
+	if err := os.MkdirAll(p.Dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating quarantine directory: %v", err)
+	}
+
+	return p, nil
+}
+
+// Start queues the files left in quarantine by a previous run and starts the workers, which stop when the context is cancelled.
+// Parameters:
+//   ctx (context.Context): Context that stops the workers when cancelled.
+func (p *Pool) Start(ctx context.Context) {
+	p.done = ctx.Done()
+	for i := 0; i < p.Workers; i++ {
+		go p.work(ctx)
+	}
+
+	err := filepath.WalkDir(p.Dir, func(path_ string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		key, err := filepath.Rel(p.Dir, path_)
+		if err != nil {
+			return err
+		}
+		p.enqueue(filepath.ToSlash(key))
+		return nil
+	})
+	if err != nil {
+		log.Printf("Quarantine: error listing the files left to scan: %v", err)
+	}
+}
+
+// Admit moves a staged file into quarantine and queues it for scanning. Its metadata must already be saved with ScanQuarantined.
+// Parameters:
+//   key (string): The storage key the file gets once found clean.
+//   staged (string): The path of the staged file, moved (or copied then removed) into the quarantine directory.
+// Returns:
+//   error: An error if the file could not be moved.
+func (p *Pool) Admit(key string, staged string) error {
+	target := p.path(key)
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return fmt.Errorf("error creating quarantine directory: %v", err)
+	}
+
+	if err := os.Rename(staged, target); err != nil {
+		// The staging directory may be on another file system
+		if err := copyFile(staged, target); err != nil {
+			return err
+		}
+		os.Remove(staged)
+	}
+
+	p.enqueue(key)
+	return nil
+}
+
+// Discard removes a file from the quarantine without scanning it, once its upload was abandoned. Its metadata must be
+// deleted first, so a worker already holding it drops it too.
+// Parameters:
+//   key (string): The storage key of the file.
+// Returns:
+//   error: An error if the file could not be removed.
+func (p *Pool) Discard(key string) error {
+	if err := os.Remove(p.path(key)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing the quarantined file: %v", err)
+	}
+	return nil
+}
+
+// Holds reports whether a file is waiting to be scanned.
+// Parameters:
+//   key (string): The storage key of the file.
+// Returns:
+//   bool: Returns true if the file is in quarantine.
+func (p *Pool) Holds(key string) bool {
+	_, err := os.Stat(p.path(key))
+	return err == nil
+}
+
+// Usage returns the space used by the files waiting to be scanned, which the storage does not hold yet.
+// Returns:
+//   int64: The total size of the quarantined files in bytes.
+//   error: An error if the quarantine directory could not be read.
+func (p *Pool) Usage() (int64, error) {
+	var total int64
+	err := filepath.WalkDir(p.Dir, func(path_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// The file was scanned while the directory was read
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error measuring the quarantine: %v", err)
+	}
+
+	return total, nil
+}
+
+// path returns the location of a quarantined file.
+func (p *Pool) path(key string) string {
+	return filepath.Join(p.Dir, filepath.FromSlash(key))
+}
+
+// enqueue adds a file to the queue without blocking the caller when the queue is full.
+// Once the pool is stopped the file is left in the directory, where the next Start finds it.
+func (p *Pool) enqueue(key string) {
+	select {
+	case <-p.done:
+		return
+	case p.jobs <- key:
+	default:
+		go func() {
+			select {
+			case p.jobs <- key:
+			case <-p.done:
+			}
+		}()
+	}
+}
+
+// work scans the queued files until the context is cancelled.
+func (p *Pool) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case key := <-p.jobs:
+			p.process(ctx, key)
+		}
+	}
+}
+
+// process scans a quarantined file and records the result.
+// Parameters:
+//   ctx (context.Context): Context of the scan and the storage operations.
+//   key (string): The storage key of the file.
+func (p *Pool) process(ctx context.Context, key string) {
+	quarantined := p.path(key)
+	owner := path.Dir(key)
+	idPublic := strings.Split(path.Base(key), ".")[0]
+
+	// The file may have been deleted or swept while it waited
+	file, err := p.Files.GetFileFromID(idPublic, "public")
+	if err != nil || file.ScanStatus != db.ScanQuarantined {
+		os.Remove(quarantined)
+		return
+	}
+
+	scanCtx, cancel := context.WithTimeout(ctx, scanTimeout)
+	verdict, err := p.Scanner.Scan(scanCtx, quarantined)
+	cancel()
+
+	// Files still quarantined when the pool stops are queued again by the next Start
+	if ctx.Err() != nil {
+		return
+	}
+
+	if errors.Is(err, scan.ErrUnavailable) {
+		if time.Since(file.SavedDate) < p.MaxWait {
+			log.Printf("Quarantine: %s will be scanned again: %v", idPublic, err)
+			time.AfterFunc(retryDelay, func() { p.enqueue(key) })
+			return
+		}
+		log.Printf("Quarantine: rejecting %s, the scanner could not be reached for %v: %v", idPublic, p.MaxWait, err)
+		p.reject(idPublic, quarantined, owner, "")
+		return
+	}
+
+	if err != nil || verdict.Infected {
+		switch {
+		case errors.Is(err, scan.ErrTooLarge):
+			// Uploads are refused above the limit of the scanner, unless the limit configured is larger than the one of clamd
+			log.Printf("Quarantine: rejecting %s, it is too large to be scanned, check CLAMD_MAX_SIZE: %v", idPublic, err)
+		case err != nil:
+			log.Printf("Quarantine: rejecting %s, it could not be scanned: %v", idPublic, err)
+		}
+		p.reject(idPublic, quarantined, owner, verdict.Signature)
+		return
+	}
+
+	if err := storage.PutFile(ctx, p.Storage, key, quarantined); err != nil {
+		log.Printf("Quarantine: error storing %s, it will be tried again: %v", idPublic, err)
+		time.AfterFunc(retryDelay, func() { p.enqueue(key) })
+		return
+	}
+	os.Remove(quarantined)
+
+	if _, err := p.Files.SetScanResult(idPublic, db.ScanAvailable, ""); err != nil {
+		// The file was deleted during its scan, the content stored meanwhile would be left without metadata
+		if errors.Is(err, db.ErrNotFound) {
+			if err := p.Storage.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("Quarantine: error deleting the content of %s, deleted during its scan: %v", idPublic, err)
+			}
+			return
+		}
+		log.Printf("Quarantine: error recording the scan of %s: %v", idPublic, err)
+	}
+
+	// Files quarantined before storage keys were saved are located once stored
+	if file.StorageKey == "" {
+		if _, err := p.Files.SetStorageKey(idPublic, key); err != nil {
+			log.Printf("Quarantine: error recording the storage key of %s: %v", idPublic, err)
+		}
+	}
+
+	if err := p.Users.SyncUser(owner, owner); err != nil {
+		log.Printf("Quarantine: error updating the owner of %s: %v", idPublic, err)
+	}
+}
+
+// reject marks a quarantined file as rejected and deletes its content.
+// Parameters:
+//   idPublic (string): The public ID of the file.
+//   quarantined (string): The path of the file in quarantine.
+//   owner (string): The directory of the owner of the file.
+//   signature (string): The name of the detected threat, empty if the file could not be scanned.
+func (p *Pool) reject(idPublic, quarantined, owner, signature string) {
+	if _, err := p.Files.SetScanResult(idPublic, db.ScanRejected, signature); err != nil {
+		log.Printf("Quarantine: error recording the rejection of %s: %v", idPublic, err)
+		return
+	}
+	os.Remove(quarantined)
+
+	// The rejected file no longer counts in the quota of its owner
+	if err := p.Users.SyncUser(owner, owner); err != nil {
+		log.Printf("Quarantine: error updating the owner of %s: %v", idPublic, err)
+	}
+}
+
+// copyFile copies the file at src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening staged file: %v", err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("error creating quarantined file: %v", err)
+	}
+
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err != nil || closeErr != nil {
+		os.Remove(dst)
+		return fmt.Errorf("error writing quarantined file: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,354 @@
+package quarantine_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"backend/db"
+	"backend/quarantine"
+	"backend/scan"
+	"backend/storage"
+)
+
+// stubScanner answers every scan with the same verdict or error, after waiting for release when it is set.
+type stubScanner struct {
+	verdict scan.Verdict
+	err     error
+	release chan struct{}
+	started chan struct{} // Receives a value when a scan starts, if release is set
+}
+
+func (s *stubScanner) Name() string {
+	return "stub"
+}
+
+func (s *stubScanner) Scan(ctx context.Context, path string) (scan.Verdict, error) {
+	if s.release != nil {
+		s.started <- struct{}{}
+		select {
+		case <-s.release:
+		case <-ctx.Done():
+			return scan.Verdict{}, ctx.Err()
+		}
+	}
+	return s.verdict, s.err
+}
+
+// fixture holds a pool and the stores it works with.
+type fixture struct {
+	pool  *quarantine.Pool
+	blobs storage.Storage
+	store *db.MemoryStore
+}
+
+// newFixture builds a pool, not started, scanning with the given scanner.
+func newFixture(t *testing.T, scanner scan.Scanner) *fixture {
+	t.Helper()
+
+	t.Setenv("QUARANTINE_PATH", "")
+	t.Setenv("SCAN_WORKERS", "")
+	t.Setenv("SCAN_MAX_WAIT", "")
+	blobs, err := storage.NewLocal(filepath.Join(t.TempDir(), "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := db.NewMemoryStore(blobs)
+	pool, err := quarantine.FromEnv(filepath.Join(t.TempDir(), "quarantine"), scanner, blobs, store, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.CreateUser("alice", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	return &fixture{pool: pool, blobs: blobs, store: store}
+}
+
+// start starts the pool until the end of the test.
+func (f *fixture) start(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	f.pool.Start(ctx)
+}
+
+// quarantined saves the metadata of a quarantined file of alice and stages its content.
+// Returns:
+//   string: The storage key of the file.
+//   string: The path of the staged content, to give to Admit.
+func (f *fixture) quarantined(t *testing.T, id string) (string, string) {
+	t.Helper()
+
+	key := storage.Key("alice", id+".txt")
+	file := db.File{Name: id + ".txt", Size: 7, ExpireDate: time.Now().Add(time.Hour), StorageKey: key, ScanStatus: db.ScanQuarantined}
+	if _, err := f.store.SaveMetadata(id, "private-"+id, file); err != nil {
+		t.Fatal(err)
+	}
+	staged := filepath.Join(t.TempDir(), id)
+	if err := os.WriteFile(staged, []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return key, staged
+}
+
+// admit quarantines a file of alice and queues it.
+func (f *fixture) admit(t *testing.T, id string) string {
+	t.Helper()
+
+	key, staged := f.quarantined(t, id)
+	if err := f.pool.Admit(key, staged); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// wait returns the metadata of a file once it left the quarantine.
+func (f *fixture) wait(t *testing.T, id string) db.File {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		file, err := f.store.GetFileFromID(id, "public")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.ScanStatus != db.ScanQuarantined {
+			return file
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s is still quarantined", id)
+	return db.File{}
+}
+
+// stored reports whether the storage holds a key.
+func (f *fixture) stored(t *testing.T, key string) bool {
+	t.Helper()
+
+	objects, err := f.blobs.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range objects {
+		if object.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPool(t *testing.T) {
+	tests := []struct {
+		name      string
+		scanner   *stubScanner
+		maxWait   time.Duration
+		status    string
+		signature string
+		stored    bool
+	}{
+		{name: "clean", scanner: &stubScanner{}, status: db.ScanAvailable, stored: true},
+		{name: "infected", scanner: &stubScanner{verdict: scan.Verdict{Infected: true, Signature: "Eicar"}}, status: db.ScanRejected, signature: "Eicar"},
+		{name: "scan error", scanner: &stubScanner{err: scan.ErrEngine}, status: db.ScanRejected},
+		{name: "too large", scanner: &stubScanner{err: scan.ErrTooLarge}, status: db.ScanRejected},
+		// The upload is older than the time allowed to wait for the scanner
+		{name: "unavailable past the wait", scanner: &stubScanner{err: scan.ErrUnavailable}, maxWait: time.Nanosecond, status: db.ScanRejected},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, test.scanner)
+			if test.maxWait != 0 {
+				f.pool.MaxWait = test.maxWait
+			}
+			f.start(t)
+
+			// More files than workers
+			ids := []string{"f1", "f2", "f3", "f4", "f5"}
+			keys := map[string]string{}
+			for _, id := range ids {
+				keys[id] = f.admit(t, id)
+			}
+
+			for _, id := range ids {
+				file := f.wait(t, id)
+				if file.ScanStatus != test.status || file.ScanSignature != test.signature {
+					t.Errorf("%s: got %q %q, want %q %q", id, file.ScanStatus, file.ScanSignature, test.status, test.signature)
+				}
+				if f.pool.Holds(keys[id]) {
+					t.Errorf("%s is left in quarantine", id)
+				}
+				if got := f.stored(t, keys[id]); got != test.stored {
+					t.Errorf("%s: stored %v, want %v", id, got, test.stored)
+				}
+			}
+
+			// Rejected files no longer count for their owner
+			alice, err := f.store.GetUser("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := len(ids); !test.stored {
+				if alice.FilesNumber != 0 {
+					t.Errorf("alice has %d files, want none", alice.FilesNumber)
+				}
+			} else if alice.FilesNumber != want {
+				t.Errorf("alice has %d files, want %d", alice.FilesNumber, want)
+			}
+		})
+	}
+}
+
+func TestPoolUnavailable(t *testing.T) {
+	scanner := &stubScanner{err: scan.ErrUnavailable, release: make(chan struct{}), started: make(chan struct{}, 1)}
+	f := newFixture(t, scanner)
+	f.start(t)
+	key := f.admit(t, "f1")
+
+	<-scanner.started
+	close(scanner.release)
+
+	// The scan is tried again later, the file waits meanwhile
+	time.Sleep(50 * time.Millisecond)
+	file, err := f.store.GetFileFromID("f1", "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.ScanStatus != db.ScanQuarantined || !f.pool.Holds(key) {
+		t.Errorf("got %q, held %v, want the file still quarantined", file.ScanStatus, f.pool.Holds(key))
+	}
+}
+
+func TestPoolRescan(t *testing.T) {
+	f := newFixture(t, &stubScanner{})
+
+	// Files left in the directory by a previous run, which never queued them
+	var keys []string
+	for _, id := range []string{"f1", "f2"} {
+		key, staged := f.quarantined(t, id)
+		target := filepath.Join(f.pool.Dir, filepath.FromSlash(key))
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(staged, target); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	f.start(t)
+
+	for i, id := range []string{"f1", "f2"} {
+		if file := f.wait(t, id); file.ScanStatus != db.ScanAvailable {
+			t.Errorf("%s: got %q, want %q", id, file.ScanStatus, db.ScanAvailable)
+		}
+		if !f.stored(t, keys[i]) {
+			t.Errorf("%s is not stored", id)
+		}
+	}
+}
+
+func TestPoolDeleted(t *testing.T) {
+	t.Run("before its scan", func(t *testing.T) {
+		f := newFixture(t, &stubScanner{})
+		key, staged := f.quarantined(t, "f1")
+		if _, err := f.store.DeleteFile("private-f1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.pool.Admit(key, staged); err != nil {
+			t.Fatal(err)
+		}
+		f.start(t)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for f.pool.Holds(key) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if f.pool.Holds(key) {
+			t.Error("the file is left in quarantine")
+		}
+		if f.stored(t, key) {
+			t.Error("the file is stored")
+		}
+	})
+
+	t.Run("during its scan", func(t *testing.T) {
+		scanner := &stubScanner{release: make(chan struct{}), started: make(chan struct{}, 1)}
+		f := newFixture(t, scanner)
+		f.start(t)
+		key := f.admit(t, "f1")
+
+		<-scanner.started
+		if _, err := f.store.DeleteFile("private-f1"); err != nil {
+			t.Fatal(err)
+		}
+		close(scanner.release)
+
+		// The content is stored once the scan ends, then deleted since its metadata is gone
+		deadline := time.Now().Add(5 * time.Second)
+		for (f.pool.Holds(key) || f.stored(t, key)) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if f.pool.Holds(key) || f.stored(t, key) {
+			t.Errorf("held %v, stored %v, want the content dropped", f.pool.Holds(key), f.stored(t, key))
+		}
+	})
+}
+
+func TestPoolStopped(t *testing.T) {
+	f := newFixture(t, &stubScanner{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	f.pool.Start(ctx)
+	time.Sleep(10 * time.Millisecond)
+
+	// Past the size of the queue, nothing reads it anymore
+	before := runtime.NumGoroutine()
+	var keys []string
+	for i := 0; i < 300; i++ {
+		keys = append(keys, f.admit(t, fmt.Sprintf("f%03d", i)))
+	}
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Errorf("%d goroutines left waiting for the queue", after-before)
+	}
+
+	// The files stay in the directory for the next start
+	for _, key := range keys {
+		if !f.pool.Holds(key) {
+			t.Fatalf("%s is not held", key)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		workers, maxWait string
+		wantWorkers      int
+		wantMaxWait      time.Duration
+		valid            bool
+	}{
+		{"", "", 2, 24 * time.Hour, true},
+		{"4", "2h", 4, 2 * time.Hour, true},
+		{"", "3d", 2, 72 * time.Hour, true},
+		{"0", "", 0, 0, false},
+		{"many", "", 0, 0, false},
+		{"", "0s", 0, 0, false},
+		{"", "soon", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Setenv("QUARANTINE_PATH", "")
+		t.Setenv("SCAN_WORKERS", test.workers)
+		t.Setenv("SCAN_MAX_WAIT", test.maxWait)
+		p, err := quarantine.FromEnv(t.TempDir(), nil, nil, nil, nil)
+		if (err == nil) != test.valid {
+			t.Errorf("%q %q: got %v, want valid %v", test.workers, test.maxWait, err, test.valid)
+			continue
+		}
+		if err == nil && (p.Workers != test.wantWorkers || p.MaxWait != test.wantMaxWait) {
+			t.Errorf("%q %q: got %d %v, want %d %v", test.workers, test.maxWait, p.Workers, p.MaxWait, test.wantWorkers, test.wantMaxWait)
+		}
+	}
+}
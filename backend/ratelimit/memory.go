@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const sweepInterval = time.Minute
+
+// Memory keeps the buckets in the process memory, each instance of the server then has its own limits.
+type Memory struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// bucket is the state of a token bucket.
+type bucket struct {
+	tokens  float64   // Tokens left at the last update
+	updated time.Time // Date of the last update
+	full    time.Time // Date from which the bucket is full again, when it can be forgotten
+}
+
+// NewMemory creates an empty in-memory store.
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]*bucket{}, now: time.Now}
+}
+
+// Take refills the bucket of a key and takes a token from it.
+// Parameters:
+//   ctx (context.Context): Not used, the buckets are always available.
+//   key (string): The key of the bucket.
+//   limit (Limit): The limit the bucket follows.
+// Returns:
+//   float64: The tokens left in the bucket.
+//   bool: Returns false if the bucket was empty.
+//   error: Always nil.
+func (m *Memory) Take(ctx context.Context, key string, limit Limit) (float64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Requests), updated: now}
+		m.buckets[key] = b
+	}
+
+	b.tokens = limit.refill(b.tokens, now.Sub(b.updated))
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.full = now.Add(limit.until(b.tokens, float64(limit.Requests)))
+
+	return b.tokens, allowed, nil
+}
+
+// sweep forgets the buckets that are full again, which behave like new ones. The caller must hold the lock.
+func (m *Memory) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < sweepInterval {
+		return
+	}
+	m.lastSweep = now
+
+	for key, b := range m.buckets {
+		if !now.Before(b.full) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+var _ Store = (*Memory)(nil)
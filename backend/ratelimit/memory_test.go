@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Limit
+		wantErr bool
+	}{
+		{value: "5/1m", want: Limit{Requests: 5, Period: time.Minute}},
+		{value: " 100 / 1d ", want: Limit{Requests: 100, Period: 24 * time.Hour}},
+		{value: "30/90s", want: Limit{Requests: 30, Period: 90 * time.Second}},
+		{value: "5", wantErr: true},
+		{value: "0/1m", wantErr: true},
+		{value: "-1/1m", wantErr: true},
+		{value: "five/1m", wantErr: true},
+		{value: "5/soon", wantErr: true},
+		{value: "5/0s", wantErr: true},
+	}
+
+	for _, test := range tests {
+		limit, err := ParseLimit(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q was accepted as %+v", test.value, limit)
+			}
+			continue
+		}
+		if err != nil || limit != test.want {
+			t.Errorf("%q: got %+v, %v, want %+v", test.value, limit, err, test.want)
+		}
+	}
+}
+
+func TestMemoryTake(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+	limit := Limit{Requests: 3, Period: time.Minute}
+	ctx := context.Background()
+
+	// The bucket starts full
+	for i, want := range []float64{2, 1, 0} {
+		tokens, allowed, err := m.Take(ctx, "client", limit)
+		if err != nil || !allowed || tokens != want {
+			t.Fatalf("request %d: got %v tokens, allowed %v, %v", i+1, tokens, allowed, err)
+		}
+	}
+	if _, allowed, _ := m.Take(ctx, "client", limit); allowed {
+		t.Fatal("the empty bucket let a request through")
+	}
+
+	// Other clients have their own bucket
+	if tokens, allowed, _ := m.Take(ctx, "other", limit); !allowed || tokens != 2 {
+		t.Errorf("another client: got %v tokens, allowed %v", tokens, allowed)
+	}
+
+	// A token is added every 20 seconds
+	now = now.Add(20 * time.Second)
+	if tokens, allowed, _ := m.Take(ctx, "client", limit); !allowed || tokens != 0 {
+		t.Errorf("after 20s: got %v tokens, allowed %v", tokens, allowed)
+	}
+
+	// Refilled buckets never hold more than the limit, and are forgotten by the next sweep
+	now = now.Add(time.Hour)
+	if tokens, allowed, _ := m.Take(ctx, "client", limit); !allowed || tokens != 2 {
+		t.Errorf("after an hour: got %v tokens, allowed %v", tokens, allowed)
+	}
+	if len(m.buckets) != 1 {
+		t.Errorf("%d buckets are kept, want only the one just used", len(m.buckets))
+	}
+}
@@ -0,0 +1,179 @@
+// Package ratelimit limits the number of requests of each client with token buckets. Every client gets a bucket per
+// class of routes, holding as many tokens as the requests allowed in a period and refilled continuously; a request
+// takes a token and is refused with 429 when the bucket is empty. The buckets are kept in memory, or in Redis when
+// several instances of the server share the limits.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"backend/apierror"
+	"backend/utils"
+)
+
+// Limit is the number of requests allowed in a period, which is also the number of requests that can be made at once.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// ParseLimit reads a limit written as "<requests>/<period>", e.g. "5/1m" or "100/1d".
+func ParseLimit(value string) (Limit, error) {
+	requestsText, periodText, ok := strings.Cut(value, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid limit %q, expected <requests>/<period>", value)
+	}
+
+	requests, err := strconv.Atoi(strings.TrimSpace(requestsText))
+	if err != nil || requests < 1 {
+		return Limit{}, fmt.Errorf("invalid number of requests in %q", value)
+	}
+	period, err := utils.ParseDuration(strings.TrimSpace(periodText))
+	if err != nil || period <= 0 {
+		return Limit{}, fmt.Errorf("invalid period in %q", value)
+	}
+
+	return Limit{Requests: requests, Period: period}, nil
+}
+
+// rate returns the number of tokens added to a bucket per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// refill returns the tokens of a bucket after the given time, capped to its capacity.
+func (l Limit) refill(tokens float64, elapsed time.Duration) float64 {
+	if elapsed > 0 {
+		tokens += elapsed.Seconds() * l.rate()
+	}
+	return math.Min(tokens, float64(l.Requests))
+}
+
+// until returns the time a bucket holding the given tokens needs to hold the wanted ones.
+func (l Limit) until(tokens, wanted float64) time.Duration {
+	if tokens >= wanted {
+		return 0
+	}
+	return time.Duration((wanted - tokens) / l.rate() * float64(time.Second))
+}
+
+// Store keeps the buckets.
+type Store interface {
+	// Take refills the bucket of a key for the time elapsed since it was last used and takes a token from it.
+	// It returns the tokens left and whether a token was available.
+	Take(ctx context.Context, key string, limit Limit) (float64, bool, error)
+}
+
+// Limiter applies the limits of the classes of routes.
+type Limiter struct {
+	Store      Store            // Where the buckets are kept
+	Limits     map[string]Limit // Limits indexed by class, classes without a limit are not limited
+	FailClosed bool             // Whether the requests are refused when the store fails, instead of let through
+}
+
+// FromEnv builds the limiter from RATE_LIMIT_<CLASS> ("<requests>/<period>" or "off") for each class, RATE_LIMIT_BACKEND
+// ("memory" or "redis", default "memory"), RATE_LIMIT_ON_ERROR ("allow" or "deny", default "allow") and, for Redis,
+// REDIS_ADDRESS, REDIS_PASSWORD and REDIS_DB.
+// Parameters:
+//   defaults (map[string]string): The default limit of each class.
+// Returns:
+//   *Limiter: The limiter.
+//   error: An error if a limit or the backend is not valid.
+func FromEnv(defaults map[string]string) (*Limiter, error) {
+	l := &Limiter{Limits: map[string]Limit{}}
+
+	for class, value := range defaults {
+		name := "RATE_LIMIT_" + strings.ToUpper(class)
+		if configured := os.Getenv(name); configured != "" {
+			value = configured
+		}
+		if value == "off" {
+			continue
+		}
+
+		limit, err := ParseLimit(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		l.Limits[class] = limit
+	}
+
+	switch onError := os.Getenv("RATE_LIMIT_ON_ERROR"); onError {
+	case "", "allow":
+	case "deny":
+		l.FailClosed = true
+	default:
+		return nil, fmt.Errorf("invalid RATE_LIMIT_ON_ERROR %q", onError)
+	}
+
+	switch backend := os.Getenv("RATE_LIMIT_BACKEND"); backend {
+	case "", "memory":
+		l.Store = NewMemory()
+	case "redis":
+		redis, err := RedisFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		l.Store = redis
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_BACKEND %q", backend)
+	}
+
+	return l, nil
+}
+
+// Middleware limits the requests of a class of routes. The limit is described in the RateLimit-Policy, RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers of the responses, and refused requests get a Retry-After header.
+// When the store fails the requests are let through, so an unreachable Redis does not stop the service, unless
+// FailClosed is set: they are then answered with an internal error. The errors of the store are logged either way.
+// Parameters:
+//   class (string): The class of the routes, whose limit is in Limits.
+//   identity (func(*gin.Context) string): Returns the key identifying the client of a request.
+// Returns:
+//   gin.HandlerFunc: The middleware, which does nothing if the class has no limit.
+func (l *Limiter) Middleware(class string, identity func(*gin.Context) string) gin.HandlerFunc {
+	limit, ok := l.Limits[class]
+	if !ok {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	return func(c *gin.Context) {
+		tokens, allowed, err := l.Store.Take(c.Request.Context(), class+":"+identity(c), limit)
+		if err != nil && l.FailClosed {
+			apierror.Respond(c, fmt.Errorf("error reading the %s rate limit bucket, refusing the request: %v", class, err))
+			return
+		}
+		if err != nil {
+			log.Printf("Rate limit: error reading the %s bucket of %s, letting the request through: %v", class, c.Request.URL.Path, err)
+			c.Next()
+			return
+		}
+
+		c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Requests, int64(math.Ceil(limit.Period.Seconds()))))
+		c.Header("RateLimit-Limit", strconv.Itoa(limit.Requests))
+		c.Header("RateLimit-Remaining", strconv.Itoa(int(tokens)))
+		c.Header("RateLimit-Reset", strconv.FormatInt(seconds(limit.until(tokens, float64(limit.Requests))), 10))
+
+		if !allowed {
+			c.Header("Retry-After", strconv.FormatInt(seconds(limit.until(tokens, 1)), 10))
+			apierror.Respond(c, apierror.New(apierror.RateLimited, "Too many requests, try again later."))
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// seconds rounds a duration up to whole seconds.
+func seconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
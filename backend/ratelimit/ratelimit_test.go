@@ -0,0 +1,303 @@
+package ratelimit_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"backend/apierror"
+	"backend/ratelimit"
+	"backend/ratelimit/ratelimittest"
+)
+
+// startRedis starts a fake Redis stopped at the end of the test.
+func startRedis(t *testing.T, options ratelimittest.Options) *ratelimittest.Redis {
+	t.Helper()
+
+	server, err := ratelimittest.NewRedis(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+// newRouter serves GET /limited, limited by the "upload" class, and GET /free, without limit. Clients are identified
+// by their Client header.
+func newRouter(store ratelimit.Store, failClosed bool) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	limiter := &ratelimit.Limiter{Store: store, Limits: map[string]ratelimit.Limit{"upload": {Requests: 2, Period: time.Minute}}, FailClosed: failClosed}
+	identity := func(c *gin.Context) string { return c.GetHeader("Client") }
+
+	router := gin.New()
+	ok := func(c *gin.Context) { c.String(http.StatusOK, "ok") }
+	router.GET("/limited", limiter.Middleware("upload", identity), ok)
+	router.GET("/free", limiter.Middleware("download", identity), ok)
+	return router
+}
+
+// get sends a request of a client.
+func get(router *gin.Engine, path, client string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Client", client)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func testMiddleware(t *testing.T, store ratelimit.Store) {
+	router := newRouter(store, false)
+
+	for i, remaining := range []string{"1", "0"} {
+		w := get(router, "/limited", "alice")
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: got %d %s", i+1, w.Code, w.Body)
+		}
+		want := map[string]string{"RateLimit-Policy": "2;w=60", "RateLimit-Limit": "2", "RateLimit-Remaining": remaining}
+		for header, value := range want {
+			if got := w.Header().Get(header); got != value {
+				t.Errorf("request %d: %s is %q, want %q", i+1, header, got, value)
+			}
+		}
+		if w.Header().Get("RateLimit-Reset") == "" || w.Header().Get("Retry-After") != "" {
+			t.Errorf("request %d: unexpected headers %v", i+1, w.Header())
+		}
+	}
+
+	w := get(router, "/limited", "alice")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request over the limit: got %d %s", w.Code, w.Body)
+	}
+	// A token is added every 30 seconds
+	if got := w.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After is %q, want 30", got)
+	}
+	if got := w.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("RateLimit-Remaining is %q, want 0", got)
+	}
+	var envelope apierror.Envelope
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("invalid body %q: %v", w.Body, err)
+	}
+	if envelope.Error.Code != apierror.RateLimited || envelope.Error.Message == "" {
+		t.Errorf("unexpected error %+v", envelope.Error)
+	}
+
+	// The limit is per client and per class
+	if w := get(router, "/limited", "bob"); w.Code != http.StatusOK {
+		t.Errorf("another client: got %d", w.Code)
+	}
+	w = get(router, "/free", "alice")
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("class without limit: got %d with the headers %v", w.Code, w.Header())
+	}
+}
+
+func TestMiddlewareMemory(t *testing.T) {
+	testMiddleware(t, ratelimit.NewMemory())
+}
+
+func TestMiddlewareRedis(t *testing.T) {
+	server := startRedis(t, ratelimittest.Options{})
+	store, err := ratelimit.NewRedis(server.Addr, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testMiddleware(t, store)
+}
+
+func TestMiddlewareStoreFailure(t *testing.T) {
+	server := startRedis(t, ratelimittest.Options{Fail: true})
+	store, err := ratelimit.NewRedis(server.Addr, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		failClosed bool
+		want       int
+	}{
+		{"let through", false, http.StatusOK},
+		{"refused", true, http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		router := newRouter(store, test.failClosed)
+		for i := 0; i < 3; i++ {
+			if w := get(router, "/limited", "alice"); w.Code != test.want {
+				t.Fatalf("%s, request %d: got %d %s, want %d", test.name, i+1, w.Code, w.Body, test.want)
+			}
+		}
+		// Routes without limit do not read the store
+		if w := get(router, "/free", "alice"); w.Code != http.StatusOK {
+			t.Errorf("%s, route without limit: got %d", test.name, w.Code)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	defaults := map[string]string{"upload": "5/1m", "api": "60/1m"}
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		limits     map[string]ratelimit.Limit
+		failClosed bool
+		valid      bool
+	}{
+		{
+			name:   "defaults",
+			limits: map[string]ratelimit.Limit{"upload": {Requests: 5, Period: time.Minute}, "api": {Requests: 60, Period: time.Minute}},
+			valid:  true,
+		},
+		{
+			name:       "configured",
+			env:        map[string]string{"RATE_LIMIT_UPLOAD": "10/1d", "RATE_LIMIT_API": "off", "RATE_LIMIT_ON_ERROR": "deny"},
+			limits:     map[string]ratelimit.Limit{"upload": {Requests: 10, Period: 24 * time.Hour}},
+			failClosed: true,
+			valid:      true,
+		},
+		{
+			name:   "allowed on error",
+			env:    map[string]string{"RATE_LIMIT_ON_ERROR": "allow"},
+			limits: map[string]ratelimit.Limit{"upload": {Requests: 5, Period: time.Minute}, "api": {Requests: 60, Period: time.Minute}},
+			valid:  true,
+		},
+		{name: "invalid limit", env: map[string]string{"RATE_LIMIT_UPLOAD": "many"}},
+		{name: "invalid behaviour on error", env: map[string]string{"RATE_LIMIT_ON_ERROR": "ignore"}},
+		{name: "unknown backend", env: map[string]string{"RATE_LIMIT_BACKEND": "memcached"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"RATE_LIMIT_UPLOAD", "RATE_LIMIT_API", "RATE_LIMIT_ON_ERROR", "RATE_LIMIT_BACKEND"} {
+				t.Setenv(name, test.env[name])
+			}
+
+			limiter, err := ratelimit.FromEnv(defaults)
+			if (err == nil) != test.valid {
+				t.Fatalf("got %v, want valid %v", err, test.valid)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(limiter.Limits, test.limits) || limiter.FailClosed != test.failClosed {
+				t.Errorf("got %+v, fail closed %v, want %+v, %v", limiter.Limits, limiter.FailClosed, test.limits, test.failClosed)
+			}
+		})
+	}
+}
+
+func TestRedisTake(t *testing.T) {
+	server := startRedis(t, ratelimittest.Options{Clock: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)})
+	store, err := ratelimit.NewRedis(server.Addr, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := ratelimit.Limit{Requests: 2, Period: time.Minute}
+	ctx := context.Background()
+
+	for i, want := range []float64{1, 0} {
+		tokens, allowed, err := store.Take(ctx, "client", limit)
+		if err != nil || !allowed || tokens != want {
+			t.Fatalf("request %d: got %v tokens, allowed %v, %v", i+1, tokens, allowed, err)
+		}
+	}
+	if _, allowed, err := store.Take(ctx, "client", limit); err != nil || allowed {
+		t.Fatalf("the empty bucket let a request through: %v", err)
+	}
+
+	// After a restart of Redis the script is sent again
+	server.FlushScripts()
+	server.Advance(30 * time.Second)
+	if tokens, allowed, err := store.Take(ctx, "client", limit); err != nil || !allowed || tokens != 0 {
+		t.Fatalf("after a restart: got %v tokens, allowed %v, %v", tokens, allowed, err)
+	}
+	if server.Evals() != 4 {
+		t.Errorf("%d scripts were run, want 4", server.Evals())
+	}
+
+	// Full buckets expire
+	server.Advance(time.Hour)
+	if server.Buckets() != 0 {
+		t.Errorf("%d buckets did not expire", server.Buckets())
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	server := startRedis(t, ratelimittest.Options{Password: "secret"})
+	limit := ratelimit.Limit{Requests: 2, Period: time.Minute}
+
+	tests := []struct {
+		password string
+		wantErr  bool
+	}{
+		{"secret", false},
+		{"wrong", true},
+		{"", true},
+	}
+	for _, test := range tests {
+		store, err := ratelimit.NewRedis(server.Addr, test.password, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = store.Take(context.Background(), "client", limit)
+		var redisErr ratelimit.RedisError
+		if test.wantErr && !errors.As(err, &redisErr) {
+			t.Errorf("password %q: got %v, want a Redis error", test.password, err)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("password %q: %v", test.password, err)
+		}
+	}
+}
+
+func TestRedisUnreachable(t *testing.T) {
+	server := startRedis(t, ratelimittest.Options{})
+	store, err := ratelimit.NewRedis(server.Addr, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	if _, _, err := store.Take(context.Background(), "client", ratelimit.Limit{Requests: 2, Period: time.Minute}); err == nil {
+		t.Error("the store answered without Redis")
+	}
+}
+
+func TestNewRedis(t *testing.T) {
+	tests := []struct {
+		address, network, want string
+	}{
+		{"localhost:6379", "tcp", "localhost:6379"},
+		{"tcp://redis:6379", "tcp", "redis:6379"},
+		{"unix:/var/run/redis.sock", "unix", "/var/run/redis.sock"},
+		{"/var/run/redis.sock", "unix", "/var/run/redis.sock"},
+	}
+	for _, test := range tests {
+		store, err := ratelimit.NewRedis(test.address, "", 0)
+		if err != nil {
+			t.Errorf("%q: %v", test.address, err)
+			continue
+		}
+		if store.Network != test.network || store.Address != test.want {
+			t.Errorf("%q: got %s %s, want %s %s", test.address, store.Network, store.Address, test.network, test.want)
+		}
+	}
+
+	for _, address := range []string{"redis", "tcp://", "unix:"} {
+		if _, err := ratelimit.NewRedis(address, "", 0); err == nil {
+			t.Errorf("%q: the invalid address was accepted", address)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Package ratelimittest provides a fake Redis server, so the shared rate limits can be exercised without a real Redis.
+package ratelimittest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/ratelimit"
+)
+
+// Redis is a fake Redis answering the commands used by ratelimit.Redis over TCP. EVAL and EVALSHA run the token
+// bucket of the rate limiter script in Go, whatever the script sent; EVALSHA only knows the scripts already sent
+// with EVAL or SCRIPT LOAD, like Redis.
+type Redis struct {
+	Addr string // Address to give to ratelimit.NewRedis, as "tcp://127.0.0.1:port"
+
+	options  Options
+	listener net.Listener
+	mu       sync.Mutex
+	clock    time.Time // Current time of the fake clock, guarded by mu
+	conns    map[net.Conn]bool
+	buckets  map[string]bucket
+	scripts  map[string]bool
+	evals    int
+	wg       sync.WaitGroup
+}
+
+// Options configures a fake Redis. They are fixed before the server accepts connections, so the tests cannot race
+// with the running commands.
+type Options struct {
+	Password string    // Password expected with AUTH, empty if none
+	Fail     bool      // When true, every command is answered with an error
+	Clock    time.Time // Start of a fake clock returned to the scripts and moved with Advance, zero for the real time
+}
+
+// bucket is the hash stored by the script.
+type bucket struct {
+	tokens  float64
+	updated int64     // Milliseconds
+	expires time.Time // Set by PEXPIRE
+}
+
+// NewRedis starts a fake Redis on a random local port.
+// Parameters:
+//   options (Options): The configuration of the server.
+// Returns:
+//   *Redis: The running server, to be stopped with Close.
+//   error: An error if no port could be opened.
+func NewRedis(options Options) (*Redis, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Redis{
+		Addr:     "tcp://" + listener.Addr().String(),
+		options:  options,
+		listener: listener,
+		clock:    options.Clock,
+		conns:    map[net.Conn]bool{},
+		buckets:  map[string]bucket{},
+		scripts:  map[string]bool{},
+	}
+
+	r.wg.Add(1)
+	go r.serve()
+	return r, nil
+}
+
+// Evals returns the number of scripts run.
+func (r *Redis) Evals() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.evals
+}
+
+// Buckets returns the number of buckets that did not expire.
+func (r *Redis) Buckets() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := 0
+	for _, b := range r.buckets {
+		if r.now().Before(b.expires) {
+			count++
+		}
+	}
+	return count
+}
+
+// FlushScripts forgets the cached scripts, as a restart of Redis does.
+func (r *Redis) FlushScripts() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scripts = map[string]bool{}
+}
+
+// Close stops the server and closes the connections, which clients keep open between commands.
+func (r *Redis) Close() error {
+	err := r.listener.Close()
+
+	r.mu.Lock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+	return err
+}
+
+// Advance moves the fake clock forward. It has no effect when the server runs on the real time.
+func (r *Redis) Advance(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.clock.IsZero() {
+		r.clock = r.clock.Add(d)
+	}
+}
+
+// now returns the time of the server. The caller must hold mu.
+func (r *Redis) now() time.Time {
+	if !r.clock.IsZero() {
+		return r.clock
+	}
+	return time.Now()
+}
+
+// serve accepts connections until the listener is closed.
+func (r *Redis) serve() {
+	defer r.wg.Done()
+
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		r.mu.Lock()
+		r.conns[conn] = true
+		r.mu.Unlock()
+
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			defer func() {
+				r.mu.Lock()
+				delete(r.conns, conn)
+				r.mu.Unlock()
+				conn.Close()
+			}()
+			r.handle(conn)
+		}()
+	}
+}
+
+// handle answers the commands of a connection until it is closed.
+func (r *Redis) handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	authenticated := r.options.Password == ""
+
+	for {
+		request, err := ratelimit.ReadReply(reader)
+		if err != nil {
+			return
+		}
+		values, ok := request.([]any)
+		if !ok || len(values) == 0 {
+			conn.Write([]byte("-ERR protocol error\r\n"))
+			return
+		}
+
+		args := make([]string, len(values))
+		for i, value := range values {
+			args[i], _ = value.(string)
+		}
+		name := strings.ToUpper(args[0])
+
+		var reply string
+		switch {
+		case r.options.Fail:
+			reply = "-ERR fake failure\r\n"
+		case name == "AUTH":
+			if len(args) == 2 && args[1] == r.options.Password {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid username-password pair\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case name == "PING":
+			reply = "+PONG\r\n"
+		case name == "SELECT":
+			reply = "+OK\r\n"
+		case name == "SCRIPT" && len(args) == 3 && strings.EqualFold(args[1], "LOAD"):
+			reply = bulk(r.load(args[2]))
+		case name == "EVAL" && len(args) >= 3:
+			r.load(args[1])
+			reply = r.eval(args[2:])
+		case name == "EVALSHA" && len(args) >= 3:
+			r.mu.Lock()
+			known := r.scripts[strings.ToLower(args[1])]
+			r.mu.Unlock()
+			if known {
+				reply = r.eval(args[2:])
+			} else {
+				reply = "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+			}
+		default:
+			reply = fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+		}
+
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// load caches a script and returns its SHA-1.
+func (r *Redis) load(script string) string {
+	sum := sha1.Sum([]byte(script))
+	sha := hex.EncodeToString(sum[:])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scripts[sha] = true
+	return sha
+}
+
+// eval runs the token bucket on "<numkeys> <key> <capacity> <tokens per millisecond>" and returns the encoded reply.
+func (r *Redis) eval(args []string) string {
+	if len(args) != 4 || args[0] != "1" {
+		return "-ERR wrong number of arguments for the rate limiter script\r\n"
+	}
+	capacity, err1 := strconv.ParseFloat(args[2], 64)
+	rate, err2 := strconv.ParseFloat(args[3], 64)
+	if err1 != nil || err2 != nil || rate <= 0 {
+		return "-ERR invalid arguments for the rate limiter script\r\n"
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.evals++
+
+	now := r.now()
+	nowMillis := now.UnixMilli()
+
+	b, ok := r.buckets[args[1]]
+	if !ok || !now.Before(b.expires) {
+		b = bucket{tokens: capacity, updated: nowMillis}
+	}
+	if nowMillis > b.updated {
+		b.tokens = math.Min(capacity, b.tokens+float64(nowMillis-b.updated)*rate)
+	}
+
+	allowed := 0
+	if b.tokens >= 1 {
+		b.tokens--
+		allowed = 1
+	}
+	b.updated = nowMillis
+	b.expires = now.Add(time.Duration(math.Ceil((capacity-b.tokens)/rate)+1000) * time.Millisecond)
+	r.buckets[args[1]] = b
+
+	// Lua writes numbers with 14 significant digits
+	return fmt.Sprintf("*2\r\n:%d\r\n%s", allowed, bulk(strconv.FormatFloat(b.tokens, 'g', 14, 64)))
+}
+
+// bulk encodes a bulk string.
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
@@ -0,0 +1,306 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRedisAddress = "localhost:6379"
+	redisTimeout        = 2 * time.Second // Maximum duration of a call, connection included
+	redisIdleConns      = 8               // Connections kept open between calls
+	redisKeyPrefix      = "moada:ratelimit:"
+)
+
+// takeScript runs the token bucket in Redis, so concurrent requests of every instance update a bucket atomically.
+// The clock of Redis is used, the instances do not need synchronized clocks. The buckets expire once full again.
+const takeScript = `
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(state[1]) or capacity
+local updated = tonumber(state[2]) or now
+if now > updated then
+	tokens = math.min(capacity, tokens + (now - updated) * rate)
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) / rate) + 1000)
+return {allowed, tostring(tokens)}
+`
+
+// TakeScriptSHA is the SHA-1 of the script run by Redis.Take, under which Redis caches it.
+var TakeScriptSHA = func() string {
+	sum := sha1.Sum([]byte(takeScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// RedisError is an error reply of Redis.
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// Redis keeps the buckets in Redis (or a server speaking its protocol, such as Valkey or KeyDB), so that every
+// instance of the server shares them. Redis 5 or later is required.
+type Redis struct {
+	Network  string // "unix" or "tcp"
+	Address  string // Path of the socket or host and port
+	Password string // Password sent with AUTH, empty if none
+	DB       int    // Database selected after connecting
+
+	idle chan *redisConn
+}
+
+// redisConn is a connection to Redis with its buffered reader.
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedis creates a Redis store.
+// Parameters:
+//   address (string): The address of Redis, as "host:port", "tcp://host:port", "unix:/path/to/redis.sock" or a socket path.
+//   password (string): The password, empty if none.
+//   db (int): The database to use.
+// Returns:
+//   *Redis: The store. No connection is made until the first call.
+//   error: An error if the address is not valid.
+func NewRedis(address, password string, db int) (*Redis, error) {
+	r := &Redis{Password: password, DB: db, idle: make(chan *redisConn, redisIdleConns)}
+
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		r.Network, r.Address = "unix", strings.TrimPrefix(strings.TrimPrefix(address, "unix:"), "//")
+	case strings.HasPrefix(address, "tcp://"):
+		r.Network, r.Address = "tcp", strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "/"):
+		r.Network, r.Address = "unix", address
+	default:
+		r.Network, r.Address = "tcp", address
+	}
+
+	if r.Network == "tcp" {
+		if _, _, err := net.SplitHostPort(r.Address); err != nil {
+			return nil, fmt.Errorf("invalid Redis address %q: %v", address, err)
+		}
+	}
+	if r.Address == "" {
+		return nil, fmt.Errorf("invalid Redis address %q", address)
+	}
+
+	return r, nil
+}
+
+// RedisFromEnv creates a Redis store from REDIS_ADDRESS (default "localhost:6379"), REDIS_PASSWORD and REDIS_DB (default 0).
+func RedisFromEnv() (*Redis, error) {
+	address := os.Getenv("REDIS_ADDRESS")
+	if address == "" {
+		address = defaultRedisAddress
+	}
+
+	db := 0
+	if value := os.Getenv("REDIS_DB"); value != "" {
+		var err error
+		if db, err = strconv.Atoi(value); err != nil || db < 0 {
+			return nil, fmt.Errorf("invalid REDIS_DB %q", value)
+		}
+	}
+
+	return NewRedis(address, os.Getenv("REDIS_PASSWORD"), db)
+}
+
+// Take refills the bucket of a key and takes a token from it.
+// Parameters:
+//   ctx (context.Context): Context of the call, which is also limited to two seconds.
+//   key (string): The key of the bucket.
+//   limit (Limit): The limit the bucket follows.
+// Returns:
+//   float64: The tokens left in the bucket.
+//   bool: Returns false if the bucket was empty.
+//   error: An error if Redis could not be reached or failed.
+func (r *Redis) Take(ctx context.Context, key string, limit Limit) (float64, bool, error) {
+	capacity := strconv.Itoa(limit.Requests)
+	perMillisecond := strconv.FormatFloat(limit.rate()/1000, 'g', -1, 64)
+
+	reply, err := r.do(ctx, "EVALSHA", TakeScriptSHA, "1", redisKeyPrefix+key, capacity, perMillisecond)
+	var redisErr RedisError
+	if errors.As(err, &redisErr) && strings.HasPrefix(string(redisErr), "NOSCRIPT") {
+		// The script is not cached yet (or Redis restarted), EVAL caches it
+		reply, err = r.do(ctx, "EVAL", takeScript, "1", redisKeyPrefix+key, capacity, perMillisecond)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	values, ok := reply.([]any)
+	if !ok || len(values) != 2 {
+		return 0, false, fmt.Errorf("unexpected reply from Redis: %v", reply)
+	}
+	allowed, _ := values[0].(int64)
+	tokensText, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(tokensText, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("unexpected reply from Redis: %v", reply)
+	}
+
+	return tokens, allowed == 1, nil
+}
+
+// do sends a command and reads its reply.
+func (r *Redis) do(ctx context.Context, args ...string) (any, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.do(ctx, args...)
+	if err != nil {
+		var redisErr RedisError
+		if !errors.As(err, &redisErr) {
+			// The connection may be in the middle of a reply
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	select {
+	case r.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+// conn returns an idle connection, or opens a new one.
+func (r *Redis) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-r.idle:
+		return conn, nil
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, r.Network, r.Address)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to Redis: %v", err)
+	}
+	conn := &redisConn{Conn: netConn, reader: bufio.NewReader(netConn)}
+
+	if r.Password != "" {
+		if _, err := conn.do(ctx, "AUTH", r.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.DB != 0 {
+		if _, err := conn.do(ctx, "SELECT", strconv.Itoa(r.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// do sends a command as an array of bulk strings and reads its reply, within the deadline of the context.
+func (c *redisConn) do(ctx context.Context, args ...string) (any, error) {
+	deadline := time.Now().Add(redisTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.SetDeadline(deadline)
+
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.Conn, command.String()); err != nil {
+		return nil, fmt.Errorf("error sending the command to Redis: %v", err)
+	}
+
+	return ReadReply(c.reader)
+}
+
+// ReadReply reads a reply of the Redis protocol (RESP2).
+// Parameters:
+//   r (*bufio.Reader): The connection.
+// Returns:
+//   any: A string for simple and bulk strings, an int64 for integers, a []any for arrays and nil for null replies.
+//   error: A RedisError for error replies, or an error if the reply could not be read.
+func ReadReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("error reading the reply of Redis: %v", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply from Redis")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length from Redis: %q", line)
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("error reading the reply of Redis: %v", err)
+		}
+		return string(data[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length from Redis: %q", line)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		values := make([]any, count)
+		for i := range values {
+			if values[i], err = ReadReply(r); err != nil {
+				var redisErr RedisError
+				if !errors.As(err, &redisErr) {
+					return nil, err
+				}
+				values[i] = redisErr
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unexpected reply from Redis: %q", line)
+	}
+}
+
+var _ Store = (*Redis)(nil)
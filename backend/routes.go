@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"backend/openapi"
+	"backend/ratelimit"
+)
+
+// apiV1 is the prefix of the version 1 of the REST API.
+const apiV1 = "/api/v1"
+
+// legacyDeprecation is the date since which the RPC-style routes are deprecated, sent in their Deprecation header.
+var legacyDeprecation = time.Date(2026, time.October, 16, 0, 0, 0, 0, time.UTC)
+
+// routes registers the REST API under /api/v1, then the legacy RPC-style routes, which answer with the same handlers
+// and announce their successor in deprecation headers during the transition. Every route is described in the OpenAPI
+// document served at /openapi.json as it is registered, so the document cannot list a route that is not served.
+// Parameters:
+//   router (*gin.Engine): The router to register the routes on.
+//   limiter (*ratelimit.Limiter): The rate limits of the routes.
+//   sunset (time.Time): The date after which the legacy routes may be removed, zero if it is not decided yet.
+func (s *server) routes(router *gin.Engine, limiter *ratelimit.Limiter, sunset time.Time) {
+	// Clients are told apart by the pseudonym of their address, which is never stored in clear
+	router.Use(s.identifyClient)
+	byClient := func(c *gin.Context) string {
+		return s.clientPseudonyms(c)[0]
+	}
+	uploadLimit := limiter.Middleware("upload", byClient)
+	downloadLimit := limiter.Middleware("download", byClient)
+	apiLimit := limiter.Middleware("api", byClient)
+
+	doc := s.document()
+	root := routeGroup{group: router.Group("/"), doc: doc, sunset: sunset}
+	v1 := routeGroup{group: router.Group(apiV1), doc: doc, sunset: sunset}
+
+	v1.handle(http.MethodPost, "/files", uploadOperation(doc), uploadLimit, s.saveFile)
+	v1.handle(http.MethodGet, "/files/:idPublic", fileDetailsOperation(doc), apiLimit, s.fileDetails)
+	v1.handle(http.MethodGet, "/files/:idPublic/content", downloadOperation(doc), downloadLimit, s.downloadFile)
+	v1.handle(http.MethodDelete, "/files/:idPublic", deleteOperation(doc), apiLimit, tokenInPath, s.deleteFile)
+	v1.handle(http.MethodGet, "/me", userOperation(doc), apiLimit, s.userInfo)
+	v1.handle(http.MethodDelete, "/me", deleteUserOperation(doc), apiLimit, s.deleteUser)
+	v1.handle(http.MethodGet, "/limits", limitsOperation(doc), apiLimit, s.limits)
+
+	// The creation of an upload counts as an upload, its chunks as API requests
+	resumable := func(handle func(method, path string, op *openapi.Operation, handlers ...gin.HandlerFunc)) {
+		handle(http.MethodOptions, "/uploads", uploadOptionsOperation(), s.uploads.Options)
+		handle(http.MethodPost, "/uploads", createUploadOperation(), uploadLimit, s.createUpload, s.uploads.Create)
+		handle(http.MethodHead, "/uploads/:id", uploadOffsetOperation(), apiLimit, s.uploads.Head)
+		handle(http.MethodPatch, "/uploads/:id", appendUploadOperation(doc), apiLimit, s.uploads.Patch)
+		handle(http.MethodDelete, "/uploads/:id", terminateUploadOperation(), apiLimit, s.uploads.Terminate)
+	}
+	resumable(v1.handle)
+	resumable(func(method, path string, op *openapi.Operation, handlers ...gin.HandlerFunc) {
+		root.deprecated(method, path, apiV1+"/uploads", op, handlers...)
+	})
+
+	root.deprecated(http.MethodPost, "/sendFile", apiV1+"/files", uploadOperation(doc), uploadLimit, s.saveFile)
+	root.deprecated(http.MethodPost, "/deleteFile", apiV1+"/files/{idPublic}", inQuery(legacyDeleteOperation(doc), "idPrivate", "idPublic"), apiLimit, s.deleteFile)
+	root.deprecated(http.MethodPost, "/deleteUser", apiV1+"/me", deleteUserOperation(doc), apiLimit, s.deleteUser)
+	root.deprecated(http.MethodGet, "/downloadFile", apiV1+"/files/{idPublic}/content", inQuery(downloadOperation(doc)), downloadLimit, s.downloadFile)
+	root.deprecated(http.MethodGet, "/myInfo", apiV1+"/me", userOperation(doc), apiLimit, s.userInfo)
+	root.deprecated(http.MethodGet, "/fileInfo", apiV1+"/files/{idPublic}", inQuery(fileInfoOperation(doc), "idPublic", "idPrivate"), apiLimit, s.fileInfo)
+
+	// Registered last, the document is complete before it can be requested
+	root.handle(http.MethodGet, "/openapi.json", specOperation(), apiLimit, func(c *gin.Context) {
+		c.JSON(http.StatusOK, doc)
+	})
+}
+
+// tokenInPath reads the segment of DELETE /files/{idPublic} as the owner token when the request has no Authorization
+// header, as the first clients of the route sent it.
+func tokenInPath(c *gin.Context) {
+	if _, ok := bearerToken(c); !ok {
+		for i := range c.Params {
+			if c.Params[i].Key == "idPublic" {
+				c.Params[i].Key = "idPrivate"
+			}
+		}
+	}
+	c.Next()
+}
+
+// routeGroup registers routes on a router group and adds their operations to the OpenAPI document.
+type routeGroup struct {
+	group  *gin.RouterGroup
+	doc    *openapi.Document
+	sunset time.Time // Date after which the deprecated routes may be removed, zero if it is not decided yet
+}
+
+// handle registers a route and describes it.
+// Parameters:
+//   method (string): The HTTP method.
+//   path (string): The path of the route, relative to the group.
+//   op (*openapi.Operation): The description of the route.
+//   handlers (...gin.HandlerFunc): The middlewares and the handler of the route.
+func (r routeGroup) handle(method, path string, op *openapi.Operation, handlers ...gin.HandlerFunc) {
+	r.group.Handle(method, path, handlers...)
+	r.doc.Add(method, strings.TrimSuffix(r.group.BasePath(), "/")+path, op)
+}
+
+// deprecated registers a legacy route, whose responses carry the deprecation headers and whose operation is marked
+// as deprecated.
+// Parameters:
+//   method (string): The HTTP method.
+//   path (string): The path of the route, relative to the group.
+//   successor (string): The path of the route replacing it, with its parameters between braces.
+//   op (*openapi.Operation): The description of the route.
+//   handlers (...gin.HandlerFunc): The middlewares and the handler of the route.
+func (r routeGroup) deprecated(method, path, successor string, op *openapi.Operation, handlers ...gin.HandlerFunc) {
+	handlers = append([]gin.HandlerFunc{deprecated(successor, r.sunset)}, handlers...)
+	r.handle(method, path, legacyOperation(op, successor), handlers...)
+}
+
+// deprecated marks the responses of a legacy route with the Deprecation (RFC 9745) and Sunset (RFC 8594) headers,
+// and links to the route replacing it.
+// Parameters:
+//   successor (string): The path of the route replacing it, with its parameters between braces.
+//   sunset (time.Time): The date after which the route may be removed, zero if it is not decided yet.
+// Returns:
+//   gin.HandlerFunc: The middleware.
+func deprecated(successor string, sunset time.Time) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", fmt.Sprintf("@%d", legacyDeprecation.Unix()))
+		c.Header("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		if !sunset.IsZero() {
+			c.Header("Sunset", sunset.UTC().Format(http.TimeFormat))
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,170 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// FLAC metadata blocks kept by stripFLAC, the others (padding, application data, Vorbis comments, pictures) are dropped.
+var flacKept = map[byte]bool{
+	0: true, // STREAMINFO
+	3: true, // SEEKTABLE
+	5: true, // CUESHEET
+}
+
+// WAV chunks dropped by stripWAV.
+var wavMetadata = map[string]bool{
+	"LIST": true, // INFO tags (artist, comments, software, ...)
+	"id3 ": true,
+	"ID3 ": true,
+	"bext": true, // Broadcast extension (originator, dates)
+	"iXML": true,
+	"_PMX": true, // XMP
+}
+
+// stripMP3 copies an MP3 file without its ID3v2 tags at the start, nor its APEv2 and ID3v1 tags at the end.
+func stripMP3(file *io.SectionReader, w io.Writer) error {
+	start := int64(0)
+	header := make([]byte, 10)
+
+	// Several ID3v2 tags may follow each other
+	for {
+		if _, err := file.ReadAt(header, start); err != nil || string(header[:3]) != "ID3" {
+			break
+		}
+		size := int64(header[6]&0x7f)<<21 | int64(header[7]&0x7f)<<14 | int64(header[8]&0x7f)<<7 | int64(header[9]&0x7f)
+		start += 10 + size
+		if header[5]&0x10 != 0 {
+			start += 10 // Footer
+		}
+	}
+
+	end := file.Size()
+	tag := make([]byte, 3)
+	if end-start >= 128 {
+		if _, err := file.ReadAt(tag, end-128); err == nil && string(tag) == "TAG" {
+			end -= 128
+		}
+	}
+
+	// The APEv2 footer gives the size of the tag, items and footer included, and says whether it has a header
+	footer := make([]byte, 32)
+	if end-start >= 32 {
+		if _, err := file.ReadAt(footer, end-32); err == nil && string(footer[:8]) == "APETAGEX" {
+			size := int64(binary.LittleEndian.Uint32(footer[12:16]))
+			if binary.LittleEndian.Uint32(footer[20:24])&(1<<31) != 0 {
+				size += 32
+			}
+			if size <= end-start {
+				end -= size
+			}
+		}
+	}
+
+	if start >= end {
+		return fmt.Errorf("the MP3 file has no audio")
+	}
+
+	_, err := io.Copy(w, io.NewSectionReader(file, start, end-start))
+	return err
+}
+
+// stripFLAC copies a FLAC file, keeping only the metadata blocks needed to play it.
+func stripFLAC(file *io.SectionReader, w io.Writer) error {
+	magic := make([]byte, 4)
+	if _, err := file.ReadAt(magic, 0); err != nil || string(magic) != "fLaC" {
+		return fmt.Errorf("not a FLAC file")
+	}
+
+	var kept bytes.Buffer
+	var lastHeader int
+	offset := int64(4)
+	for {
+		header := make([]byte, 4)
+		if _, err := file.ReadAt(header, offset); err != nil {
+			return fmt.Errorf("truncated FLAC metadata")
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7f
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+
+		if flacKept[blockType] {
+			lastHeader = kept.Len()
+			kept.Write(header)
+			if _, err := io.Copy(&kept, io.NewSectionReader(file, offset+4, length)); err != nil {
+				return err
+			}
+		}
+
+		offset += 4 + length
+		if last {
+			break
+		}
+	}
+
+	if kept.Len() == 0 || kept.Bytes()[0]&0x7f != 0 {
+		return fmt.Errorf("the FLAC file has no STREAMINFO block")
+	}
+
+	// The last kept block is marked as the last one
+	metadata := kept.Bytes()
+	for i := 0; i < len(metadata); {
+		length := int(metadata[i+1])<<16 | int(metadata[i+2])<<8 | int(metadata[i+3])
+		metadata[i] &= 0x7f
+		i += 4 + length
+	}
+	metadata[lastHeader] |= 0x80
+
+	if _, err := w.Write(magic); err != nil {
+		return err
+	}
+	if _, err := w.Write(metadata); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, io.NewSectionReader(file, offset, file.Size()-offset))
+	return err
+}
+
+// stripWAV copies a WAV file without its tag chunks, updating the size of the RIFF container.
+func stripWAV(file *io.SectionReader, w io.Writer) error {
+	header := make([]byte, 12)
+	if _, err := file.ReadAt(header, 0); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WAVE" {
+		return fmt.Errorf("not a WAV file")
+	}
+
+	type chunk struct {
+		offset, size int64 // Position and size of the chunk, header and padding included
+	}
+
+	var chunks []chunk
+	riffSize := int64(4)
+	end := min(file.Size(), 8+int64(binary.LittleEndian.Uint32(header[4:8])))
+	chunkHeader := make([]byte, 8)
+	for offset := int64(12); offset+8 <= end; {
+		if _, err := file.ReadAt(chunkHeader, offset); err != nil {
+			return fmt.Errorf("truncated WAV file")
+		}
+		size := 8 + int64(binary.LittleEndian.Uint32(chunkHeader[4:]))
+		size += size % 2
+		size = min(size, end-offset)
+
+		if !wavMetadata[string(chunkHeader[:4])] {
+			chunks = append(chunks, chunk{offset, size})
+			riffSize += size
+		}
+		offset += size
+	}
+
+	binary.LittleEndian.PutUint32(header[4:8], uint32(riffSize))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if _, err := io.Copy(w, io.NewSectionReader(file, c.offset, c.size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// mp3Frames stands for the audio frames of an MP3 file.
+var mp3Frames = append([]byte{0xff, 0xfb, 0x90, 0x64}, bytes.Repeat([]byte{0x55}, 413)...)
+
+// id3v2 encodes an ID3v2.4 tag, with a footer when asked.
+func id3v2(payload string, footer bool) []byte {
+	size := len(payload)
+	flags := byte(0)
+	if footer {
+		flags = 0x10
+	}
+	header := []byte{'I', 'D', '3', 4, 0, flags, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	tag := append(header, payload...)
+	if footer {
+		tag = append(tag, '3', 'D', 'I', 4, 0, flags, header[6], header[7], header[8], header[9])
+	}
+	return tag
+}
+
+// id3v1 encodes an ID3v1 tag.
+func id3v1(title string) []byte {
+	tag := make([]byte, 128)
+	copy(tag, "TAG")
+	copy(tag[3:], title)
+	return tag
+}
+
+// apev2 encodes an APEv2 tag with a header and a footer.
+func apev2(item string) []byte {
+	block := func(isHeader bool) []byte {
+		b := make([]byte, 32)
+		copy(b, "APETAGEX")
+		binary.LittleEndian.PutUint32(b[8:], 2000)
+		binary.LittleEndian.PutUint32(b[12:], uint32(len(item)+32)) // Items and footer
+		binary.LittleEndian.PutUint32(b[16:], 1)
+		flags := uint32(1 << 31) // Has a header
+		if isHeader {
+			flags |= 1 << 29
+		}
+		binary.LittleEndian.PutUint32(b[20:], flags)
+		return b
+	}
+	tag := append(block(true), item...)
+	return append(tag, block(false)...)
+}
+
+func TestStripMP3(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts [][]byte
+	}{
+		{"ID3v2", [][]byte{id3v2("TPE1 Jane Doe", false), mp3Frames}},
+		{"ID3v2 with footer", [][]byte{id3v2("TPE1 Jane Doe", true), mp3Frames}},
+		{"several ID3v2", [][]byte{id3v2("TPE1 Jane Doe", false), id3v2("COMM recorded at home", false), mp3Frames}},
+		{"ID3v1", [][]byte{mp3Frames, id3v1("Song by Jane Doe")}},
+		{"APEv2 and ID3v1", [][]byte{id3v2("TPE1 Jane Doe", false), mp3Frames, apev2("Artist\x00Jane Doe"), id3v1("Song by Jane Doe")}},
+		{"no tag", [][]byte{mp3Frames}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stripped, err := stripBytes(t, "audio/mpeg", bytes.Join(test.parts, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stripped, mp3Frames) {
+				t.Errorf("got %d bytes, want the %d bytes of the frames", len(stripped), len(mp3Frames))
+			}
+		})
+	}
+
+	if _, err := stripBytes(t, "audio/mpeg", id3v2("TPE1 Jane Doe", false)); err == nil {
+		t.Error("a file holding only tags was accepted")
+	}
+}
+
+// flacBlock encodes a FLAC metadata block.
+func flacBlock(blockType byte, last bool, data string) []byte {
+	if last {
+		blockType |= 0x80
+	}
+	return append([]byte{blockType, byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+func TestStripFLAC(t *testing.T) {
+	streamInfo := string(bytes.Repeat([]byte{0x11}, 34))
+	seekTable := string(bytes.Repeat([]byte{0x22}, 18))
+	frames := append([]byte{0xff, 0xf8, 0x69, 0x08}, bytes.Repeat([]byte{0x33}, 200)...)
+
+	var input bytes.Buffer
+	input.WriteString("fLaC")
+	input.Write(flacBlock(0, false, streamInfo))
+	input.Write(flacBlock(4, false, "reference libFLAC\x01\x00\x00\x00ARTIST=Jane Doe"))
+	input.Write(flacBlock(3, false, seekTable))
+	input.Write(flacBlock(6, false, "picture of Jane Doe"))
+	input.Write(flacBlock(2, false, "appl data"))
+	input.Write(flacBlock(1, true, "\x00\x00\x00\x00"))
+	input.Write(frames)
+
+	stripped, err := stripBytes(t, "audio/x-flac", input.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last block kept is marked as the last one
+	var want bytes.Buffer
+	want.WriteString("fLaC")
+	want.Write(flacBlock(0, false, streamInfo))
+	want.Write(flacBlock(3, true, seekTable))
+	want.Write(frames)
+	if !bytes.Equal(stripped, want.Bytes()) {
+		t.Errorf("got %q, want %q", stripped[:min(len(stripped), 80)], want.Bytes()[:80])
+	}
+
+	for name, content := range map[string][]byte{
+		"not FLAC":       []byte("OggS"),
+		"no STREAMINFO":  append([]byte("fLaC"), flacBlock(4, true, "ARTIST=Jane Doe")...),
+		"truncated":      append([]byte("fLaC"), flacBlock(0, false, streamInfo)...),
+		"only a comment": append([]byte("fLaC"), flacBlock(4, true, "")...),
+	} {
+		if _, err := stripBytes(t, "audio/x-flac", content); err == nil {
+			t.Errorf("%s: the malformed file was accepted", name)
+		}
+	}
+}
+
+// wavChunk encodes a RIFF chunk, padded to an even size.
+func wavChunk(id, data string) []byte {
+	chunk := binary.LittleEndian.AppendUint32([]byte(id), uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// wavFile encodes a WAV file made of the given chunks.
+func wavFile(chunks ...[]byte) []byte {
+	body := bytes.Join(chunks, nil)
+	file := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)+4))
+	file = append(file, "WAVE"...)
+	return append(file, body...)
+}
+
+func TestStripWAV(t *testing.T) {
+	format := wavChunk("fmt ", "\x01\x00\x01\x00\x44\xac\x00\x00\x88\x58\x01\x00\x02\x00\x10\x00")
+	data := wavChunk("data", string(bytes.Repeat([]byte{0x7f, 0x01}, 100)))
+
+	input := wavFile(
+		format,
+		wavChunk("LIST", "INFOIART\x09\x00\x00\x00Jane Doe"), // Odd size, padded
+		wavChunk("bext", "recorded by Jane Doe"),
+		data,
+		wavChunk("id3 ", string(id3v2("TPE1 Jane Doe", false))),
+		wavChunk("_PMX", "<x:xmpmeta>Jane Doe</x:xmpmeta>"),
+	)
+
+	stripped, err := stripBytes(t, "audio/x-wav", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The size of the RIFF container is updated
+	if want := wavFile(format, data); !bytes.Equal(stripped, want) {
+		t.Errorf("got %q, want %q", stripped[:min(len(stripped), 64)], want[:64])
+	}
+
+	if _, err := stripBytes(t, "audio/x-wav", []byte("RIFF\x04\x00\x00\x00AVI ")); err == nil {
+		t.Error("a RIFF file that is not a WAV file was accepted")
+	}
+}
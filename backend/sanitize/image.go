@@ -0,0 +1,166 @@
+package sanitize
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// JPEG markers read by stripJPEG
+const (
+	jpegSOI   = 0xd8
+	jpegEOI   = 0xd9
+	jpegSOS   = 0xda
+	jpegAPP0  = 0xe0
+	jpegAPP2  = 0xe2
+	jpegAPP14 = 0xee
+	jpegAPP15 = 0xef
+	jpegCOM   = 0xfe
+)
+
+// pngMetadata lists the PNG chunks holding text, EXIF data or a modification date.
+var pngMetadata = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+// stripJPEG copies a JPEG image, dropping the comments and the application segments other than JFIF (APP0),
+// ICC profiles (APP2) and Adobe color information (APP14). EXIF (and its thumbnail), XMP and IPTC are removed.
+// The compressed image data, starting at the first scan, is copied as is.
+func stripJPEG(file *io.SectionReader, w io.Writer) error {
+	r := bufio.NewReader(file)
+
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil || soi[0] != 0xff || soi[1] != jpegSOI {
+		return fmt.Errorf("not a JPEG image")
+	}
+	if _, err := w.Write(soi); err != nil {
+		return err
+	}
+
+	marker := make([]byte, 1)
+	for {
+		// Markers start with 0xff, possibly repeated as fill bytes
+		if _, err := io.ReadFull(r, marker); err != nil {
+			return fmt.Errorf("truncated JPEG image")
+		}
+		if marker[0] != 0xff {
+			return fmt.Errorf("invalid JPEG marker")
+		}
+		for marker[0] == 0xff {
+			if _, err := io.ReadFull(r, marker); err != nil {
+				return fmt.Errorf("truncated JPEG image")
+			}
+		}
+		code := marker[0]
+
+		if code == jpegEOI || (code >= 0xd0 && code <= 0xd7) || code == 0x01 {
+			if _, err := w.Write([]byte{0xff, code}); err != nil {
+				return err
+			}
+			if code == jpegEOI {
+				return nil
+			}
+			continue
+		}
+
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return fmt.Errorf("truncated JPEG image")
+		}
+		segmentSize := int(binary.BigEndian.Uint16(length))
+		if segmentSize < 2 {
+			return fmt.Errorf("invalid JPEG segment length")
+		}
+		payload := make([]byte, segmentSize-2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return fmt.Errorf("truncated JPEG image")
+		}
+
+		if !keepJPEGSegment(code, payload) {
+			continue
+		}
+
+		if _, err := w.Write([]byte{0xff, code}); err != nil {
+			return err
+		}
+		if _, err := w.Write(length); err != nil {
+			return err
+		}
+		if _, err := w.Write(payload); err != nil {
+			return err
+		}
+
+		if code == jpegSOS {
+			_, err := io.Copy(w, r)
+			return err
+		}
+	}
+}
+
+// keepJPEGSegment reports whether a segment is needed to display the image.
+func keepJPEGSegment(code byte, payload []byte) bool {
+	switch {
+	case code == jpegCOM:
+		return false
+	case code == jpegAPP0 || code == jpegAPP14:
+		return true
+	case code == jpegAPP2:
+		return bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+	case code > jpegAPP0 && code <= jpegAPP15:
+		return false
+	}
+	return true
+}
+
+// stripPNG copies a PNG image without its text, EXIF and time chunks, nor anything appended after its end.
+func stripPNG(file *io.SectionReader, w io.Writer) error {
+	r := bufio.NewReader(file)
+
+	signature := make([]byte, 8)
+	if _, err := io.ReadFull(r, signature); err != nil || string(signature) != "\x89PNG\r\n\x1a\n" {
+		return fmt.Errorf("not a PNG image")
+	}
+	if _, err := w.Write(signature); err != nil {
+		return err
+	}
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return fmt.Errorf("truncated PNG image")
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+
+		// Data and CRC
+		chunk := io.LimitReader(r, length+4)
+
+		if pngMetadata[chunkType] {
+			if _, err := io.Copy(io.Discard, chunk); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		written, err := io.Copy(w, chunk)
+		if err != nil {
+			return err
+		}
+		if written != length+4 {
+			return fmt.Errorf("truncated PNG image")
+		}
+
+		if chunkType == "IEND" {
+			return nil
+		}
+	}
+}
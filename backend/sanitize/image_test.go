@@ -0,0 +1,171 @@
+package sanitize
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stripBytes runs Strip on a temporary file holding content and returns the rewritten file.
+func stripBytes(t *testing.T, contentType string, content []byte) ([]byte, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := Strip(path, contentType)
+	if err != nil {
+		return nil, err
+	}
+	stripped, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(stripped)) {
+		t.Errorf("got size %d, the file has %d bytes", size, len(stripped))
+	}
+	return stripped, nil
+}
+
+// testImage returns a small image with distinct pixels.
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 16), 128, 255})
+		}
+	}
+	return img
+}
+
+// jpegSegment encodes a JPEG segment.
+func jpegSegment(code byte, payload string) []byte {
+	segment := []byte{0xff, code, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// pngChunk encodes a PNG chunk with its CRC.
+func pngChunk(chunkType, data string) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE([]byte(chunkType+data)))
+}
+
+func TestStripJPEG(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(), &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	image_ := encoded.Bytes()[2:] // Without SOI
+
+	jfif := jpegSegment(jpegAPP0, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	icc := jpegSegment(jpegAPP2, "ICC_PROFILE\x00\x01\x01profile")
+	adobe := jpegSegment(jpegAPP14, "Adobe\x00\x64\x00\x00\x00\x00\x01")
+
+	var input bytes.Buffer
+	input.Write([]byte{0xff, jpegSOI})
+	input.Write(jfif)
+	input.Write(jpegSegment(0xe1, "Exif\x00\x00MM\x00\x2aGPS 48.8566N 2.3522E"))
+	input.Write(jpegSegment(0xe1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>creator: Jane Doe</x:xmpmeta>"))
+	input.Write(icc)
+	input.Write(jpegSegment(jpegAPP2, "FPXR\x00flashpix by Jane Doe"))
+	input.Write(jpegSegment(0xed, "Photoshop 3.0\x008BIM Jane Doe"))
+	input.Write(adobe)
+	input.Write(jpegSegment(jpegCOM, "taken by Jane Doe"))
+	input.Write(image_)
+
+	stripped, err := stripBytes(t, "image/jpeg", input.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the metadata segments are gone, the image data is copied as it is
+	want := append([]byte{0xff, jpegSOI}, jfif...)
+	want = append(append(append(want, icc...), adobe...), image_...)
+	if !bytes.Equal(stripped, want) {
+		t.Errorf("got %q, want %q", stripped[:min(len(stripped), 64)], want[:64])
+	}
+	for _, leaked := range []string{"Jane Doe", "Exif", "GPS", "8BIM"} {
+		if bytes.Contains(stripped, []byte(leaked)) {
+			t.Errorf("%q is still in the image", leaked)
+		}
+	}
+
+	decoded, err := jpeg.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("the stripped image cannot be decoded: %v", err)
+	}
+	original, _ := jpeg.Decode(bytes.NewReader(encoded.Bytes()))
+	if decoded.Bounds() != original.Bounds() || decoded.At(5, 9) != original.At(5, 9) {
+		t.Error("the pixels of the image changed")
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	original := encoded.Bytes()
+	// The signature and IHDR chunk (8 + 25 bytes) come first, the metadata is inserted after them
+	header, rest := original[:33], original[33:]
+
+	var input bytes.Buffer
+	input.Write(header)
+	input.Write(pngChunk("tEXt", "Author\x00Jane Doe"))
+	input.Write(pngChunk("zTXt", "Comment\x00\x00compressed"))
+	input.Write(pngChunk("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta>Jane Doe</x:xmpmeta>"))
+	input.Write(pngChunk("eXIf", "MM\x00\x2aGPS 48.8566N"))
+	input.Write(pngChunk("tIME", "\x07\xe8\x01\x01\x00\x00\x00"))
+	input.Write(rest)
+	input.WriteString("data appended after IEND by Jane Doe")
+
+	stripped, err := stripBytes(t, "image/png", input.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(stripped, original) {
+		t.Errorf("the stripped image differs from the original one without metadata")
+	}
+	if _, err := png.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("the stripped image cannot be decoded: %v", err)
+	}
+}
+
+func TestStripMalformedImages(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, testImage()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, contentType string
+		content           []byte
+	}{
+		{"JPEG without SOI", "image/jpeg", []byte("GIF89a")},
+		{"truncated JPEG segment", "image/jpeg", []byte{0xff, jpegSOI, 0xff, 0xe1, 0x10, 0x00, 'E'}},
+		{"JPEG without marker", "image/jpeg", []byte{0xff, jpegSOI, 0x12, 0x34}},
+		{"PNG without signature", "image/png", []byte("GIF89a")},
+		{"truncated PNG", "image/png", encoded.Bytes()[:40]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := stripBytes(t, test.contentType, test.content); err == nil {
+				t.Error("the malformed image was accepted")
+			}
+		})
+	}
+}
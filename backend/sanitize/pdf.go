@@ -0,0 +1,195 @@
+package sanitize
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+var (
+	pdfStreamType  = regexp.MustCompile(`/Type\s*/(ObjStm|XRef)\b`)
+	pdfInfoRef     = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+	pdfInfoInline  = regexp.MustCompile(`/Info\s*<<`)
+	pdfMetadataRef = regexp.MustCompile(`/Metadata\s+(\d+)\s+(\d+)\s+R`)
+	pdfFilter      = regexp.MustCompile(`/Filter\s*(/[^\s/<>\[\]()]+|\[[^\]]*\])`)
+)
+
+// stripPDF removes the document information dictionaries (author, creator, producer, dates, ...) and the XMP
+// metadata streams of a PDF. In documents with cross-reference tables, their bytes are overwritten with spaces
+// instead of being removed, so that every offset of the tables stays valid. Documents keeping objects in compressed
+// object streams or cross-reference streams (PDF 1.5 and later) are rewritten by rewritePDF, since their metadata
+// may be compressed out of reach and their binary streams could be mistaken for objects. The whole document is read
+// in memory, its size is bounded by the upload limits.
+func stripPDF(file *io.SectionReader, w io.Writer) error {
+	content := make([]byte, file.Size())
+	if _, err := file.ReadAt(content, 0); err != nil {
+		return fmt.Errorf("error reading the PDF: %v", err)
+	}
+	if !bytes.HasPrefix(content, []byte("%PDF-")) {
+		return fmt.Errorf("not a PDF document")
+	}
+	if pdfStreamType.Match(content) {
+		return rewritePDF(content, w)
+	}
+
+	// Every revision of the trailer may point to its own Info dictionary
+	for _, match := range pdfInfoRef.FindAllSubmatch(content, -1) {
+		for _, start := range findObjects(content, match[1], match[2]) {
+			if start < len(content)-1 && string(content[start:start+2]) == "<<" {
+				blankDictionary(content, start)
+			}
+		}
+	}
+	for _, match := range pdfInfoInline.FindAllIndex(content, -1) {
+		blankDictionary(content, match[1]-2)
+	}
+
+	for _, match := range pdfMetadataRef.FindAllSubmatch(content, -1) {
+		for _, start := range findObjects(content, match[1], match[2]) {
+			blankStream(content, start)
+		}
+	}
+
+	_, err := w.Write(content)
+	return err
+}
+
+// findObjects returns the position of the value of every definition of an indirect object ("<number> <generation> obj").
+func findObjects(content []byte, number, generation []byte) []int {
+	number = bytes.TrimLeft(number, "0")
+	if len(number) == 0 {
+		number = []byte("0")
+	}
+	if _, err := strconv.Atoi(string(number)); err != nil {
+		return nil
+	}
+
+	definition := regexp.MustCompile(`(?:^|[^0-9])0*` + string(number) + `\s+` + string(generation) + `\s+obj\b\s*`)
+
+	var starts []int
+	for _, match := range definition.FindAllIndex(content, -1) {
+		starts = append(starts, match[1])
+	}
+	return starts
+}
+
+// blankDictionary overwrites the entries of the dictionary starting at start with spaces, leaving an empty dictionary.
+// Returns the position following the dictionary, or -1 if it is not terminated.
+func blankDictionary(content []byte, start int) int {
+	end := dictionaryEnd(content, start)
+	if end < 0 {
+		return -1
+	}
+
+	for i := start + 2; i < end-2; i++ {
+		content[i] = ' '
+	}
+	return end
+}
+
+// blankStream overwrites the data of the stream object starting at start with spaces, removing its filter so that
+// the spaces are read as they are.
+func blankStream(content []byte, start int) {
+	if start >= len(content)-1 || string(content[start:start+2]) != "<<" {
+		return
+	}
+
+	end := dictionaryEnd(content, start)
+	if end < 0 {
+		return
+	}
+
+	for _, match := range pdfFilter.FindAllIndex(content[start:end], -1) {
+		for i := start + match[0]; i < start+match[1]; i++ {
+			content[i] = ' '
+		}
+	}
+
+	rest := content[end:]
+	keyword := bytes.Index(rest, []byte("stream"))
+	if keyword < 0 || len(bytes.TrimSpace(rest[:keyword])) > 0 {
+		return
+	}
+
+	dataStart := end + keyword + len("stream")
+	if bytes.HasPrefix(content[dataStart:], []byte("\r\n")) {
+		dataStart += 2
+	} else if bytes.HasPrefix(content[dataStart:], []byte("\n")) {
+		dataStart++
+	}
+
+	dataEnd := bytes.Index(content[dataStart:], []byte("endstream"))
+	if dataEnd < 0 {
+		return
+	}
+	for i := dataStart; i < dataStart+dataEnd; i++ {
+		if content[i] != '\r' && content[i] != '\n' {
+			content[i] = ' '
+		}
+	}
+}
+
+// dictionaryEnd returns the position following the dictionary starting at start ("<<"), skipping nested dictionaries,
+// strings and comments, or -1 if it is not terminated.
+func dictionaryEnd(content []byte, start int) int {
+	depth := 0
+	for i := start; i < len(content); i++ {
+		switch content[i] {
+		case '<':
+			if i+1 < len(content) && content[i+1] == '<' {
+				depth++
+				i++
+			} else {
+				// Hexadecimal string
+				end := bytes.IndexByte(content[i:], '>')
+				if end < 0 {
+					return -1
+				}
+				i += end
+			}
+		case '>':
+			if i+1 < len(content) && content[i+1] == '>' {
+				depth--
+				i++
+				if depth == 0 {
+					return i + 1
+				}
+			}
+		case '(':
+			i = stringEnd(content, i)
+			if i < 0 {
+				return -1
+			}
+		case '%':
+			end := bytes.IndexAny(content[i:], "\r\n")
+			if end < 0 {
+				return -1
+			}
+			i += end
+		}
+	}
+
+	return -1
+}
+
+// stringEnd returns the position of the parenthesis closing the literal string starting at start, or -1.
+func stringEnd(content []byte, start int) int {
+	depth := 0
+	for i := start; i < len(content); i++ {
+		switch content[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
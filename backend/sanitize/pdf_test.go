@@ -0,0 +1,211 @@
+package sanitize
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// classicPDF is a document with a cross-reference table, an Info dictionary and an XMP stream.
+const classicPDF = `%PDF-1.4
+1 0 obj
+<< /Type /Catalog /Pages 2 0 R /Metadata 4 0 R >>
+endobj
+2 0 obj
+<< /Type /Pages /Kids [] /Count 0 >>
+endobj
+3 0 obj
+<< /Author (Jane Doe) /Producer (Secret Writer 1.0) /CreationDate (D:20240101000000Z) >>
+endobj
+4 0 obj
+<< /Type /Metadata /Subtype /XML /Length 40 >>
+stream
+<x:xmpmeta>creator: Jane Doe</x:xmpmeta>
+endstream
+endobj
+xref
+0 5
+0000000000 65535 f
+trailer
+<< /Size 5 /Root 1 0 R /Info 3 0 R >>
+startxref
+0
+%%EOF
+`
+
+// compressedPDF builds a PDF 1.5 document keeping its catalog, page tree and Info dictionary in a compressed object
+// stream, indexed by a cross-reference stream. The catalog points to an XMP stream, and the content stream of the
+// page has an indirect length. When encrypted, the trailer has an Encrypt dictionary.
+func compressedPDF(t *testing.T, encrypted bool) []byte {
+	t.Helper()
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R /Metadata 4 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Author (Jane Doe) /Producer (Secret Writer 1.0) /CreationDate (D:20240101000000Z) >>",
+	}
+	var header, body bytes.Buffer
+	for i, number := range []int{1, 2, 5} {
+		fmt.Fprintf(&header, "%d %d ", number, body.Len())
+		body.WriteString(objects[i] + "\n")
+	}
+	var packed bytes.Buffer
+	z := zlib.NewWriter(&packed)
+	z.Write(header.Bytes())
+	z.Write(body.Bytes())
+	z.Close()
+
+	encrypt := ""
+	if encrypted {
+		encrypt = " /Encrypt << /Filter /Standard /V 1 /R 2 /O <00> /U <00> /P -4 >>"
+	}
+
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.5\n%\xe2\xe3\xcf\xd3\n")
+	pdf.WriteString("3 0 obj\n<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 6 0 R >>\nendobj\n")
+	pdf.WriteString("4 0 obj\n<< /Type /Metadata /Subtype /XML /Length 40 >>\nstream\n<x:xmpmeta>creator: Jane Doe</x:xmpmeta>\nendstream\nendobj\n")
+	pdf.WriteString("6 0 obj\n<< /Length 7 0 R >>\nstream\nBT /F1 12 Tf (Hello) Tj ET\nendstream\nendobj\n")
+	pdf.WriteString("7 0 obj\n26\nendobj\n")
+	fmt.Fprintf(&pdf, "8 0 obj\n<< /Type /ObjStm /N 3 /First %d /Filter /FlateDecode /Length %d >>\nstream\n", header.Len(), packed.Len())
+	pdf.Write(packed.Bytes())
+	pdf.WriteString("\nendstream\nendobj\n")
+	xref := pdf.Len()
+	fmt.Fprintf(&pdf, "9 0 obj\n<< /Type /XRef /Size 10 /W [1 4 2] /Root 1 0 R /Info 5 0 R%s /ID [<01> <01>] /Length 4 >>\nstream\n\x00\x01\xff\x02\nendstream\nendobj\n", encrypt)
+	fmt.Fprintf(&pdf, "startxref\n%d\n%%%%EOF\n", xref)
+	return pdf.Bytes()
+}
+
+// writePDF writes a document to a temporary file and returns its path.
+func writePDF(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "document.pdf")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestStripPDF(t *testing.T) {
+	path := writePDF(t, classicPDF)
+
+	size, err := Strip(path, "application/pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Blanking keeps every offset of the cross-reference table
+	if size != int64(len(classicPDF)) || len(stripped) != len(classicPDF) {
+		t.Errorf("the size changed from %d to %d", len(classicPDF), len(stripped))
+	}
+	for _, leaked := range []string{"Jane Doe", "Secret Writer", "D:2024"} {
+		if bytes.Contains(stripped, []byte(leaked)) {
+			t.Errorf("%q is still in the document", leaked)
+		}
+	}
+	for _, kept := range []string{"/Type /Catalog", "/Info 3 0 R", "3 0 obj\n<<", "endstream", "%%EOF"} {
+		if !bytes.Contains(stripped, []byte(kept)) {
+			t.Errorf("%q was removed from the document", kept)
+		}
+	}
+}
+
+func TestStripCompressedPDF(t *testing.T) {
+	path := writePDF(t, string(compressedPDF(t, false)))
+
+	size, err := Strip(path, "application/pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(stripped)) {
+		t.Errorf("got size %d, the file has %d bytes", size, len(stripped))
+	}
+
+	// The document is rewritten with uncompressed objects, so the metadata would be readable if it was kept
+	for _, leaked := range []string{"Jane Doe", "Secret Writer", "D:2024", "/Info", "/Metadata", "/ObjStm", "/XRef"} {
+		if bytes.Contains(stripped, []byte(leaked)) {
+			t.Errorf("%q is still in the document", leaked)
+		}
+	}
+	for _, kept := range []string{"%PDF-1.5\n", "/Type /Catalog", "/Kids [3 0 R]", "/Length 26 >>\nstream\nBT /F1 12 Tf (Hello) Tj ET\nendstream", "/Root 1 0 R", "/ID [<01> <01>]", "%%EOF"} {
+		if !bytes.Contains(stripped, []byte(kept)) {
+			t.Errorf("%q is missing from the document", kept)
+		}
+	}
+
+	// The new cross-reference table points to the objects kept, the metadata and the length of the content are gone
+	startxref := bytes.LastIndex(stripped, []byte("startxref\n"))
+	var xref int
+	if _, err := fmt.Sscanf(string(stripped[startxref:]), "startxref\n%d", &xref); err != nil || !bytes.HasPrefix(stripped[xref:], []byte("xref\n0 7\n")) {
+		t.Fatalf("startxref does not point to the cross-reference table: %v", err)
+	}
+	entries := strings.Split(string(stripped[xref:]), "\r\n")[1:7]
+	for i, entry := range entries {
+		number := i + 1
+		var offset, generation int
+		var kind string
+		if _, err := fmt.Sscanf(entry, "%d %d %s", &offset, &generation, &kind); err != nil {
+			t.Fatalf("entry %d: invalid %q", number, entry)
+		}
+		if kept := number != 4 && number != 5; kept != (kind == "n") {
+			t.Errorf("entry %d: got %q", number, entry)
+			continue
+		}
+		if want := fmt.Sprintf("%d 0 obj\n", number); kind == "n" && !bytes.HasPrefix(stripped[offset:], []byte(want)) {
+			t.Errorf("entry %d: offset %d points to %q", number, offset, stripped[offset:offset+10])
+		}
+	}
+
+	// The rewritten document has a cross-reference table, it is left as it is when sanitized again
+	if again, err := Strip(path, "application/pdf"); err != nil || again != size {
+		t.Errorf("second pass: got %d bytes, %v", again, err)
+	}
+}
+
+func TestStripPDFRefused(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    error
+	}{
+		{name: "encrypted with object streams", content: string(compressedPDF(t, true)), want: ErrUnsupported},
+		{name: "damaged object stream", content: strings.Replace(string(compressedPDF(t, false)), "/Type /ObjStm /N 3", "/Type /ObjStm /N 9", 1)},
+		{name: "no catalog", content: strings.Replace(string(compressedPDF(t, false)), "/Root 1 0 R", "/Root 12 0 R", 1)},
+		{name: "not a PDF", content: "GIF89a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writePDF(t, test.content)
+
+			_, err := Strip(path, "application/pdf")
+			if err == nil {
+				t.Fatal("the document was accepted")
+			}
+			if test.want != nil && !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+			if test.want == nil && errors.Is(err, ErrUnsupported) {
+				t.Errorf("got %v, want a malformed file error", err)
+			}
+
+			// Refused documents are left untouched
+			if content, _ := os.ReadFile(path); string(content) != test.content {
+				t.Error("the refused document was modified")
+			}
+		})
+	}
+}
@@ -0,0 +1,617 @@
+package sanitize
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+const (
+	maxPDFDepth         = 100              // Maximum nesting of arrays and dictionaries
+	maxObjectStreamSize = 64 * 1024 * 1024 // Maximum size of a decompressed object stream
+)
+
+// pdfDict is a dictionary, whose entries keep their order so the rewritten document looks like the original one.
+type pdfDict []pdfEntry
+
+type pdfEntry struct {
+	Key   string // Name of the key, without the slash and with its escapes as written
+	Value any
+}
+
+// pdfArray is an array of values.
+type pdfArray []any
+
+// pdfName is a name, without the slash and with its escapes as written.
+type pdfName string
+
+// pdfRef is a reference to an indirect object.
+type pdfRef struct {
+	Number, Generation int
+}
+
+// pdfRaw is a value copied as it was written: a number, a string, a boolean or null.
+type pdfRaw []byte
+
+// pdfObject is an indirect object.
+type pdfObject struct {
+	Generation int
+	Value      any
+	Stream     []byte // Data of the stream, nil when the object is not a stream
+	order      int    // Position of the definition, later definitions replace earlier ones
+}
+
+// get returns the value of a key, or nil.
+func (d pdfDict) get(key string) any {
+	for _, entry := range d {
+		if entry.Key == key {
+			return entry.Value
+		}
+	}
+	return nil
+}
+
+// rewritePDF writes a new document holding the objects reachable from the catalog of a PDF, without the document
+// information dictionary and the XMP metadata streams. It reads documents keeping objects in compressed object
+// streams or in cross-reference streams (PDF 1.5 and later), and writes them back with uncompressed objects and a
+// cross-reference table. Object numbers are kept, so encrypted documents stay readable; they are refused with
+// ErrUnsupported when they have object streams, which would have to be decrypted.
+func rewritePDF(content []byte, w io.Writer) error {
+	objects, trailer, err := scanPDF(content)
+	if err != nil {
+		return err
+	}
+
+	if err := expandObjectStreams(objects, trailer.get("Encrypt") != nil); err != nil {
+		return err
+	}
+
+	root, ok := trailer.get("Root").(pdfRef)
+	if !ok {
+		return fmt.Errorf("the PDF has no catalog")
+	}
+	if _, ok := objects[root.Number]; !ok {
+		return fmt.Errorf("the catalog of the PDF is missing")
+	}
+
+	// The new trailer drops Info, and the previous cross-reference sections which no longer exist
+	newTrailer := pdfDict{{Key: "Root", Value: root}}
+	for _, key := range []string{"Encrypt", "ID"} {
+		if value := trailer.get(key); value != nil {
+			newTrailer = append(newTrailer, pdfEntry{Key: key, Value: value})
+		}
+	}
+
+	reachable := reachableObjects(objects, newTrailer)
+
+	var out bytes.Buffer
+	// The header keeps the version of the document, followed by the binary marker
+	header := content[:min(len(content), len("%PDF-1.7"))]
+	out.Write(bytes.TrimRight(header, " \r\n"))
+	out.WriteString("\n%\xe2\xe3\xcf\xd3\n")
+
+	size := 0
+	for _, number := range reachable {
+		size = max(size, number+1)
+	}
+	offsets := make(map[int]int, len(reachable))
+	for _, number := range reachable {
+		object := objects[number]
+		offsets[number] = out.Len()
+
+		fmt.Fprintf(&out, "%d %d obj\n", number, object.Generation)
+		writePDFValue(&out, rewrittenValue(object))
+		if object.Stream != nil {
+			out.WriteString("\nstream\n")
+			out.Write(object.Stream)
+			out.WriteString("\nendstream")
+		}
+		out.WriteString("\nendobj\n")
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f\r\n", size)
+	for number := 1; number < size; number++ {
+		if offset, ok := offsets[number]; ok {
+			fmt.Fprintf(&out, "%010d %05d n\r\n", offset, objects[number].Generation)
+		} else {
+			out.WriteString("0000000000 00000 f\r\n")
+		}
+	}
+	out.WriteString("trailer\n")
+	writePDFValue(&out, append(pdfDict{{Key: "Size", Value: pdfRaw(strconv.Itoa(size))}}, newTrailer...))
+	fmt.Fprintf(&out, "\nstartxref\n%d\n%%%%EOF\n", xref)
+
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+// scanPDF reads the indirect objects of a document in order, and the keys of its trailers, the later ones replacing
+// the earlier ones. The dictionaries of cross-reference streams count as trailers.
+func scanPDF(content []byte) (map[int]*pdfObject, pdfDict, error) {
+	objects := map[int]*pdfObject{}
+	var trailer pdfDict
+	merge := func(dict pdfDict) {
+		for _, entry := range dict {
+			trailer = setKey(trailer, entry.Key, entry.Value)
+		}
+	}
+
+	p := &pdfParser{content: content}
+	for {
+		p.skipSpace()
+		if p.pos >= len(content) {
+			break
+		}
+		start := p.pos
+
+		switch token := p.keyword(); {
+		case token == "xref":
+			// The entries of a cross-reference table are only digits, up to the trailer
+			next := bytes.Index(content[p.pos:], []byte("trailer"))
+			if next < 0 {
+				p.pos = len(content)
+			} else {
+				p.pos += next
+			}
+
+		case token == "trailer":
+			p.skipSpace()
+			value, err := p.value(0)
+			if err != nil {
+				return nil, nil, err
+			}
+			if dict, ok := value.(pdfDict); ok {
+				merge(dict)
+			}
+
+		case isInteger(token):
+			number, _ := strconv.Atoi(token)
+			object, ok, err := p.object()
+			if err != nil {
+				return nil, nil, fmt.Errorf("object %d: %v", number, err)
+			}
+			if !ok {
+				continue
+			}
+			object.order = start
+			objects[number] = object
+
+			if dict, ok := object.Value.(pdfDict); ok && object.Stream != nil && dict.get("Type") == pdfName("XRef") {
+				merge(dict)
+			}
+
+		case token == "":
+			// Stray delimiter
+			p.pos++
+		}
+	}
+
+	if trailer == nil {
+		return nil, nil, fmt.Errorf("the PDF has no trailer")
+	}
+	return objects, trailer, nil
+}
+
+// expandObjectStreams adds the objects stored in the compressed object streams of a document.
+func expandObjectStreams(objects map[int]*pdfObject, encrypted bool) error {
+	var streams []*pdfObject
+	for _, object := range objects {
+		if dict, ok := object.Value.(pdfDict); ok && object.Stream != nil && dict.get("Type") == pdfName("ObjStm") {
+			streams = append(streams, object)
+		}
+	}
+	if len(streams) > 0 && encrypted {
+		return fmt.Errorf("%w: encrypted PDF with object streams", ErrUnsupported)
+	}
+	// Streams are expanded in the order of the file, so the objects of later revisions win
+	sort.Slice(streams, func(i, j int) bool { return streams[i].order < streams[j].order })
+
+	for _, stream := range streams {
+		dict := stream.Value.(pdfDict)
+		data, err := decodeStream(dict, stream.Stream)
+		if err != nil {
+			return err
+		}
+
+		count, ok1 := integer(objects, dict.get("N"))
+		first, ok2 := integer(objects, dict.get("First"))
+		if !ok1 || !ok2 || first < 0 || first > len(data) {
+			return fmt.Errorf("invalid object stream")
+		}
+
+		p := &pdfParser{content: data[:first]}
+		for i := 0; i < count; i++ {
+			p.skipSpace()
+			number, err1 := strconv.Atoi(p.keyword())
+			p.skipSpace()
+			offset, err2 := strconv.Atoi(p.keyword())
+			if err1 != nil || err2 != nil || offset < 0 || first+offset > len(data) {
+				return fmt.Errorf("invalid object stream header")
+			}
+
+			// A direct definition found after the stream belongs to a later revision
+			if existing, ok := objects[number]; ok && existing.order > stream.order {
+				continue
+			}
+
+			value, err := (&pdfParser{content: data, pos: first + offset}).value(0)
+			if err != nil {
+				return fmt.Errorf("object %d: %v", number, err)
+			}
+			objects[number] = &pdfObject{Value: value, order: stream.order}
+		}
+	}
+
+	return nil
+}
+
+// decodeStream returns the data of a stream without its compression. Only Flate without predictor is supported,
+// the filter used by object streams in practice.
+func decodeStream(dict pdfDict, data []byte) ([]byte, error) {
+	filter := dict.get("Filter")
+	if array, ok := filter.(pdfArray); ok && len(array) == 1 {
+		filter = array[0]
+	}
+
+	switch {
+	case filter == nil:
+		return data, nil
+	case filter != pdfName("FlateDecode") || dict.get("DecodeParms") != nil:
+		return nil, fmt.Errorf("%w: object stream with filter %v", ErrUnsupported, filter)
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid object stream: %v", err)
+	}
+	defer r.Close()
+
+	decoded, err := io.ReadAll(io.LimitReader(r, maxObjectStreamSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid object stream: %v", err)
+	}
+	if len(decoded) > maxObjectStreamSize {
+		return nil, fmt.Errorf("%w: object stream larger than %d bytes", ErrUnsupported, maxObjectStreamSize)
+	}
+	return decoded, nil
+}
+
+// reachableObjects returns, in increasing order, the numbers of the objects referenced from the trailer, directly
+// or through other objects. The references found in metadata entries are not followed.
+func reachableObjects(objects map[int]*pdfObject, trailer pdfDict) []int {
+	seen := map[int]bool{}
+	var pending []any
+	pending = append(pending, trailer)
+
+	for len(pending) > 0 {
+		value := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		switch v := value.(type) {
+		case pdfRef:
+			object, ok := objects[v.Number]
+			if !ok || seen[v.Number] {
+				continue
+			}
+			seen[v.Number] = true
+			pending = append(pending, rewrittenValue(object))
+		case pdfDict:
+			for _, entry := range v {
+				if entry.Key != "Metadata" {
+					pending = append(pending, entry.Value)
+				}
+			}
+		case pdfArray:
+			pending = append(pending, v...)
+		}
+	}
+
+	numbers := make([]int, 0, len(seen))
+	for number := range seen {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// writePDFValue writes a value, leaving out the metadata entries of the dictionaries.
+func writePDFValue(w *bytes.Buffer, value any) {
+	switch v := value.(type) {
+	case pdfDict:
+		w.WriteString("<<")
+		for _, entry := range v {
+			if entry.Key == "Metadata" {
+				continue
+			}
+			w.WriteString(" /" + entry.Key + " ")
+			writePDFValue(w, entry.Value)
+		}
+		w.WriteString(" >>")
+	case pdfArray:
+		w.WriteString("[")
+		for i, item := range v {
+			if i > 0 {
+				w.WriteString(" ")
+			}
+			writePDFValue(w, item)
+		}
+		w.WriteString("]")
+	case pdfName:
+		w.WriteString("/" + string(v))
+	case pdfRef:
+		fmt.Fprintf(w, "%d %d R", v.Number, v.Generation)
+	case pdfRaw:
+		w.Write(v)
+	default:
+		w.WriteString("null")
+	}
+}
+
+// rewrittenValue returns the value of an object as it is written back. The Length of streams is written directly,
+// so the objects holding their original length are no longer needed.
+func rewrittenValue(object *pdfObject) any {
+	if object.Stream == nil {
+		return object.Value
+	}
+	dict := append(pdfDict(nil), object.Value.(pdfDict)...)
+	return setKey(dict, "Length", pdfRaw(strconv.Itoa(len(object.Stream))))
+}
+
+// setKey sets the value of a key, adding it when missing.
+func setKey(dict pdfDict, key string, value any) pdfDict {
+	for i := range dict {
+		if dict[i].Key == key {
+			dict[i].Value = value
+			return dict
+		}
+	}
+	return append(dict, pdfEntry{Key: key, Value: value})
+}
+
+// integer returns the value of a direct or indirect integer.
+func integer(objects map[int]*pdfObject, value any) (int, bool) {
+	if ref, ok := value.(pdfRef); ok {
+		object, found := objects[ref.Number]
+		if !found {
+			return 0, false
+		}
+		value = object.Value
+	}
+
+	raw, ok := value.(pdfRaw)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(raw))
+	return n, err == nil
+}
+
+// isInteger reports whether a token is an unsigned integer.
+func isInteger(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, c := range token {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// pdfParser reads the values of a document.
+type pdfParser struct {
+	content []byte
+	pos     int
+}
+
+// isPDFSpace reports whether a byte is white space.
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+// isPDFDelimiter reports whether a byte ends a token.
+func isPDFDelimiter(c byte) bool {
+	return isPDFSpace(c) || bytes.IndexByte([]byte("()<>[]{}/%"), c) >= 0
+}
+
+// skipSpace moves past white space and comments.
+func (p *pdfParser) skipSpace() {
+	for p.pos < len(p.content) {
+		switch c := p.content[p.pos]; {
+		case isPDFSpace(c):
+			p.pos++
+		case c == '%':
+			end := bytes.IndexAny(p.content[p.pos:], "\r\n")
+			if end < 0 {
+				p.pos = len(p.content)
+			} else {
+				p.pos += end
+			}
+		default:
+			return
+		}
+	}
+}
+
+// keyword reads the regular characters up to the next delimiter.
+func (p *pdfParser) keyword() string {
+	start := p.pos
+	for p.pos < len(p.content) && !isPDFDelimiter(p.content[p.pos]) {
+		p.pos++
+	}
+	return string(p.content[start:p.pos])
+}
+
+// object reads the rest of an indirect object definition, after its number. Returns false, with the position
+// unchanged, when the number is not followed by a generation and "obj".
+func (p *pdfParser) object() (*pdfObject, bool, error) {
+	start := p.pos
+	p.skipSpace()
+	generation, err := strconv.Atoi(p.keyword())
+	p.skipSpace()
+	if err != nil || p.keyword() != "obj" {
+		p.pos = start
+		return nil, false, nil
+	}
+
+	p.skipSpace()
+	value, err := p.value(0)
+	if err != nil {
+		return nil, false, err
+	}
+	object := &pdfObject{Generation: generation, Value: value}
+
+	p.skipSpace()
+	if bytes.HasPrefix(p.content[p.pos:], []byte("stream")) {
+		dict, ok := value.(pdfDict)
+		if !ok {
+			return nil, false, fmt.Errorf("stream without dictionary")
+		}
+		p.pos += len("stream")
+		if bytes.HasPrefix(p.content[p.pos:], []byte("\r\n")) {
+			p.pos += 2
+		} else if p.pos < len(p.content) && p.content[p.pos] == '\n' {
+			p.pos++
+		}
+
+		object.Stream, err = p.streamData(dict)
+		if err != nil {
+			return nil, false, err
+		}
+		p.skipSpace()
+	}
+
+	if bytes.HasPrefix(p.content[p.pos:], []byte("endobj")) {
+		p.pos += len("endobj")
+	}
+	return object, true, nil
+}
+
+// streamData reads the data of a stream and moves past "endstream". The Length of the dictionary is trusted when
+// it is direct and ends right before the keyword; otherwise the data ends at the keyword.
+func (p *pdfParser) streamData(dict pdfDict) ([]byte, error) {
+	if raw, ok := dict.get("Length").(pdfRaw); ok {
+		if length, err := strconv.Atoi(string(raw)); err == nil && length >= 0 && p.pos+length <= len(p.content) {
+			rest := bytes.TrimLeft(p.content[p.pos+length:], " \r\n")
+			if bytes.HasPrefix(rest, []byte("endstream")) {
+				data := p.content[p.pos : p.pos+length]
+				p.pos = len(p.content) - len(rest) + len("endstream")
+				return data, nil
+			}
+		}
+	}
+
+	end := bytes.Index(p.content[p.pos:], []byte("endstream"))
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated stream")
+	}
+	data := p.content[p.pos : p.pos+end]
+	// The end of line before the keyword is not part of the data
+	if bytes.HasSuffix(data, []byte("\r\n")) {
+		data = data[:len(data)-2]
+	} else if bytes.HasSuffix(data, []byte("\n")) || bytes.HasSuffix(data, []byte("\r")) {
+		data = data[:len(data)-1]
+	}
+	p.pos += end + len("endstream")
+	return data, nil
+}
+
+// value reads a direct value or a reference.
+func (p *pdfParser) value(depth int) (any, error) {
+	if depth > maxPDFDepth {
+		return nil, fmt.Errorf("values nested too deeply")
+	}
+	if p.pos >= len(p.content) {
+		return nil, fmt.Errorf("truncated value")
+	}
+
+	switch c := p.content[p.pos]; {
+	case bytes.HasPrefix(p.content[p.pos:], []byte("<<")):
+		p.pos += 2
+		var dict pdfDict
+		for {
+			p.skipSpace()
+			if bytes.HasPrefix(p.content[p.pos:], []byte(">>")) {
+				p.pos += 2
+				return dict, nil
+			}
+			if p.pos >= len(p.content) || p.content[p.pos] != '/' {
+				return nil, fmt.Errorf("invalid dictionary key")
+			}
+			p.pos++
+			key := p.keyword()
+			p.skipSpace()
+			value, err := p.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			dict = setKey(dict, key, value)
+		}
+
+	case c == '[':
+		p.pos++
+		array := pdfArray{}
+		for {
+			p.skipSpace()
+			if p.pos < len(p.content) && p.content[p.pos] == ']' {
+				p.pos++
+				return array, nil
+			}
+			value, err := p.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, value)
+		}
+
+	case c == '<':
+		end := bytes.IndexByte(p.content[p.pos:], '>')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		raw := pdfRaw(p.content[p.pos : p.pos+end+1])
+		p.pos += end + 1
+		return raw, nil
+
+	case c == '(':
+		end := stringEnd(p.content, p.pos)
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated string")
+		}
+		raw := pdfRaw(p.content[p.pos : end+1])
+		p.pos = end + 1
+		return raw, nil
+
+	case c == '/':
+		p.pos++
+		return pdfName(p.keyword()), nil
+	}
+
+	token := p.keyword()
+	if token == "" {
+		return nil, fmt.Errorf("unexpected %q", p.content[p.pos])
+	}
+
+	// "<number> <generation> R" is a reference
+	if isInteger(token) {
+		start := p.pos
+		p.skipSpace()
+		generation := p.keyword()
+		p.skipSpace()
+		if isInteger(generation) && p.keyword() == "R" {
+			number, err1 := strconv.Atoi(token)
+			gen, err2 := strconv.Atoi(generation)
+			if err1 == nil && err2 == nil {
+				return pdfRef{Number: number, Generation: gen}, nil
+			}
+		}
+		p.pos = start
+	}
+
+	return pdfRaw(token), nil
+}
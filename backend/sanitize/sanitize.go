@@ -0,0 +1,96 @@
+// Package sanitize removes the metadata embedded in uploaded files (EXIF and XMP in images, the Info dictionary
+// and XMP stream of PDFs, ID3 tags and Vorbis comments in audio), so that sharing a file does not leak where,
+// when or by whom it was made.
+package sanitize
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrUnsupported is returned for well formed files whose metadata cannot be removed safely, such as PDFs keeping their
+// objects in compressed streams.
+var ErrUnsupported = errors.New("the metadata of the file cannot be removed")
+
+// stripper copies a file of a given type to w without its metadata.
+type stripper func(file *io.SectionReader, w io.Writer) error
+
+// strippers lists the supported types, as reported by sniff.Detect.
+var strippers = map[string]stripper{
+	"image/jpeg":      stripJPEG,
+	"image/png":       stripPNG,
+	"audio/mpeg":      stripMP3,
+	"audio/x-flac":    stripFLAC,
+	"audio/x-wav":     stripWAV,
+	"application/pdf": stripPDF,
+}
+
+// Supports reports whether the metadata of a type can be removed.
+// Parameters:
+//   contentType (string): A type returned by sniff.Detect.
+// Returns:
+//   bool: Returns true if Strip handles the type.
+func Supports(contentType string) bool {
+	_, ok := strippers[contentType]
+	return ok
+}
+
+// Strip rewrites a file without its metadata. The file is replaced atomically, and left untouched if it cannot be parsed.
+// Parameters:
+//   path_ (string): The path of the file.
+//   contentType (string): The type of the file, as reported by sniff.Detect.
+// Returns:
+//   int64: The size of the file once rewritten.
+//   error: An error wrapping ErrUnsupported if the metadata of the file cannot be removed safely, or an error if the
+//   type is not supported, the file is malformed or could not be written.
+func Strip(path_ string, contentType string) (int64, error) {
+	strip, ok := strippers[contentType]
+	if !ok {
+		return 0, fmt.Errorf("metadata of %s files cannot be removed", contentType)
+	}
+
+	in, err := os.Open(path_)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// The new file is written next to the original one, so it can replace it with a rename
+	out, err := os.CreateTemp(filepath.Dir(path_), "sanitized_*")
+	if err != nil {
+		return 0, fmt.Errorf("error creating sanitized file: %v", err)
+	}
+	defer os.Remove(out.Name())
+
+	writer := bufio.NewWriter(out)
+	err = strip(io.NewSectionReader(in, 0, info.Size()), writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	closeErr := out.Close()
+	if err != nil {
+		return 0, fmt.Errorf("error removing the metadata: %w", err)
+	}
+	if closeErr != nil {
+		return 0, fmt.Errorf("error writing sanitized file: %v", closeErr)
+	}
+
+	sanitized, err := os.Stat(out.Name())
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(out.Name(), path_); err != nil {
+		return 0, fmt.Errorf("error replacing the file: %v", err)
+	}
+	return sanitized.Size(), nil
+}
@@ -0,0 +1,228 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultClamdTimeout = 2 * time.Minute
+	defaultClamdMaxSize = 25 * 1024 * 1024 // Default StreamMaxLength of clamd
+	clamdChunkSize      = 64 * 1024 // Size of the INSTREAM chunks, below the default StreamMaxLength of clamd
+)
+
+// Clamd scans files with a ClamAV daemon, streaming their content with the INSTREAM command so clamd
+// does not need access to the files themselves.
+type Clamd struct {
+	Network string        // "unix" or "tcp"
+	Address string        // Path of the socket or host and port
+	Timeout time.Duration // Maximum duration of a scan, connection included
+
+	StreamMaxLength int64 // Largest stream accepted by clamd, larger files are not sent. 0 for no limit
+}
+
+// NewClamd creates a clamd client.
+// Parameters:
+//   address (string): The address of clamd, as "unix:/path/to/clamd.ctl", "tcp://host:port", a socket path or "host:port".
+//   timeout (time.Duration): The maximum duration of a scan.
+// Returns:
+//   *Clamd: The client, limited to the default StreamMaxLength of clamd. No connection is made until the first scan.
+//   error: An error if the address is not valid.
+func NewClamd(address string, timeout time.Duration) (*Clamd, error) {
+	c := &Clamd{Timeout: timeout, StreamMaxLength: defaultClamdMaxSize}
+
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		c.Network, c.Address = "unix", strings.TrimPrefix(strings.TrimPrefix(address, "unix:"), "//")
+	case strings.HasPrefix(address, "tcp://"):
+		c.Network, c.Address = "tcp", strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "/"):
+		c.Network, c.Address = "unix", address
+	default:
+		c.Network, c.Address = "tcp", address
+	}
+
+	if c.Network == "tcp" {
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			return nil, fmt.Errorf("invalid clamd address %q: %v", address, err)
+		}
+	}
+	if c.Address == "" {
+		return nil, fmt.Errorf("invalid clamd address %q", address)
+	}
+
+	return c, nil
+}
+
+// Name returns "clamd".
+func (c *Clamd) Name() string {
+	return "clamd"
+}
+
+// MaxSize returns StreamMaxLength.
+func (c *Clamd) MaxSize() int64 {
+	return c.StreamMaxLength
+}
+
+// Ping checks that clamd answers.
+// Parameters:
+//   ctx (context.Context): Context of the check.
+// Returns:
+//   error: An error wrapping ErrUnavailable if clamd does not answer.
+func (c *Clamd) Ping(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("%w: unexpected reply %q", ErrUnavailable, reply)
+	}
+	return nil
+}
+
+// Scan streams the file at path to clamd.
+// Parameters:
+//   ctx (context.Context): Context of the scan.
+//   path (string): The path of the file.
+// Returns:
+//   Verdict: The verdict of clamd, with the name of the signature when the file is infected.
+//   error: An error wrapping ErrUnavailable if clamd cannot be reached, ErrTooLarge if the file is over its size limit,
+//   or ErrEngine if it reported another error.
+func (c *Clamd) Scan(ctx context.Context, path string) (Verdict, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Verdict{}, fmt.Errorf("error opening the file to scan: %v", err)
+	}
+	defer file.Close()
+
+	// Files clamd would refuse are not streamed
+	if info, err := file.Stat(); err == nil && c.StreamMaxLength > 0 && info.Size() > c.StreamMaxLength {
+		return Verdict{}, fmt.Errorf("%w: %d bytes, clamd accepts %d", ErrTooLarge, info.Size(), c.StreamMaxLength)
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer conn.Close()
+
+	// Cancelling the context interrupts the transfer
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	// clamd stops reading and replies with an error when the stream is too long, so the reply is read even if sending failed
+	sendErr := sendStream(conn, file)
+
+	reply, err := readReply(conn)
+	if err != nil {
+		if sendErr != nil {
+			return Verdict{}, fmt.Errorf("%w: %v", ErrUnavailable, sendErr)
+		}
+		return Verdict{}, err
+	}
+
+	return parseReply(reply)
+}
+
+// dial connects to clamd. The connection has a deadline set from the timeout or the deadline of the context, whichever comes first.
+func (c *Clamd) dial(ctx context.Context) (net.Conn, error) {
+	var deadline time.Time
+	if c.Timeout > 0 {
+		deadline = time.Now().Add(c.Timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	if !deadline.IsZero() {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// sendStream sends the INSTREAM command followed by the content of r, as length-prefixed chunks ended by an empty one.
+func sendStream(conn net.Conn, r io.Reader) error {
+	writer := bufio.NewWriterSize(conn, clamdChunkSize+4)
+	if _, err := writer.WriteString("zINSTREAM\x00"); err != nil {
+		return err
+	}
+
+	chunk := make([]byte, clamdChunkSize)
+	length := make([]byte, 4)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(length, uint32(n))
+			if _, err := writer.Write(length); err != nil {
+				return err
+			}
+			if _, err := writer.Write(chunk[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading the file to scan: %v", err)
+		}
+	}
+
+	binary.BigEndian.PutUint32(length, 0)
+	if _, err := writer.Write(length); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// readReply reads a NUL terminated reply of clamd.
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil && (err != io.EOF || len(reply) == 0) {
+		return "", fmt.Errorf("%w: error reading the reply: %v", ErrUnavailable, err)
+	}
+	return string(bytes.TrimRight(reply, "\x00\n")), nil
+}
+
+// parseReply reads a scan reply such as "stream: OK", "stream: Eicar-Signature FOUND" or "... ERROR". The reply to a
+// stream over StreamMaxLength, "INSTREAM size limit exceeded. ERROR", has no "stream: " prefix.
+func parseReply(reply string) (Verdict, error) {
+	_, result, _ := strings.Cut(reply, ": ")
+
+	switch {
+	case result == "OK":
+		return Verdict{Engine: "clamd"}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return Verdict{Infected: true, Signature: strings.TrimSuffix(result, " FOUND"), Engine: "clamd"}, nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return Verdict{}, fmt.Errorf("%w: %s", ErrTooLarge, strings.TrimSuffix(reply, " ERROR"))
+	case strings.HasSuffix(reply, " ERROR"):
+		return Verdict{}, fmt.Errorf("%w: %s", ErrEngine, strings.TrimSuffix(reply, " ERROR"))
+	default:
+		return Verdict{}, fmt.Errorf("%w: unexpected reply %q", ErrEngine, reply)
+	}
+}
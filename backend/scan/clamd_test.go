@@ -0,0 +1,184 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/scan/scantest"
+)
+
+// startClamd starts a fake clamd detecting EICAR and returns a client of it.
+func startClamd(t *testing.T) (*scantest.Clamd, *Clamd) {
+	t.Helper()
+
+	server, err := scantest.NewClamd(scantest.EICAR())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	client, err := NewClamd(server.Addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+// writeFile writes a file to scan in a temporary directory and returns its path.
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "scanned")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestClamdScan(t *testing.T) {
+	eicar := `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+	// Larger than a chunk, so the stream is sent in several of them
+	large := strings.Repeat("a", 3*clamdChunkSize/2)
+
+	tests := []struct {
+		name    string
+		content string
+		setup   func(*scantest.Clamd)
+		want    Verdict
+		wantErr error
+	}{
+		{name: "clean", content: "a harmless text", want: Verdict{Engine: "clamd"}},
+		{name: "empty", content: "", want: Verdict{Engine: "clamd"}},
+		{name: "clean in several chunks", content: large, want: Verdict{Engine: "clamd"}},
+		{name: "found", content: eicar, want: Verdict{Infected: true, Signature: "Eicar-Signature", Engine: "clamd"}},
+		{name: "found across chunks", content: large[:clamdChunkSize-10] + eicar, want: Verdict{Infected: true, Signature: "Eicar-Signature", Engine: "clamd"}},
+		{name: "engine error", content: "a harmless text", setup: func(c *scantest.Clamd) { c.Fail = true }, wantErr: ErrEngine},
+		{name: "size limit", content: large, setup: func(c *scantest.Clamd) { c.MaxStreamSize = clamdChunkSize }, wantErr: ErrTooLarge},
+		{name: "connection drop", content: "a harmless text", setup: func(c *scantest.Clamd) { c.Drop = true }, wantErr: ErrUnavailable},
+		{name: "connection drop in a large stream", content: large, setup: func(c *scantest.Clamd) { c.Drop = true }, wantErr: ErrUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, client := startClamd(t)
+			if test.setup != nil {
+				test.setup(server)
+			}
+
+			verdict, err := client.Scan(context.Background(), writeFile(t, test.content))
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got %v, %v, want the error %v", verdict, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if verdict != test.want {
+				t.Errorf("got %+v, want %+v", verdict, test.want)
+			}
+			if server.Scans() != 1 {
+				t.Errorf("clamd received %d scans, want 1", server.Scans())
+			}
+		})
+	}
+}
+
+func TestClamdMaxSize(t *testing.T) {
+	server, client := startClamd(t)
+	client.StreamMaxLength = 16
+
+	// Files over the limit are refused without being sent
+	if _, err := client.Scan(context.Background(), writeFile(t, strings.Repeat("a", 17))); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("got %v, want ErrTooLarge", err)
+	}
+	if server.Scans() != 0 {
+		t.Errorf("clamd received %d scans, want 0", server.Scans())
+	}
+
+	if _, err := client.Scan(context.Background(), writeFile(t, strings.Repeat("a", 16))); err != nil {
+		t.Errorf("a file at the limit: %v", err)
+	}
+}
+
+func TestClamdUnavailable(t *testing.T) {
+	server, client := startClamd(t)
+	server.Close()
+
+	if err := client.Ping(context.Background()); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Ping: got %v, want ErrUnavailable", err)
+	}
+	if _, err := client.Scan(context.Background(), writeFile(t, "a harmless text")); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Scan: got %v, want ErrUnavailable", err)
+	}
+}
+
+func TestClamdPing(t *testing.T) {
+	_, client := startClamd(t)
+
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	tests := []struct {
+		reply   string
+		want    Verdict
+		wantErr error
+	}{
+		{reply: "stream: OK", want: Verdict{Engine: "clamd"}},
+		{reply: "stream: Win.Test.EICAR_HDB-1 FOUND", want: Verdict{Infected: true, Signature: "Win.Test.EICAR_HDB-1", Engine: "clamd"}},
+		{reply: "INSTREAM size limit exceeded. ERROR", wantErr: ErrTooLarge},
+		{reply: "stream: Can't allocate memory ERROR", wantErr: ErrEngine},
+		{reply: "UNKNOWN COMMAND", wantErr: ErrEngine},
+		{reply: "", wantErr: ErrEngine},
+	}
+
+	for _, test := range tests {
+		verdict, err := parseReply(test.reply)
+		if test.wantErr != nil {
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("%q: got %v, %v, want the error %v", test.reply, verdict, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || verdict != test.want {
+			t.Errorf("%q: got %+v, %v, want %+v", test.reply, verdict, err, test.want)
+		}
+	}
+}
+
+func TestNewClamd(t *testing.T) {
+	tests := []struct {
+		address, network, want string
+	}{
+		{"unix:/var/run/clamav/clamd.ctl", "unix", "/var/run/clamav/clamd.ctl"},
+		{"unix:///var/run/clamav/clamd.ctl", "unix", "/var/run/clamav/clamd.ctl"},
+		{"/tmp/clamd.sock", "unix", "/tmp/clamd.sock"},
+		{"tcp://clamav:3310", "tcp", "clamav:3310"},
+		{"clamav:3310", "tcp", "clamav:3310"},
+	}
+	for _, test := range tests {
+		c, err := NewClamd(test.address, time.Second)
+		if err != nil {
+			t.Errorf("%q: %v", test.address, err)
+			continue
+		}
+		if c.Network != test.network || c.Address != test.want {
+			t.Errorf("%q: got %s %s, want %s %s", test.address, c.Network, c.Address, test.network, test.want)
+		}
+	}
+
+	for _, address := range []string{"clamav", "tcp://", "unix:"} {
+		if _, err := NewClamd(address, time.Second); err == nil {
+			t.Errorf("%q: the invalid address was accepted", address)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// Package scan checks uploaded files for malware with one or more engines (ClamAV, YARA rules), combining their verdicts.
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrUnavailable is returned when an engine cannot be reached, the file may be scanned again later.
+	ErrUnavailable = errors.New("scanner unavailable")
+	// ErrEngine is returned when an engine was reached but could not scan the file.
+	ErrEngine = errors.New("scanner could not scan the file")
+	// ErrTooLarge is returned when the file is over the size limit of an engine, which did not scan it.
+	ErrTooLarge = errors.New("file too large for the scanner")
+)
+
+const defaultClamdAddress = "unix:/var/run/clamav/clamd.ctl"
+
+// Verdict is the result of a scan.
+type Verdict struct {
+	Infected  bool   // True if the file is considered malicious
+	Signature string // Name of the detected threat, empty for clean files
+	Engine    string // Name of the engine that produced the verdict
+}
+
+// Scanner is implemented by every malware scanning engine.
+type Scanner interface {
+	// Name returns the name of the engine, reported in the verdicts.
+	Name() string
+	// Scan reads the file at path and reports whether it is infected.
+	Scan(ctx context.Context, path string) (Verdict, error)
+}
+
+// Limited is implemented by the engines that cannot scan files over a given size.
+type Limited interface {
+	// MaxSize returns the size of the largest file the engine can scan, 0 if there is no limit.
+	MaxSize() int64
+}
+
+// MaxSize returns the size of the largest file scanner can scan, 0 if there is no limit.
+// Parameters:
+//   scanner (Scanner): The scanner.
+// Returns:
+//   int64: The limit of the scanner if it implements Limited, 0 otherwise.
+func MaxSize(scanner Scanner) int64 {
+	if limited, ok := scanner.(Limited); ok {
+		return limited.MaxSize()
+	}
+	return 0
+}
+
+// Policy decides how the verdicts of several engines are combined.
+type Policy string
+
+const (
+	Any      Policy = "any"      // The file is infected if one engine says so
+	All      Policy = "all"      // The file is infected only if every engine says so
+	Majority Policy = "majority" // The file is infected if more than half of the engines say so
+)
+
+// Multi runs several engines on the same file and combines their verdicts with a policy.
+type Multi struct {
+	Engines   []Scanner // Engines run on each file, in order
+	Policy    Policy    // How the verdicts are combined
+	FailOpen  bool      // When true, failing engines are ignored as long as one engine scanned the file
+	SkipLarge bool      // When true, engines are skipped for the files over their size limit, which are accepted unscanned if no engine can scan them
+}
+
+// Name returns the names of the engines, joined with "+".
+func (m *Multi) Name() string {
+	names := make([]string, len(m.Engines))
+	for i, engine := range m.Engines {
+		names[i] = engine.Name()
+	}
+	return strings.Join(names, "+")
+}
+
+// MaxSize returns the smallest size limit of the engines, so larger files can be refused before being scanned.
+// Returns:
+//   int64: The limit, 0 if no engine has one or SkipLarge is set.
+func (m *Multi) MaxSize() int64 {
+	if m.SkipLarge {
+		return 0
+	}
+
+	var limit int64
+	for _, engine := range m.Engines {
+		if size := MaxSize(engine); size > 0 && (limit == 0 || size < limit) {
+			limit = size
+		}
+	}
+	return limit
+}
+
+// Scan runs every engine and combines their verdicts.
+// Parameters:
+//   ctx (context.Context): Context of the scan.
+//   path (string): The path of the file.
+// Returns:
+//   Verdict: The combined verdict, with the signature and engine of the first detection.
+//   error: The error of the first failing engine, unless FailOpen is set and another engine succeeded.
+//   Engines skipped with SkipLarge do not fail nor count as having scanned the file.
+func (m *Multi) Scan(ctx context.Context, path string) (Verdict, error) {
+	var detection Verdict
+	var firstErr error
+	scanned, infected := 0, 0
+
+	for _, engine := range m.Engines {
+		verdict, err := engine.Scan(ctx, path)
+		if err != nil && m.SkipLarge && errors.Is(err, ErrTooLarge) {
+			continue
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", engine.Name(), err)
+			}
+			continue
+		}
+
+		scanned++
+		if verdict.Infected {
+			infected++
+			if detection.Engine == "" {
+				detection = verdict
+			}
+		}
+	}
+
+	if firstErr != nil && (!m.FailOpen || scanned == 0) {
+		return Verdict{}, firstErr
+	}
+
+	var isInfected bool
+	switch m.Policy {
+	case All:
+		isInfected = scanned > 0 && infected == scanned
+	case Majority:
+		isInfected = infected*2 > scanned
+	default:
+		isInfected = infected > 0
+	}
+
+	if !isInfected {
+		return Verdict{Engine: m.Name()}, nil
+	}
+	return detection, nil
+}
+
+// FromEnv builds the scanner configured by the environment variables:
+// SCAN_ENGINES (comma separated list of "clamd" and "yara", "clamd" by default, "none" to disable scanning),
+// SCAN_POLICY ("any" by default, "all" or "majority"), SCAN_FAIL_OPEN, SCAN_SKIP_LARGE, CLAMD_ADDRESS, CLAMD_TIMEOUT,
+// CLAMD_MAX_SIZE, YARA_RULES and YARA_BINARY.
+// Returns:
+//   Scanner: The configured scanner.
+//   error: An error if a variable is not valid or an engine could not be configured.
+func FromEnv() (Scanner, error) {
+	multi := &Multi{Policy: Any}
+
+	if value := os.Getenv("SCAN_POLICY"); value != "" {
+		switch policy := Policy(value); policy {
+		case Any, All, Majority:
+			multi.Policy = policy
+		default:
+			return nil, fmt.Errorf("unknown SCAN_POLICY %q", value)
+		}
+	}
+
+	if value := os.Getenv("SCAN_FAIL_OPEN"); value != "" {
+		failOpen, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SCAN_FAIL_OPEN %q", value)
+		}
+		multi.FailOpen = failOpen
+	}
+
+	if value := os.Getenv("SCAN_SKIP_LARGE"); value != "" {
+		skipLarge, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SCAN_SKIP_LARGE %q", value)
+		}
+		multi.SkipLarge = skipLarge
+	}
+
+	engines := os.Getenv("SCAN_ENGINES")
+	if engines == "" {
+		engines = "clamd"
+	}
+	if engines == "none" {
+		return multi, nil
+	}
+
+	for _, name := range strings.Split(engines, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "clamd":
+			address := os.Getenv("CLAMD_ADDRESS")
+			if address == "" {
+				address = defaultClamdAddress
+			}
+
+			timeout := defaultClamdTimeout
+			if value := os.Getenv("CLAMD_TIMEOUT"); value != "" {
+				var err error
+				if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+					return nil, fmt.Errorf("invalid CLAMD_TIMEOUT %q", value)
+				}
+			}
+
+			clamd, err := NewClamd(address, timeout)
+			if err != nil {
+				return nil, err
+			}
+
+			if value := os.Getenv("CLAMD_MAX_SIZE"); value != "" {
+				if clamd.StreamMaxLength, err = strconv.ParseInt(value, 10, 64); err != nil || clamd.StreamMaxLength < 0 {
+					return nil, fmt.Errorf("invalid CLAMD_MAX_SIZE %q", value)
+				}
+			}
+			multi.Engines = append(multi.Engines, clamd)
+		case "yara":
+			yara, err := NewYara(os.Getenv("YARA_RULES"), os.Getenv("YARA_BINARY"))
+			if err != nil {
+				return nil, err
+			}
+			multi.Engines = append(multi.Engines, yara)
+		default:
+			return nil, fmt.Errorf("unknown scan engine %q in SCAN_ENGINES", name)
+		}
+	}
+
+	return multi, nil
+}
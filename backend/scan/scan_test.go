@@ -0,0 +1,83 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// stubEngine answers every scan with the same verdict or error.
+type stubEngine struct {
+	name    string
+	verdict Verdict
+	err     error
+	maxSize int64
+}
+
+func (s stubEngine) Name() string {
+	return s.name
+}
+
+func (s stubEngine) Scan(ctx context.Context, path string) (Verdict, error) {
+	return s.verdict, s.err
+}
+
+func (s stubEngine) MaxSize() int64 {
+	return s.maxSize
+}
+
+func TestMultiTooLarge(t *testing.T) {
+	large := stubEngine{name: "clamd", err: ErrTooLarge, maxSize: 16}
+	clean := stubEngine{name: "yara", verdict: Verdict{Engine: "yara"}}
+	infected := stubEngine{name: "yara", verdict: Verdict{Infected: true, Signature: "Test", Engine: "yara"}}
+	broken := stubEngine{name: "yara", err: ErrEngine}
+
+	tests := []struct {
+		name    string
+		multi   Multi
+		want    Verdict
+		wantErr error
+	}{
+		{name: "refused", multi: Multi{Engines: []Scanner{large}}, wantErr: ErrTooLarge},
+		{name: "refused with another engine", multi: Multi{Engines: []Scanner{large, clean}}, wantErr: ErrTooLarge},
+		{name: "fail open", multi: Multi{Engines: []Scanner{large, clean}, FailOpen: true}, want: Verdict{Engine: "clamd+yara"}},
+		{name: "skipped", multi: Multi{Engines: []Scanner{large}, SkipLarge: true}, want: Verdict{Engine: "clamd"}},
+		{name: "skipped, found by another engine", multi: Multi{Engines: []Scanner{large, infected}, SkipLarge: true}, want: infected.verdict},
+		{name: "skipped, all of the others found it", multi: Multi{Engines: []Scanner{large, infected}, Policy: All, SkipLarge: true}, want: infected.verdict},
+		{name: "skipped, another engine failed", multi: Multi{Engines: []Scanner{large, broken}, SkipLarge: true}, wantErr: ErrEngine},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verdict, err := test.multi.Scan(context.Background(), "unused")
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got %+v, %v, want the error %v", verdict, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || verdict != test.want {
+				t.Errorf("got %+v, %v, want %+v", verdict, err, test.want)
+			}
+		})
+	}
+}
+
+func TestMultiMaxSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		multi *Multi
+		want  int64
+	}{
+		{"no engine", &Multi{}, 0},
+		{"no limit", &Multi{Engines: []Scanner{stubEngine{name: "yara"}}}, 0},
+		{"smallest limit", &Multi{Engines: []Scanner{stubEngine{maxSize: 32}, stubEngine{}, stubEngine{maxSize: 16}}}, 16},
+		{"skipped", &Multi{Engines: []Scanner{stubEngine{maxSize: 16}}, SkipLarge: true}, 0},
+	}
+
+	for _, test := range tests {
+		if got := MaxSize(test.multi); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
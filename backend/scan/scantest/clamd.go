@@ -0,0 +1,163 @@
+// Package scantest provides a fake ClamAV daemon, so the scanning pipeline can be exercised without a real clamd.
+package scantest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Clamd is a fake clamd answering PING and INSTREAM over TCP. A stream is reported as infected when it contains
+// one of the configured patterns.
+type Clamd struct {
+	Addr          string            // Address to give to scan.NewClamd, as "tcp://127.0.0.1:port"
+	Signatures    map[string]string // Signature names indexed by the byte pattern they detect
+	MaxStreamSize int               // Streams longer than this are refused like clamd does, 0 for no limit
+	Fail          bool              // When true, every scan is answered with an error
+	Drop          bool              // When true, the connections are closed without a reply, as a crashing clamd does
+
+	// The fields above must not be changed while scans are running
+
+	listener net.Listener
+	mu       sync.Mutex
+	scans    int
+	wg       sync.WaitGroup
+}
+
+// NewClamd starts a fake clamd on a random local port.
+// Parameters:
+//   signatures (map[string]string): The signature names indexed by the byte pattern they detect.
+// Returns:
+//   *Clamd: The running server, to be stopped with Close.
+//   error: An error if no port could be opened.
+func NewClamd(signatures map[string]string) (*Clamd, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Clamd{
+		Addr:       "tcp://" + listener.Addr().String(),
+		Signatures: signatures,
+		listener:   listener,
+	}
+
+	c.wg.Add(1)
+	go c.serve()
+	return c, nil
+}
+
+// EICAR returns the signatures of a clamd detecting the EICAR test file, the usual way to check an antivirus setup.
+func EICAR() map[string]string {
+	return map[string]string{
+		`X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`: "Eicar-Signature",
+	}
+}
+
+// Scans returns the number of INSTREAM commands received.
+func (c *Clamd) Scans() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.scans
+}
+
+// Close stops the server and waits for the running connections.
+func (c *Clamd) Close() error {
+	err := c.listener.Close()
+	c.wg.Wait()
+	return err
+}
+
+// serve accepts connections until the listener is closed.
+func (c *Clamd) serve() {
+	defer c.wg.Done()
+
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			defer conn.Close()
+			c.handle(conn)
+		}()
+	}
+}
+
+// handle answers a single command, in its "z" (NUL terminated) or "n" (newline terminated) form.
+func (c *Clamd) handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	prefix, err := reader.ReadByte()
+	if err != nil {
+		return
+	}
+	delimiter := byte('\n')
+	if prefix == 'z' {
+		delimiter = 0
+	}
+
+	command, err := reader.ReadString(delimiter)
+	if err != nil {
+		return
+	}
+
+	var reply string
+	switch strings.TrimSuffix(command, string(delimiter)) {
+	case "PING":
+		reply = "PONG"
+	case "INSTREAM":
+		c.mu.Lock()
+		c.scans++
+		c.mu.Unlock()
+		if c.Drop {
+			return
+		}
+		reply = c.scan(reader)
+	default:
+		reply = "UNKNOWN COMMAND"
+	}
+
+	conn.Write(append([]byte(reply), delimiter))
+}
+
+// scan reads the chunks of a stream and returns the reply of clamd.
+func (c *Clamd) scan(r io.Reader) string {
+	var content bytes.Buffer
+	length := make([]byte, 4)
+
+	for {
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "stream: read error ERROR"
+		}
+
+		size := binary.BigEndian.Uint32(length)
+		if size == 0 {
+			break
+		}
+		if c.MaxStreamSize > 0 && content.Len()+int(size) > c.MaxStreamSize {
+			return "INSTREAM size limit exceeded. ERROR"
+		}
+		if _, err := io.CopyN(&content, r, int64(size)); err != nil {
+			return "stream: read error ERROR"
+		}
+	}
+
+	if c.Fail {
+		return "stream: Can't allocate memory ERROR"
+	}
+
+	for pattern, name := range c.Signatures {
+		if bytes.Contains(content.Bytes(), []byte(pattern)) {
+			return "stream: " + name + " FOUND"
+		}
+	}
+	return "stream: OK"
+}
@@ -0,0 +1,85 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Yara matches files against a set of YARA rules with the yara command line tool.
+type Yara struct {
+	Binary string // Path of the yara executable
+	Rules  string // Path of the rules file, source or compiled
+}
+
+// NewYara creates a YARA scanner.
+// Parameters:
+//   rules (string): The path of the rules file.
+//   binary (string): The yara executable, looked up in PATH; "yara" when empty.
+// Returns:
+//   *Yara: The scanner.
+//   error: An error if the rules file or the executable cannot be found.
+func NewYara(rules string, binary string) (*Yara, error) {
+	if rules == "" {
+		return nil, fmt.Errorf("YARA_RULES must be set to use the yara engine")
+	}
+	if _, err := os.Stat(rules); err != nil {
+		return nil, fmt.Errorf("error reading the YARA rules: %v", err)
+	}
+
+	if binary == "" {
+		binary = "yara"
+	}
+	resolved, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, fmt.Errorf("yara executable not found: %v", err)
+	}
+
+	return &Yara{Binary: resolved, Rules: rules}, nil
+}
+
+// Name returns "yara".
+func (y *Yara) Name() string {
+	return "yara"
+}
+
+// Scan runs the rules on the file at path. The file is infected if a rule matches.
+// Parameters:
+//   ctx (context.Context): Context of the scan, killing yara when cancelled.
+//   path (string): The path of the file.
+// Returns:
+//   Verdict: The verdict, with the names of the matching rules as signature.
+//   error: An error wrapping ErrUnavailable if yara could not be run, or ErrEngine if it failed.
+func (y *Yara) Scan(ctx context.Context, path string) (Verdict, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, y.Binary, "--no-warnings", y.Rules, path)
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return Verdict{}, fmt.Errorf("%w: %s", ErrEngine, strings.TrimSpace(stderr.String()))
+		}
+		return Verdict{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	// Each match is reported as "<rule> <path>"
+	var matches []string
+	lines := bufio.NewScanner(bytes.NewReader(output))
+	for lines.Scan() {
+		if rule, _, ok := strings.Cut(lines.Text(), " "); ok {
+			matches = append(matches, rule)
+		}
+	}
+
+	if len(matches) == 0 {
+		return Verdict{Engine: "yara"}, nil
+	}
+	return Verdict{Infected: true, Signature: strings.Join(matches, ","), Engine: "yara"}, nil
+}
@@ -0,0 +1,434 @@
+// Package sniff detects the type of a file from its content (magic numbers and structure), instead of trusting
+// the type and extension sent by the client.
+package sniff
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Unknown is the type reported for content that matches none of the known formats.
+const Unknown = "application/octet-stream"
+
+const headerSize = 512 // Number of bytes read to recognize a format
+
+// format describes a recognized file format.
+type format struct {
+	Type       string                               // Canonical MIME type
+	Extensions []string                             // Extensions allowed for this type, without the dot
+	Match      func(header []byte) bool             // Recognizes the magic number at the start of the file
+	Check      func(file *os.File, size int64) bool // Verifies the structure of the file, nil when the magic number is enough
+}
+
+// formats lists the recognized formats, in the order they are tried.
+var formats = []format{
+	{"image/png", []string{"png"}, prefix("\x89PNG\r\n\x1a\n"), checkPNG},
+	{"image/jpeg", []string{"jpg", "jpeg", "jpe", "jfif"}, prefix("\xff\xd8\xff"), nil},
+	{"image/gif", []string{"gif"}, prefix("GIF87a", "GIF89a"), nil},
+	{"application/pdf", []string{"pdf"}, prefix("%PDF-"), checkPDF},
+	{"application/zip", []string{"zip"}, prefix("PK\x03\x04", "PK\x05\x06"), checkZip},
+	{"application/x-rar-compressed", []string{"rar"}, prefix("Rar!\x1a\x07"), nil},
+	{"application/x-tar", []string{"tar"}, matchTar, checkTar},
+	{"audio/x-flac", []string{"flac"}, prefix("fLaC"), nil},
+	{"audio/x-wav", []string{"wav", "wave"}, matchWAV, nil},
+	{"audio/mpeg", []string{"mp3"}, matchMP3, nil},
+	{"video/mp4", []string{"mp4", "m4v"}, matchMP4, nil},
+	{"application/gzip", []string{"gz", "tgz"}, prefix("\x1f\x8b"), nil},
+	{"application/x-msdownload", []string{"exe", "dll", "scr", "sys"}, matchPE, nil},
+	{"application/x-executable", []string{"elf", "so"}, prefix("\x7fELF"), nil},
+	{"application/x-mach-binary", []string{"dylib"}, prefix("\xfe\xed\xfa\xce", "\xfe\xed\xfa\xcf", "\xce\xfa\xed\xfe", "\xcf\xfa\xed\xfe"), nil},
+}
+
+// executables lists the types of native executable programs.
+var executables = map[string]bool{
+	"application/x-msdownload":  true,
+	"application/x-executable":  true,
+	"application/x-mach-binary": true,
+}
+
+// text lists the extensions of the textual types, which are recognized by their content being valid UTF-8.
+var text = map[string][]string{
+	"application/json": {"json"},
+	"text/plain":       {"txt", "text", "log", "md", "csv"},
+}
+
+// aliases maps the non-canonical names clients use for a type to the name reported by Detect.
+var aliases = map[string]string{
+	"image/jpg":                    "image/jpeg",
+	"image/pjpeg":                  "image/jpeg",
+	"application/x-pdf":            "application/pdf",
+	"application/x-zip-compressed": "application/zip",
+	"application/vnd.rar":          "application/x-rar-compressed",
+	"application/x-rar":            "application/x-rar-compressed",
+	"audio/flac":                   "audio/x-flac",
+	"audio/wav":                    "audio/x-wav",
+	"audio/wave":                   "audio/x-wav",
+	"audio/vnd.wave":               "audio/x-wav",
+	"audio/mp3":                    "audio/mpeg",
+	"text/json":                    "application/json",
+	"application/x-gzip":           "application/gzip",
+	"application/x-dosexec":        "application/x-msdownload",
+	"application/vnd.microsoft.portable-executable": "application/x-msdownload",
+}
+
+// Detect reads a file and returns its type.
+// Parameters:
+//   path_ (string): The path of the file.
+// Returns:
+//   string: The MIME type of the content, Unknown if it is not recognized or its structure is broken.
+//   error: An error if the file could not be read.
+func Detect(path_ string) (string, error) {
+	file, err := os.Open(path_)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", fmt.Errorf("error reading file header: %v", err)
+	}
+	header = header[:n]
+
+	for _, f := range formats {
+		if !f.Match(header) {
+			continue
+		}
+
+		if f.Check != nil && !f.Check(file, info.Size()) {
+			return Unknown, nil
+		}
+		return f.Type, nil
+	}
+
+	return detectText(file)
+}
+
+// DetectHeader recognizes a format from the first bytes of a file only, without verifying its structure
+// nor recognizing text, for content that is not available as a file (e.g. the entries of an archive).
+// Parameters:
+//   header ([]byte): The first bytes of the content, up to 512.
+// Returns:
+//   string: The MIME type of the content, Unknown if it is not recognized.
+func DetectHeader(header []byte) string {
+	for _, f := range formats {
+		if f.Match(header) {
+			return f.Type
+		}
+	}
+
+	return Unknown
+}
+
+// Executable reports whether a type is the one of a native executable program (PE, ELF or Mach-O).
+// Parameters:
+//   contentType (string): A type returned by Detect or DetectHeader.
+// Returns:
+//   bool: Returns true if the type is executable.
+func Executable(contentType string) bool {
+	return executables[contentType]
+}
+
+// Canonical returns the name Detect uses for a type, ignoring parameters such as the charset.
+// Parameters:
+//   contentType (string): A MIME type, as sent by a client.
+// Returns:
+//   string: The canonical MIME type.
+func Canonical(contentType string) string {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+
+	if alias, ok := aliases[contentType]; ok {
+		return alias
+	}
+	return contentType
+}
+
+// Matches reports whether the declared type of a file agrees with its detected type.
+// JSON files may be declared as plain text, since they are text.
+// Parameters:
+//   declared (string): The type sent by the client.
+//   detected (string): The type returned by Detect.
+// Returns:
+//   bool: Returns true if the types agree.
+func Matches(declared, detected string) bool {
+	declared = Canonical(declared)
+
+	return declared == detected || (declared == "text/plain" && detected == "application/json")
+}
+
+// ExtensionMatches reports whether the extension of a file name is one used by its detected type.
+// Text files may use any extension that does not belong to another known type.
+// Parameters:
+//   name (string): The name of the file.
+//   detected (string): The type returned by Detect.
+// Returns:
+//   bool: Returns true if the extension agrees with the type.
+func ExtensionMatches(name, detected string) bool {
+	extension := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+
+	if owner, known := extensionOwner(extension); known {
+		return owner == detected || (owner == "text/plain" && detected == "application/json")
+	}
+
+	_, isText := text[detected]
+	return isText
+}
+
+// Extension returns the usual extension of a detected type, without the dot.
+// Parameters:
+//   detected (string): The type returned by Detect.
+// Returns:
+//   string: The first extension allowed for the type.
+//   bool: Returns false if the type is not a known format.
+func Extension(detected string) (string, bool) {
+	for _, f := range formats {
+		if f.Type == detected {
+			return f.Extensions[0], true
+		}
+	}
+
+	if extensions, ok := text[detected]; ok {
+		return extensions[0], true
+	}
+
+	return "", false
+}
+
+// extensionOwner returns the type an extension belongs to.
+func extensionOwner(extension string) (string, bool) {
+	for _, f := range formats {
+		for _, e := range f.Extensions {
+			if e == extension {
+				return f.Type, true
+			}
+		}
+	}
+
+	for contentType, extensions := range text {
+		for _, e := range extensions {
+			if e == extension {
+				return contentType, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// prefix returns a matcher recognizing files starting with one of the given magic numbers.
+func prefix(magics ...string) func([]byte) bool {
+	return func(header []byte) bool {
+		for _, magic := range magics {
+			if bytes.HasPrefix(header, []byte(magic)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// checkPNG verifies that the first chunk is a valid IHDR and that the file ends with an IEND chunk.
+func checkPNG(file *os.File, size int64) bool {
+	if size < 8+25+12 {
+		return false
+	}
+
+	ihdr := make([]byte, 8)
+	if _, err := file.ReadAt(ihdr, 8); err != nil {
+		return false
+	}
+	if binary.BigEndian.Uint32(ihdr[:4]) != 13 || string(ihdr[4:]) != "IHDR" {
+		return false
+	}
+
+	iend := make([]byte, 12)
+	if _, err := file.ReadAt(iend, size-12); err != nil {
+		return false
+	}
+	return bytes.Equal(iend, []byte("\x00\x00\x00\x00IEND\xaeB`\x82"))
+}
+
+// checkPDF verifies that the file ends with an end-of-file marker, as every complete PDF does.
+func checkPDF(file *os.File, size int64) bool {
+	tail := make([]byte, min(size, 1024))
+	if _, err := file.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return false
+	}
+	return bytes.Contains(tail, []byte("%%EOF"))
+}
+
+// checkZip verifies that the central directory of the archive can be read.
+func checkZip(file *os.File, size int64) bool {
+	_, err := zip.NewReader(file, size)
+	return err == nil
+}
+
+// matchTar recognizes the "ustar" magic of POSIX and GNU tar headers.
+func matchTar(header []byte) bool {
+	return len(header) >= 512 && string(header[257:262]) == "ustar"
+}
+
+// checkTar verifies the checksum of the first header block.
+func checkTar(file *os.File, size int64) bool {
+	block := make([]byte, 512)
+	if _, err := file.ReadAt(block, 0); err != nil {
+		return false
+	}
+
+	stored, err := strconv.ParseUint(strings.Trim(string(block[148:156]), " \x00"), 8, 32)
+	if err != nil {
+		return false
+	}
+
+	// The checksum is computed with its own field filled with spaces
+	var sum uint64
+	for i, b := range block {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		sum += uint64(b)
+	}
+	return sum == stored
+}
+
+// matchWAV recognizes a RIFF container holding WAVE audio.
+func matchWAV(header []byte) bool {
+	return len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WAVE"
+}
+
+// matchMP3 recognizes an ID3v2 tag or an MPEG audio frame header.
+func matchMP3(header []byte) bool {
+	if bytes.HasPrefix(header, []byte("ID3")) {
+		return true
+	}
+	return len(header) >= 2 && header[0] == 0xff && header[1]&0xe0 == 0xe0 && header[1]&0x06 != 0
+}
+
+// matchMP4 recognizes the "ftyp" box starting ISO base media files with an MP4 brand.
+func matchMP4(header []byte) bool {
+	if len(header) < 12 || string(header[4:8]) != "ftyp" {
+		return false
+	}
+
+	switch string(header[8:12]) {
+	case "isom", "iso2", "mp41", "mp42", "avc1", "M4V ", "dash":
+		return true
+	}
+	return false
+}
+
+// matchPE recognizes the DOS header of Windows executables, followed by the PE signature at the offset it points to.
+func matchPE(header []byte) bool {
+	if len(header) < 64 || string(header[:2]) != "MZ" {
+		return false
+	}
+
+	offset := int64(binary.LittleEndian.Uint32(header[0x3c:0x40]))
+	if offset < 64 {
+		return false
+	}
+	if offset+4 <= int64(len(header)) {
+		return string(header[offset:offset+4]) == "PE\x00\x00"
+	}
+
+	// The signature is past the header: trust the DOS header when the offset is plausible
+	return offset < 64*1024
+}
+
+// detectText reports valid UTF-8 content without NUL bytes as plain text, or as JSON if it is a single valid JSON value.
+func detectText(file *os.File) (string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if !isText(file) {
+		return Unknown, nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if isJSON(file) {
+		return "application/json", nil
+	}
+	return "text/plain", nil
+}
+
+// isText reads the whole content and reports whether it is valid UTF-8 without NUL bytes.
+func isText(r io.Reader) bool {
+	buffer := make([]byte, 32*1024)
+	var pending []byte
+
+	for {
+		n, err := r.Read(buffer)
+		chunk := append(pending, buffer[:n]...)
+
+		if bytes.IndexByte(chunk, 0) >= 0 {
+			return false
+		}
+
+		// A multi-byte character may be cut at the end of the chunk
+		valid := len(chunk)
+		for cut := 0; cut < utf8.UTFMax && valid > 0 && !utf8.Valid(chunk[:valid]); cut++ {
+			valid--
+		}
+		if !utf8.Valid(chunk[:valid]) {
+			return false
+		}
+		pending = append([]byte(nil), chunk[valid:]...)
+
+		if errors.Is(err, io.EOF) {
+			return len(pending) == 0
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+// isJSON reports whether the content is exactly one valid JSON value, reading it as a stream of tokens.
+func isJSON(r io.Reader) bool {
+	decoder := json.NewDecoder(r)
+
+	first, err := decoder.Token()
+	if err != nil {
+		return false
+	}
+	if delim, ok := first.(json.Delim); !ok || (delim != '{' && delim != '[') {
+		return false
+	}
+
+	for depth := 1; depth > 0; {
+		token, err := decoder.Token()
+		if err != nil {
+			return false
+		}
+
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+
+	// Nothing but spaces may follow the value
+	_, err = decoder.Token()
+	return err == io.EOF
+}
@@ -0,0 +1,239 @@
+package sniff_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"backend/sniff"
+)
+
+// detect writes content to a temporary file and returns the type Detect reports for it.
+func detect(t *testing.T, content []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	detected, err := sniff.Detect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return detected
+}
+
+// pngFile encodes a small PNG image.
+func pngFile(t *testing.T) []byte {
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return encoded.Bytes()
+}
+
+// zipFile builds a zip archive holding the given files.
+func zipFile(t *testing.T, names ...string) []byte {
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	for _, name := range names {
+		entry, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Write([]byte("content of " + name))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+// tarFile builds a tar archive holding one file.
+func tarFile(t *testing.T) []byte {
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	if err := writer.WriteHeader(&tar.Header{Name: "notes.txt", Mode: 0600, Size: 5, Format: tar.FormatUSTAR}); err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte("notes"))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+// peFile builds the DOS header of a Windows executable pointing to its PE signature.
+func peFile(offset uint32) []byte {
+	header := make([]byte, 256)
+	copy(header, "MZ")
+	binary.LittleEndian.PutUint32(header[0x3c:], offset)
+	if int(offset)+4 <= len(header) {
+		copy(header[offset:], "PE\x00\x00")
+	}
+	return header
+}
+
+func TestDetect(t *testing.T) {
+	validPNG := pngFile(t)
+	validTar := tarFile(t)
+	brokenTar := append([]byte(nil), validTar...)
+	brokenTar[0] = 'N' // The checksum no longer matches
+	// A character of 2 bytes cut by the 32 KB read buffer
+	cutText := strings.Repeat("a", 32*1024-1) + "é"
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"png", validPNG, "image/png"},
+		{"truncated png", validPNG[:len(validPNG)-12], sniff.Unknown},
+		{"png without IHDR", append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 64)...), sniff.Unknown},
+		{"jpeg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF"), "image/jpeg"},
+		{"gif87a", []byte("GIF87a\x01\x00"), "image/gif"},
+		{"gif89a", []byte("GIF89a\x01\x00"), "image/gif"},
+		{"pdf", []byte("%PDF-1.7\n1 0 obj\n<<>>\nendobj\n%%EOF\n"), "application/pdf"},
+		{"truncated pdf", []byte("%PDF-1.7\n1 0 obj\n<<>>\n"), sniff.Unknown},
+		{"zip", zipFile(t, "notes.txt"), "application/zip"},
+		{"empty zip", zipFile(t), "application/zip"},
+		{"zip-based document", zipFile(t, "[Content_Types].xml", "word/document.xml"), "application/zip"},
+		{"zip without central directory", []byte("PK\x03\x04\x14\x00\x00\x00garbage"), sniff.Unknown},
+		{"rar", []byte("Rar!\x1a\x07\x01\x00"), "application/x-rar-compressed"},
+		{"tar", validTar, "application/x-tar"},
+		{"tar with a wrong checksum", brokenTar, sniff.Unknown},
+		{"flac", []byte("fLaC\x00\x00\x00\x22"), "audio/x-flac"},
+		{"wav", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), "audio/x-wav"},
+		{"riff not wav", []byte("RIFF\x24\x00\x00\x00AVI LIST"), sniff.Unknown},
+		{"mp3 with ID3", []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), "audio/mpeg"},
+		{"mp3 frame", []byte{0xff, 0xfb, 0x90, 0x64}, "audio/mpeg"},
+		{"mp4", []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00"), "video/mp4"},
+		{"ftyp of another brand", []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00"), sniff.Unknown},
+		{"gzip", []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00"), "application/gzip"},
+		{"pe", peFile(0x80), "application/x-msdownload"},
+		{"pe signature past the header", peFile(0x400), "application/x-msdownload"},
+		{"dos header without pe", peFile(0x10), sniff.Unknown},
+		{"elf", []byte("\x7fELF\x02\x01\x01"), "application/x-executable"},
+		{"mach-o", []byte("\xcf\xfa\xed\xfe\x07\x00\x00\x01"), "application/x-mach-binary"},
+		{"text", []byte("hello world\n"), "text/plain"},
+		{"utf-8 text", []byte("héllo wörld ✓"), "text/plain"},
+		{"character across reads", []byte(cutText), "text/plain"},
+		{"empty", nil, "text/plain"},
+		{"json object", []byte(`{"name": "report", "tags": [1, 2, {"a": null}]}`), "application/json"},
+		{"json array", []byte(" [1, 2, 3]\n"), "application/json"},
+		{"json scalar", []byte("42"), "text/plain"},
+		{"json followed by text", []byte(`{"a": 1} trailing`), "text/plain"},
+		{"unbalanced json", []byte(`{"a": [1, 2}`), "text/plain"},
+		{"invalid utf-8", []byte("caf\xe9 au lait"), sniff.Unknown},
+		{"truncated utf-8", []byte("caf\xc3"), sniff.Unknown},
+		{"nul byte", []byte("text\x00with a nul"), sniff.Unknown},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := detect(t, test.content); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDetectHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"elf", []byte("\x7fELF\x02\x01\x01"), "application/x-executable"},
+		{"pe", peFile(0x80), "application/x-msdownload"},
+		// The structure is not verified, nor text recognized
+		{"truncated pdf", []byte("%PDF-1.7\n"), "application/pdf"},
+		{"text", []byte("hello"), sniff.Unknown},
+		{"empty", nil, sniff.Unknown},
+	}
+
+	for _, test := range tests {
+		if got := sniff.DetectHeader(test.header); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTypes(t *testing.T) {
+	canonical := []struct {
+		declared, want string
+	}{
+		{"image/jpg", "image/jpeg"},
+		{" Image/JPEG ", "image/jpeg"},
+		{"text/plain; charset=utf-8", "text/plain"},
+		{"application/x-zip-compressed", "application/zip"},
+		{"audio/wav", "audio/x-wav"},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+	}
+	for _, test := range canonical {
+		if got := sniff.Canonical(test.declared); got != test.want {
+			t.Errorf("Canonical(%q): got %q, want %q", test.declared, got, test.want)
+		}
+	}
+
+	matches := []struct {
+		declared, detected string
+		want               bool
+	}{
+		{"image/jpg", "image/jpeg", true},
+		{"text/plain", "application/json", true},
+		{"application/json", "text/plain", false},
+		{"image/png", "image/jpeg", false},
+		// Zip-based formats are matched against their container by the type policy, not here
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", "application/zip", false},
+	}
+	for _, test := range matches {
+		if got := sniff.Matches(test.declared, test.detected); got != test.want {
+			t.Errorf("Matches(%q, %q): got %v, want %v", test.declared, test.detected, got, test.want)
+		}
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	tests := []struct {
+		name, detected string
+		want           bool
+	}{
+		{"photo.JPG", "image/jpeg", true},
+		{"photo.jpeg", "image/jpeg", true},
+		{"photo.png", "image/jpeg", false},
+		{"data.json", "application/json", true},
+		{"data.txt", "application/json", true},
+		{"notes.txt", "text/plain", true},
+		// Text may use any extension not owned by another type
+		{"config.yaml", "text/plain", true},
+		{"README", "text/plain", true},
+		{"script.exe", "text/plain", false},
+		{"notes.json", "text/plain", false},
+		// Unknown extensions are only accepted for text, zip-based documents need a rule in the type policy
+		{"report.docx", "application/zip", false},
+		{"archive.zip", "application/zip", true},
+		{"setup.exe", "application/x-msdownload", true},
+	}
+	for _, test := range tests {
+		if got := sniff.ExtensionMatches(test.name, test.detected); got != test.want {
+			t.Errorf("ExtensionMatches(%q, %q): got %v, want %v", test.name, test.detected, got, test.want)
+		}
+	}
+
+	for detected, want := range map[string]string{"image/jpeg": "jpg", "text/plain": "txt", "application/json": "json", "application/x-tar": "tar"} {
+		if got, ok := sniff.Extension(detected); !ok || got != want {
+			t.Errorf("Extension(%q): got %q, %v, want %q", detected, got, ok, want)
+		}
+	}
+	if _, ok := sniff.Extension(sniff.Unknown); ok {
+		t.Error("Unknown has an extension")
+	}
+}
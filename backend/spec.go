@@ -0,0 +1,478 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"backend/apierror"
+	"backend/db"
+	"backend/openapi"
+	"backend/tus"
+)
+
+// errorComponent is the name of the component describing the body of the error responses.
+const errorComponent = "ErrorResponse"
+
+// Descriptions of the IDs of a file, as parameters.
+var idDescriptions = map[string]string{
+	"idPublic":  "The public ID of the file",
+	"idPrivate": "The owner token of the file",
+}
+
+// Errors an upload can be refused with, whether it is sent as a form or through tus.
+var uploadErrors = []apierror.Code{
+	apierror.InvalidField,
+	apierror.UnsupportedFileType,
+	apierror.FileTooLarge,
+	apierror.QuotaExceeded,
+	apierror.ContentMismatch,
+	apierror.ArchiveRejected,
+	apierror.MalformedFile,
+	apierror.DuplicateFile,
+	apierror.StorageFull,
+}
+
+// Errors of the operations of an owner on their file.
+var ownerErrors = []apierror.Code{
+	apierror.OwnerTokenRequired,
+	apierror.OwnerTokenMismatch,
+	apierror.FileNotFound,
+	apierror.RateLimited,
+}
+
+// document creates the OpenAPI document of the API, with the components shared by the operations. The operations
+// are added by routes as they are registered.
+// Returns:
+//   *openapi.Document: The document, served at /openapi.json.
+func (s *server) document() *openapi.Document {
+	doc := openapi.New("Moada", "1.0.0")
+	doc.Info.Description = "Temporary file sharing. Every response carries an X-Request-ID header, and the rate " +
+		"limited routes the RateLimit-Policy, RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers."
+	doc.Tags = []openapi.Tag{
+		{Name: "files", Description: "Upload, download and manage files"},
+		{Name: "uploads", Description: "Resumable uploads (tus 1.0)"},
+		{Name: "users", Description: "Data kept about the client, identified by its address"},
+		{Name: "meta", Description: "Description of the API and its limits"},
+	}
+	doc.Components.SecuritySchemes = map[string]*openapi.SecurityScheme{
+		"ownerToken": {
+			Type:        "http",
+			Scheme:      "bearer",
+			Description: "The owner token returned once by the upload, which manages the file.",
+		},
+		"ownerCookie": {
+			Type:        "apiKey",
+			In:          "cookie",
+			Name:        ownerCookiePrefix + "{idPublic}",
+			Description: "The owner token set by the upload when OWNER_COOKIE is enabled, one cookie per file.",
+		},
+	}
+
+	doc.Named(errorComponent, apierror.Envelope{})
+	codes := apierror.Codes()
+	enum := make([]string, len(codes))
+	for i, code := range codes {
+		enum[i] = string(code)
+	}
+	apiError := doc.Component("Error")
+	apiError.Properties["code"].Enum = enum
+	apiError.Properties["details"].Description = "Values helping to handle the error, depending on the code " +
+		"(field for invalid_field, maxSize for file_too_large, remainingSpace for quota_exceeded, file for duplicate_file, ...)"
+
+	scanStatuses := []string{db.ScanQuarantined, db.ScanAvailable, db.ScanRejected}
+	doc.Schema(db.File{})
+	doc.Component("File").Properties["scanStatus"].Enum = append(scanStatuses, "")
+	doc.Schema(fileInfoResponse{})
+	doc.Component("FileInfoResponse").Properties["scanStatus"].Enum = scanStatuses
+	doc.Schema(publicFileResponse{})
+	doc.Component("PublicFileResponse").Properties["scanStatus"].Enum = scanStatuses
+
+	return doc
+}
+
+// responses returns the responses of an operation: its successes, then its errors grouped by HTTP status. Every
+// operation may fail with an internal error.
+// Parameters:
+//   successes (map[string]*openapi.Response): The successful responses, indexed by status.
+//   codes (...apierror.Code): The errors the operation answers with.
+// Returns:
+//   map[string]*openapi.Response: The responses.
+func responses(successes map[string]*openapi.Response, codes ...apierror.Code) map[string]*openapi.Response {
+	byStatus := map[int][]string{}
+	retry := map[int]bool{}
+	for _, code := range append(codes, apierror.Internal) {
+		byStatus[code.Status()] = append(byStatus[code.Status()], string(code))
+		switch code {
+		case apierror.FileScanning, apierror.RateLimited, apierror.TooManyPasswordAttempts:
+			retry[code.Status()] = true
+		}
+	}
+
+	for status, names := range byStatus {
+		sort.Strings(names)
+		response := &openapi.Response{
+			Description: http.StatusText(status) + ": " + strings.Join(names, ", "),
+			Content:     map[string]openapi.MediaType{"application/json": {Schema: openapi.Ref(errorComponent)}},
+		}
+		if retry[status] {
+			response.Headers = map[string]*openapi.Header{
+				"Retry-After": {Description: "Seconds to wait before trying again", Schema: openapi.Integer("")},
+			}
+		}
+		successes[strconv.Itoa(status)] = response
+	}
+
+	return successes
+}
+
+// legacyOperation marks the operation of a legacy route as deprecated, pointing to the route replacing it.
+// Parameters:
+//   op (*openapi.Operation): The operation, as described for its successor.
+//   successor (string): The path of the route replacing it.
+// Returns:
+//   *openapi.Operation: The operation, renamed so its ID stays unique.
+func legacyOperation(op *openapi.Operation, successor string) *openapi.Operation {
+	op.OperationID = "legacy" + strings.ToUpper(op.OperationID[:1]) + op.OperationID[1:]
+	op.Deprecated = true
+	op.Description = strings.TrimSpace(op.Description + " Deprecated, use " + successor + " instead.")
+	return op
+}
+
+// inQuery moves the path parameters of an operation to the query string, where the legacy routes read them.
+// Parameters:
+//   op (*openapi.Operation): The operation.
+//   optional (...string): The parameters that can be omitted, added when the operation has no parameter of this name.
+// Returns:
+//   *openapi.Operation: The operation.
+func inQuery(op *openapi.Operation, optional ...string) *openapi.Operation {
+	for _, name := range optional {
+		found := false
+		for _, parameter := range op.Parameters {
+			found = found || parameter.Name == name
+		}
+		if !found {
+			op.Parameters = append(op.Parameters, &openapi.Parameter{Name: name, In: "path", Description: idDescriptions[name], Schema: openapi.String("")})
+		}
+	}
+
+	for _, parameter := range op.Parameters {
+		if parameter.In != "path" {
+			continue
+		}
+		parameter.In = "query"
+		for _, name := range optional {
+			if parameter.Name == name {
+				parameter.Required = false
+			}
+		}
+	}
+
+	// The owner token may also be sent as the idPrivate parameter
+	if op.Security != nil {
+		op.Security = append(op.Security, map[string][]string{})
+	}
+	return op
+}
+
+// uploadOperation describes the upload of a file as a multipart form.
+func uploadOperation(doc *openapi.Document) *openapi.Operation {
+	form := &openapi.Schema{
+		Type: "object",
+		Properties: map[string]*openapi.Schema{
+			"file":             openapi.Binary("The file, with its name and extension. Its type must be allowed by the upload policy."),
+			"email":            openapi.String("Email associated with the file."),
+			"expiresIn":        openapi.String("Time after which the file is deleted (e.g. \"10m\", \"1h\", \"7d\"), among the allowed expiration times. The default one when omitted."),
+			"maxDownloads":     openapi.Integer("Number of downloads after which the file is deleted, 0 for no limit."),
+			"burnAfterReading": openapi.Boolean("When true, the file is deleted after its first download."),
+			"password":         openapi.String("Password required to download the file, at most " + strconv.Itoa(maxPasswordLength) + " characters."),
+			"keepMetadata":     openapi.Boolean("When true, the metadata embedded in the file is not removed."),
+		},
+		Required: []string{"file"},
+	}
+
+	return &openapi.Operation{
+		OperationID: "uploadFile",
+		Summary:     "Upload a file",
+		Description: "The file is scanned for malware before it can be downloaded. The owner token managing it is only returned in this response.",
+		Tags:        []string{"files"},
+		RequestBody: &openapi.RequestBody{
+			Required: true,
+			Content:  map[string]openapi.MediaType{"multipart/form-data": {Schema: form}},
+		},
+		Responses: responses(map[string]*openapi.Response{
+			"202": openapi.JSON(doc, "The file was received and waits for its malware scan", uploadResponse{}),
+		}, append([]apierror.Code{apierror.InvalidRequest, apierror.RateLimited}, uploadErrors...)...),
+	}
+}
+
+// fileInfoOperation describes the information given to the owner of a file.
+func fileInfoOperation(doc *openapi.Document) *openapi.Operation {
+	return &openapi.Operation{
+		OperationID: "getFile",
+		Summary:     "Get a file",
+		Description: "Describes a file to its owner, with its owner token as idPrivate.",
+		Tags:        []string{"files"},
+		Security:    []map[string][]string{{"ownerToken": {}}, {"ownerCookie": {}}},
+		Parameters:  []*openapi.Parameter{idPublicParameter("path")},
+		Responses: responses(map[string]*openapi.Response{
+			"200": openapi.JSON(doc, "The file", fileInfoResponse{}),
+		}, ownerErrors...),
+	}
+}
+
+// fileDetailsOperation describes the information given about a file: its public metadata to anyone, and everything
+// to its owner.
+func fileDetailsOperation(doc *openapi.Document) *openapi.Operation {
+	return &openapi.Operation{
+		OperationID: "getFile",
+		Summary:     "Get a file",
+		Description: "Describes a file to anyone knowing its public ID: name, size, type, expiration, scan status and " +
+			"whether it is protected by a password. With the owner token, the whole metadata of the file is returned, " +
+			"with the owner token as idPrivate and the signature found by the scan.",
+		Tags:       []string{"files"},
+		Security:   []map[string][]string{{}, {"ownerToken": {}}, {"ownerCookie": {}}},
+		Parameters: []*openapi.Parameter{idPublicParameter("path")},
+		Responses: responses(map[string]*openapi.Response{
+			"200": {
+				Description: "The file: a FileInfoResponse for its owner, a PublicFileResponse otherwise",
+				Content: map[string]openapi.MediaType{"application/json": {
+					Schema: openapi.OneOf(doc.Schema(fileInfoResponse{}), doc.Schema(publicFileResponse{})),
+				}},
+			},
+		}, apierror.OwnerTokenMismatch, apierror.FileNotFound, apierror.RateLimited),
+	}
+}
+
+// downloadOperation describes the download of a file.
+func downloadOperation(doc *openapi.Document) *openapi.Operation {
+	return &openapi.Operation{
+		OperationID: "downloadFile",
+		Summary:     "Download a file",
+		Description: "Anyone with the public ID of a file can download it once it passed the malware scan. The file is deleted after its last allowed download.",
+		Tags:        []string{"files"},
+		Parameters: []*openapi.Parameter{
+			idPublicParameter("path"),
+			{Name: "X-File-Password", In: "header", Description: "Password of the file, when it is protected by one", Schema: openapi.String("")},
+		},
+		Responses: responses(map[string]*openapi.Response{
+			"200": {
+				Description: "The content of the file",
+				Headers: map[string]*openapi.Header{
+					"Content-Disposition": {Description: "attachment, with the name of the file", Schema: openapi.String("")},
+				},
+				Content: map[string]openapi.MediaType{"application/octet-stream": {Schema: openapi.Binary("The file, sent with its detected type")}},
+			},
+		}, apierror.FileNotFound, apierror.FileScanning, apierror.FileRejected, apierror.PasswordRequired,
+			apierror.WrongPassword, apierror.TooManyPasswordAttempts, apierror.DownloadLimitReached, apierror.RateLimited),
+	}
+}
+
+// deleteOperation describes the deletion of a file by its owner.
+func deleteOperation(doc *openapi.Document) *openapi.Operation {
+	return &openapi.Operation{
+		OperationID: "deleteFile",
+		Summary:     "Delete a file",
+		Description: "The owner token is sent in the Authorization header. Without it, the path segment is read as the " +
+			"owner token instead of the public ID, as the first clients sent it; this form is deprecated, since the " +
+			"token then appears in the logs of the proxies.",
+		Tags:     []string{"files"},
+		Security: []map[string][]string{{"ownerToken": {}}, {}},
+		Parameters: []*openapi.Parameter{
+			{Name: "idPublic", In: "path", Required: true, Description: "The public ID of the file, or its owner token without Authorization header", Schema: openapi.String("")},
+		},
+		Responses: responses(map[string]*openapi.Response{
+			"200": openapi.JSON(doc, "The file was deleted", messageResponse{}),
+		}, ownerErrors...),
+	}
+}
+
+// legacyDeleteOperation describes the deletion of a file by /deleteFile, which reads the owner token from the idPrivate
+// parameter.
+func legacyDeleteOperation(doc *openapi.Document) *openapi.Operation {
+	op := deleteOperation(doc)
+	op.Description = ""
+	op.Security = nil
+	op.Parameters = []*openapi.Parameter{
+		{Name: "idPrivate", In: "path", Required: true, Description: idDescriptions["idPrivate"], Schema: openapi.String("")},
+	}
+	return op
+}
+
+// userOperation describes the data kept about the client.
+func userOperation(doc *openapi.Document) *openapi.Operation {
+	return &openapi.Operation{
+		OperationID: "getMe",
+		Summary:     "Get the data kept about the client",
+		Tags:        []string{"users"},
+		Responses: responses(map[string]*openapi.Response{
+			"200": openapi.JSON(doc, "The user of the client", userResponse{}),
+		}, apierror.UserNotFound, apierror.RateLimited),
+	}
+}
+
+// deleteUserOperation describes the erasure of the client and its files.
+func deleteUserOperation(doc *openapi.Document) *openapi.Operation {
+	return &openapi.Operation{
+		OperationID: "deleteMe",
+		Summary:     "Erase the client and its files",
+		Tags:        []string{"users"},
+		Responses: responses(map[string]*openapi.Response{
+			"200": openapi.JSON(doc, "The data of the client was erased", messageResponse{}),
+		}, apierror.UserNotFound, apierror.RateLimited),
+	}
+}
+
+// limitsOperation describes the upload policy.
+func limitsOperation(doc *openapi.Document) *openapi.Operation {
+	return &openapi.Operation{
+		OperationID: "getLimits",
+		Summary:     "Get the upload policy and the user quota",
+		Tags:        []string{"meta"},
+		Responses: responses(map[string]*openapi.Response{
+			"200": openapi.JSON(doc, "The allowed types and the space of each client", limitsResponse{}),
+		}, apierror.RateLimited),
+	}
+}
+
+// specOperation describes the OpenAPI document itself.
+func specOperation() *openapi.Operation {
+	return &openapi.Operation{
+		OperationID: "getOpenAPI",
+		Summary:     "Get this OpenAPI document",
+		Tags:        []string{"meta"},
+		Responses: responses(map[string]*openapi.Response{
+			"200": {
+				Description: "The OpenAPI " + openapi.Version + " document of the API",
+				Content:     map[string]openapi.MediaType{"application/json": {Schema: &openapi.Schema{Type: "object"}}},
+			},
+		}, apierror.RateLimited),
+	}
+}
+
+// idPublicParameter describes the public ID of a file.
+func idPublicParameter(in string) *openapi.Parameter {
+	return &openapi.Parameter{Name: "idPublic", In: in, Required: in == "path", Description: idDescriptions["idPublic"], Schema: openapi.String("")}
+}
+
+// tusHeader describes a header of the tus protocol.
+func tusHeader(name, description string, required bool) *openapi.Parameter {
+	return &openapi.Parameter{Name: name, In: "header", Required: required, Description: description, Schema: openapi.String("")}
+}
+
+// tusVersion is the Tus-Resumable header every tus request but OPTIONS must send.
+func tusVersion() *openapi.Parameter {
+	parameter := tusHeader("Tus-Resumable", "Version of the tus protocol", true)
+	parameter.Schema.Enum = []string{tus.Version}
+	return parameter
+}
+
+// uploadOptionsOperation describes the capabilities of the tus server.
+func uploadOptionsOperation() *openapi.Operation {
+	return &openapi.Operation{
+		OperationID: "getUploadOptions",
+		Summary:     "Describe the resumable upload capabilities",
+		Tags:        []string{"uploads"},
+		Responses: map[string]*openapi.Response{
+			"204": {
+				Description: "The capabilities of the server",
+				Headers: map[string]*openapi.Header{
+					"Tus-Version":   {Schema: openapi.String("")},
+					"Tus-Extension": {Schema: openapi.String("")},
+					"Tus-Max-Size":  {Schema: openapi.Integer("")},
+				},
+			},
+		},
+	}
+}
+
+// createUploadOperation describes the creation of a resumable upload.
+func createUploadOperation() *openapi.Operation {
+	return &openapi.Operation{
+		OperationID: "createUpload",
+		Summary:     "Start a resumable upload",
+		Description: "The file is refused before any of it is sent when its settings, type or size are not accepted.",
+		Tags:        []string{"uploads"},
+		Parameters: []*openapi.Parameter{
+			tusVersion(),
+			tusHeader("Upload-Length", "Size of the file in bytes", true),
+			tusHeader("Upload-Metadata", "Comma separated \"key base64(value)\" pairs: filename, filetype, and the optional email, expiresIn, maxDownloads, burnAfterReading, password and keepMetadata of the upload form", true),
+		},
+		Responses: responses(map[string]*openapi.Response{
+			"201": {
+				Description: "The upload was created",
+				Headers: map[string]*openapi.Header{
+					"Location":       {Description: "URL of the upload", Schema: openapi.String("")},
+					"Upload-Expires": {Description: "Date after which an unfinished upload is discarded", Schema: openapi.String("")},
+				},
+			},
+		}, apierror.InvalidRequest, apierror.InvalidField, apierror.UnsupportedFileType, apierror.FileTooLarge,
+			apierror.QuotaExceeded, apierror.StorageFull, apierror.UnsupportedTusVersion, apierror.RateLimited),
+	}
+}
+
+// uploadOffsetOperation describes the state of a resumable upload.
+func uploadOffsetOperation() *openapi.Operation {
+	return &openapi.Operation{
+		OperationID: "getUploadOffset",
+		Summary:     "Get the number of bytes received",
+		Tags:        []string{"uploads"},
+		Parameters:  []*openapi.Parameter{tusVersion()},
+		Responses: map[string]*openapi.Response{
+			"200": {
+				Description: "The state of the upload",
+				Headers: map[string]*openapi.Header{
+					"Upload-Offset":  {Description: "Number of bytes received", Schema: openapi.Integer("")},
+					"Upload-Length":  {Description: "Size of the file in bytes", Schema: openapi.Integer("")},
+					"Upload-Expires": {Description: "Date after which an unfinished upload is discarded", Schema: openapi.String("")},
+				},
+			},
+			"404": {Description: "No upload of the client has this ID"},
+			"412": {Description: "The tus version is not supported"},
+			"429": {Description: "Too many requests"},
+		},
+	}
+}
+
+// appendUploadOperation describes the transfer of a chunk of a resumable upload.
+func appendUploadOperation(doc *openapi.Document) *openapi.Operation {
+	return &openapi.Operation{
+		OperationID: "appendUpload",
+		Summary:     "Send a chunk of a resumable upload",
+		Description: "Once the last chunk is received, the file goes through the checks of the upload form and is answered the same way.",
+		Tags:        []string{"uploads"},
+		Parameters: []*openapi.Parameter{
+			tusVersion(),
+			tusHeader("Upload-Offset", "Number of bytes already received, where the chunk starts", true),
+		},
+		RequestBody: &openapi.RequestBody{
+			Required: true,
+			Content:  map[string]openapi.MediaType{"application/offset+octet-stream": {Schema: openapi.Binary("The chunk")}},
+		},
+		Responses: responses(map[string]*openapi.Response{
+			"202": openapi.JSON(doc, "The last chunk was received and the file waits for its malware scan", uploadResponse{}),
+			"204": {
+				Description: "The chunk was received",
+				Headers: map[string]*openapi.Header{
+					"Upload-Offset":  {Description: "Number of bytes received", Schema: openapi.Integer("")},
+					"Upload-Expires": {Description: "Date after which an unfinished upload is discarded", Schema: openapi.String("")},
+				},
+			},
+		}, append([]apierror.Code{apierror.UploadNotFound, apierror.OffsetMismatch, apierror.UploadLocked,
+			apierror.UnsupportedContentType, apierror.UnsupportedTusVersion, apierror.RateLimited}, uploadErrors...)...),
+	}
+}
+
+// terminateUploadOperation describes the cancellation of a resumable upload.
+func terminateUploadOperation() *openapi.Operation {
+	return &openapi.Operation{
+		OperationID: "terminateUpload",
+		Summary:     "Cancel a resumable upload",
+		Tags:        []string{"uploads"},
+		Parameters:  []*openapi.Parameter{tusVersion()},
+		Responses: responses(map[string]*openapi.Response{
+			"204": {Description: "The upload was discarded"},
+		}, apierror.UploadNotFound, apierror.UnsupportedTusVersion, apierror.RateLimited),
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/openapi"
+)
+
+// openapiPath returns the OpenAPI form of a gin path: ":id" and "*id" become "{id}".
+func openapiPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// fetchDocument returns the document served at /openapi.json, as the clients read it.
+func fetchDocument(t *testing.T, ts *testServer) *openapi.Document {
+	t.Helper()
+
+	w := ts.do(http.MethodGet, "/openapi.json", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("openapi.json: got %d %s", w.Code, w.Body)
+	}
+	return decode[*openapi.Document](t, w)
+}
+
+func TestRoutesDocumented(t *testing.T) {
+	ts := newTestServer(t)
+	doc := fetchDocument(t, ts)
+
+	registered := map[string]bool{}
+	for _, route := range ts.router.Routes() {
+		operation := strings.ToLower(route.Method) + " " + openapiPath(route.Path)
+		registered[operation] = true
+
+		item, ok := doc.Paths[openapiPath(route.Path)]
+		if !ok || item[strings.ToLower(route.Method)] == nil {
+			t.Errorf("%s %s is registered but not documented", route.Method, route.Path)
+		}
+	}
+
+	operationIDs := map[string]string{}
+	for path, item := range doc.Paths {
+		for method, op := range item {
+			operation := method + " " + path
+			if !registered[operation] {
+				t.Errorf("%s is documented but not registered", operation)
+			}
+			if len(op.Responses) == 0 {
+				t.Errorf("%s documents no response", operation)
+			}
+
+			// The legacy routes share the operation of their successor, under a suffixed ID
+			if other, taken := operationIDs[op.OperationID]; taken {
+				t.Errorf("%s and %s share the operation ID %q", other, operation, op.OperationID)
+			}
+			operationIDs[op.OperationID] = operation
+		}
+	}
+}
+
+// validate checks a decoded JSON value against a schema of the document.
+// Parameters:
+//
+//	doc (*openapi.Document): The document holding the components the schema refers to.
+//	schema (*openapi.Schema): The schema.
+//	value (any): The value, as decoded by encoding/json into an interface.
+//	at (string): Where the value is in the body, for the messages.
+//
+// Returns:
+//
+//	[]string: What does not match, empty if the value is valid.
+func validate(doc *openapi.Document, schema *openapi.Schema, value any, at string) []string {
+	if schema == nil {
+		return nil
+	}
+
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		component, ok := doc.Components.Schemas[name]
+		if !ok {
+			return []string{fmt.Sprintf("%s: unknown reference %s", at, schema.Ref)}
+		}
+		return validate(doc, component, value, at)
+	}
+
+	if len(schema.OneOf) > 0 {
+		matched := 0
+		for _, option := range schema.OneOf {
+			if len(validate(doc, option, value, at)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return []string{fmt.Sprintf("%s: matches %d of the oneOf schemas, want 1", at, matched)}
+		}
+		return nil
+	}
+
+	var types []string
+	switch typ := schema.Type.(type) {
+	case string:
+		types = []string{typ}
+	case []any:
+		for _, name := range typ {
+			types = append(types, fmt.Sprint(name))
+		}
+	case []string:
+		types = typ
+	}
+	if len(types) > 0 && !slices.Contains(types, jsonType(value)) && !(jsonType(value) == "integer" && slices.Contains(types, "number")) {
+		return []string{fmt.Sprintf("%s: got a %s, want %s", at, jsonType(value), strings.Join(types, " or "))}
+	}
+
+	var problems []string
+	switch value := value.(type) {
+	case string:
+		if len(schema.Enum) > 0 && !slices.Contains(schema.Enum, value) {
+			problems = append(problems, fmt.Sprintf("%s: %q is not one of %v", at, value, schema.Enum))
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q is not a date-time", at, value))
+			}
+		}
+	case float64:
+		if schema.Minimum != nil && value < *schema.Minimum {
+			problems = append(problems, fmt.Sprintf("%s: %v is less than %v", at, value, *schema.Minimum))
+		}
+	case []any:
+		for i, item := range value {
+			problems = append(problems, validate(doc, schema.Items, item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case map[string]any:
+		for _, name := range schema.Required {
+			if _, ok := value[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: the required %q is missing", at, name))
+			}
+		}
+		for name, property := range value {
+			propertySchema, ok := schema.Properties[name]
+			if !ok {
+				propertySchema = schema.AdditionalProperties
+			}
+			if !ok && propertySchema == nil && schema.Properties != nil {
+				problems = append(problems, fmt.Sprintf("%s: %q is not documented", at, name))
+				continue
+			}
+			problems = append(problems, validate(doc, propertySchema, property, at+"."+name)...)
+		}
+	}
+	return problems
+}
+
+// jsonType returns the JSON Schema type of a decoded JSON value.
+func jsonType(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func TestValidate(t *testing.T) {
+	doc := openapi.New("test", "1")
+	doc.Schema(publicFileResponse{})
+	schema := openapi.OneOf(doc.Schema(fileInfoResponse{}), doc.Schema(publicFileResponse{}))
+
+	tests := []struct {
+		name  string
+		body  string
+		valid bool
+	}{
+		{"public", `{"data":{"idPublic":"a","name":"a.txt","size":1,"contentType":"text/plain","expireDate":"2026-01-02T03:04:05Z"},"expiresIn":1,"passwordProtected":false,"scanStatus":"available"}`, true},
+		{"undocumented key", `{"data":{"idPublic":"a","name":"a.txt","size":1,"contentType":"text/plain","expireDate":"2026-01-02T03:04:05Z","idPrivate":"b"},"expiresIn":1,"passwordProtected":false,"scanStatus":"available"}`, false},
+		{"missing key", `{"data":{"idPublic":"a","name":"a.txt","size":1,"contentType":"text/plain"},"expiresIn":1,"passwordProtected":false,"scanStatus":"available"}`, false},
+		{"wrong type", `{"data":{"idPublic":"a","name":"a.txt","size":"1","contentType":"text/plain","expireDate":"2026-01-02T03:04:05Z"},"expiresIn":1,"passwordProtected":false,"scanStatus":"available"}`, false},
+		{"bad date", `{"data":{"idPublic":"a","name":"a.txt","size":1,"contentType":"text/plain","expireDate":"tomorrow"},"expiresIn":1,"passwordProtected":false,"scanStatus":"available"}`, false},
+		{"fractional integer", `{"data":{"idPublic":"a","name":"a.txt","size":1,"contentType":"text/plain","expireDate":"2026-01-02T03:04:05Z"},"expiresIn":1.5,"passwordProtected":false,"scanStatus":"available"}`, false},
+		{"null object", `null`, false},
+	}
+
+	// The document goes through JSON like the one served to clients
+	var served openapi.Document
+	var servedSchema openapi.Schema
+	for v, decoded := range map[any]any{doc: &served, schema: &servedSchema} {
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(encoded, decoded); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range tests {
+		var value any
+		if err := json.Unmarshal([]byte(test.body), &value); err != nil {
+			t.Fatal(err)
+		}
+
+		problems := validate(&served, &servedSchema, value, "body")
+		if test.valid && len(problems) > 0 {
+			t.Errorf("%s: unexpected problems %v", test.name, problems)
+		}
+		if !test.valid && len(problems) == 0 {
+			t.Errorf("%s: the body was accepted", test.name)
+		}
+	}
+}
+
+// specChecker sends requests and checks their responses against the operation documenting their route.
+type specChecker struct {
+	t         *testing.T
+	ts        *testServer
+	doc       *openapi.Document
+	exercised map[string]bool // Operations that answered at least once, as "method path"
+}
+
+// operation finds the documented route of a request: the path with the most literal segments matching it.
+func (sc *specChecker) operation(method, target string) (string, *openapi.Operation) {
+	path, _, _ := strings.Cut(target, "?")
+	segments := strings.Split(path, "/")
+
+	best, bestLiterals := "", -1
+	for candidate, item := range sc.doc.Paths {
+		if item[method] == nil {
+			continue
+		}
+		parts := strings.Split(candidate, "/")
+		if len(parts) != len(segments) {
+			continue
+		}
+
+		literals := 0
+		for i, part := range parts {
+			if strings.HasPrefix(part, "{") {
+				continue
+			}
+			if part != segments[i] {
+				literals = -1
+				break
+			}
+			literals++
+		}
+		if literals > bestLiterals {
+			best, bestLiterals = candidate, literals
+		}
+	}
+	if best == "" {
+		return "", nil
+	}
+	return best, sc.doc.Paths[best][method]
+}
+
+// do sends a request and checks that its status is documented and its JSON body matches the documented schema.
+func (sc *specChecker) do(method, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	t := sc.t
+	t.Helper()
+
+	w := sc.ts.do(method, target, body, header)
+	path, op := sc.operation(strings.ToLower(method), target)
+	if op == nil {
+		t.Errorf("%s %s: no documented route matches", method, target)
+		return w
+	}
+	sc.exercised[strings.ToLower(method)+" "+path] = true
+
+	response, ok := op.Responses[strconv.Itoa(w.Code)]
+	if !ok {
+		t.Errorf("%s %s: the status %d is not documented: %s", method, target, w.Code, w.Body)
+		return w
+	}
+	if w.Body.Len() == 0 || method == http.MethodHead {
+		return w
+	}
+
+	contentType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	media, ok := response.Content[contentType]
+	if !ok {
+		// Downloads are documented as any type of content
+		if media, ok = response.Content["application/octet-stream"]; !ok {
+			t.Errorf("%s %s: the %s body of %d is not documented", method, target, contentType, w.Code)
+			return w
+		}
+	}
+	if contentType != "application/json" {
+		return w
+	}
+
+	var value any
+	if err := decodeBody(w, &value); err != nil {
+		t.Errorf("%s %s: %v", method, target, err)
+		return w
+	}
+	for _, problem := range validate(sc.doc, media.Schema, value, "body") {
+		t.Errorf("%s %s %d: %s", method, target, w.Code, problem)
+	}
+	return w
+}
+
+// uploadForm sends a text file with a multipart form and returns the upload.
+func (sc *specChecker) uploadForm(target, name string, fields map[string]string) uploadResponse {
+	t := sc.t
+	t.Helper()
+
+	body, contentType := uploadForm(t, name, "text/plain", []byte("content of "+name), fields)
+	w := sc.do(http.MethodPost, target, body, http.Header{"Content-Type": {contentType}})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("%s: got %d %s", target, w.Code, w.Body)
+	}
+	uploaded := decode[uploadResponse](t, w)
+	sc.ts.waitScanned(t, uploaded.Data.IdPublic)
+	return uploaded
+}
+
+// resumable runs a tus upload on a base path, returning the upload it created.
+func (sc *specChecker) resumable(base, name string) uploadResponse {
+	t := sc.t
+	t.Helper()
+
+	content := "resumed content of " + name
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte(name)) + ",filetype " + base64.StdEncoding.EncodeToString([]byte("text/plain"))
+	sc.do(http.MethodOptions, base, nil, nil)
+
+	w := sc.do(http.MethodPost, base, nil, tusRequestHeader("Upload-Length", strconv.Itoa(len(content)), "Upload-Metadata", metadata))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create %s: got %d %s", base, w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+
+	sc.do(http.MethodHead, location, nil, tusRequestHeader())
+	chunk := tusRequestHeader("Content-Type", "application/offset+octet-stream", "Upload-Offset", "0")
+	sc.do(http.MethodPatch, location, strings.NewReader(content[:4]), chunk)
+	chunk.Set("Upload-Offset", "1")
+	sc.do(http.MethodPatch, location, strings.NewReader(content[4:]), chunk)
+	chunk.Set("Upload-Offset", "4")
+	w = sc.do(http.MethodPatch, location, strings.NewReader(content[4:]), chunk)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("last chunk of %s: got %d %s", base, w.Code, w.Body)
+	}
+	uploaded := decode[uploadResponse](t, w)
+	sc.ts.waitScanned(t, uploaded.Data.IdPublic)
+
+	// A second upload is abandoned
+	w = sc.do(http.MethodPost, base, nil, tusRequestHeader("Upload-Length", "4", "Upload-Metadata", metadata))
+	sc.do(http.MethodDelete, w.Header().Get("Location"), nil, tusRequestHeader())
+	sc.do(http.MethodHead, w.Header().Get("Location"), nil, tusRequestHeader())
+	return uploaded
+}
+
+func TestResponsesMatchDocument(t *testing.T) {
+	ts := newTestServer(t)
+	sc := &specChecker{t: t, ts: ts, doc: fetchDocument(t, ts), exercised: map[string]bool{}}
+	sc.do(http.MethodGet, "/openapi.json", nil, nil)
+
+	sc.do(http.MethodGet, "/api/v1/limits", nil, nil)
+	sc.do(http.MethodGet, "/api/v1/me", nil, nil)
+	sc.do(http.MethodGet, "/myInfo", nil, nil)
+
+	uploaded := sc.uploadForm("/api/v1/files", "spec.txt", map[string]string{"email": "someone@example.com", "password": "open sesame"})
+	legacy := sc.uploadForm("/sendFile", "legacy.txt", map[string]string{"maxDownloads": "1"})
+	sc.uploadForm("/api/v1/files", "duplicate.txt", nil)
+	deleted := sc.uploadForm("/api/v1/files", "deleted.txt", nil)
+	body, contentType := uploadForm(t, "duplicate.txt", "text/plain", []byte("content of duplicate.txt"), nil)
+	sc.do(http.MethodPost, "/api/v1/files", body, http.Header{"Content-Type": {contentType}})
+	body, contentType = uploadForm(t, "negative.txt", "text/plain", []byte("negative"), map[string]string{"maxDownloads": "-1"})
+	sc.do(http.MethodPost, "/sendFile", body, http.Header{"Content-Type": {contentType}})
+	resumed := sc.resumable("/api/v1/uploads", "resumed.txt")
+	sc.resumable("/uploads", "legacy-resumed.txt")
+
+	owner := http.Header{"Authorization": {"Bearer " + uploaded.OwnerToken}}
+	info := "/api/v1/files/" + uploaded.Data.IdPublic
+	sc.do(http.MethodGet, info, nil, nil)
+	sc.do(http.MethodGet, info, nil, owner)
+	sc.do(http.MethodGet, info, nil, http.Header{"Authorization": {"Bearer " + legacy.OwnerToken}})
+	sc.do(http.MethodGet, "/api/v1/files/unknown", nil, nil)
+	sc.do(http.MethodGet, "/fileInfo?idPublic="+uploaded.Data.IdPublic, nil, owner)
+	sc.do(http.MethodGet, "/fileInfo?idPublic="+uploaded.Data.IdPublic, nil, nil)
+
+	content := "/api/v1/files/" + uploaded.Data.IdPublic + "/content"
+	sc.do(http.MethodGet, content, nil, nil)
+	sc.do(http.MethodGet, content, nil, http.Header{"X-File-Password": {"guess"}})
+	sc.do(http.MethodGet, content, nil, http.Header{"X-File-Password": {"open sesame"}})
+	sc.do(http.MethodGet, "/api/v1/files/"+resumed.Data.IdPublic+"/content", nil, nil)
+	sc.do(http.MethodGet, "/downloadFile?idPublic="+legacy.Data.IdPublic, nil, nil)
+	sc.do(http.MethodGet, "/downloadFile?idPublic="+legacy.Data.IdPublic, nil, nil)
+
+	sc.do(http.MethodGet, "/api/v1/me", nil, nil)
+	sc.do(http.MethodGet, "/myInfo", nil, nil)
+
+	sc.do(http.MethodDelete, "/api/v1/files/"+uploaded.OwnerToken, nil, nil)
+	deletedOwner := http.Header{"Authorization": {"Bearer " + deleted.OwnerToken}}
+	sc.do(http.MethodDelete, "/api/v1/files/"+legacy.Data.IdPublic, nil, deletedOwner)
+	sc.do(http.MethodDelete, "/api/v1/files/"+deleted.Data.IdPublic, nil, deletedOwner)
+	sc.do(http.MethodDelete, "/api/v1/files/unknown", nil, nil)
+	form := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	sc.do(http.MethodPost, "/deleteFile", strings.NewReader("idPrivate="+resumed.OwnerToken), form)
+	sc.do(http.MethodPost, "/deleteFile", strings.NewReader(""), form)
+
+	sc.do(http.MethodDelete, "/api/v1/me", nil, nil)
+	sc.do(http.MethodPost, "/deleteUser", nil, nil)
+
+	var missed []string
+	for path, item := range sc.doc.Paths {
+		for method := range item {
+			if !sc.exercised[method+" "+path] {
+				missed = append(missed, method+" "+path)
+			}
+		}
+	}
+	sort.Strings(missed)
+	for _, operation := range missed {
+		t.Errorf("%s was not exercised", operation)
+	}
+}
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Local stores the objects as regular files under a root directory.
+type Local struct {
+	root string
+}
+
+// NewLocal creates a storage backed by the given directory, creating it if needed.
+// Parameters:
+//   root (string): The directory where the objects are stored.
+// Returns:
+//   *Local: The local storage.
+//   error: An error if the directory could not be created.
+func NewLocal(root string) (*Local, error) {
+	if root == "" {
+		return nil, fmt.Errorf("the storage root directory was not provided")
+	}
+
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating storage directory: %v", err)
+	}
+
+	return &Local{root: root}, nil
+}
+
+// path converts an object key into a path inside the root directory.
+// Empty keys, keys naming the root itself and keys that are absolute or escape the root are refused with ErrInvalidKey.
+func (l *Local) path(key string) (string, error) {
+	native := filepath.FromSlash(key)
+	if !filepath.IsLocal(native) || filepath.Clean(native) == "." {
+		return "", fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+
+	return filepath.Join(l.root, native), nil
+}
+
+// key converts a path inside the root directory back into an object key.
+func (l *Local) key(path_ string) string {
+	rel, err := filepath.Rel(l.root, path_)
+	if err != nil {
+		return filepath.ToSlash(path_)
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// Put writes the object to a temporary file next to its destination and renames it into place.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	path_, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path_), os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path_), ".tmp_*")
+	if err != nil {
+		return fmt.Errorf("error creating output file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error copying file: %v", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing output file: %v", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path_); err != nil {
+		return fmt.Errorf("error moving file into place: %v", err)
+	}
+
+	return nil
+}
+
+// Adopt renames the file at path into place. When path is on another file system the file is copied with Put instead.
+func (l *Local) Adopt(ctx context.Context, key string, path string) error {
+	dest, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+
+	if err := os.Rename(path, dest); err == nil {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening input file: %v", err)
+	}
+	defer file.Close()
+
+	if err := l.Put(ctx, key, file, -1); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Get opens the file stored under key.
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, Object, error) {
+	path_, err := l.path(key)
+	if err != nil {
+		return nil, Object{}, err
+	}
+
+	file, err := os.Open(path_)
+	if os.IsNotExist(err) {
+		return nil, Object{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, Object{}, fmt.Errorf("error opening file: %v", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		return nil, Object{}, ErrNotFound
+	}
+
+	return file, Object{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// Delete removes the file stored under key.
+func (l *Local) Delete(ctx context.Context, key string) error {
+	path_, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path_); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error deleting file: %v", err)
+	}
+
+	return nil
+}
+
+// Stat describes the file stored under key.
+func (l *Local) Stat(ctx context.Context, key string) (Object, error) {
+	path_, err := l.path(key)
+	if err != nil {
+		return Object{}, err
+	}
+
+	info, err := os.Stat(path_)
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return Object{}, ErrNotFound
+	}
+	if err != nil {
+		return Object{}, fmt.Errorf("error reading file information: %v", err)
+	}
+
+	return Object{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// List walks the root directory and returns the files whose key starts with prefix.
+// Hidden entries, such as the temporary files left by an interrupted Put or a staging directory, are skipped.
+func (l *Local) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects := []Object{}
+
+	// Only walk the deepest directory that can contain the prefix.
+	dir := l.root
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		var err error
+		if dir, err = l.path(prefix[:i]); err != nil {
+			return objects, err
+		}
+	}
+
+	err := filepath.WalkDir(dir, func(path_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if strings.HasPrefix(entry.Name(), ".") && path_ != dir {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if entry.IsDir() {
+			return nil
+		}
+
+		key := l.key(path_)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, Object{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return []Object{}, fmt.Errorf("it was not possible to read the storage directory: %v", err)
+	}
+
+	return objects, nil
+}
+
+// Usage sums the size of the files whose key starts with prefix.
+func (l *Local) Usage(ctx context.Context, prefix string) (int64, error) {
+	objects, err := l.List(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, object := range objects {
+		total += object.Size
+	}
+
+	return total, nil
+}
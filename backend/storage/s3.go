@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config holds the settings needed to reach an S3-compatible bucket (AWS S3, MinIO, ...).
+type S3Config struct {
+	Endpoint  string // Host and port of the S3 API, without scheme (e.g. "localhost:9000")
+	AccessKey string // Access key ID
+	SecretKey string // Secret access key
+	Bucket    string // Bucket where the objects are stored
+	Region    string // Region of the bucket, optional
+	Prefix    string // Prefix added to every key, optional
+	UseSSL    bool   // Whether HTTPS is used to reach the endpoint
+}
+
+// S3 stores the objects in an S3-compatible bucket.
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 creates a storage backed by an S3-compatible bucket, creating the bucket if it does not exist.
+// Parameters:
+//   config (S3Config): The connection settings.
+// Returns:
+//   *S3: The S3 storage.
+//   error: An error if the client could not be created or the bucket is not reachable.
+func NewS3(config S3Config) (*S3, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT and S3_BUCKET must be provided")
+	}
+
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating S3 client: %v", err)
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("error reaching S3 bucket: %v", err)
+	}
+
+	if !exists {
+		if err := client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region}); err != nil {
+			return nil, fmt.Errorf("error creating S3 bucket: %v", err)
+		}
+	}
+
+	prefix := strings.Trim(config.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return &S3{client: client, bucket: config.Bucket, prefix: prefix}, nil
+}
+
+// isNotFound reports whether err means the object does not exist.
+func isNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+// Put uploads the object to the bucket.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, s.prefix+key, r, size, minio.PutObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("error uploading object: %v", err)
+	}
+
+	return nil
+}
+
+// Get downloads the object from the bucket.
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, Object, error) {
+	object, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, Object{}, err
+	}
+
+	reader, err := s.client.GetObject(ctx, s.bucket, s.prefix+key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, Object{}, fmt.Errorf("error downloading object: %v", err)
+	}
+
+	return reader, object, nil
+}
+
+// Delete removes the object from the bucket.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	err := s.client.RemoveObject(ctx, s.bucket, s.prefix+key, minio.RemoveObjectOptions{})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("error deleting object: %v", err)
+	}
+
+	return nil
+}
+
+// Stat describes the object stored in the bucket.
+func (s *S3) Stat(ctx context.Context, key string) (Object, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, s.prefix+key, minio.StatObjectOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return Object{}, ErrNotFound
+		}
+		return Object{}, fmt.Errorf("error reading object information: %v", err)
+	}
+
+	return Object{Key: key, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+// List returns the objects of the bucket whose key starts with prefix.
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	objects := []Object{}
+
+	for info := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix + prefix, Recursive: true}) {
+		if info.Err != nil {
+			return []Object{}, fmt.Errorf("error listing objects: %v", info.Err)
+		}
+
+		objects = append(objects, Object{
+			Key:     strings.TrimPrefix(info.Key, s.prefix),
+			Size:    info.Size,
+			ModTime: info.LastModified,
+		})
+	}
+
+	return objects, nil
+}
+
+// Usage sums the size of the objects whose key starts with prefix.
+func (s *S3) Usage(ctx context.Context, prefix string) (int64, error) {
+	objects, err := s.List(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, object := range objects {
+		total += object.Size
+	}
+
+	return total, nil
+}
@@ -0,0 +1,118 @@
+// Package storage abstracts where uploaded files are kept, so the same handlers can work on a local disk or on an S3-compatible bucket.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// ErrNotFound is returned when the requested object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// ErrInvalidKey is returned when a key cannot name an object, such as an empty key or one escaping the storage.
+var ErrInvalidKey = errors.New("invalid object key")
+
+// Object describes a stored file.
+type Object struct {
+	Key     string    // Key of the object, using "/" as separator (e.g. "<user>/<file>")
+	Size    int64     // Size of the object in bytes
+	ModTime time.Time // Last modification date of the object
+}
+
+// Storage is implemented by every backend able to keep the uploaded files.
+type Storage interface {
+	// Put stores the content read from r under key, replacing any previous object. size is -1 when unknown.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens the object stored under key. The caller must close the returned reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, Object, error)
+	// Delete removes the object stored under key. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+	// Stat returns the description of the object stored under key, or ErrNotFound.
+	Stat(ctx context.Context, key string) (Object, error)
+	// List returns every object whose key starts with prefix, recursively.
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Usage returns the total size in bytes of every object whose key starts with prefix.
+	Usage(ctx context.Context, prefix string) (int64, error)
+}
+
+// Adopter is implemented by the storages able to take ownership of a local file without copying it.
+type Adopter interface {
+	// Adopt moves the file at path so that it becomes the object stored under key.
+	Adopt(ctx context.Context, key string, path string) error
+}
+
+// PutFile stores the local file at path under key. Storages implementing Adopter take the file over
+// (usually with an atomic rename); the others receive a copy and the file is left in place.
+// Parameters:
+//   ctx (context.Context): Context of the storage operation.
+//   s (Storage): The storage receiving the file.
+//   key (string): The key of the new object.
+//   path (string): The path of the local file.
+// Returns:
+//   error: An error if the file could not be stored.
+func PutFile(ctx context.Context, s Storage, key string, path string) error {
+	if adopter, ok := s.(Adopter); ok {
+		return adopter.Adopt(ctx, key, path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening input file: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading input file: %v", err)
+	}
+
+	return s.Put(ctx, key, file, info.Size())
+}
+
+// Key joins the given parts into an object key.
+// Parameters:
+//   parts (...string): The directory and file names composing the key.
+// Returns:
+//   string: The object key, using "/" as separator.
+func Key(parts ...string) string {
+	return path.Join(parts...)
+}
+
+// FromEnv builds the storage selected by the STORAGE_BACKEND environment variable ("local" by default, or "s3").
+// The local backend stores files under SAVE_PATH; the s3 backend reads its configuration from the S3_* variables.
+// Returns:
+//   Storage: The configured storage backend.
+//   error: An error if the backend is unknown or could not be configured.
+func FromEnv() (Storage, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		return NewLocal(os.Getenv("SAVE_PATH"))
+	case "s3":
+		useSSL := true
+		if value := os.Getenv("S3_USE_SSL"); value != "" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid S3_USE_SSL %q", value)
+			}
+			useSSL = parsed
+		}
+
+		return NewS3(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Region:    os.Getenv("S3_REGION"),
+			Prefix:    os.Getenv("S3_PREFIX"),
+			UseSSL:    useSSL,
+		})
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+}
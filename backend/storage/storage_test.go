@@ -0,0 +1,271 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/storage"
+	"backend/storage/storagetest"
+)
+
+// testStorage runs the operations every backend must support on an empty storage.
+func testStorage(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	objects := map[string]string{
+		"alice/one.txt":   "first file of alice",
+		"alice/two.txt":   "second",
+		"alicia/one.txt":  "not alice",
+		"bob/nested/file": "deeper",
+	}
+
+	t.Run("put", func(t *testing.T) {
+		for key, content := range objects {
+			if err := s.Put(ctx, key, strings.NewReader(content), int64(len(content))); err != nil {
+				t.Fatalf("put %s: %v", key, err)
+			}
+		}
+
+		// The size may be unknown
+		if err := s.Put(ctx, "carol/unknown", strings.NewReader("unknown size"), -1); err != nil {
+			t.Fatalf("put without size: %v", err)
+		}
+		objects["carol/unknown"] = "unknown size"
+
+		// A new object replaces the previous one
+		if err := s.Put(ctx, "alice/two.txt", strings.NewReader("second, replaced"), 16); err != nil {
+			t.Fatalf("put over an object: %v", err)
+		}
+		objects["alice/two.txt"] = "second, replaced"
+	})
+
+	t.Run("get", func(t *testing.T) {
+		for key, content := range objects {
+			reader, object, err := s.Get(ctx, key)
+			if err != nil {
+				t.Fatalf("get %s: %v", key, err)
+			}
+			got, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil || string(got) != content {
+				t.Errorf("get %s: got %q, %v, want %q", key, got, err, content)
+			}
+			if object.Key != key || object.Size != int64(len(content)) || object.ModTime.IsZero() {
+				t.Errorf("get %s: unexpected description %+v", key, object)
+			}
+		}
+
+		if _, _, err := s.Get(ctx, "alice/missing.txt"); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("get of a missing object: got %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("stat", func(t *testing.T) {
+		object, err := s.Stat(ctx, "bob/nested/file")
+		if err != nil || object.Key != "bob/nested/file" || object.Size != 6 {
+			t.Errorf("got %+v, %v", object, err)
+		}
+		if _, err := s.Stat(ctx, "bob/missing"); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("stat of a missing object: got %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		tests := []struct {
+			prefix string
+			want   []string
+		}{
+			{"alice/", []string{"alice/one.txt", "alice/two.txt"}},
+			{"ali", []string{"alice/one.txt", "alice/two.txt", "alicia/one.txt"}},
+			{"bob/", []string{"bob/nested/file"}},
+			{"", []string{"alice/one.txt", "alice/two.txt", "alicia/one.txt", "bob/nested/file", "carol/unknown"}},
+			{"dave/", []string{}},
+		}
+		for _, test := range tests {
+			listed, err := s.List(ctx, test.prefix)
+			if err != nil {
+				t.Fatalf("list %q: %v", test.prefix, err)
+			}
+			keys := []string{}
+			for _, object := range listed {
+				keys = append(keys, object.Key)
+				if object.Size != int64(len(objects[object.Key])) {
+					t.Errorf("list %q: got size %d for %s", test.prefix, object.Size, object.Key)
+				}
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, test.want) {
+				t.Errorf("list %q: got %v, want %v", test.prefix, keys, test.want)
+			}
+		}
+
+		usage, err := s.Usage(ctx, "alice/")
+		if want := int64(len(objects["alice/one.txt"]) + len(objects["alice/two.txt"])); err != nil || usage != want {
+			t.Errorf("usage: got %d, %v, want %d", usage, err, want)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := s.Delete(ctx, "alice/one.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Stat(ctx, "alice/one.txt"); !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("stat after delete: got %v, want ErrNotFound", err)
+		}
+		if err := s.Delete(ctx, "alice/one.txt"); err != nil {
+			t.Errorf("deleting a missing object: %v", err)
+		}
+		if listed, err := s.List(ctx, "alice/"); err != nil || len(listed) != 1 {
+			t.Errorf("list after delete: got %v, %v", listed, err)
+		}
+	})
+}
+
+func TestLocal(t *testing.T) {
+	local, err := storage.NewLocal(filepath.Join(t.TempDir(), "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, local)
+}
+
+func TestLocalLayout(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	local, err := storage.NewLocal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys cannot be empty, name the root directory or escape it
+	for _, key := range []string{"", ".", "alice/..", "..", "../escaped", "alice/../../escaped", "/escaped"} {
+		if err := local.Put(ctx, key, strings.NewReader("content"), 7); !errors.Is(err, storage.ErrInvalidKey) {
+			t.Errorf("put %q: got %v, want ErrInvalidKey", key, err)
+		}
+		if err := local.Delete(ctx, key); !errors.Is(err, storage.ErrInvalidKey) {
+			t.Errorf("delete %q: got %v, want ErrInvalidKey", key, err)
+		}
+		if _, _, err := local.Get(ctx, key); !errors.Is(err, storage.ErrInvalidKey) {
+			t.Errorf("get %q: got %v, want ErrInvalidKey", key, err)
+		}
+		if _, err := local.Stat(ctx, key); !errors.Is(err, storage.ErrInvalidKey) {
+			t.Errorf("stat %q: got %v, want ErrInvalidKey", key, err)
+		}
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("the root directory was removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "escaped")); !os.IsNotExist(err) {
+		t.Errorf("an object was stored outside the root: %v", err)
+	}
+
+	// Hidden entries, such as temporary files and the staging directory, are not objects
+	os.MkdirAll(filepath.Join(root, "alice", ".staging"), 0700)
+	os.WriteFile(filepath.Join(root, "alice", ".tmp_123"), []byte("partial"), 0600)
+	os.WriteFile(filepath.Join(root, "alice", ".staging", "upload"), []byte("staged"), 0600)
+	if listed, err := local.List(ctx, "alice/"); err != nil || len(listed) != 0 {
+		t.Errorf("got %v, %v, want no object", listed, err)
+	}
+
+	// Adopted files are moved into place
+	path := filepath.Join(root, "alice", ".staging", "upload")
+	if err := storage.PutFile(ctx, local, "alice/adopted", path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the adopted file was left in place: %v", err)
+	}
+	if object, err := local.Stat(ctx, "alice/adopted"); err != nil || object.Size != 6 {
+		t.Errorf("got %+v, %v", object, err)
+	}
+
+	// A directory is not an object
+	if _, err := local.Stat(ctx, "alice"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("stat of a directory: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestS3(t *testing.T) {
+	server := storagetest.NewS3()
+	defer server.Close()
+
+	s3, err := storage.NewS3(storage.S3Config{Endpoint: server.Endpoint, Bucket: "uploads", Region: "us-east-1", Prefix: "/files/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s3)
+
+	// The keys are stored under the prefix, which List removes
+	want := []string{"alice/two.txt", "alicia/one.txt", "bob/nested/file", "carol/unknown"}
+	for i := range want {
+		want[i] = "files/" + want[i]
+	}
+	if got := server.Keys("uploads"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got the keys %v, want %v", got, want)
+	}
+
+	// Objects larger than a part are sent in several ones when their size is unknown
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1<<20+1)
+	if err := s3.Put(context.Background(), "alice/large", bytes.NewReader(large), -1); err != nil {
+		t.Fatal(err)
+	}
+	reader, object, err := s3.Get(context.Background(), "alice/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if got, err := io.ReadAll(reader); err != nil || !bytes.Equal(got, large) || object.Size != int64(len(large)) {
+		t.Errorf("got %d bytes, %v, want %d", len(got), err, len(large))
+	}
+}
+
+func TestS3Config(t *testing.T) {
+	if _, err := storage.NewS3(storage.S3Config{Bucket: "uploads"}); err == nil {
+		t.Error("a configuration without endpoint was accepted")
+	}
+	if _, err := storage.NewS3(storage.S3Config{Endpoint: "localhost:9000"}); err == nil {
+		t.Error("a configuration without bucket was accepted")
+	}
+}
+
+// TestMinIO runs the storage tests against a real S3-compatible server, when STORAGE_TEST_S3_ENDPOINT is set
+// (e.g. "localhost:9000" for a MinIO started with its default credentials in STORAGE_TEST_S3_ACCESS_KEY and
+// STORAGE_TEST_S3_SECRET_KEY). Each run uses its own prefix in the STORAGE_TEST_S3_BUCKET bucket ("backend-test" by default).
+func TestMinIO(t *testing.T) {
+	endpoint := os.Getenv("STORAGE_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("STORAGE_TEST_S3_ENDPOINT is not set")
+	}
+	bucket := os.Getenv("STORAGE_TEST_S3_BUCKET")
+	if bucket == "" {
+		bucket = "backend-test"
+	}
+
+	s3, err := storage.NewS3(storage.S3Config{
+		Endpoint:  endpoint,
+		AccessKey: os.Getenv("STORAGE_TEST_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("STORAGE_TEST_S3_SECRET_KEY"),
+		Bucket:    bucket,
+		Prefix:    fmt.Sprintf("test-%d", time.Now().UnixNano()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		objects, _ := s3.List(context.Background(), "")
+		for _, object := range objects {
+			s3.Delete(context.Background(), object.Key)
+		}
+	})
+
+	testStorage(t, s3)
+}
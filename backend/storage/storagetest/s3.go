@@ -0,0 +1,282 @@
+// Package storagetest provides a fake S3 server, so the S3 storage can be exercised without a real bucket.
+package storagetest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3 is a fake S3 API answering the requests of minio-go used by storage.S3: buckets, single and multipart uploads,
+// downloads, deletions and ListObjectsV2. Signatures are not checked and every bucket lives in memory.
+type S3 struct {
+	Endpoint string // Host and port to give to storage.S3Config, reached over plain HTTP
+
+	server  *httptest.Server
+	mu      sync.Mutex
+	buckets map[string]map[string]object
+	uploads map[string]map[int][]byte // Parts of the unfinished multipart uploads, indexed by upload ID
+	next    int
+}
+
+// object is a stored object.
+type object struct {
+	data     []byte
+	modified time.Time
+}
+
+// etag returns the quoted MD5 of the object, like S3 does for single part uploads.
+func (o object) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// NewS3 starts a fake S3 server on a random local port.
+// Returns:
+//   *S3: The running server, to be stopped with Close.
+func NewS3() *S3 {
+	s := &S3{buckets: map[string]map[string]object{}, uploads: map[string]map[int][]byte{}}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.Endpoint = strings.TrimPrefix(s.server.URL, "http://")
+	return s
+}
+
+// Close stops the server.
+func (s *S3) Close() {
+	s.server.Close()
+}
+
+// Keys returns the keys stored in a bucket, sorted.
+// Parameters:
+//   bucket (string): The name of the bucket.
+// Returns:
+//   []string: The keys of the objects, nil if the bucket does not exist.
+func (s *S3) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// serve routes the path style requests, "/bucket" and "/bucket/key".
+func (s *S3) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	objects, exists := s.buckets[bucket]
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case r.Method == http.MethodPut:
+			if !exists {
+				s.buckets[bucket] = map[string]object{}
+			}
+		case !exists:
+			writeError(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		case r.Method == http.MethodGet && query.Has("location"):
+			writeXML(w, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Region  string   `xml:",chardata"`
+			}{Region: "us-east-1"})
+		case r.Method == http.MethodGet:
+			s.list(w, objects, query.Get("prefix"))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if !exists {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.next++
+		id := strconv.Itoa(s.next)
+		s.uploads[id] = map[int][]byte{}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", key)
+			return
+		}
+		data, err := readBody(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", key)
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[number] = data
+		w.Header().Set("ETag", object{data: data}.etag())
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", key)
+			return
+		}
+		delete(s.uploads, query.Get("uploadId"))
+		numbers := make([]int, 0, len(parts))
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, number := range numbers {
+			data = append(data, parts[number]...)
+		}
+		stored := object{data: data, modified: time.Now().UTC()}
+		objects[key] = stored
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: stored.etag()})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		data, err := readBody(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", key)
+			return
+		}
+		stored := object{data: data, modified: time.Now().UTC()}
+		objects[key] = stored
+		w.Header().Set("ETag", stored.etag())
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		stored, ok := objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(stored.data)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", stored.etag())
+		w.Header().Set("Last-Modified", stored.modified.Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(stored.data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// list answers ListObjectsV2 with every object whose key starts with prefix, in a single page.
+func (s *S3) list(w http.ResponseWriter, objects map[string]object, prefix string) {
+	type contents struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+		StorageClass string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Prefix      string
+		KeyCount    int
+		MaxKeys     int
+		IsTruncated bool
+		Contents    []contents
+	}{Prefix: prefix, MaxKeys: 1000}
+
+	for key, stored := range objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, contents{
+				Key:          key,
+				LastModified: stored.modified.Format("2006-01-02T15:04:05.000Z"),
+				ETag:         stored.etag(),
+				Size:         len(stored.data),
+				StorageClass: "STANDARD",
+			})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+
+	writeXML(w, result)
+}
+
+// readBody reads the content of an upload, decoding the aws-chunked encoding minio-go uses over plain HTTP.
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	// Each chunk is "<hex size>[;chunk-signature=...]\r\n<data>\r\n", the last one is empty and may be followed by trailers
+	var data bytes.Buffer
+	reader := bufio.NewReader(r.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chunk size %q", sizeHex)
+		}
+		if size == 0 {
+			io.Copy(io.Discard, reader)
+			return data.Bytes(), nil
+		}
+		if _, err := io.CopyN(&data, reader, size); err != nil {
+			return nil, err
+		}
+		if _, err := reader.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// writeXML answers with an XML document.
+func writeXML(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(value)
+}
+
+// writeError answers with an S3 error. HEAD requests only get the status, like on S3.
+func writeError(w http.ResponseWriter, status int, code, resource string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: code, Message: code, Resource: resource})
+}
@@ -0,0 +1,231 @@
+// Package sweeper periodically removes expired files and users from the storage and the database.
+package sweeper
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/db"
+	"backend/storage"
+	"backend/utils"
+)
+
+const defaultInterval = 10 * time.Minute
+
+// Sweeper enforces File.ExpireDate and User.IpExpireDate by deleting whatever has expired.
+type Sweeper struct {
+	Interval time.Duration     // Time between two sweeps
+	DryRun   bool              // When true, expired data is only logged and nothing is deleted
+	Storage  storage.Storage   // Storage where the users files are kept
+	Files    db.FileRepository // Metadata of the files
+	Users    db.UserRepository // Users owning the files
+}
+
+// Report summarizes what a single sweep did (or would do, in dry-run mode).
+type Report struct {
+	Files  int // Number of expired files removed
+	Users  int // Number of expired users purged
+	Errors int // Number of operations that failed
+}
+
+// FromEnv builds a Sweeper using the SWEEP_INTERVAL and SWEEP_DRY_RUN environment variables.
+// Parameters:
+//   blobs (storage.Storage): The storage where the users files are kept.
+//   files (db.FileRepository): The repository holding the metadata of the files.
+//   users (db.UserRepository): The repository holding the users.
+// Returns:
+//   *Sweeper: The configured sweeper.
+//   error: An error if SWEEP_INTERVAL or SWEEP_DRY_RUN cannot be parsed.
+func FromEnv(blobs storage.Storage, files db.FileRepository, users db.UserRepository) (*Sweeper, error) {
+	s := &Sweeper{
+		Interval: defaultInterval,
+		Storage:  blobs,
+		Files:    files,
+		Users:    users,
+	}
+
+	if value := os.Getenv("SWEEP_INTERVAL"); value != "" {
+		interval, err := utils.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid SWEEP_INTERVAL %q", value)
+		}
+		s.Interval = interval
+	}
+
+	if value := os.Getenv("SWEEP_DRY_RUN"); value != "" {
+		dryRun, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SWEEP_DRY_RUN %q", value)
+		}
+		s.DryRun = dryRun
+	}
+
+	return s, nil
+}
+
+// Start runs a sweep immediately and then once every Interval until the context is cancelled.
+// Parameters:
+//   ctx (context.Context): Context that stops the sweeper when cancelled.
+func (s *Sweeper) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.Interval)
+		defer ticker.Stop()
+
+		for {
+			report := s.Sweep(time.Now())
+			log.Printf("Sweep finished (dry run: %v): %d files, %d users, %d errors", s.DryRun, report.Files, report.Users, report.Errors)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Sweep removes the files and users that expired before the given date.
+// Expired files are removed from the storage and the database first, then the owners are recomputed,
+// and finally the users whose own expiration date has passed are purged.
+// Parameters:
+//   now (time.Time): The reference date used to decide what is expired.
+// Returns:
+//   Report: What was removed during this sweep.
+func (s *Sweeper) Sweep(now time.Time) Report {
+	var report Report
+
+	files, err := s.Files.GetExpiredFiles(now)
+	if err != nil {
+		log.Printf("Sweeper: %v", err)
+		report.Errors++
+		return report
+	}
+
+	owners := map[string]bool{}
+	for _, file := range files {
+		// The storage key starts with the directory of the owner, only the files that have none are searched in the users
+		ownerIp := ""
+		if file.StorageKey != "" {
+			ownerIp = path.Dir(file.StorageKey)
+		} else if owner, err := s.Users.GetFileOwner(file.IdPublic); err == nil {
+			ownerIp = owner.Ip
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		keys := s.blobKeys(ctx, file, ownerIp)
+
+		if s.DryRun {
+			cancel()
+			log.Printf("Sweeper (dry run): would remove file %s (%s) at %v", file.IdPublic, file.Name, keys)
+			report.Files++
+			continue
+		}
+
+		err := s.removeBlobs(ctx, keys)
+		cancel()
+		if err != nil {
+			log.Printf("Sweeper: error removing file %s: %v", file.IdPublic, err)
+			report.Errors++
+			continue
+		}
+
+		if _, err := s.Files.DeleteFile(file.IdPrivate); err != nil {
+			log.Printf("Sweeper: error deleting metadata of file %s: %v", file.IdPublic, err)
+			report.Errors++
+			continue
+		}
+
+		if ownerIp != "" {
+			owners[ownerIp] = true
+		}
+		report.Files++
+	}
+
+	for ip := range owners {
+		if err := s.Users.SyncUser(ip, ip); err != nil {
+			log.Printf("Sweeper: error updating user %s: %v", ip, err)
+			report.Errors++
+		}
+	}
+
+	users, err := s.Users.GetExpiredUsers(now)
+	if err != nil {
+		log.Printf("Sweeper: %v", err)
+		report.Errors++
+		return report
+	}
+
+	for _, user := range users {
+		if s.DryRun {
+			log.Printf("Sweeper (dry run): would purge user %s with %d files", user.Ip, user.FilesNumber)
+			report.Users++
+			continue
+		}
+
+		if err := s.Users.DeleteUser(user.Ip); err != nil {
+			log.Printf("Sweeper: error purging user %s: %v", user.Ip, err)
+			report.Errors++
+			continue
+		}
+		report.Users++
+	}
+
+	return report
+}
+
+// blobKeys returns the keys under which the given file is stored, its storage key when it has one.
+// When the owner is unknown, every user directory is searched for the file.
+// Parameters:
+//   ctx (context.Context): Context of the storage operations.
+//   file (db.File): The file to locate.
+//   ownerIp (string): The anonymized (hashed) IP address of the owner, or "" if unknown.
+// Returns:
+//   []string: The keys of the stored file.
+func (s *Sweeper) blobKeys(ctx context.Context, file db.File, ownerIp string) []string {
+	if file.StorageKey != "" {
+		return []string{file.StorageKey}
+	}
+
+	if ownerIp != "" {
+		parts := strings.Split(file.Name, ".")
+		if len(parts) > 1 {
+			return []string{storage.Key(ownerIp, file.IdPublic+"."+parts[1])}
+		}
+	}
+
+	objects, err := s.Storage.List(ctx, "")
+	if err != nil {
+		return []string{}
+	}
+
+	var keys []string
+	for _, object := range objects {
+		if strings.HasPrefix(path.Base(object.Key), file.IdPublic+".") {
+			keys = append(keys, object.Key)
+		}
+	}
+
+	return keys
+}
+
+// removeBlobs removes the objects stored under the given keys.
+// Parameters:
+//   ctx (context.Context): Context of the storage operations.
+//   keys ([]string): The keys to remove.
+// Returns:
+//   error: The first error found while removing the objects.
+func (s *Sweeper) removeBlobs(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := s.Storage.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
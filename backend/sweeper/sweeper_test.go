@@ -0,0 +1,172 @@
+package sweeper_test
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/db"
+	"backend/storage"
+	"backend/sweeper"
+)
+
+// seed stores the files of two users: alice has a file expiring in an hour and another in three days, bob has a file
+// expiring in an hour whose content is already gone from the storage.
+func seed(t *testing.T, blobs storage.Storage, store *db.MemoryStore, now time.Time) {
+	t.Helper()
+
+	files := []struct {
+		owner, id, content string
+		expires            time.Duration
+		stored             bool
+	}{
+		{"alice", "a1", "expires soon", time.Hour, true},
+		{"alice", "a2", "expires later", 72 * time.Hour, true},
+		{"bob", "b1", "already gone", time.Hour, false},
+	}
+	for _, f := range files {
+		key := storage.Key(f.owner, f.id+".txt")
+		file := db.File{Name: f.id + ".txt", Size: float64(len(f.content)), ExpireDate: now.Add(f.expires), StorageKey: key}
+		if _, err := store.SaveMetadata(f.id, "private-"+f.id, file); err != nil {
+			t.Fatal(err)
+		}
+		if f.stored {
+			if err := blobs.Put(context.Background(), key, strings.NewReader(f.content), int64(len(f.content))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, owner := range []string{"alice", "bob"} {
+		if _, err := store.CreateUser(owner, owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	tests := []struct {
+		name      string
+		after     time.Duration // Time between the upload and the sweep
+		dryRun    bool
+		want      sweeper.Report
+		files     []string // Public IDs of the files left
+		blobs     []string // Keys of the objects left
+		users     []string // Users left
+		aliceUsed float64  // Space used by alice after the sweep, when she is left
+	}{
+		{
+			name:  "expired files",
+			after: 2 * time.Hour,
+			want:  sweeper.Report{Files: 2},
+			files: []string{"a2"}, blobs: []string{"alice/a2.txt"}, users: []string{"alice", "bob"},
+			aliceUsed: float64(len("expires later")),
+		},
+		{
+			name:  "expired user",
+			after: 48 * time.Hour,
+			want:  sweeper.Report{Files: 2, Users: 1},
+			files: []string{"a2"}, blobs: []string{"alice/a2.txt"}, users: []string{"alice"},
+			aliceUsed: float64(len("expires later")),
+		},
+		{
+			name:  "everything expired",
+			after: 96 * time.Hour,
+			want:  sweeper.Report{Files: 3, Users: 2},
+			files: []string{}, blobs: []string{}, users: []string{},
+		},
+		{
+			name:   "dry run",
+			after:  96 * time.Hour,
+			dryRun: true,
+			want:   sweeper.Report{Files: 3, Users: 2},
+			files:  []string{"a1", "a2", "b1"}, blobs: []string{"alice/a1.txt", "alice/a2.txt"}, users: []string{"alice", "bob"},
+			aliceUsed: float64(len("expires soon") + len("expires later")),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blobs, err := storage.NewLocal(filepath.Join(t.TempDir(), "files"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := db.NewMemoryStore(blobs)
+			now := time.Now()
+			seed(t, blobs, store, now)
+
+			s := &sweeper.Sweeper{DryRun: test.dryRun, Storage: blobs, Files: store, Users: store}
+			if report := s.Sweep(now.Add(test.after)); report != test.want {
+				t.Errorf("got %+v, want %+v", report, test.want)
+			}
+
+			files := []string{}
+			for _, id := range []string{"a1", "a2", "b1"} {
+				if _, err := store.GetFileFromID(id, "public"); err == nil {
+					files = append(files, id)
+				}
+			}
+			if !reflect.DeepEqual(files, test.files) {
+				t.Errorf("got the files %v, want %v", files, test.files)
+			}
+
+			objects, err := blobs.List(context.Background(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := []string{}
+			for _, object := range objects {
+				keys = append(keys, object.Key)
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, test.blobs) {
+				t.Errorf("got the objects %v, want %v", keys, test.blobs)
+			}
+
+			users := []string{}
+			for _, ip := range []string{"alice", "bob"} {
+				if store.UserExists(ip) {
+					users = append(users, ip)
+				}
+			}
+			if !reflect.DeepEqual(users, test.users) {
+				t.Errorf("got the users %v, want %v", users, test.users)
+			}
+
+			// The owners of the removed files are recomputed from the files left
+			if alice, err := store.GetUser("alice"); err == nil && alice.UsedSpace != test.aliceUsed {
+				t.Errorf("alice uses %v bytes, want %v", alice.UsedSpace, test.aliceUsed)
+			}
+		})
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		interval string
+		want     time.Duration
+		valid    bool
+	}{
+		{"", 10 * time.Minute, true},
+		{"30m", 30 * time.Minute, true},
+		{"1d", 24 * time.Hour, true},
+		{"0s", 0, false},
+		{"often", 0, false},
+	}
+
+	for _, test := range tests {
+		t.Setenv("SWEEP_INTERVAL", test.interval)
+		s, err := sweeper.FromEnv(nil, nil, nil)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: got %v, want valid %v", test.interval, err, test.valid)
+			continue
+		}
+		if err == nil && s.Interval != test.want {
+			t.Errorf("%q: got %v, want %v", test.interval, s.Interval, test.want)
+		}
+	}
+}
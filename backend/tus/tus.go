@@ -0,0 +1,486 @@
+// Package tus implements the server side of the tus 1.0 resumable upload protocol (core, creation, termination and expiration extensions).
+// The chunks are appended to a file in a staging directory; once the upload is complete the file is handed over to a callback.
+package tus
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"backend/apierror"
+)
+
+const (
+	// Version is the only version of the protocol supported by the handler.
+	Version = "1.0.0"
+	// Extensions lists the protocol extensions supported by the handler.
+	Extensions = "creation,termination,expiration"
+
+	offsetContentType = "application/offset+octet-stream"
+)
+
+// Upload describes an upload in progress.
+type Upload struct {
+	ID       string            `json:"id"`       // Identifier of the upload, used in its URL
+	Length   int64             `json:"length"`   // Total size of the file in bytes
+	Offset   int64             `json:"-"`        // Number of bytes already received
+	Metadata map[string]string `json:"metadata"` // Decoded Upload-Metadata (e.g. "filename", "filetype")
+	Created  time.Time         `json:"created"`  // Date when the upload was created
+	Owner    string            `json:"owner"`    // Client that created the upload, as returned by Handler.Owner
+}
+
+// CompleteFunc is called once every byte of an upload has been received.
+// It receives the path of the assembled file and is responsible for replying to the client.
+// The file is removed once the function returns.
+type CompleteFunc func(c *gin.Context, upload Upload, path string)
+
+// Handler serves the tus endpoints and keeps the partial uploads in a staging directory.
+type Handler struct {
+	Dir        string        // Directory where partial uploads are kept
+	MaxSize    int64         // Maximum accepted Upload-Length in bytes
+	Expiration time.Duration // Time after which an unfinished upload is discarded
+	OnComplete CompleteFunc  // Called when an upload is complete
+
+	// Owner returns the client creating an upload, so its unfinished uploads can be counted against its quota and
+	// only it can send, query or discard them. Uploads have no owner when it is nil
+	Owner func(c *gin.Context) string
+	// Owns reports whether the client of a request is the owner of an upload, for clients known under several names.
+	// The name returned by Owner is compared when it is nil
+	Owns func(c *gin.Context, owner string) bool
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// NewHandler creates a tus handler storing its partial uploads in dir.
+// Parameters:
+//   dir (string): The staging directory, created if needed.
+//   maxSize (int64): The maximum size of an upload in bytes.
+//   onComplete (CompleteFunc): The function called when an upload is complete.
+// Returns:
+//   *Handler: The tus handler.
+//   error: An error if the staging directory could not be created.
+func NewHandler(dir string, maxSize int64, onComplete CompleteFunc) (*Handler, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating upload directory: %v", err)
+	}
+
+	return &Handler{
+		Dir:        dir,
+		MaxSize:    maxSize,
+		Expiration: 24 * time.Hour,
+		OnComplete: onComplete,
+		locks:      map[string]*sync.Mutex{},
+	}, nil
+}
+
+// ParseMetadata decodes an Upload-Metadata header ("key base64value,key2 base64value2").
+// Parameters:
+//   header (string): The raw header value.
+// Returns:
+//   map[string]string: The decoded metadata.
+//   error: An error if a value is not valid base64.
+func ParseMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata value for key %q", key)
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+// Options answers the OPTIONS request describing the server capabilities.
+func (h *Handler) Options(c *gin.Context) {
+	c.Header("Tus-Resumable", Version)
+	c.Header("Tus-Version", Version)
+	c.Header("Tus-Extension", Extensions)
+	c.Header("Tus-Max-Size", strconv.FormatInt(h.MaxSize, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// Create starts a new upload (creation extension).
+func (h *Handler) Create(c *gin.Context) {
+	if !checkVersion(c) {
+		return
+	}
+
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		reply(c, apierror.InvalidRequest, "The Upload-Length header is missing or invalid.")
+		return
+	}
+
+	if length > h.MaxSize {
+		reply(c, apierror.FileTooLarge, "The upload exceeds the maximum allowed size.")
+		return
+	}
+
+	metadata, err := ParseMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		reply(c, apierror.InvalidRequest, "The Upload-Metadata header is invalid.")
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		reply(c, apierror.Internal, "Error creating the upload.")
+		return
+	}
+
+	upload := Upload{ID: id, Length: length, Metadata: metadata, Created: time.Now()}
+	if h.Owner != nil {
+		upload.Owner = h.Owner(c)
+	}
+	if err := h.writeInfo(upload); err != nil {
+		reply(c, apierror.Internal, "Error creating the upload.")
+		return
+	}
+
+	file, err := os.Create(h.dataPath(id))
+	if err != nil {
+		os.Remove(h.infoPath(id))
+		reply(c, apierror.Internal, "Error creating the upload.")
+		return
+	}
+	file.Close()
+
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+id)
+	c.Header("Upload-Expires", upload.Created.Add(h.Expiration).UTC().Format(http.TimeFormat))
+
+	if length == 0 {
+		h.complete(c, upload)
+		return
+	}
+
+	c.Status(http.StatusCreated)
+}
+
+// Head reports how many bytes of an upload were received, so the client can resume it.
+func (h *Handler) Head(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	if !checkVersion(c) {
+		return
+	}
+
+	upload, err := h.readInfo(c.Param("id"))
+	if err != nil || !h.owns(c, upload) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Header("Upload-Expires", upload.Created.Add(h.Expiration).UTC().Format(http.TimeFormat))
+	c.Status(http.StatusOK)
+}
+
+// Patch appends a chunk at the offset given by the client.
+func (h *Handler) Patch(c *gin.Context) {
+	if !checkVersion(c) {
+		return
+	}
+
+	if c.ContentType() != offsetContentType {
+		reply(c, apierror.UnsupportedContentType, "The Content-Type must be "+offsetContentType+".")
+		return
+	}
+
+	id := c.Param("id")
+	lock := h.lock(id)
+	if !lock.TryLock() {
+		reply(c, apierror.UploadLocked, "The upload is already receiving data.")
+		return
+	}
+	defer lock.Unlock()
+
+	upload, err := h.readInfo(id)
+	if err != nil || !h.owns(c, upload) {
+		reply(c, apierror.UploadNotFound, "Upload not found.")
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Offset {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		reply(c, apierror.OffsetMismatch, "The Upload-Offset does not match the received data.")
+		return
+	}
+
+	file, err := os.OpenFile(h.dataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		reply(c, apierror.Internal, "Error opening the upload.")
+		return
+	}
+
+	written, copyErr := io.Copy(file, io.LimitReader(c.Request.Body, upload.Length-upload.Offset))
+	closeErr := file.Close()
+	upload.Offset += written
+
+	if copyErr != nil || closeErr != nil {
+		c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		reply(c, apierror.Internal, "Error receiving the upload data.")
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Expires", upload.Created.Add(h.Expiration).UTC().Format(http.TimeFormat))
+
+	if upload.Offset == upload.Length {
+		h.complete(c, upload)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// Terminate discards an upload (termination extension).
+func (h *Handler) Terminate(c *gin.Context) {
+	if !checkVersion(c) {
+		return
+	}
+
+	id := c.Param("id")
+	if upload, err := h.readInfo(id); err != nil || !h.owns(c, upload) {
+		reply(c, apierror.UploadNotFound, "Upload not found.")
+		return
+	}
+
+	lock := h.lock(id)
+	lock.Lock()
+	h.remove(id)
+	lock.Unlock()
+
+	c.Status(http.StatusNoContent)
+}
+
+// owns reports whether the client of a request created an upload. The uploads of other clients are reported as not
+// found, so their IDs cannot be probed.
+func (h *Handler) owns(c *gin.Context, upload Upload) bool {
+	if h.Owner == nil || upload.Owner == "" {
+		return true
+	}
+	if h.Owns != nil {
+		return h.Owns(c, upload.Owner)
+	}
+	return h.Owner(c) == upload.Owner
+}
+
+// Usage returns the space reserved by the unfinished uploads, so that clients cannot fill the disk with uploads they
+// never finish. The whole Upload-Length of an upload is counted from its creation, since the client may send it.
+// Complete uploads are not counted: they are being handed over to OnComplete, which checks their actual size.
+// Parameters:
+//   owner (string): The client whose uploads are counted, or "" for the uploads of every client.
+// Returns:
+//   int64: The total length of the unfinished uploads in bytes.
+//   error: An error if the staging directory could not be read.
+func (h *Handler) Usage(owner string) (int64, error) {
+	matches, err := filepath.Glob(filepath.Join(h.Dir, "*.info"))
+	if err != nil {
+		return 0, fmt.Errorf("error listing the uploads: %v", err)
+	}
+
+	var total int64
+	for _, match := range matches {
+		// Uploads removed while the directory is read are skipped
+		upload, err := h.readInfo(strings.TrimSuffix(filepath.Base(match), ".info"))
+		if err != nil || upload.Offset >= upload.Length {
+			continue
+		}
+		if owner == "" || upload.Owner == owner {
+			total += upload.Length
+		}
+	}
+
+	return total, nil
+}
+
+// Start removes the expired unfinished uploads once every hour until the context is cancelled.
+// Parameters:
+//   ctx (context.Context): Context that stops the cleanup when cancelled.
+func (h *Handler) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if removed := h.Cleanup(time.Now()); removed > 0 {
+					log.Printf("Removed %d expired uploads", removed)
+				}
+			}
+		}
+	}()
+}
+
+// Cleanup removes the unfinished uploads created more than Expiration before now.
+// Parameters:
+//   now (time.Time): The reference date.
+// Returns:
+//   int: The number of uploads removed.
+func (h *Handler) Cleanup(now time.Time) int {
+	matches, err := filepath.Glob(filepath.Join(h.Dir, "*.info"))
+	if err != nil {
+		return 0
+	}
+
+	removed := 0
+	for _, match := range matches {
+		id := strings.TrimSuffix(filepath.Base(match), ".info")
+
+		upload, err := h.readInfo(id)
+		if err != nil || now.Sub(upload.Created) < h.Expiration {
+			continue
+		}
+
+		lock := h.lock(id)
+		if lock.TryLock() {
+			h.remove(id)
+			lock.Unlock()
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// complete hands the assembled file to OnComplete and removes the upload afterwards.
+func (h *Handler) complete(c *gin.Context, upload Upload) {
+	defer h.remove(upload.ID)
+
+	if h.OnComplete == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	h.OnComplete(c, upload, h.dataPath(upload.ID))
+}
+
+func (h *Handler) dataPath(id string) string {
+	return filepath.Join(h.Dir, id)
+}
+
+func (h *Handler) infoPath(id string) string {
+	return filepath.Join(h.Dir, id+".info")
+}
+
+// readInfo loads the description of an upload, using the size of its data file as offset.
+func (h *Handler) readInfo(id string) (Upload, error) {
+	if !validID(id) {
+		return Upload{}, fmt.Errorf("invalid upload id")
+	}
+
+	content, err := os.ReadFile(h.infoPath(id))
+	if err != nil {
+		return Upload{}, err
+	}
+
+	var upload Upload
+	if err := json.Unmarshal(content, &upload); err != nil {
+		return Upload{}, err
+	}
+
+	info, err := os.Stat(h.dataPath(id))
+	if err != nil {
+		return Upload{}, err
+	}
+	upload.Offset = info.Size()
+
+	return upload, nil
+}
+
+func (h *Handler) writeInfo(upload Upload) error {
+	content, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(h.infoPath(upload.ID), content, 0644)
+}
+
+// remove deletes the files of an upload and forgets its lock.
+func (h *Handler) remove(id string) {
+	os.Remove(h.dataPath(id))
+	os.Remove(h.infoPath(id))
+
+	h.mu.Lock()
+	delete(h.locks, id)
+	h.mu.Unlock()
+}
+
+// lock returns the mutex serializing the writes of an upload.
+func (h *Handler) lock(id string) *sync.Mutex {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	lock, ok := h.locks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		h.locks[id] = lock
+	}
+
+	return lock
+}
+
+// checkVersion rejects requests made with an unsupported version of the protocol.
+func checkVersion(c *gin.Context) bool {
+	c.Header("Tus-Resumable", Version)
+
+	if c.GetHeader("Tus-Resumable") != Version {
+		c.Header("Tus-Version", Version)
+		reply(c, apierror.UnsupportedTusVersion, "Unsupported tus version.")
+		return false
+	}
+
+	return true
+}
+
+// reply answers a request with an error of the API, whose code decides the status.
+func reply(c *gin.Context, code apierror.Code, message string) {
+	apierror.Respond(c, apierror.New(code, message))
+}
+
+func newID() (string, error) {
+	buffer := make([]byte, 16)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buffer), nil
+}
+
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
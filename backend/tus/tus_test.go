@@ -0,0 +1,309 @@
+package tus_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"backend/apierror"
+	"backend/tus"
+)
+
+// completed records the uploads handed over to OnComplete.
+type completed struct {
+	upload  tus.Upload
+	content string
+}
+
+// newHandler builds a tus handler in a temporary directory, served under /uploads. Uploads are owned by the client
+// named in their Client header, and the complete ones are sent to the returned channel.
+func newHandler(t *testing.T) (*tus.Handler, *gin.Engine, chan completed) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	done := make(chan completed, 4)
+	handler, err := tus.NewHandler(filepath.Join(t.TempDir(), "tus"), 16, func(c *gin.Context, upload tus.Upload, path string) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("the complete upload cannot be read: %v", err)
+		}
+		done <- completed{upload, string(content)}
+		c.Status(http.StatusAccepted)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.Owner = func(c *gin.Context) string { return c.GetHeader("Client") }
+
+	router := gin.New()
+	router.OPTIONS("/uploads", handler.Options)
+	router.POST("/uploads", handler.Create)
+	router.HEAD("/uploads/:id", handler.Head)
+	router.PATCH("/uploads/:id", handler.Patch)
+	router.DELETE("/uploads/:id", handler.Terminate)
+	return handler, router, done
+}
+
+// send sends a tus request with the given headers, as "name", "value" pairs.
+func send(router *gin.Engine, method, target, body string, pairs ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", tus.Version)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		req.Header.Set(pairs[i], pairs[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// create starts an upload of the given length and returns its URL.
+func create(t *testing.T, router *gin.Engine, length, client string) string {
+	t.Helper()
+
+	// "filename hello.txt"
+	w := send(router, http.MethodPost, "/uploads", "", "Upload-Length", length, "Upload-Metadata", "filename aGVsbG8udHh0", "Client", client)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d %s", w.Code, w.Body)
+	}
+	location := w.Header().Get("Location")
+	if !strings.HasPrefix(location, "/uploads/") || w.Header().Get("Upload-Expires") == "" {
+		t.Fatalf("create: unexpected headers %v", w.Header())
+	}
+	return location
+}
+
+// errorCode returns the code of an error response.
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) apierror.Code {
+	t.Helper()
+
+	var envelope apierror.Envelope
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("invalid error body %q: %v", w.Body, err)
+	}
+	return envelope.Error.Code
+}
+
+func TestResumeUpload(t *testing.T) {
+	_, router, done := newHandler(t)
+	location := create(t, router, "11", "alice")
+
+	w := send(router, http.MethodPatch, location, "hello", "Content-Type", "application/offset+octet-stream", "Upload-Offset", "0", "Client", "alice")
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("first chunk: got %d %v", w.Code, w.Header())
+	}
+
+	// After an interruption, the client asks where to resume
+	w = send(router, http.MethodHead, location, "", "Client", "alice")
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "5" || w.Header().Get("Upload-Length") != "11" {
+		t.Fatalf("head: got %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Error("the offset may be cached")
+	}
+
+	w = send(router, http.MethodPatch, location, " world", "Content-Type", "application/offset+octet-stream", "Upload-Offset", "5", "Client", "alice")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("last chunk: got %d %s", w.Code, w.Body)
+	}
+
+	got := <-done
+	if got.content != "hello world" || got.upload.Metadata["filename"] != "hello.txt" || got.upload.Owner != "alice" {
+		t.Errorf("unexpected complete upload %+v", got)
+	}
+
+	// The complete upload is removed once handed over
+	if w := send(router, http.MethodHead, location, "", "Client", "alice"); w.Code != http.StatusNotFound {
+		t.Errorf("head after completion: got %d", w.Code)
+	}
+}
+
+func TestCreateUpload(t *testing.T) {
+	_, router, done := newHandler(t)
+
+	tests := []struct {
+		name   string
+		pairs  []string
+		status int
+		code   apierror.Code
+	}{
+		{"missing length", nil, http.StatusBadRequest, apierror.InvalidRequest},
+		{"negative length", []string{"Upload-Length", "-1"}, http.StatusBadRequest, apierror.InvalidRequest},
+		{"too large", []string{"Upload-Length", "17"}, http.StatusRequestEntityTooLarge, apierror.FileTooLarge},
+		{"invalid metadata", []string{"Upload-Length", "4", "Upload-Metadata", "filename not-base64!"}, http.StatusBadRequest, apierror.InvalidRequest},
+		{"unsupported version", []string{"Upload-Length", "4", "Tus-Resumable", "0.2.2"}, http.StatusPreconditionFailed, apierror.UnsupportedTusVersion},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := send(router, http.MethodPost, "/uploads", "", test.pairs...)
+			if w.Code != test.status || errorCode(t, w) != test.code {
+				t.Errorf("got %d %s, want %d %s", w.Code, w.Body, test.status, test.code)
+			}
+		})
+	}
+
+	// An empty upload is complete as soon as it is created
+	if w := send(router, http.MethodPost, "/uploads", "", "Upload-Length", "0"); w.Code != http.StatusAccepted {
+		t.Fatalf("empty upload: got %d %s", w.Code, w.Body)
+	}
+	if got := <-done; got.content != "" || got.upload.Length != 0 {
+		t.Errorf("unexpected empty upload %+v", got)
+	}
+
+	w := send(router, http.MethodOptions, "/uploads", "")
+	if w.Code != http.StatusNoContent || w.Header().Get("Tus-Max-Size") != "16" || w.Header().Get("Tus-Extension") != tus.Extensions {
+		t.Errorf("options: got %d %v", w.Code, w.Header())
+	}
+}
+
+func TestPatchUpload(t *testing.T) {
+	_, router, _ := newHandler(t)
+	location := create(t, router, "8", "alice")
+	chunk := []string{"Content-Type", "application/offset+octet-stream", "Upload-Offset", "0", "Client", "alice"}
+
+	if w := send(router, http.MethodPatch, location, "abcd", chunk...); w.Code != http.StatusNoContent {
+		t.Fatalf("first chunk: got %d %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		pairs  []string
+		status int
+		code   apierror.Code
+	}{
+		// A chunk sent twice is refused, with the offset to resume from
+		{"offset behind", location, chunk, http.StatusConflict, apierror.OffsetMismatch},
+		{"offset ahead", location, []string{"Content-Type", "application/offset+octet-stream", "Upload-Offset", "6"}, http.StatusConflict, apierror.OffsetMismatch},
+		{"missing offset", location, []string{"Content-Type", "application/offset+octet-stream"}, http.StatusConflict, apierror.OffsetMismatch},
+		{"wrong content type", location, []string{"Content-Type", "text/plain", "Upload-Offset", "4"}, http.StatusUnsupportedMediaType, apierror.UnsupportedContentType},
+		{"unknown upload", "/uploads/0123456789abcdef0123456789abcdef", []string{"Content-Type", "application/offset+octet-stream", "Upload-Offset", "0"}, http.StatusNotFound, apierror.UploadNotFound},
+		{"invalid id", "/uploads/..", []string{"Content-Type", "application/offset+octet-stream", "Upload-Offset", "0"}, http.StatusNotFound, apierror.UploadNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := send(router, http.MethodPatch, test.target, "efgh", append(test.pairs, "Client", "alice")...)
+			if w.Code != test.status || errorCode(t, w) != test.code {
+				t.Fatalf("got %d %s, want %d %s", w.Code, w.Body, test.status, test.code)
+			}
+			if test.code == apierror.OffsetMismatch && w.Header().Get("Upload-Offset") != "4" {
+				t.Errorf("got Upload-Offset %q, want 4", w.Header().Get("Upload-Offset"))
+			}
+		})
+	}
+
+	// Nothing was appended by the refused chunks
+	if w := send(router, http.MethodHead, location, "", "Client", "alice"); w.Header().Get("Upload-Offset") != "4" {
+		t.Errorf("head: got offset %q, want 4", w.Header().Get("Upload-Offset"))
+	}
+}
+
+func TestTerminateUpload(t *testing.T) {
+	handler, router, _ := newHandler(t)
+	location := create(t, router, "8", "alice")
+	send(router, http.MethodPatch, location, "abcd", "Content-Type", "application/offset+octet-stream", "Upload-Offset", "0", "Client", "alice")
+
+	if w := send(router, http.MethodDelete, location, "", "Client", "alice"); w.Code != http.StatusNoContent {
+		t.Fatalf("terminate: got %d %s", w.Code, w.Body)
+	}
+	if w := send(router, http.MethodHead, location, "", "Client", "alice"); w.Code != http.StatusNotFound {
+		t.Errorf("head after termination: got %d", w.Code)
+	}
+	if w := send(router, http.MethodDelete, location, "", "Client", "alice"); w.Code != http.StatusNotFound || errorCode(t, w) != apierror.UploadNotFound {
+		t.Errorf("second termination: got %d %s", w.Code, w.Body)
+	}
+
+	if entries, _ := os.ReadDir(handler.Dir); len(entries) != 0 {
+		t.Errorf("the terminated upload left files: %v", entries)
+	}
+}
+
+func TestUploadOwner(t *testing.T) {
+	handler, router, _ := newHandler(t)
+	location := create(t, router, "8", "alice")
+	chunk := []string{"Content-Type", "application/offset+octet-stream", "Upload-Offset", "0"}
+
+	// The uploads of another client are not found, whatever the request
+	if w := send(router, http.MethodPatch, location, "abcd", append(chunk, "Client", "bob")...); w.Code != http.StatusNotFound || errorCode(t, w) != apierror.UploadNotFound {
+		t.Errorf("chunk of another client: got %d %s", w.Code, w.Body)
+	}
+	if w := send(router, http.MethodHead, location, "", "Client", "bob"); w.Code != http.StatusNotFound {
+		t.Errorf("head of another client: got %d", w.Code)
+	}
+	if w := send(router, http.MethodDelete, location, "", "Client", "bob"); w.Code != http.StatusNotFound || errorCode(t, w) != apierror.UploadNotFound {
+		t.Errorf("termination by another client: got %d %s", w.Code, w.Body)
+	}
+	if w := send(router, http.MethodHead, location, "", "Client", "alice"); w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "0" {
+		t.Errorf("head after the refused requests: got %d %v", w.Code, w.Header())
+	}
+
+	// A client known under several names is recognized by Owns
+	handler.Owns = func(c *gin.Context, owner string) bool {
+		return owner == "alice" && (c.GetHeader("Client") == "alice" || c.GetHeader("Client") == "alice-renamed")
+	}
+	if w := send(router, http.MethodPatch, location, "abcd", append(chunk, "Client", "alice-renamed")...); w.Code != http.StatusNoContent {
+		t.Errorf("chunk under another name: got %d %s", w.Code, w.Body)
+	}
+	if w := send(router, http.MethodDelete, location, "", "Client", "bob"); w.Code != http.StatusNotFound {
+		t.Errorf("termination by another client: got %d", w.Code)
+	}
+}
+
+func TestCleanupUploads(t *testing.T) {
+	handler, router, _ := newHandler(t)
+	expired := create(t, router, "8", "alice")
+	send(router, http.MethodPatch, expired, "abcd", "Content-Type", "application/offset+octet-stream", "Upload-Offset", "0", "Client", "alice")
+
+	// Uploads created less than Expiration ago are kept
+	if removed := handler.Cleanup(time.Now().Add(handler.Expiration - time.Minute)); removed != 0 {
+		t.Fatalf("%d uploads removed before their expiration", removed)
+	}
+
+	recent := create(t, router, "8", "bob")
+	if removed := handler.Cleanup(time.Now().Add(handler.Expiration + time.Second)); removed != 2 {
+		t.Fatalf("%d uploads removed, want 2", removed)
+	}
+	for _, location := range []string{expired, recent} {
+		if w := send(router, http.MethodHead, location, ""); w.Code != http.StatusNotFound {
+			t.Errorf("head of an expired upload: got %d", w.Code)
+		}
+	}
+}
+
+func TestUploadUsage(t *testing.T) {
+	handler, router, done := newHandler(t)
+	alice := create(t, router, "10", "alice")
+	create(t, router, "6", "alice")
+	create(t, router, "4", "bob")
+	send(router, http.MethodPatch, alice, "abcd", "Content-Type", "application/offset+octet-stream", "Upload-Offset", "0", "Client", "alice")
+
+	// The whole length of the unfinished uploads is reserved, whatever was received
+	tests := []struct {
+		owner string
+		want  int64
+	}{
+		{"", 20},
+		{"alice", 16},
+		{"bob", 4},
+		{"carol", 0},
+	}
+	for _, test := range tests {
+		if got, err := handler.Usage(test.owner); err != nil || got != test.want {
+			t.Errorf("usage of %q: got %d, %v, want %d", test.owner, got, err, test.want)
+		}
+	}
+
+	// A complete upload no longer counts
+	send(router, http.MethodPatch, alice, "efghij", "Content-Type", "application/offset+octet-stream", "Upload-Offset", "4", "Client", "alice")
+	<-done
+	if got, err := handler.Usage("alice"); err != nil || got != 6 {
+		t.Errorf("usage after completion: got %d, %v, want 6", got, err)
+	}
+}
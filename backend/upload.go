@@ -0,0 +1,547 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"backend/apierror"
+	"backend/archive"
+	"backend/db"
+	"backend/ids"
+	"backend/sanitize"
+	"backend/sniff"
+	"backend/storage"
+	"backend/tus"
+	"backend/utils"
+)
+
+const (
+	maxFieldSize      = 1024 // Maximum size of the text fields of the upload form
+	maxPasswordLength = 128  // Maximum length of the download passwords
+)
+
+// errTooLarge is returned by stageStream when the file is bigger than the limit it was given.
+var errTooLarge = errors.New("file too large")
+
+// upload describes a received file, whether it was sent as a multipart form or through tus.
+type upload struct {
+	Name         string        // Name of the file, with extension
+	Type         string        // Content type declared by the client
+	Email        string        // Email associated with the file
+	ExpiresIn    time.Duration // Time after which the file is deleted
+	MaxDownloads int           // Number of downloads after which the file is deleted, 0 for no limit
+	Password     string        // Password required to download the file, empty for none
+	KeepMetadata bool          // When true, the metadata embedded in the file is not removed
+	Size         int64         // Size of the file in bytes
+	Path         string        // Path of the complete file in the staging directory
+	Digest       string        // SHA-256 of the file content followed by its name, used to find duplicates
+}
+
+func (s *server) saveFile(c *gin.Context) {
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		apierror.Respond(c, apierror.New(apierror.InvalidRequest, "The request must be a multipart form."))
+		return
+	}
+
+	// The body is read part by part, so the file is streamed once to the staging directory
+	var received upload
+	fields := map[string]string{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			apierror.Respond(c, apierror.New(apierror.InvalidRequest, "The multipart form could not be read."))
+			return
+		}
+
+		switch part.FormName() {
+		case "file":
+			if received.Path != "" {
+				break
+			}
+
+			received.Name = part.FileName()
+			received.Type = part.Header.Get("Content-Type")
+
+			// Refuse the file before reading it when its type is not allowed or the host is full
+			if !s.checkUpload(c, received.Type, 0) {
+				part.Close()
+				return
+			}
+
+			// Files bigger than the limit of their type, or than the space of a user, are refused while they are read
+			limit := int64(userMaxSpace)
+			if rule, _ := s.types.Load().rule(received.Type); rule.MaxSize > 0 && rule.MaxSize < limit {
+				limit = rule.MaxSize
+			}
+
+			received.Path, received.Size, received.Digest, err = stageStream(s.staging, part, received.Name, limit)
+			if errors.Is(err, errTooLarge) {
+				part.Close()
+				apierror.Respond(c, apierror.Newf(apierror.FileTooLarge, "The file must not be larger than %.2f MB.", float64(limit)/(1024*1024)).With("maxSize", limit))
+				return
+			}
+			if err != nil {
+				part.Close()
+				apierror.Respond(c, fmt.Errorf("error staging the upload: %v", err))
+				return
+			}
+			defer os.Remove(received.Path)
+
+		case "email", "expiresIn", "maxDownloads", "burnAfterReading", "password", "keepMetadata":
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+			if err != nil {
+				part.Close()
+				apierror.Respond(c, apierror.New(apierror.InvalidRequest, "The multipart form could not be read."))
+				return
+			}
+			fields[part.FormName()] = string(value)
+		}
+
+		part.Close()
+	}
+
+	// File Validation
+	if received.Path == "" {
+		apierror.Respond(c, apierror.New(apierror.InvalidRequest, "The file is missing.").With("field", "file"))
+		return
+	}
+
+	if !s.readSettings(c, fields, &received) {
+		return
+	}
+
+	s.storeUpload(c, received)
+}
+
+// readSettings reads the optional upload settings, sent as form fields or as tus metadata, replying to the client when one is not valid.
+// Parameters:
+//   c (*gin.Context): The request context.
+//   fields (map[string]string): The settings by name ("email", "expiresIn", "maxDownloads", "burnAfterReading", "password", "keepMetadata").
+//   received (*upload): The upload the settings are written to.
+// Returns:
+//   bool: Returns false if a setting is not valid.
+func (s *server) readSettings(c *gin.Context, fields map[string]string, received *upload) bool {
+	received.Email = fields["email"]
+	received.Password = fields["password"]
+
+	if len(received.Password) > maxPasswordLength {
+		apierror.Respond(c, apierror.Newf(apierror.InvalidField, "The password must not be longer than %d characters.", maxPasswordLength).With("field", "password"))
+		return false
+	}
+
+	var ok bool
+	if received.ExpiresIn, ok = s.expirations.parse(fields["expiresIn"]); !ok {
+		apierror.Respond(c, apierror.New(apierror.InvalidField, "The requested expiration time is not allowed.").With("field", "expiresIn"))
+		return false
+	}
+
+	if value := fields["maxDownloads"]; value != "" {
+		maxDownloads, err := strconv.Atoi(value)
+		if err != nil || maxDownloads < 0 {
+			apierror.Respond(c, apierror.New(apierror.InvalidField, "The maximum number of downloads must be a non-negative number (0 for no limit).").With("field", "maxDownloads"))
+			return false
+		}
+		received.MaxDownloads = maxDownloads
+	}
+
+	// Burn after reading: the file is deleted right after its first download
+	if value := fields["burnAfterReading"]; value != "" {
+		burn, err := strconv.ParseBool(value)
+		if err != nil {
+			apierror.Respond(c, apierror.New(apierror.InvalidField, "The burnAfterReading option must be true or false.").With("field", "burnAfterReading"))
+			return false
+		}
+		if burn {
+			received.MaxDownloads = 1
+		}
+	}
+
+	if value := fields["keepMetadata"]; value != "" {
+		keep, err := strconv.ParseBool(value)
+		if err != nil {
+			apierror.Respond(c, apierror.New(apierror.InvalidField, "The keepMetadata option must be true or false.").With("field", "keepMetadata"))
+			return false
+		}
+		received.KeepMetadata = keep
+	}
+
+	return true
+}
+
+// createUpload validates a tus upload before it is created, so that refused files are not transferred at all.
+func (s *server) createUpload(c *gin.Context) {
+	metadata, err := tus.ParseMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		// Malformed requests are refused by the tus handler itself
+		return
+	}
+	length, _ := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+
+	// The upload reserves its length once created, the other uploads of the owner wait until then
+	defer s.owners.Lock(s.userKey(c))()
+
+	if !s.readSettings(c, metadata, &upload{}) || !s.checkUpload(c, metadata["filetype"], length) {
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// completeUpload feeds a finished tus upload through the same pipeline as saveFile.
+func (s *server) completeUpload(c *gin.Context, received tus.Upload, path_ string) {
+	stored := upload{
+		Name: received.Metadata["filename"],
+		Type: received.Metadata["filetype"],
+		Size: received.Length,
+		Path: path_,
+	}
+	if !s.readSettings(c, received.Metadata, &stored) {
+		return
+	}
+
+	digest, err := hashFile(path_, stored.Name)
+	if err != nil {
+		apierror.Respond(c, fmt.Errorf("error hashing the upload: %v", err))
+		return
+	}
+	stored.Digest = digest
+
+	s.storeUpload(c, stored)
+}
+
+// uploadOwner returns the user creating a resumable upload, whose unfinished uploads count against its quota.
+func (s *server) uploadOwner(c *gin.Context) string {
+	return s.userKey(c)
+}
+
+// ownsUpload reports whether the client of a request created a resumable upload, under the current or the previous
+// pseudonym of its address.
+func (s *server) ownsUpload(c *gin.Context, owner string) bool {
+	for _, candidate := range s.clientPseudonyms(c) {
+		if candidate == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUpload verifies that the host and the user have room for a file of the given type and size,
+// replying to the client when they do not. The unfinished resumable uploads count as if they were complete.
+func (s *server) checkUpload(c *gin.Context, contentType string, size int64) bool {
+	hostUsage, err := s.blobs.Usage(c.Request.Context(), "")
+	if err != nil {
+		apierror.Respond(c, fmt.Errorf("error checking the storage usage: %v", err))
+		return false
+	}
+	// The files waiting for their scan are not in the storage yet, but will be
+	quarantined, err := s.quarantine.Usage()
+	if err != nil {
+		apierror.Respond(c, fmt.Errorf("error checking the storage usage: %v", err))
+		return false
+	}
+	hostUsage += quarantined
+
+	resumable, err := s.uploads.Usage("")
+	if err != nil {
+		apierror.Respond(c, fmt.Errorf("error checking the storage usage: %v", err))
+		return false
+	}
+	hostUsage += resumable
+
+	if float64(hostUsage) >= maxHostSpaceUsage {
+		apierror.Respond(c, apierror.New(apierror.StorageFull, "The host server storage capacity is full."))
+		return false
+	}
+
+	// Extension validation
+	rule, ok := s.types.Load().rule(contentType)
+	if !ok {
+		apierror.Respond(c, apierror.New(apierror.UnsupportedFileType, "The uploaded file is not allowed. You can try compressing it in .rar, .zip, or .tar format, for example.").With("type", contentType))
+		return false
+	}
+
+	if rule.MaxSize > 0 && size > rule.MaxSize {
+		apierror.Respond(c, apierror.Newf(apierror.FileTooLarge, "Files of this type must not be larger than %.2f MB.", float64(rule.MaxSize)/(1024*1024)).With("maxSize", rule.MaxSize))
+		return false
+	}
+
+	if float64(size) > userMaxSpace {
+		apierror.Respond(c, apierror.Newf(apierror.FileTooLarge, "The file must not be larger than %.2f MB.", userMaxSpace/(1024*1024)).With("maxSize", int64(userMaxSpace)))
+		return false
+	}
+
+	// A file the scanner cannot scan would be rejected once quarantined
+	if s.scanMaxSize > 0 && size > s.scanMaxSize {
+		apierror.Respond(c, apierror.Newf(apierror.FileTooLarge, "Files larger than %.2f MB cannot be scanned for viruses.", float64(s.scanMaxSize)/(1024*1024)).With("maxSize", s.scanMaxSize))
+		return false
+	}
+
+	// Check available space, new users only have their unfinished uploads
+	owner := s.userKey(c)
+	var usedSpace float64
+	if user, err := s.users.GetUser(owner); err == nil {
+		usedSpace = user.UsedSpace
+	}
+	pending, err := s.uploads.Usage(owner)
+	if err != nil {
+		apierror.Respond(c, fmt.Errorf("error checking the storage usage: %v", err))
+		return false
+	}
+	usedSpace += float64(pending)
+
+	if usedSpace+float64(size) > userMaxSpace {
+		remainingSpace := max(userMaxSpace-usedSpace, 0) / (1024 * 1024)
+		apierror.Respond(c, apierror.Newf(apierror.QuotaExceeded, "The file size exceeds your available storage capacity. You have %.2f MB left.", remainingSpace).With("remainingSpace", int64(max(userMaxSpace-usedSpace, 0))))
+		return false
+	}
+
+	return true
+}
+
+// storeUpload validates a staged file, saves its metadata, moves it into quarantine to be scanned and replies to the client.
+func (s *server) storeUpload(c *gin.Context, received upload) {
+	if !strings.Contains(received.Name, ".") {
+		apierror.Respond(c, apierror.New(apierror.InvalidField, "The uploaded file must have an extension.").With("field", "file"))
+		return
+	}
+
+	// The other uploads of the owner wait until this one is saved, so they cannot all pass the quota check together
+	defer s.owners.Lock(s.userKey(c))()
+
+	if !s.checkUpload(c, received.Type, received.Size) {
+		return
+	}
+
+	// The type is detected from the content, the one sent by the client is only trusted to refuse files early
+	detected, err := sniff.Detect(received.Path)
+	if err != nil {
+		apierror.Respond(c, fmt.Errorf("error detecting the type of the upload: %v", err))
+		return
+	}
+
+	contentType, ok := s.types.Load().accepts(received.Type, detected, received.Name)
+	if !ok {
+		apierror.Respond(c, apierror.New(apierror.ContentMismatch, "The content of the file does not match its type or extension.").With("detectedType", detected))
+		return
+	}
+
+	// Archives are opened to refuse zip bombs, path traversal and executables hidden inside them
+	var entries []db.ArchiveEntry
+	if archive.Supports(contentType) {
+		found, err := s.archives.Inspect(received.Path, contentType)
+		if err != nil {
+			if errors.Is(err, archive.ErrRejected) {
+				apierror.Respond(c, apierror.Newf(apierror.ArchiveRejected, "The archive is not allowed: %v.", err))
+			} else {
+				apierror.Respond(c, fmt.Errorf("error inspecting the archive: %v", err))
+			}
+			return
+		}
+
+		for _, entry := range found {
+			entries = append(entries, db.ArchiveEntry{Name: entry.Name, Size: entry.Size})
+		}
+	}
+
+	// EXIF, PDF information and audio tags are removed unless the uploader asked to keep them
+	if !received.KeepMetadata && sanitize.Supports(contentType) {
+		size, err := sanitize.Strip(received.Path, contentType)
+		if errors.Is(err, sanitize.ErrUnsupported) {
+			apierror.Respond(c, apierror.New(apierror.UnsupportedFileType, "The metadata of this file cannot be removed. Send it with keepMetadata set to true to share it as it is.").With("field", "keepMetadata"))
+			return
+		}
+		if err != nil {
+			apierror.Respond(c, apierror.New(apierror.MalformedFile, "The file is damaged, its metadata could not be removed."))
+			return
+		}
+		received.Size = size
+	}
+
+	// Validating Email
+	if !utils.ValidateEmail(received.Email) && received.Email != "" {
+		apierror.Respond(c, apierror.New(apierror.InvalidField, "The email address is not valid.").With("field", "email"))
+		return
+	}
+
+	// Identical content sent by the same user is only stored once; the content hash is keyed so it reveals nothing alone
+	owner := s.userKey(c)
+	for _, contentHash := range s.ids.Candidates(owner + "\x00" + received.Digest) {
+		existingFile, srcErr := s.files.GetFileFromID(contentHash, "content")
+		if srcErr != nil {
+			continue
+		}
+
+		// The private ID was only given to the uploader
+		existingFile.IdPrivate = ""
+		apierror.Respond(c, apierror.New(apierror.DuplicateFile, "The file is already on the server.").With("file", existingFile))
+		return
+	}
+
+	// Generate random IDs for the file, only a keyed hash of the private one is stored
+	idPublic, err := ids.New()
+	if err != nil {
+		apierror.Respond(c, fmt.Errorf("error generating the file ID: %v", err))
+		return
+	}
+	idPrivate, err := ids.New()
+	if err != nil {
+		apierror.Respond(c, fmt.Errorf("error generating the file ID: %v", err))
+		return
+	}
+	// The file is stored under its owner directory whoever downloads it, the key is saved with its metadata
+	fileKey := storage.Key(owner, idPublic+"."+storageExtension(contentType, received.Name))
+
+	// Only a slow salted hash of the password is kept
+	var passwordHash string
+	if received.Password != "" {
+		passwordHash, err = utils.HashPassword(received.Password)
+		if err != nil {
+			apierror.Respond(c, fmt.Errorf("error hashing the password: %v", err))
+			return
+		}
+	}
+
+	// Save metadata to the DB, the file cannot be downloaded until it is scanned
+	newFile, err := s.files.SaveMetadata(idPublic, s.ids.Seal(idPrivate), db.File{
+		Name:         received.Name,
+		Size:         float64(received.Size),
+		ExpireDate:   time.Now().Add(received.ExpiresIn),
+		Email:        received.Email,
+		ContentType:  contentType,
+		MaxDownloads: received.MaxDownloads,
+		PasswordHash: passwordHash,
+		ScanStatus:   db.ScanQuarantined,
+		Entries:      entries,
+		ContentHash:  s.ids.Seal(owner + "\x00" + received.Digest),
+		StorageKey:   fileKey,
+	})
+	if err != nil {
+		apierror.Respond(c, fmt.Errorf("error saving the metadata: %v", err))
+		return
+	}
+
+	// Move the staged file into quarantine, the scanner workers store it once it is found clean
+	if err := s.quarantine.Admit(fileKey, received.Path); err != nil {
+		s.files.DeleteFile(newFile.IdPrivate)
+		apierror.Respond(c, fmt.Errorf("error quarantining the upload: %v", err))
+		return
+	}
+
+	// saveUser already answered when it failed. The file is removed, it would not count against the quota
+	if !s.saveUser(c) {
+		s.files.DeleteFile(newFile.IdPrivate)
+		s.quarantine.Discard(fileKey)
+		return
+	}
+
+	// The uploader receives the private ID once, it cannot be recovered from the database. It is the owner token
+	// managing the file, whichever network it is used from
+	newFile.IdPrivate = idPrivate
+
+	s.setOwnerCookie(c, newFile, idPrivate)
+	c.JSON(http.StatusAccepted, uploadResponse{
+		Message:    "File received, it will be available once scanned for viruses",
+		Data:       newFile,
+		OwnerToken: idPrivate,
+	})
+}
+
+// storageExtension returns the extension of a stored file: the usual one of its detected type, or the extension of
+// its name for the types only known to the upload policy.
+// Parameters:
+//   contentType (string): The type of the file accepted by the policy.
+//   name (string): The name of the file.
+// Returns:
+//   string: The extension, without the dot.
+func storageExtension(contentType, name string) string {
+	if extension, ok := sniff.Extension(contentType); ok {
+		return extension
+	}
+
+	if extension := strings.ToLower(strings.TrimPrefix(path.Ext(name), ".")); extension != "" {
+		return extension
+	}
+	return "bin"
+}
+
+// stageStream copies r to a new file in the staging directory while hashing it, reading at most limit+1 bytes.
+// Parameters:
+//   dir (string): The staging directory.
+//   r (io.Reader): The content of the file.
+//   name (string): The name of the file, hashed after its content.
+//   limit (int64): The maximum size of the file.
+// Returns:
+//   string: The path of the staged file.
+//   int64: The number of bytes written.
+//   string: The hexadecimal SHA-256 of the content followed by the name.
+//   error: errTooLarge if the file is bigger than limit, or an error if the file could not be written.
+func stageStream(dir string, r io.Reader, name string, limit int64) (string, int64, string, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", 0, "", fmt.Errorf("error creating staging directory: %v", err)
+	}
+
+	file, err := os.CreateTemp(dir, "upload_*")
+	if err != nil {
+		return "", 0, "", fmt.Errorf("error creating staging file: %v", err)
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, h), io.LimitReader(r, limit+1))
+	closeErr := file.Close()
+
+	if err != nil || closeErr != nil {
+		os.Remove(file.Name())
+		return "", 0, "", fmt.Errorf("error writing staging file: %v", err)
+	}
+
+	if size > limit {
+		os.Remove(file.Name())
+		return "", 0, "", errTooLarge
+	}
+
+	return file.Name(), size, digest(h, name), nil
+}
+
+// hashFile computes the digest of a file already on disk, as stageStream would.
+// Parameters:
+//   path_ (string): The path of the file.
+//   name (string): The name of the file, hashed after its content.
+// Returns:
+//   string: The hexadecimal SHA-256 of the content followed by the name.
+//   error: An error if the file could not be read.
+func hashFile(path_ string, name string) (string, error) {
+	file, err := os.Open(path_)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	return digest(h, name), nil
+}
+
+// digest adds the file name to a running hash of the file content and returns it in hexadecimal format.
+func digest(h hash.Hash, name string) string {
+	h.Write([]byte(name))
+	return hex.EncodeToString(h.Sum(nil))
+}
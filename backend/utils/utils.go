@@ -2,16 +2,26 @@
 package utils
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
 	"net/mail"
-	"io"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/dutchcoders/go-clamd"
-	"os"
-	"path/filepath"
+	"golang.org/x/crypto/argon2"
+)
+
+// Parameters of the argon2id password hashes, following the RFC 9106 recommendation for memory constrained systems
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+	argonKeyLen  = 32
+	argonSaltLen = 16
 )
 
 
@@ -32,129 +42,76 @@ func ValidateEmail(email string) bool {
 }
 
 
-// EncryptString hashes the input string using SHA-256 and returns the hash in hexadecimal format.
-// Parameters:
-//   str (string): The string to be hashed.
-// Returns:
-//   string: The SHA-256 hash of the input string in hexadecimal format.
-func EncryptString(str string) string {
-	h := sha256.New()
-	h.Write([]byte(str))
-	return hex.EncodeToString(h.Sum(nil))
-}
-
-
-// CheckVirus scans the given file for viruses using ClamAV.
+// ParseDuration parses a duration like time.ParseDuration, also accepting a number of days with the "d" suffix (e.g. "7d").
 // Parameters:
-//   filepath (string): The path to the file to be scanned for viruses.
+//   value (string): The duration to parse (e.g. "10m", "1h", "1d").
 // Returns:
-//   bool: Returns `true` if a virus is detected, `false` otherwise.
-//   error: Returns an error if there is an issue while scanning the file, nil otherwise.
-func CheckVirus(filepath string) (bool, error) {
-	clam := clamd.NewClamd("/var/run/clamav/clamd.ctl")
-	res, err := clam.ScanFile(filepath)
-
-	if err != nil {
-		return false, fmt.Errorf("error while checking file with antivirus ")
-	}
-
-	for r := range res {
-		if r.Status == clamd.RES_FOUND {
-			return true, nil // Virus
+//   time.Duration: The parsed duration.
+//   error: Returns an error if the value is not a valid duration.
+func ParseDuration(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		number, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
 		}
+
+		return time.Duration(number) * 24 * time.Hour, nil
 	}
 
-	return false, nil // No virus
+	return time.ParseDuration(value)
 }
 
 
-// FileExists checks if a file exists at the given filepath.
+// HashPassword hashes a password with argon2id and a random salt.
 // Parameters:
-//   filepath (string): The path to the file or directory to check.
+//   password (string): The password to hash.
 // Returns:
-//   bool: Returns `true` if the file or directory exists, `false` otherwise.
-func FileExists(filepath string) bool {
-	_, err := os.Stat(filepath)
-	return !os.IsNotExist(err)
-}
-
-
-// GetStoredFiles retrieves all file paths (not directories) from the specified directory.
-// Parameters:
-//   path (string): The directory path to search for files.
-// Returns:
-//   []string: A slice of file paths found in the directory.
-//   error: An error if the directory does not exist or if there is an issue reading the directory.
-func GetStoredFiles(path string) ([]string, error){
-	
-	var files []string
-
-	_, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		return []string{}, fmt.Errorf("directory does not exist: %v", path)
+//   string: The hash in the PHC string format ("$argon2id$v=19$m=...,t=...,p=...$salt$key"), which keeps its parameters.
+//   error: Returns an error if no random salt could be generated.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("error generating the password salt: %v", err)
 	}
 
-	entries, err := os.ReadDir(path)
-	if err != nil {
-		return []string{}, fmt.Errorf("it was not possible to read the user's directory")
-	}
-	
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			filepath := filepath.Join(path, entry.Name())
-			files = append(files, filepath)
-		}
-	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
 
-	return files, nil
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
 }
 
 
-// CopyFileWithoutMetadata copies a file from the input path to the output path without copying its metadata (e.g., timestamps, ownership).
+// VerifyPassword checks a password against a hash made by HashPassword, comparing the keys in constant time.
 // Parameters:
-//   inputFilePath (string): The path to the source file.
-//   outputFilePath (string): The path to the destination file.
+//   password (string): The password to check.
+//   encoded (string): The hash of the expected password.
 // Returns:
-//   error: An error if there was a problem opening the input file, creating the output file, or copying the contents.
-func CopyFileWithoutMetadata(inputFilePath, outputFilePath string) error {
-	inputFile, err := os.Open(inputFilePath)
-	if err != nil {
-		return fmt.Errorf("error opening input file: %v", err)
+//   bool: Returns `true` if the password matches, `false` otherwise or if the hash is malformed.
+func VerifyPassword(password string, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false
 	}
-	
-	defer inputFile.Close()
 
-	outputFile, err := os.Create(outputFilePath)
-	if err != nil {
-		return fmt.Errorf("error creating output file: %v", err)
+	var version int
+	var memory, iterations uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &threads); err != nil {
+		return false
 	}
-	defer outputFile.Close()
 
-	_, err = io.Copy(outputFile, inputFile)
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
 	if err != nil {
-		return fmt.Errorf("error copying file: %v", err)
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
 	}
 
-	return nil
+	key := argon2.IDKey([]byte(password), salt, iterations, memory, threads, uint32(len(expected)))
+	return subtle.ConstantTimeCompare(key, expected) == 1
 }
-
-// GetFolderSize walks through the specified directory and calculates the total size of all files and subdirectories inside it
-// Parameters:
-//   path (string): The path to the directory to be checked.
-// Returns:
-//   float64: The total size of the directory in bytes.
-func GetFolderSize(path string) float64 {
-    var dirSize float64 = 0
-
-    readSize := func(path string, file os.FileInfo, err error) error {
-        if !file.IsDir() {
-            dirSize += float64(file.Size())
-        }
-
-        return nil
-    }
-
-    filepath.Walk(path, readSize)
-
-    return float64(dirSize)
-}
\ No newline at end of file
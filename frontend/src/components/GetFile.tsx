@@ -4,6 +4,7 @@ import { useState } from "react"
 function GetFile(){
     const [loading, setLoading] = useState<boolean>(false);
     const [idPublic, setIdPublic] = useState<string>("");
+    const [password, setPassword] = useState<string>("");
 
     const handleInputChange = (e: React.ChangeEvent<HTMLInputElement>) => {
         setIdPublic(e.target.value);
@@ -17,7 +18,9 @@ function GetFile(){
                 throw new Error("Invalid ID Format.");
             }
 
-            const res = await fetch(`http://localhost:8082/downloadFile?idPublic=${encodeURIComponent(idPublic)}`);
+            const res = await fetch(`http://localhost:8082/downloadFile?idPublic=${encodeURIComponent(idPublic)}`, {
+                headers: password ? { "X-File-Password": password } : {},
+            });
 
             if (!res.ok){
                 throw new Error("Failed to fetch the file.");
@@ -61,6 +64,8 @@ function GetFile(){
                 <form onSubmit={handleSubmit}>
                     <label htmlFor="">Public Id:</label>
                     <input type="text" name="" id="" onChange={handleInputChange}/>
+                    <label htmlFor="">Password (if any):</label>
+                    <input type="password" onChange={(e) => setPassword(e.target.value)}/>
                     <input className="button" type="submit" value="Get File"/>
                 </form>
             )}
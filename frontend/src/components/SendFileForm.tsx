@@ -1,4 +1,4 @@
-import { useState } from "react";
+import { useEffect, useState } from "react";
 import { formatDate } from "../utils/dateUtils";
 
 type FileData = {
@@ -9,14 +9,39 @@ type FileData = {
     savedDate: string;
     expireDate: string;
     email: string;
+    maxDownloads: number;
+    downloads: number;
+    scanStatus: string;
+};
+
+type TypeRule = {
+    maxSize: number;
+    extensions: string[] | null;
+};
+
+type Limits = {
+    types: Record<string, TypeRule>;
+    userMaxSpace: number;
 };
   
 
 function SendFileForm(){
 
     const [file, setFile] = useState<File | null>(null);
+    const [expiresIn, setExpiresIn] = useState<string>("1d");
+    const [burnAfterReading, setBurnAfterReading] = useState<boolean>(false);
+    const [keepMetadata, setKeepMetadata] = useState<boolean>(false);
+    const [password, setPassword] = useState<string>("");
     const [loading, setLoading] = useState<boolean>(false);
     const [data, setData] = useState<FileData | null>(null); 
+    const [limits, setLimits] = useState<Limits | null>(null);
+
+    useEffect(() => {
+        fetch("http://localhost:8082/api/v1/limits")
+            .then((response) => response.ok ? response.json() : null)
+            .then((data_) => data_ && setLimits(data_.data))
+            .catch((error) => console.error("Error:", error));
+    }, []);
 
     const handleFileChange = (e: React.ChangeEvent<HTMLInputElement>) => {
         const file = e.target.files?.[0];
@@ -30,10 +55,20 @@ function SendFileForm(){
     const handleSubmit = async (e: React.FormEvent) => {
         e.preventDefault();
 
+        const rule = file && limits ? limits.types[file.type] : undefined;
+
         if (!file) {
             alert("Please, enter a file before submiting");
+        }else if (rule && rule.maxSize > 0 && file.size > rule.maxSize) {
+            alert("This file is too large for its type.");
         }else{
             const formData = new FormData();
+            formData.append("expiresIn", expiresIn);
+            formData.append("burnAfterReading", String(burnAfterReading));
+            formData.append("keepMetadata", String(keepMetadata));
+            if (password) {
+                formData.append("password", password);
+            }
             formData.append("file", file);
 
             try {
@@ -75,13 +110,31 @@ function SendFileForm(){
                     <p>Public Id: {data.idPublic}</p>
                     <p>Private Id: {data.idPrivate}</p>
                     <p>Expire Date: {formatDate(data.expireDate)}</p>
+                    {data.scanStatus === "quarantined" && <p>The file is being scanned for viruses and can be downloaded once the scan is over.</p>}
                 </div>
             ) : (
                 !loading && (
                     <>
                         <form onSubmit={handleSubmit}>
                             <label>Select a file:</label>
-                            <input  type="file" onChange={handleFileChange}/>
+                            <input  type="file" accept={limits ? Object.keys(limits.types).join(",") : undefined} onChange={handleFileChange}/>
+                            <label>Delete after:</label>
+                            <select value={expiresIn} onChange={(e) => setExpiresIn(e.target.value)}>
+                                <option value="10m">10 minutes</option>
+                                <option value="1h">1 hour</option>
+                                <option value="1d">1 day</option>
+                                <option value="7d">7 days</option>
+                            </select>
+                            <label>
+                                <input type="checkbox" checked={burnAfterReading} onChange={(e) => setBurnAfterReading(e.target.checked)}/>
+                                Delete after the first download
+                            </label>
+                            <label>
+                                <input type="checkbox" checked={keepMetadata} onChange={(e) => setKeepMetadata(e.target.checked)}/>
+                                Keep the file metadata (location, author, tags)
+                            </label>
+                            <label>Password (optional):</label>
+                            <input type="password" value={password} onChange={(e) => setPassword(e.target.value)}/>
                             <input className="button" type="submit" value="Send File"/>
                         </form>
                         <p>When sending files you agree with our <a href=""><b>Terms of Service</b></a></p>
@@ -1,14 +1,12 @@
 import { useEffect, useState } from "react"
 
 type UserData = {
-    Ip: string;
-    Files: Array<string>;
-    FilesNumber: number;
-    UsedSpace: number;
-    IpSavedDate: string;
-    IpExpireDate: string;
-    APICalls: number;
-    APILastCallDate: string;
+    ip: string;
+    files: Array<string> | null;
+    filesNumber: number;
+    usedSpace: number;
+    ipSavedDate: string;
+    ipExpireDate: string;
 };
 
 function UserData(){
@@ -49,16 +47,14 @@ function UserData(){
 
             {userData && !loading && (
                 <div>
-                    <p>User IP: {userData.Ip}</p>
-                    <p>Files Number: {userData.FilesNumber}</p>
-                    <p>Used Space: {userData.UsedSpace}</p>
-                    <p>API Calls: {userData.APICalls}</p>
-                    <p>Last API Call Date: {userData.APILastCallDate}</p>
-                    <p>IP Saved Date: {userData.IpSavedDate}</p>
-                    <p>IP Expire Date: {userData.IpExpireDate}</p>
+                    <p>User IP: {userData.ip}</p>
+                    <p>Files Number: {userData.filesNumber}</p>
+                    <p>Used Space: {userData.usedSpace}</p>
+                    <p>IP Saved Date: {userData.ipSavedDate}</p>
+                    <p>IP Expire Date: {userData.ipExpireDate}</p>
                     <h3>Files:</h3>
                     <ul>
-                        {userData.Files.map((file, index) => (
+                        {(userData.files ?? []).map((file, index) => (
                         <li key={index}>{file}</li>
                         ))}
                     </ul>